@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"my/esexample/config"
+	"my/esexample/store"
+)
+
+// es-backfill populates the index by type from the events table, for the keyspaces
+// created with the former events_by_type materialized view. Once it completed,
+// the view can be dropped
+func main() {
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	log.Info().Msg("EVENT-STORE BACKFILL")
+
+	cfg, err := config.NewLoader("es-backfill", config.CassandraSettings).Load(os.Args[1:], os.LookupEnv)
+
+	if err != nil {
+		log.Fatal().Msgf("invalid configuration: %+v", err)
+	}
+
+	cfg.Log()
+
+	cassandra, err := cfg.Cassandra()
+
+	if err != nil {
+		log.Fatal().Msgf("invalid configuration: %+v", err)
+	}
+
+	eventstore, err := store.NewCassandraEventStore(cassandra)
+
+	if err != nil {
+		log.Fatal().Msgf("unable connect to database: %+v", err)
+	}
+
+	defer eventstore.Dispose()
+
+	indexed, err := eventstore.BackfillTypeIndex(context.Background(), func(indexed int) {
+		log.Info().Msgf("indexed %d events", indexed)
+	})
+
+	if err != nil {
+		log.Fatal().Msgf("backfill stopped after %d events: %+v", indexed, err)
+	}
+
+	log.Info().Msgf("indexed %d events", indexed)
+}
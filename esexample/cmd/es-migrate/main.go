@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"my/esexample/config"
+	"my/esexample/store"
+)
+
+// es-migrate creates the keyspace of the event store and brings its schema
+// to the version expected by this release
+func main() {
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	loader := config.NewLoader("es-migrate", config.CassandraSettings, config.MigrateSettings)
+
+	// flags of the former releases
+	loader.Alias("hosts", "CASSANDRA_HOSTS")
+	loader.Alias("port", "CASSANDRA_PORT")
+	loader.Alias("keyspace", "CASSANDRA_KEYSPACE")
+	loader.Alias("replication-factor", "CASSANDRA_REPLICATION_FACTOR")
+	loader.Alias("datacenters", "CASSANDRA_DATACENTERS")
+
+	dryRun := loader.Flags.Bool("dry-run", false, "print the statements instead of running them")
+	status := loader.Flags.Bool("status", false, "print the schema version and exit")
+
+	cfg, err := loader.Load(os.Args[1:], os.LookupEnv)
+
+	if err != nil {
+		log.Fatal().Msgf("invalid configuration: %+v", err)
+	}
+
+	cfg.Log()
+
+	replication, err := parseReplication(cfg.Int("CASSANDRA_REPLICATION_FACTOR"), cfg.Get("CASSANDRA_DATACENTERS"))
+
+	if err != nil {
+		log.Fatal().Msgf("%+v", err)
+	}
+
+	cassandra, err := cfg.Cassandra()
+
+	if err != nil {
+		log.Fatal().Msgf("invalid configuration: %+v", err)
+	}
+
+	keyspace := cassandra.Keyspace
+
+	migrator, err := store.NewCassandraMigrator(cassandra, replication)
+
+	if err != nil {
+		log.Fatal().Msgf("unable connect to database: %+v", err)
+	}
+
+	defer migrator.Dispose()
+
+	ctx := context.Background()
+
+	if *status {
+		version, err := migrator.Version(ctx)
+
+		if err != nil {
+			log.Fatal().Msgf("unable to read the schema version: %+v", err)
+		}
+
+		fmt.Printf("keyspace %s is at version %d, this release expects %d\n", keyspace, version, store.CassandraSchemaVersion)
+		return
+	}
+
+	migrator.DryRun = *dryRun
+	migrator.Out = os.Stdout
+
+	applied, err := migrator.Migrate(ctx)
+
+	if err != nil {
+		log.Fatal().Msgf("migration failed after versions %v: %+v", applied, err)
+	}
+
+	if len(applied) == 0 {
+		log.Info().Msgf("keyspace %s is up to date at version %d", keyspace, store.CassandraSchemaVersion)
+		return
+	}
+
+	if !*dryRun {
+		log.Info().Msgf("keyspace %s migrated to version %d, applied %v", keyspace, store.CassandraSchemaVersion, applied)
+	}
+}
+
+// parseReplication reads the replication factors by data center in the form dc1:3,dc2:3
+func parseReplication(factor int, datacenters string) (store.KeyspaceReplication, error) {
+	replication := store.KeyspaceReplication{Factor: factor}
+
+	if datacenters == "" {
+		return replication, replication.Validate()
+	}
+
+	replication.DataCenters = map[string]int{}
+
+	for _, entry := range strings.Split(datacenters, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+
+		if len(parts) != 2 {
+			return replication, fmt.Errorf("invalid data center replication %q, expected dc:factor", entry)
+		}
+
+		n, err := strconv.Atoi(parts[1])
+
+		if err != nil {
+			return replication, fmt.Errorf("invalid data center replication %q: %v", entry, err)
+		}
+
+		replication.DataCenters[parts[0]] = n
+	}
+
+	return replication, replication.Validate()
+}
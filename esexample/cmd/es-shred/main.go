@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"my/esexample/config"
+	"my/esexample/store"
+)
+
+// es-shred erases the aggregates given as arguments by shredding their data keys, in the
+// keyring of ENCRYPTION_KEYRING or else in the keyspace of the Cassandra backend. Their events
+// stay in the store, unreadable. A keyring file is changed under its lock, so a server may use it meanwhile
+func main() {
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	log.Info().Msg("EVENT-STORE SHRED")
+
+	loader := config.NewLoader("es-shred", config.StoreSettings, config.CassandraSettings, config.EncryptionSettings)
+	cfg, err := loader.Load(os.Args[1:], os.LookupEnv)
+
+	if err != nil {
+		log.Fatal().Msgf("invalid configuration: %+v", err)
+	}
+
+	cfg.Log()
+
+	ids := loader.Flags.Args()
+
+	if len(ids) == 0 {
+		log.Fatal().Msg("usage: es-shred [flags] aggregate-id...")
+	}
+
+	var es store.EventStore
+
+	if cfg.Get("ENCRYPTION_KEYRING") == "" {
+		cassandra, err := cfg.Cassandra()
+
+		if err != nil {
+			log.Fatal().Msgf("invalid configuration: %+v", err)
+		}
+
+		eventstore, err := store.NewCassandraEventStore(cassandra)
+
+		if err != nil {
+			log.Fatal().Msgf("unable connect to database: %+v", err)
+		}
+
+		defer eventstore.Dispose()
+
+		es = eventstore
+	}
+
+	keys, err := cfg.OpenKeyStore(es)
+
+	if err != nil {
+		log.Fatal().Msgf("unable to open the key store: %+v", err)
+	}
+
+	for _, id := range ids {
+		if err := keys.ShredDataKey(context.Background(), store.EventID(id)); err != nil {
+			log.Fatal().Msgf("unable to shred aggregate %s: %+v", id, err)
+		}
+
+		log.Info().Msgf("shredded aggregate %s", id)
+	}
+}
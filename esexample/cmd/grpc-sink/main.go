@@ -5,6 +5,7 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"context"
+	"my/esexample/config"
 	"my/esexample/storegrpc"
 	"net"
 	"os"
@@ -34,22 +35,21 @@ func (me *Server) Update(c context.Context, in *storegrpc.UpdateRequest) (*store
 	return response, nil
 }
 
-// Get the value of the environment variable key or the fallback
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
-	}
-	return fallback
-}
-
 func main() {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	log.Info().Msg("GRPC SINK")
 	server := &Server{}
 
+	cfg, err := config.NewLoader("grpc-sink", config.ServerSettings).Load(os.Args[1:], os.LookupEnv)
+
+	if err != nil {
+		log.Fatal().Msgf("invalid configuration: %+v", err)
+	}
+
+	cfg.Log()
+
 	// Listen
-	port := getEnv("PORT", "8080")
-	listener, err := net.Listen("tcp", ":"+port)
+	listener, err := net.Listen("tcp", ":"+cfg.Get("PORT"))
 
 	if err != nil {
 		log.Fatal().Msgf("unable to listen: %+v", err)
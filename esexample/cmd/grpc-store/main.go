@@ -1,12 +1,10 @@
 package main
 
 import (
-	"strings"
-
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
-	"context"
+	"my/esexample/config"
 	"my/esexample/store"
 	"my/esexample/storegrpc"
 	"net"
@@ -15,131 +13,58 @@ import (
 	"google.golang.org/grpc"
 )
 
-type Server struct {
-	EventStore store.EventStore
-	storegrpc.UnimplementedEventStoreServiceServer
-}
+func main() {
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
-func (me *Server) FindByID(c context.Context, in *storegrpc.FindByIDRequest) (*storegrpc.FindResponse, error) {
-	log.Info().Msgf("FindByID: %v", in.Id)
+	log.Info().Msg("GRPC EVENT-STORE")
 
-	events, err := me.EventStore.Find(store.EventID(in.Id))
+	cfg, err := config.NewLoader("grpc-store", config.ServerSettings, config.StoreSettings, config.CassandraSettings, config.EncryptionSettings).Load(os.Args[1:], os.LookupEnv)
 
 	if err != nil {
-		return nil, err
+		log.Fatal().Msgf("invalid configuration: %+v", err)
 	}
 
-	var findResponseEvents []*storegrpc.FindResponse_Event
+	cfg.Log()
 
-	for _, e := range events {
-		findResponseEvents = append(findResponseEvents, &storegrpc.FindResponse_Event{
-			Id:       string(e.ID),
-			Type:     int32(e.Type),
-			Payload:  string(e.Payload),
-			Savetime: e.TimeStamp})
-	}
+	es, err := cfg.OpenEventStore()
 
-	result := &storegrpc.FindResponse{Success: true, Events: findResponseEvents}
-
-	return result, nil
-}
-
-func (me *Server) FindByType(c context.Context, in *storegrpc.FindByTypeRequest) (*storegrpc.FindResponse, error) {
-	log.Debug().Msgf("FindByTYPE: %v", in.Type)
-
-	events, latest, err := me.EventStore.GetEventsByType(store.EventType(in.Type), in.Since, int(in.BatchSize))
 	if err != nil {
-		return nil, err
-	}
-
-	var findResponseEvents []*storegrpc.FindResponse_Event
-
-	for _, e := range events {
-		findResponseEvents = append(findResponseEvents, &storegrpc.FindResponse_Event{
-			Id:       string(e.ID),
-			Type:     int32(e.Type),
-			Payload:  string(e.Payload),
-			Savetime: e.TimeStamp})
-	}
-
-	result := &storegrpc.FindResponse{
-		Success: true,
-		Events:  findResponseEvents,
-		Latest:  latest,
+		log.Fatal().Msgf("unable to open the event store: %+v", err)
 	}
 
-	return result, nil
-}
-
-func (me *Server) Update(c context.Context, in *storegrpc.UpdateRequest) (*storegrpc.UpdateResponse, error) {
-	log.Info().Msgf("Update: %v", in.Id)
+	server := store.NewGrpcEventStoreServer(es)
+	server.Settle = cfg.Duration("SUBSCRIPTION_SETTLE")
 
-	var events []store.StoreEvent
-
-	for _, e := range in.Events {
-		events = append(events, store.StoreEvent{
-			ID:      store.EventID(in.Id),
-			Payload: store.EventPayload(e.Payload),
-			Type:    store.EventType(e.Type),
-		})
-	}
-
-	err := me.EventStore.Update(store.EventID(in.Id), int(in.Version), events)
+	// Listen
+	listener, err := net.Listen("tcp", ":"+cfg.Get("PORT"))
 
 	if err != nil {
-		return nil, err
-	}
-
-	response := &storegrpc.UpdateResponse{
-		Success: true,
+		log.Fatal().Msgf("unable to listen: %+v", err)
 	}
 
-	return response, nil
-}
-
-// Get the value of the environment variable key or the fallback
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
-	}
-	return fallback
-}
-
-func main() {
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-
-	log.Info().Msg("GRPC EVENT-STORE")
+	grpcServer := grpc.NewServer()
 
-	port := getEnv("PORT", "8080")
-	hosts := getEnv("CASSANDRA_HOSTS", "localhost")
-	keyspace := getEnv("CASSANDRA_KEYSPACE", "eventstore")
-	writeQuorum := getEnv("CASSANDRA_WRITE_QUORUM", "QUORUM")
-	readQuorum := getEnv("CASSANDRA_WRITE_QUORUM", "LOCAL_QUORUM")
+	storegrpc.RegisterEventStoreServiceServer(grpcServer, server)
 
-	store, err := store.NewCassandraEventStore(&store.CassandraEventStoreConfig{
-		Hosts:       []string{hosts},
-		Keyspace:    keyspace,
-		WriteQuorum: strings.ToUpper(writeQuorum),
-		ReadQuorum:  strings.ToUpper(readQuorum),
-	})
+	// the commands retiring the streams on their own address, loopback or a private network
+	if address := cfg.Get("ADMIN_ADDRESS"); address != "" {
+		adminListener, err := net.Listen("tcp", address)
 
-	if err != nil {
-		log.Fatal().Msgf("unable connect to database: %+v", err)
-	}
+		if err != nil {
+			log.Fatal().Msgf("unable to listen on the admin address: %+v", err)
+		}
 
-	server := &Server{EventStore: store}
+		adminServer := store.NewGrpcEventStoreAdminServer(es)
+		adminServer.Retention = cfg.Duration("DELETE_RETENTION")
 
-	// Listen
-	listener, err := net.Listen("tcp", ":"+port)
+		adminGrpcServer := grpc.NewServer()
+		storegrpc.RegisterEventStoreAdminServiceServer(adminGrpcServer, adminServer)
 
-	if err != nil {
-		log.Fatal().Msgf("unable to listen: %+v", err)
+		go func() {
+			log.Fatal().Msgf("admin server failed: %+v", adminGrpcServer.Serve(adminListener))
+		}()
 	}
 
-	grpcServer := grpc.NewServer()
-
-	storegrpc.RegisterEventStoreServiceServer(grpcServer, server)
-
 	if err := grpcServer.Serve(listener); err != nil {
 		log.Fatal().Msgf("failed to serve: %s", err)
 	}
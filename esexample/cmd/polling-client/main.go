@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
-	"github.com/cenkalti/backoff"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"my/esexample/config"
 	"my/esexample/patient"
 	"my/esexample/store"
 	"time"
@@ -17,8 +18,13 @@ func main() {
 	initLog()
 	log.Info().Msg("POLLING TEST")
 
-	host := getEnv("STORE_HOST", "localhost")
-	port := getEnv("STORE_PORT", "8080")
+	cfg, err := config.NewLoader("polling-client", config.ClientSettings).Load(os.Args[1:], os.LookupEnv)
+
+	if err != nil {
+		log.Fatal().Msgf("invalid configuration: %+v", err)
+	}
+
+	cfg.Log()
 
 	// eventstore := store.NewInMemStore()
 
@@ -33,62 +39,32 @@ func main() {
 
 	// eventstore := store.NewRemoteEventStore(&store.RemoteEventStoreConfig{Host: "http://localhost:8080"})
 
-	eventstore := store.NewGrpcEventStore(&store.GrpcEventStoreConfig{Host: host + ":" + port})
+	eventstore := store.NewGrpcEventStore(&store.GrpcEventStoreConfig{Host: cfg.Get("STORE_HOST") + ":" + cfg.Get("STORE_PORT")})
 	eventTypes := [...]store.EventType{patient.PatientAdmittedEventType, patient.PatientDischargedEventType}
 
+	// start listening from 1 second ago
+	since := store.CursorAt(time.Now().Add(-1 * time.Second))
+	positions := map[store.EventType]store.Cursor{}
+
 	for _, etype := range eventTypes {
 		log.Info().Msgf("Listening for event type %v", etype)
-
-		go func(t store.EventType) {
-			var err error
-			var interval time.Duration
-
-			// start polling starting from 1 second ago
-			since := time.Now().UnixNano()/int64(time.Millisecond) - 1*time.Second.Milliseconds()
-
-			defaultInterval := 500 * time.Millisecond
-
-			boff := backoff.NewExponentialBackOff()
-			boff.InitialInterval = defaultInterval
-			boff.MaxElapsedTime = 0
-			boff.MaxInterval = 10 * time.Second
-
-			for {
-				since, err = listenForEvents(t, eventstore, since)
-
-				if err != nil {
-					log.Error().Msgf("Unable to get events: %v", err)
-					interval = boff.NextBackOff()
-				} else {
-					interval = defaultInterval
-					boff.Reset()
-				}
-
-				time.Sleep(interval)
-
-			}
-		}(etype)
-
+		positions[etype] = since
 	}
 
 	log.Info().Msg("Listening...")
-	<-make(chan bool)
-}
 
-func listenForEvents(etype store.EventType, store store.EventStore, since int64) (int64, error) {
-	events, latest, err := store.GetEventsByType(etype, since, 100)
+	// the subscription reconnects by itself, it only ends on handler errors
+	err = eventstore.Subscribe(context.Background(), positions, func(e *store.StoreEvent) error {
+		if e == nil {
+			log.Debug().Msg("HEARTBEAT")
+			return nil
+		}
 
-	if err != nil {
-		log.Info().Msgf("ERROR POLLING EVENT %v: %v", etype, err)
-		return since, err
-	}
+		log.Info().Msgf("FOUND EVENT OF EVENT TYPE %s (%d): %s version %d", e.TypeName, e.Type, e.ID, e.Version)
+		return nil
+	})
 
-	if nevents := len(events); nevents > 0 {
-		log.Info().Msgf("FOUND %d EVENTS OF EVENT TYPE %+v", len(events), etype)
-		return latest, nil
-	}
-
-	return since, nil
+	log.Fatal().Msgf("Subscription ended: %v", err)
 }
 
 func initLog() {
@@ -99,11 +75,3 @@ func initLog() {
 	}
 	log.Logger = zerolog.New(output).With().Timestamp().Logger()
 }
-
-// Get the value of the environment variable key or the fallback
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
-	}
-	return fallback
-}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -36,6 +37,11 @@ func mainShort() {
 	eventstore := store.NewGrpcEventStore(&store.GrpcEventStoreConfig{Host: "localhost:8080"})
 
 	pstore := patient.NewPatientEventStore(eventstore)
+
+	if err := pstore.CheckTypes(context.Background()); err != nil {
+		log.Fatal().Msgf("patient event types: %+v", err)
+	}
+
 	cmdhandler := patient.NewPatientCommandHandler(pstore)
 
 	admitPatient(cmdhandler, guid1.String(), "John Doe", 34, "AA")
@@ -64,6 +70,11 @@ func main() {
 	eventstore := store.NewGrpcEventStore(&store.GrpcEventStoreConfig{Host: "localhost:8080"})
 
 	pstore := patient.NewPatientEventStore(eventstore)
+
+	if err := pstore.CheckTypes(context.Background()); err != nil {
+		log.Fatal().Msgf("patient event types: %+v", err)
+	}
+
 	cmdhandler := patient.NewPatientCommandHandler(pstore)
 
 	admitPatient(cmdhandler, guid1.String(), "John Doe", 34, "AA")
@@ -89,7 +100,7 @@ func main() {
 	calcNumberOfPatients(eventstore)
 
 	// VERIFY OPTIMISTICK LOCKING ENFORCEMENT
-	patient1, _ := pstore.Find(store.EventID(guid1.String()))
+	patient1, _ := pstore.Find(context.Background(), store.EventID(guid1.String()))
 
 	patient1.Transfer("XX")
 	log.Info().Msgf("patient1 version %v", patient1)
@@ -97,13 +108,13 @@ func main() {
 	transferPatient(cmdhandler, guid1.String(), "DD")
 
 	// try to store the user, expect an error
-	if err := pstore.Update(patient1); err != nil {
+	if err := pstore.Update(context.Background(), patient1); err != nil {
 		log.Info().Msgf("ERROR, unable to update patient1: %+v", err)
 	}
 }
 
 func admitPatient(cmdhandler *patient.PatientCommandHandler, uuid string, name string, age int, ward string) {
-	if err := cmdhandler.HandleAdmitPatient(&patient.AdmitPatient{
+	if err := cmdhandler.HandleAdmitPatient(context.Background(), &patient.AdmitPatient{
 		ID:   uuid,
 		Name: patient.Name(name),
 		Age:  patient.Age(age),
@@ -114,7 +125,7 @@ func admitPatient(cmdhandler *patient.PatientCommandHandler, uuid string, name s
 }
 
 func transferPatient(cmdhandler *patient.PatientCommandHandler, uuid string, ward string) {
-	if err := cmdhandler.HandleTransferPatient(&patient.TransferPatient{
+	if err := cmdhandler.HandleTransferPatient(context.Background(), &patient.TransferPatient{
 		ID:            uuid,
 		NewWardNumber: patient.WardNumber(ward),
 	}); err != nil {
@@ -123,19 +134,18 @@ func transferPatient(cmdhandler *patient.PatientCommandHandler, uuid string, war
 }
 
 func dischargePatient(cmdhandler *patient.PatientCommandHandler, uuid string) {
-	cmdhandler.HandleDischargePatient(&patient.DischargePatient{
+	cmdhandler.HandleDischargePatient(context.Background(), &patient.DischargePatient{
 		ID: uuid,
 	})
 }
 
-func calcNumberOfPatients(store store.EventStore) {
-	nowInMillis := time.Now().UnixNano() / int64(time.Millisecond)
-	since := nowInMillis - 1*time.Second.Milliseconds()
+func calcNumberOfPatients(eventstore store.EventStore) {
+	since := time.Now().Add(-1 * time.Second)
 
-	log.Info().Msgf("SINCE %v = %v", since, time.Unix(0, since*int64(time.Millisecond)))
+	log.Info().Msgf("SINCE %v", since)
 
-	admittedEvents, _, _ := store.GetEventsByType(patient.PatientAdmittedEventType, since, 100)
-	dichargedEvents, _, _ := store.GetEventsByType(patient.PatientDischargedEventType, since, 100)
+	admittedEvents, _, _ := eventstore.GetEventsByType(context.Background(), store.TypeQuery{TypeNames: []string{patient.PatientAdmittedTypeName}, After: store.CursorAt(since), BatchSize: 100})
+	dichargedEvents, _, _ := eventstore.GetEventsByType(context.Background(), store.TypeQuery{TypeNames: []string{patient.PatientDischargedTypeName}, After: store.CursorAt(since), BatchSize: 100})
 
 	admitted := len(admittedEvents)
 	dicharged := len(dichargedEvents)
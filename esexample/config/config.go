@@ -0,0 +1,398 @@
+// Package config loads the configuration of the commands. Each setting is taken, from the
+// lowest to the highest precedence, from its default, the configuration file, its
+// environment variable and its flag
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+
+	"my/esexample/store"
+)
+
+// Kind is the type of the value of a setting, checked when loading
+type Kind int
+
+const (
+	String Kind = iota
+	Int
+	Bool
+	Duration
+)
+
+// Setting is a configuration value. Key is the name of its environment variable, its
+// flag is the key in lower case with dashes, CASSANDRA_HOSTS is set by -cassandra-hosts
+type Setting struct {
+	Key     string
+	Default string
+	Usage   string
+	Kind    Kind
+	Values  []string // accepted values, any if empty
+	Secret  bool     // redacted when printed
+}
+
+// flagName is the name of the flag of the setting
+func (s Setting) flagName() string {
+	return strings.Replace(strings.ToLower(s.Key), "_", "-", -1)
+}
+
+// check validates a value of the setting, an empty value stands for unset
+func (s Setting) check(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	var err error
+
+	switch s.Kind {
+	case Int:
+		_, err = strconv.Atoi(value)
+	case Bool:
+		_, err = strconv.ParseBool(value)
+	case Duration:
+		_, err = time.ParseDuration(value)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %v", s.Key, value, err)
+	}
+
+	if len(s.Values) == 0 {
+		return nil
+	}
+
+	for _, accepted := range s.Values {
+		if strings.EqualFold(value, accepted) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid %s %q, expected %s", s.Key, value, strings.Join(s.Values, ", "))
+}
+
+// settingFlag sets a setting from the command line
+type settingFlag struct {
+	setting Setting
+	values  map[string]string
+}
+
+func (f *settingFlag) String() string {
+	return f.setting.Default
+}
+
+func (f *settingFlag) Set(value string) error {
+	if err := f.setting.check(value); err != nil {
+		return err
+	}
+
+	f.values[f.setting.Key] = value
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.setting.Kind == Bool
+}
+
+// Loader reads the settings of a command. Flags holds their flags, the command
+// may add its own before calling Load
+type Loader struct {
+	Flags *flag.FlagSet
+
+	settings   []Setting
+	flagValues map[string]string
+	configFile *string
+}
+
+// initializer for loader, reading the settings of the groups
+func NewLoader(name string, groups ...[]Setting) *Loader {
+	l := &Loader{Flags: flag.NewFlagSet(name, flag.ContinueOnError), flagValues: map[string]string{}}
+	l.configFile = l.Flags.String("config", "", "YAML or JSON configuration file (CONFIG_FILE)")
+
+	for _, group := range groups {
+		for _, s := range group {
+			if _, ok := l.setting(s.Key); ok {
+				continue
+			}
+
+			l.settings = append(l.settings, s)
+			l.Flags.Var(&settingFlag{setting: s, values: l.flagValues}, s.flagName(), fmt.Sprintf("%s (%s)", s.Usage, s.Key))
+		}
+	}
+
+	return l
+}
+
+func (l *Loader) setting(key string) (Setting, bool) {
+	for _, s := range l.settings {
+		if s.Key == key {
+			return s, true
+		}
+	}
+
+	return Setting{}, false
+}
+
+// Alias adds another flag for the setting key, such as the one of a former release
+func (l *Loader) Alias(name, key string) {
+	s, ok := l.setting(key)
+
+	if !ok {
+		panic("config: alias of unknown setting " + key)
+	}
+
+	l.Flags.Var(&settingFlag{setting: s, values: l.flagValues}, name, "same as -"+s.flagName())
+}
+
+// Load parses the command line args and reads the environment through lookupEnv, which is
+// os.LookupEnv but in the tests. The configuration is validated before being returned
+func (l *Loader) Load(args []string, lookupEnv func(key string) (string, bool)) (*Config, error) {
+	if err := l.Flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := &Config{settings: l.settings, values: map[string]string{}, sources: map[string]string{}}
+
+	for _, s := range l.settings {
+		if s.Default != "" {
+			c.set(s.Key, s.Default, "default")
+		}
+	}
+
+	path := *l.configFile
+
+	if path == "" {
+		path, _ = lookupEnv("CONFIG_FILE")
+	}
+
+	if path != "" {
+		values, err := readFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range values {
+			// a file may be shared by several commands, each one takes its settings
+			if _, ok := l.setting(key); ok {
+				c.set(key, value, path)
+			} else if !known(key) {
+				return nil, fmt.Errorf("unknown setting %s in %s", key, path)
+			}
+		}
+	}
+
+	for _, s := range l.settings {
+		if value, ok := lookupEnv(s.Key); ok {
+			c.set(s.Key, value, "env")
+		}
+	}
+
+	for key, value := range l.flagValues {
+		c.set(key, value, "flag")
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readFile reads the settings of a YAML or JSON file. Nested keys are joined with underscores,
+// cassandra: {hosts: [a, b]} sets CASSANDRA_HOSTS to a,b
+func readFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the configuration: %v", err)
+	}
+
+	var doc interface{}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+
+	values := map[string]string{}
+
+	if doc != nil {
+		if err := flatten("", doc, values); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %v", path, err)
+		}
+	}
+
+	return values, nil
+}
+
+func flatten(prefix string, node interface{}, values map[string]string) error {
+	key := func(k interface{}) string {
+		name := strings.ToUpper(strings.Replace(fmt.Sprint(k), "-", "_", -1))
+
+		if prefix == "" {
+			return name
+		}
+		return prefix + "_" + name
+	}
+
+	switch node := node.(type) {
+	case map[interface{}]interface{}: // YAML
+		for k, v := range node {
+			if err := flatten(key(k), v, values); err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}: // JSON
+		for k, v := range node {
+			if err := flatten(key(k), v, values); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		items := make([]string, len(node))
+
+		for i, item := range node {
+			switch item.(type) {
+			case map[interface{}]interface{}, map[string]interface{}, []interface{}:
+				return fmt.Errorf("%s: lists hold plain values only", prefix)
+			}
+
+			items[i] = fmt.Sprint(item)
+		}
+
+		values[prefix] = strings.Join(items, ",")
+
+	case nil:
+		values[prefix] = ""
+
+	case float64: // JSON numbers, 9042 rather than 9042.000000
+		values[prefix] = strconv.FormatFloat(node, 'f', -1, 64)
+
+	default:
+		if prefix == "" {
+			return fmt.Errorf("expected a map of settings")
+		}
+
+		values[prefix] = fmt.Sprint(node)
+	}
+
+	return nil
+}
+
+// Config is the effective configuration of a command
+type Config struct {
+	settings []Setting
+	values   map[string]string
+	sources  map[string]string // default, env, flag or the configuration file
+}
+
+func (c *Config) set(key, value, source string) {
+	c.values[key] = value
+	c.sources[key] = source
+}
+
+// Lookup returns the value of a setting and whether it is set, even by a default
+func (c *Config) Lookup(key string) (string, bool) {
+	value, ok := c.values[key]
+	return value, ok
+}
+
+// Get returns the value of a setting, empty if unset
+func (c *Config) Get(key string) string {
+	return c.values[key]
+}
+
+// Int returns the value of an Int setting, 0 if unset
+func (c *Config) Int(key string) int {
+	n, _ := strconv.Atoi(c.values[key])
+	return n
+}
+
+// Bool returns the value of a Bool setting, false if unset
+func (c *Config) Bool(key string) bool {
+	b, _ := strconv.ParseBool(c.values[key])
+	return b
+}
+
+// Duration returns the value of a Duration setting, 0 if unset
+func (c *Config) Duration(key string) time.Duration {
+	d, _ := time.ParseDuration(c.values[key])
+	return d
+}
+
+// Cassandra returns the configuration of the Cassandra store, see store.CassandraEventStoreConfigFromEnv
+func (c *Config) Cassandra() (*store.CassandraEventStoreConfig, error) {
+	return store.CassandraEventStoreConfigFromEnv(c.Lookup)
+}
+
+// validate checks every value, and the configuration of the backend as a whole
+func (c *Config) validate() error {
+	for _, s := range c.settings {
+		if err := s.check(c.values[s.Key]); err != nil {
+			return err
+		}
+	}
+
+	if _, _, err := c.Encryption(); err != nil {
+		return err
+	}
+
+	backend, ok := c.Lookup("STORE_BACKEND")
+
+	if _, cassandra := c.Lookup("CASSANDRA_HOSTS"); cassandra && (!ok || strings.EqualFold(backend, "cassandra")) {
+		if _, err := c.Cassandra(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// String prints the effective configuration, one setting per line with its source.
+// The secrets are redacted
+func (c *Config) String() string {
+	var lines []string
+
+	for _, s := range c.settings {
+		value, ok := c.values[s.Key]
+
+		if !ok {
+			continue
+		}
+
+		if s.Secret && value != "" {
+			value = "[REDACTED]"
+		}
+
+		lines = append(lines, fmt.Sprintf("%s=%s (%s)", s.Key, value, c.sources[s.Key]))
+	}
+
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// Log writes the effective configuration to the log, the secrets redacted
+func (c *Config) Log() {
+	for _, line := range strings.Split(c.String(), "\n") {
+		if line != "" {
+			log.Info().Msgf("config %s", line)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"my/esexample/store"
+)
+
+// env is a lookup on a fixed environment
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := vars[key]
+		return value, ok
+	}
+}
+
+// writeFile writes a configuration file in a temporary directory
+func writeFile(t *testing.T, name, content string) string {
+	dir, _ := ioutil.TempDir("", "config")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	return path
+}
+
+func newServerLoader() *Loader {
+	return NewLoader("test", ServerSettings, StoreSettings, CassandraSettings, EncryptionSettings)
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := newServerLoader().Load(nil, env(nil))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if c.Get("PORT") != "8080" || c.Get("STORE_BACKEND") != "cassandra" || c.Get("CASSANDRA_HOSTS") != "localhost" {
+		t.Errorf("unexpected defaults\n%s", c)
+	}
+
+	if _, ok := c.Lookup("CASSANDRA_LOCAL_DC"); ok {
+		t.Errorf("expected CASSANDRA_LOCAL_DC unset")
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+port: 9000
+store:
+  backend: file
+  dir: /var/lib/events
+cassandra:
+  hosts: [cassandra-1, cassandra-2]
+  keyspace: from_file
+  read-quorum: ONE
+`)
+
+	c, err := newServerLoader().Load(
+		[]string{"-config", path, "-cassandra-keyspace", "from_flag", "-cassandra-tls"},
+		env(map[string]string{"STORE_DIR": "/data", "CASSANDRA_KEYSPACE": "from_env"}))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	expected := map[string]string{
+		"PORT":                  "9000",
+		"STORE_BACKEND":         "file",
+		"STORE_DIR":             "/data",
+		"CASSANDRA_HOSTS":       "cassandra-1,cassandra-2",
+		"CASSANDRA_KEYSPACE":    "from_flag",
+		"CASSANDRA_READ_QUORUM": "ONE",
+		"CASSANDRA_TLS":         "true",
+		"STORE_FSYNC":           "always",
+	}
+
+	for key, value := range expected {
+		if c.Get(key) != value {
+			t.Errorf("expected %s=%s, got %q", key, value, c.Get(key))
+		}
+	}
+
+	if !c.Bool("CASSANDRA_TLS") || c.Int("PORT") != 9000 {
+		t.Errorf("unexpected typed values\n%s", c)
+	}
+
+	cassandra, err := c.Cassandra()
+
+	if err != nil || !reflect.DeepEqual(cassandra.Hosts, []string{"cassandra-1", "cassandra-2"}) || cassandra.ReadQuorum != "ONE" {
+		t.Errorf("unexpected Cassandra configuration %+v, error %+v", cassandra, err)
+	}
+}
+
+func TestLoadJSONFromEnv(t *testing.T) {
+	path := writeFile(t, "config.json", `{"cassandra": {"port": 9142, "timeout": "2s"}, "STORE_HOST": "store"}`)
+
+	c, err := newServerLoader().Load(nil, env(map[string]string{"CONFIG_FILE": path}))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// STORE_HOST is a setting of the clients, ignored by the servers
+	if c.Int("CASSANDRA_PORT") != 9142 || c.Duration("CASSANDRA_TIMEOUT") != 2*time.Second || c.Get("STORE_HOST") != "" {
+		t.Errorf("unexpected configuration\n%s", c)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	cases := map[string]struct {
+		args []string
+		env  map[string]string
+		file string
+	}{
+		"backend":         {env: map[string]string{"STORE_BACKEND": "mongo"}},
+		"int":             {args: []string{"-port", "http"}},
+		"duration":        {env: map[string]string{"CASSANDRA_TIMEOUT": "2"}},
+		"unknown flag":    {args: []string{"-cassandra-host", "localhost"}},
+		"unknown key":     {file: "cassandra:\n  host: localhost\n"},
+		"malformed file":  {file: "cassandra: [\n"},
+		"missing file":    {args: []string{"-config", "/nonexistent/config.yaml"}},
+		"cassandra":       {env: map[string]string{"CASSANDRA_PASSWORD": "secret", "CASSANDRA_PASSWORD_FILE": "/run/secrets/password"}},
+		"cassandra hosts": {env: map[string]string{"CASSANDRA_HOSTS": ","}},
+		"encryption key":  {env: map[string]string{"ENCRYPTION_KEY": "c2hvcnQ="}},
+		"encryption keys": {env: map[string]string{"ENCRYPTION_KEY": testKey, "ENCRYPTION_KEY_FILE": "/run/secrets/key"}},
+		"sealed fields":   {env: map[string]string{"ENCRYPTION_KEY": testKey, "ENCRYPTION_FIELDS": "patient.admitted"}},
+	}
+
+	for name, test := range cases {
+		args := test.args
+
+		if test.file != "" {
+			args = append(args, "-config", writeFile(t, "config.yaml", test.file))
+		}
+
+		loader := newServerLoader()
+		loader.Flags.SetOutput(ioutil.Discard)
+
+		if _, err := loader.Load(args, env(test.env)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// the Cassandra settings are checked only when Cassandra is the backend
+	if _, err := newServerLoader().Load(nil, env(map[string]string{"STORE_BACKEND": "memory", "CASSANDRA_HOSTS": ","})); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	loader := NewLoader("test", CassandraSettings)
+	loader.Alias("hosts", "CASSANDRA_HOSTS")
+
+	c, err := loader.Load([]string{"-hosts", "cassandra-1"}, env(nil))
+
+	if err != nil || c.Get("CASSANDRA_HOSTS") != "cassandra-1" {
+		t.Errorf("unexpected hosts %q, error %+v", c.Get("CASSANDRA_HOSTS"), err)
+	}
+}
+
+func TestStringRedactsSecrets(t *testing.T) {
+	c, err := newServerLoader().Load([]string{"-cassandra-password", "s3cr3t"}, env(map[string]string{"CASSANDRA_USERNAME": "store"}))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	printed := c.String()
+
+	if strings.Contains(printed, "s3cr3t") || !strings.Contains(printed, "CASSANDRA_PASSWORD=[REDACTED] (flag)") {
+		t.Errorf("expected the password redacted\n%s", printed)
+	}
+
+	if !strings.Contains(printed, "CASSANDRA_USERNAME=store (env)") || !strings.Contains(printed, "PORT=8080 (default)") {
+		t.Errorf("expected the values with their source\n%s", printed)
+	}
+}
+
+// testKey is a base64 AES-256 key
+const testKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+func TestOpenEncryptedEventStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+
+	c, err := newServerLoader().Load(nil, env(map[string]string{
+		"STORE_BACKEND":      "memory",
+		"ENCRYPTION_KEY":     testKey,
+		"ENCRYPTION_KEYRING": filepath.Join(dir, "keyring.json"),
+		"ENCRYPTION_FIELDS":  "patient.admitted=name, age;patient.transferred=ward",
+	}))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	es, err := c.OpenEventStore()
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	encrypted, ok := es.(*store.EncryptedEventStore)
+
+	if !ok {
+		t.Fatalf("unexpected store %T", es)
+	}
+
+	expected := map[string][]string{"patient.admitted": {"name", "age"}, "patient.transferred": {"ward"}}
+
+	if !reflect.DeepEqual(encrypted.Fields, expected) {
+		t.Errorf("unexpected fields %v", encrypted.Fields)
+	}
+
+	// the backends but Cassandra need a keyring, the backend is closed without one
+	c, _ = newServerLoader().Load(nil, env(map[string]string{"STORE_BACKEND": "file", "STORE_DIR": filepath.Join(dir, "store"), "ENCRYPTION_KEY": testKey}))
+
+	if es, err := c.OpenEventStore(); err == nil || es != nil {
+		t.Errorf("expected an error without keyring, got %T", es)
+	}
+
+	// a backend left open would keep its directory locked
+	c, _ = newServerLoader().Load(nil, env(map[string]string{"STORE_BACKEND": "file", "STORE_DIR": filepath.Join(dir, "store")}))
+
+	if es, err := c.OpenEventStore(); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	} else {
+		es.(*store.FileEventStore).Close()
+	}
+}
+
+func TestOpenEventStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+
+	backends := map[string]map[string]string{
+		"memory": {"STORE_BACKEND": "memory"},
+		"file":   {"STORE_BACKEND": "file", "STORE_DIR": dir, "STORE_FSYNC": "never"},
+		"sqlite": {"STORE_BACKEND": "sqlite", "STORE_DSN": ":memory:"},
+	}
+
+	for name, vars := range backends {
+		c, err := newServerLoader().Load(nil, env(vars))
+
+		if err != nil {
+			t.Fatalf("%s: unexpected error %+v", name, err)
+		}
+
+		es, err := c.OpenEventStore()
+
+		if err != nil || es == nil {
+			t.Errorf("%s: unexpected error %+v", name, err)
+		}
+
+		if closer, ok := es.(interface{ Close() error }); ok {
+			closer.Close()
+		}
+	}
+}
+
+func TestOpenArchivedEventStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+
+	c, err := newServerLoader().Load(nil, env(map[string]string{"STORE_BACKEND": "memory", "ARCHIVE_DIR": filepath.Join(dir, "archive")}))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if retention := c.Duration("DELETE_RETENTION"); retention != 720*time.Hour {
+		t.Errorf("unexpected retention %v", retention)
+	}
+
+	if es, err := c.OpenEventStore(); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	} else if _, ok := es.(*store.ArchivedEventStore); !ok {
+		t.Errorf("unexpected store %T", es)
+	}
+
+	// the file backend purges the archived streams from its log
+	c, _ = newServerLoader().Load(nil, env(map[string]string{"STORE_BACKEND": "file", "STORE_DIR": filepath.Join(dir, "store"), "STORE_FSYNC": "never", "ARCHIVE_DIR": filepath.Join(dir, "archive")}))
+
+	if es, err := c.OpenEventStore(); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	} else if _, ok := es.(*store.ArchivedEventStore); !ok {
+		t.Errorf("unexpected store %T", es)
+	}
+}
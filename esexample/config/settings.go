@@ -0,0 +1,84 @@
+package config
+
+// ServerSettings are the settings of the servers
+var ServerSettings = []Setting{
+	{Key: "PORT", Default: "8080", Usage: "port the server listens on", Kind: Int},
+	{Key: "ADMIN_ADDRESS", Usage: "address serving the deletion, purge and archival of the streams, none if empty"},
+}
+
+// StoreSettings select and configure the backend of the servers, Cassandra
+// is configured by CassandraSettings
+var StoreSettings = []Setting{
+	{Key: "STORE_BACKEND", Default: "cassandra", Usage: "backend of the events", Values: []string{"cassandra", "memory", "file", "sqlite"}},
+	{Key: "STORE_DIR", Default: "data", Usage: "directory of the file backend"},
+	{Key: "STORE_FSYNC", Default: "always", Usage: "flush policy of the file backend", Values: []string{"always", "interval", "never"}},
+	{Key: "STORE_DSN", Default: "file:eventstore.db?_pragma=busy_timeout(5000)", Usage: "database of the sqlite backend"},
+	{Key: "ARCHIVE_DIR", Usage: "directory of the archived streams, no archival if empty"},
+	{Key: "DELETE_RETENTION", Default: "720h", Usage: "time a deleted stream is kept before it can be purged", Kind: Duration},
+	{Key: "SUBSCRIPTION_SETTLE", Default: "1s", Usage: "settle window of the subscriptions not asking for one", Kind: Duration},
+}
+
+// CassandraSettings are read by store.CassandraEventStoreConfigFromEnv
+var CassandraSettings = []Setting{
+	{Key: "CASSANDRA_HOSTS", Default: "localhost", Usage: "comma separated contact points"},
+	{Key: "CASSANDRA_PORT", Usage: "native protocol port, 9042 if empty", Kind: Int},
+	{Key: "CASSANDRA_KEYSPACE", Default: "eventstore", Usage: "keyspace of the event store"},
+	{Key: "CASSANDRA_WRITE_QUORUM", Default: "QUORUM", Usage: "consistency of the writes"},
+	{Key: "CASSANDRA_READ_QUORUM", Default: "LOCAL_QUORUM", Usage: "consistency of the reads"},
+	{Key: "CASSANDRA_SERIAL_CONSISTENCY", Usage: "consistency of the lightweight transactions", Values: []string{"SERIAL", "LOCAL_SERIAL"}},
+	{Key: "CASSANDRA_LOCAL_DC", Usage: "data center the queries are routed to first"},
+	{Key: "CASSANDRA_USERNAME", Usage: "user name"},
+	{Key: "CASSANDRA_PASSWORD", Usage: "password", Secret: true},
+	{Key: "CASSANDRA_USERNAME_FILE", Usage: "file holding the user name"},
+	{Key: "CASSANDRA_PASSWORD_FILE", Usage: "file holding the password"},
+	{Key: "CASSANDRA_TLS", Usage: "encrypt the connections", Kind: Bool},
+	{Key: "CASSANDRA_TLS_CA_FILE", Usage: "authorities of the node certificates"},
+	{Key: "CASSANDRA_TLS_CERT_FILE", Usage: "client certificate"},
+	{Key: "CASSANDRA_TLS_KEY_FILE", Usage: "key of the client certificate"},
+	{Key: "CASSANDRA_TLS_SERVER_NAME", Usage: "name expected in the node certificates"},
+	{Key: "CASSANDRA_TLS_INSECURE_SKIP_VERIFY", Usage: "accept any certificate, for tests only", Kind: Bool},
+	{Key: "CASSANDRA_RETRIES", Usage: "retries of a failed query", Kind: Int},
+	{Key: "CASSANDRA_RETRY_MIN_BACKOFF", Usage: "first wait before a retry", Kind: Duration},
+	{Key: "CASSANDRA_RETRY_MAX_BACKOFF", Usage: "longest wait before a retry", Kind: Duration},
+	{Key: "CASSANDRA_CONNECT_TIMEOUT", Usage: "timeout of the connections", Kind: Duration},
+	{Key: "CASSANDRA_TIMEOUT", Usage: "timeout of the queries", Kind: Duration},
+	{Key: "CASSANDRA_PAGE_SIZE", Usage: "rows fetched at once", Kind: Int},
+	{Key: "CASSANDRA_TYPE_BUCKET_SIZE", Usage: "time buckets of the index by type, 1h if empty", Kind: Duration},
+	{Key: "CASSANDRA_MAX_CLOCK_SKEW", Usage: "largest difference between the clocks of the servers, 1s if empty", Kind: Duration},
+	{Key: "CASSANDRA_INDEX_REPAIR_INTERVAL", Usage: "interval between the repairs of the index by type, 5m if empty, never if negative", Kind: Duration},
+	{Key: "CASSANDRA_TYPE_LIST_REFRESH", Usage: "how long the list of the types is kept by the readers of all the types, 10s if empty, not kept if negative", Kind: Duration},
+}
+
+// EncryptionSettings turn on the encryption of the payloads of the servers, see store.EncryptedEventStore.
+// The data keys are kept in the keyspace of the Cassandra backend, in a keyring file for the others
+var EncryptionSettings = []Setting{
+	{Key: "ENCRYPTION_KEY", Usage: "base64 AES-256 key wrapping the data keys of the aggregates, no encryption if empty", Secret: true},
+	{Key: "ENCRYPTION_KEY_FILE", Usage: "file holding the base64 key wrapping the data keys"},
+	{Key: "ENCRYPTION_KEYRING", Usage: "file keeping the data keys, instead of the keyspace of the Cassandra backend"},
+	{Key: "ENCRYPTION_FIELDS", Usage: "fields sealed alone by event type name, as patient.admitted=name,age;other.type=field, whole payloads for the other types"},
+}
+
+// MigrateSettings are the replication of the keyspace created by es-migrate
+var MigrateSettings = []Setting{
+	{Key: "CASSANDRA_REPLICATION_FACTOR", Default: "1", Usage: "replication factor of a SimpleStrategy keyspace", Kind: Int},
+	{Key: "CASSANDRA_DATACENTERS", Usage: "replication factor by data center of a NetworkTopologyStrategy keyspace, as dc1:3,dc2:3"},
+}
+
+// ClientSettings locate the event store server of the clients
+var ClientSettings = []Setting{
+	{Key: "STORE_HOST", Default: "localhost", Usage: "host of the event store"},
+	{Key: "STORE_PORT", Default: "8080", Usage: "port of the event store", Kind: Int},
+}
+
+// known tells whether key is a setting of any command, the other keys of a configuration file are mistakes
+func known(key string) bool {
+	for _, group := range [][]Setting{ServerSettings, StoreSettings, CassandraSettings, EncryptionSettings, MigrateSettings, ClientSettings} {
+		for _, s := range group {
+			if s.Key == key {
+				return true
+			}
+		}
+	}
+
+	return false
+}
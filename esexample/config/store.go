@@ -0,0 +1,204 @@
+package config
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	_ "modernc.org/sqlite"
+
+	"my/esexample/store"
+)
+
+// OpenEventStore opens the backend selected by STORE_BACKEND, cassandra, memory, file or sqlite,
+// archiving the closed streams to ARCHIVE_DIR when it is set and encrypted when ENCRYPTION_KEY
+// or ENCRYPTION_KEY_FILE is set. The archives hold the events as stored, encrypted
+func (c *Config) OpenEventStore() (es store.EventStore, err error) {
+	backend, err := c.openBackend()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the backend is closed when the wrappers can't be set up
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if closer, ok := backend.(interface{ Close() error }); ok {
+			closer.Close()
+		}
+	}()
+
+	es = backend
+
+	if dir := c.Get("ARCHIVE_DIR"); dir != "" {
+		// archiving purges the streams
+		if _, ok := backend.(store.StreamDeleter); !ok {
+			return nil, fmt.Errorf("ARCHIVE_DIR is not supported by the %s backend, whose streams can't be purged", c.Get("STORE_BACKEND"))
+		}
+
+		archive, err := store.NewFileArchive(dir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		es = store.NewArchivedEventStore(backend, archive)
+	}
+
+	kek, fields, err := c.Encryption()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if kek == nil {
+		return es, nil
+	}
+
+	keys, err := c.OpenKeyStore(backend)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := store.NewEncryptedEventStore(es, keys, kek)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted.Fields = fields
+
+	return encrypted, nil
+}
+
+// OpenKeyStore opens the keyring of ENCRYPTION_KEYRING, else the keyspace of the Cassandra backend es
+func (c *Config) OpenKeyStore(es store.EventStore) (store.KeyStore, error) {
+	if path := c.Get("ENCRYPTION_KEYRING"); path != "" {
+		return store.NewFileKeyring(path)
+	}
+
+	if keys, ok := es.(*store.CassandraEventStore); ok {
+		return keys, nil
+	}
+
+	return nil, fmt.Errorf("ENCRYPTION_KEYRING is required by the %s backend", c.Get("STORE_BACKEND"))
+}
+
+// Encryption returns the key wrapping the data keys, nil when the payloads are not encrypted,
+// and the fields sealed alone by event type name
+func (c *Config) Encryption() ([]byte, map[string][]string, error) {
+	encoded, file := c.Get("ENCRYPTION_KEY"), c.Get("ENCRYPTION_KEY_FILE")
+
+	if encoded != "" && file != "" {
+		return nil, nil, fmt.Errorf("ENCRYPTION_KEY and ENCRYPTION_KEY_FILE are exclusive")
+	}
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		encoded = strings.TrimSpace(string(data))
+	}
+
+	if encoded == "" {
+		return nil, nil, nil
+	}
+
+	kek, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil || len(kek) != 32 {
+		return nil, nil, fmt.Errorf("the encryption key is not a base64 AES-256 key")
+	}
+
+	fields, err := parseSealedFields(c.Get("ENCRYPTION_FIELDS"))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return kek, fields, nil
+}
+
+// parseSealedFields parses the fields by type name of ENCRYPTION_FIELDS, as patient.admitted=name,age;other.type=field
+func parseSealedFields(value string) (map[string][]string, error) {
+	fields := map[string][]string{}
+
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		name := strings.TrimSpace(parts[0])
+
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("invalid ENCRYPTION_FIELDS entry %q, expected type=field,field", entry)
+		}
+
+		for _, field := range strings.Split(parts[1], ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields[name] = append(fields[name], field)
+			}
+		}
+	}
+
+	return fields, nil
+}
+
+// openBackend opens the backend selected by STORE_BACKEND
+func (c *Config) openBackend() (store.EventStore, error) {
+	switch backend := strings.ToLower(c.Get("STORE_BACKEND")); backend {
+	case "cassandra":
+		config, err := c.Cassandra()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return store.NewCassandraEventStore(config)
+
+	case "memory":
+		return store.NewInMemStore(), nil
+
+	case "file":
+		fsync, err := store.ParseFsyncPolicy(c.Get("STORE_FSYNC"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return store.NewFileEventStore(&store.FileEventStoreConfig{
+			Dir:   c.Get("STORE_DIR"),
+			Fsync: fsync,
+		})
+
+	case "sqlite":
+		db, err := sql.Open("sqlite", c.Get("STORE_DSN"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		// SQLite allows a single writer at a time
+		db.SetMaxOpenConns(1)
+
+		if err := store.CreateSQLiteSchema(context.Background(), db); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		return store.NewSQLEventStore(db), nil
+	}
+
+	return nil, fmt.Errorf("unknown STORE_BACKEND %q, expected cassandra, memory, file or sqlite", c.Get("STORE_BACKEND"))
+}
@@ -4,12 +4,16 @@ go 1.15
 
 require (
 	github.com/cenkalti/backoff v2.2.1+incompatible
-	github.com/cenkalti/backoff/v4 v4.1.0 // indirect
 	github.com/gin-gonic/gin v1.6.3
 	github.com/gocql/gocql v0.0.0-20201204142955-93eedddb6466
 	github.com/golang/protobuf v1.4.3
-	github.com/google/uuid v1.1.2
+	github.com/google/uuid v1.3.0
 	github.com/rs/zerolog v1.20.0
+	github.com/stretchr/testify v1.5.1
+	github.com/ugorji/go/codec v1.1.7
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
 	google.golang.org/grpc v1.34.0
 	google.golang.org/protobuf v1.25.0
+	gopkg.in/yaml.v2 v2.2.8
+	modernc.org/sqlite v1.14.0
 )
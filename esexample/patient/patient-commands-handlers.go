@@ -1,6 +1,19 @@
 package patient
 
-import "my/esexample/store"
+import (
+	"context"
+	"errors"
+	"my/esexample/store"
+
+	"github.com/google/uuid"
+)
+
+// maxConflictRetries bounds how many times a command is replayed
+// against a freshly loaded patient after a concurrency conflict
+const maxConflictRetries = 3
+
+// MetadataCommand is the metadata key holding the name of the command that produced the events
+const MetadataCommand = "command"
 
 type PatientCommandHandler struct {
 	store *patientEventStore
@@ -10,39 +23,76 @@ func NewPatientCommandHandler(store *patientEventStore) *PatientCommandHandler {
 	return &PatientCommandHandler{store: store}
 }
 
-func (h *PatientCommandHandler) HandleAdmitPatient(c *AdmitPatient) error {
+func (h *PatientCommandHandler) HandleAdmitPatient(ctx context.Context, c *AdmitPatient) error {
+	ctx = commandContext(ctx, "AdmitPatient")
 	p := New(c.ID, c.Name, c.Age, c.Ward)
-	return h.store.Update(p)
+	return h.store.Update(ctx, p)
 }
 
-func (h *PatientCommandHandler) HandleTransferPatient(c *TransferPatient) error {
-	p, err := h.store.Find(store.EventID(c.ID))
+func (h *PatientCommandHandler) HandleTransferPatient(ctx context.Context, c *TransferPatient) error {
+	ctx = commandContext(ctx, "TransferPatient")
+	return h.retryOnConflict(func() error {
+		p, err := h.store.Find(ctx, store.EventID(c.ID))
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	err = p.Transfer(c.NewWardNumber)
+		err = p.Transfer(c.NewWardNumber)
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
+
+		return h.store.Update(ctx, p)
+	})
+}
 
-	return h.store.Update(p)
+func (h *PatientCommandHandler) HandleDischargePatient(ctx context.Context, c *DischargePatient) error {
+	ctx = commandContext(ctx, "DischargePatient")
+	return h.retryOnConflict(func() error {
+		p, err := h.store.Find(ctx, store.EventID(c.ID))
+
+		if err != nil {
+			return err
+		}
+
+		err = p.Discharge()
+
+		if err != nil {
+			return err
+		}
+
+		return h.store.Update(ctx, p)
+	})
 }
 
-func (h *PatientCommandHandler) HandleDischargePatient(c *DischargePatient) error {
-	p, err := h.store.Find(store.EventID(c.ID))
+// commandContext attaches the metadata of the command to ctx. The command gets
+// its own id, used as causation of the events it produces and as correlation
+// unless ctx already belongs to a workflow. Principal and source are expected
+// to be set by the caller with store.WithMetadata
+func commandContext(ctx context.Context, command string) context.Context {
+	commandID := uuid.New().String()
 
-	if err != nil {
-		return err
+	if store.MetadataFromContext(ctx)[store.MetadataCorrelationID] == "" {
+		ctx = store.WithMetadata(ctx, store.MetadataCorrelationID, commandID)
 	}
 
-	err = p.Discharge()
+	ctx = store.WithMetadata(ctx, store.MetadataCausationID, commandID)
+
+	return store.WithMetadata(ctx, MetadataCommand, command)
+}
+
+// retryOnConflict runs the load-execute-save cycle again when another
+// writer updated the patient in the meanwhile
+func (h *PatientCommandHandler) retryOnConflict(handle func() error) error {
+	var err error
 
-	if err != nil {
-		return err
+	for attempt := 0; attempt < maxConflictRetries; attempt++ {
+		if err = handle(); !errors.Is(err, store.ErrConcurrencyConflict) {
+			return err
+		}
 	}
 
-	return h.store.Update(p)
+	return err
 }
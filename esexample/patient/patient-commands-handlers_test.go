@@ -1,6 +1,8 @@
 package patient
 
 import (
+	"context"
+	"errors"
 	"my/esexample/store"
 	"testing"
 )
@@ -16,7 +18,7 @@ func TestNewByHandler(t *testing.T) {
 		Ward: "AA",
 	}
 
-	if err := cmdhandler.HandleAdmitPatient(command); err != nil {
+	if err := cmdhandler.HandleAdmitPatient(context.Background(), command); err != nil {
 		t.Errorf("unexpected error %+v", err)
 	}
 }
@@ -32,7 +34,7 @@ func TestTransferByHandler(t *testing.T) {
 		Ward: "AA",
 	}
 
-	if err := cmdhandler.HandleAdmitPatient(adminCommand); err != nil {
+	if err := cmdhandler.HandleAdmitPatient(context.Background(), adminCommand); err != nil {
 		t.Errorf("unexpected error %+v", err)
 	}
 
@@ -41,7 +43,7 @@ func TestTransferByHandler(t *testing.T) {
 		NewWardNumber: "BB",
 	}
 
-	if err := cmdhandler.HandleTransferPatient(transferCommand); err != nil {
+	if err := cmdhandler.HandleTransferPatient(context.Background(), transferCommand); err != nil {
 		t.Errorf("unexpected error %+v", err)
 	}
 }
@@ -57,7 +59,7 @@ func TestDischargeByHandler(t *testing.T) {
 		Ward: "AA",
 	}
 
-	if err := cmdhandler.HandleAdmitPatient(adminCommand); err != nil {
+	if err := cmdhandler.HandleAdmitPatient(context.Background(), adminCommand); err != nil {
 		t.Errorf("unexpected error %+v", err)
 	}
 
@@ -65,7 +67,7 @@ func TestDischargeByHandler(t *testing.T) {
 		ID: "uuid1",
 	}
 
-	if err := cmdhandler.HandleDischargePatient(dischargeCommand); err != nil {
+	if err := cmdhandler.HandleDischargePatient(context.Background(), dischargeCommand); err != nil {
 		t.Errorf("unexpected error %+v", err)
 	}
 }
@@ -81,7 +83,7 @@ func TestDoubleDischargeByHandler(t *testing.T) {
 		Ward: "AA",
 	}
 
-	if err := cmdhandler.HandleAdmitPatient(adminCommand); err != nil {
+	if err := cmdhandler.HandleAdmitPatient(context.Background(), adminCommand); err != nil {
 		t.Errorf("unexpected error %+v", err)
 	}
 
@@ -89,11 +91,98 @@ func TestDoubleDischargeByHandler(t *testing.T) {
 		ID: "uuid1",
 	}
 
-	if err := cmdhandler.HandleDischargePatient(dischargeCommand); err != nil {
+	if err := cmdhandler.HandleDischargePatient(context.Background(), dischargeCommand); err != nil {
 		t.Errorf("unexpected error %+v", err)
 	}
 
-	if err := cmdhandler.HandleDischargePatient(dischargeCommand); err != ErrPatientDischarged {
+	if err := cmdhandler.HandleDischargePatient(context.Background(), dischargeCommand); err != ErrPatientDischarged {
 		t.Errorf("unexpected error ErrPatientDischarged, got %+v", err)
 	}
 }
+
+// conflictingStore fails the first Update calls with a concurrency conflict
+type conflictingStore struct {
+	store.EventStore
+	conflicts int
+}
+
+func (s *conflictingStore) Update(ctx context.Context, guid store.EventID, expectedVersion int, events []store.StoreEvent) error {
+	if s.conflicts > 0 {
+		s.conflicts--
+		return store.NewConcurrencyError(guid, expectedVersion, expectedVersion+1)
+	}
+	return s.EventStore.Update(ctx, guid, expectedVersion, events)
+}
+
+func TestTransferRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	eventstore := &conflictingStore{EventStore: store.NewInMemStore()}
+	cmdhandler := NewPatientCommandHandler(NewPatientEventStore(eventstore))
+
+	if err := cmdhandler.HandleAdmitPatient(ctx, &AdmitPatient{ID: "uuid1", Name: "John Doe", Age: 33, Ward: "AA"}); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	eventstore.conflicts = maxConflictRetries - 1
+
+	if err := cmdhandler.HandleTransferPatient(ctx, &TransferPatient{ID: "uuid1", NewWardNumber: "BB"}); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	eventstore.conflicts = maxConflictRetries
+
+	err := cmdhandler.HandleTransferPatient(ctx, &TransferPatient{ID: "uuid1", NewWardNumber: "CC"})
+
+	if !errors.Is(err, store.ErrConcurrencyConflict) {
+		t.Errorf("expected concurrency conflict, got %+v", err)
+	}
+}
+
+func TestTransferUnknownPatient(t *testing.T) {
+	cmdhandler := NewPatientCommandHandler(NewPatientEventStore(store.NewInMemStore()))
+
+	err := cmdhandler.HandleTransferPatient(context.Background(), &TransferPatient{ID: "missing", NewWardNumber: "BB"})
+
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected not found error, got %+v", err)
+	}
+}
+
+func TestMetadataByHandler(t *testing.T) {
+	eventstore := store.NewInMemStore()
+	cmdhandler := NewPatientCommandHandler(NewPatientEventStore(eventstore))
+
+	ctx := store.WithMetadata(context.Background(), store.MetadataPrincipal, "dr.house")
+	ctx = store.WithMetadata(ctx, store.MetadataCorrelationID, "workflow1")
+
+	if err := cmdhandler.HandleAdmitPatient(ctx, &AdmitPatient{ID: "uuid1", Name: "John Doe", Age: 33, Ward: "AA"}); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	if err := cmdhandler.HandleDischargePatient(context.Background(), &DischargePatient{ID: "uuid1"}); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	events, err := eventstore.Find(context.Background(), "uuid1")
+
+	if err != nil || len(events) != 2 {
+		t.Fatalf("unexpected events %+v, error %+v", events, err)
+	}
+
+	admitted := events[0].Metadata
+
+	if admitted[store.MetadataPrincipal] != "dr.house" || admitted[store.MetadataCorrelationID] != "workflow1" {
+		t.Errorf("unexpected metadata %+v", admitted)
+	}
+
+	if admitted[store.MetadataCausationID] == "" || admitted[MetadataCommand] != "AdmitPatient" {
+		t.Errorf("unexpected metadata %+v", admitted)
+	}
+
+	discharged := events[1].Metadata
+
+	// a command outside of a workflow starts a new correlation
+	if discharged[store.MetadataCorrelationID] != discharged[store.MetadataCausationID] || discharged[MetadataCommand] != "DischargePatient" {
+		t.Errorf("unexpected metadata %+v", discharged)
+	}
+}
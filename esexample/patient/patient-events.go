@@ -1,27 +1,49 @@
 package patient
 
 import (
-	"fmt"
 	"my/esexample/store"
 )
 
+// the codes the patient events were stored with before their types were named
 const (
 	PatientAdmittedEventType store.EventType = iota + 1
 	PatientTransferredEventType
 	PatientDischargedEventType
 )
 
+// the names of the patient event types
+const (
+	PatientAdmittedTypeName    = "patient.admitted"
+	PatientTransferredTypeName = "patient.transferred"
+	PatientDischargedTypeName  = "patient.discharged"
+)
+
+// patientEventTypes is built at startup, a collision of the types panics
+var patientEventTypes = PatientEventTypes()
+
+// PatientEventTypes returns the registry of the patient event types
+func PatientEventTypes() *store.EventTypeRegistry {
+	return store.NewEventTypeRegistry().MustRegister(
+		store.RegisteredType{Name: PatientAdmittedTypeName, Code: PatientAdmittedEventType, New: func() store.Event { return &PatientAdmitted{} }},
+		store.RegisteredType{Name: PatientTransferredTypeName, Code: PatientTransferredEventType, New: func() store.Event { return &PatientTransferred{} }},
+		store.RegisteredType{Name: PatientDischargedTypeName, Code: PatientDischargedEventType, New: func() store.Event { return &PatientDischarged{} }},
+	)
+}
+
 func PatientEventFromType(e store.EventType) (store.Event, error) {
-	switch e {
-	case PatientAdmittedEventType:
-		return &PatientAdmitted{}, nil
-	case PatientTransferredEventType:
-		return &PatientTransferred{}, nil
-	case PatientDischargedEventType:
-		return &PatientDischarged{}, nil
-	}
-
-	return nil, fmt.Errorf("Event type not found %d", e)
+	return patientEventTypes.Mapper()(e)
+}
+
+// PatientPersonalFields returns the fields of the patient events holding personal data by type
+// name, for the store to seal them alone, as ENCRYPTION_FIELDS=patient.admitted=name,age does
+func PatientPersonalFields() map[string][]string {
+	return map[string][]string{PatientAdmittedTypeName: {"name", "age"}}
+}
+
+// PatientUpcasters returns the upcasters of the patient events. Changing the layout of
+// an event means registering here the upcaster from its latest schema version to the new one
+func PatientUpcasters() *store.Upcasters {
+	return store.NewUpcasters()
 }
 
 func (e PatientAdmitted) GetEventType() store.EventType    { return PatientAdmittedEventType }
@@ -0,0 +1,65 @@
+package patient
+
+import (
+	"encoding/json"
+	"fmt"
+	"my/esexample/store"
+)
+
+// PatientSnapshotSchemaVersion is the version of the layout of patientSnapshot.
+// Bump it whenever the layout changes: older snapshots are then ignored
+// and the patient is rebuilt from its events
+const PatientSnapshotSchemaVersion = 1
+
+// patientSnapshot is the serialized state of a patient
+type patientSnapshot struct {
+	ID         string     `json:"id"`
+	Ward       WardNumber `json:"ward"`
+	Name       Name       `json:"name"`
+	Age        Age        `json:"age"`
+	Discharged bool       `json:"discharged"`
+}
+
+// Snapshot captures the current state of the patient, uncommitted changes included
+func (p *Patient) Snapshot() (store.Snapshot, error) {
+	b, err := json.Marshal(&patientSnapshot{
+		ID:         p.id,
+		Ward:       p.ward,
+		Name:       p.name,
+		Age:        p.age,
+		Discharged: p.discharged,
+	})
+
+	if err != nil {
+		return store.Snapshot{}, err
+	}
+
+	return store.Snapshot{
+		ID:            store.EventID(p.id),
+		Version:       p.version + len(p.changes),
+		SchemaVersion: PatientSnapshotSchemaVersion,
+		Payload:       store.EventPayload(b),
+	}, nil
+}
+
+// RestoreSnapshot restores a blank patient from a snapshot written with the current schema version
+func (p *Patient) RestoreSnapshot(s *store.Snapshot) error {
+	if s.SchemaVersion != PatientSnapshotSchemaVersion {
+		return fmt.Errorf("%w: patient snapshot schema version %d", store.ErrIncompatibleSchema, s.SchemaVersion)
+	}
+
+	var state patientSnapshot
+
+	if err := json.Unmarshal([]byte(s.Payload), &state); err != nil {
+		return err
+	}
+
+	p.id = state.ID
+	p.ward = state.Ward
+	p.name = state.Name
+	p.age = state.Age
+	p.discharged = state.Discharged
+	p.version = s.Version
+
+	return nil
+}
@@ -1,66 +1,78 @@
 package patient
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"my/esexample/store"
+	"time"
 )
 
+// patientEventStore is the repository of the patients
 type patientEventStore struct {
-	EventStore             store.EventStore
-	EventTypeToEventMapper store.EventTypeToEventMapper
+	*store.Repository
 }
 
-func NewPatientEventStore(store store.EventStore) *patientEventStore {
-	return &patientEventStore{
-		EventStore:             store,
-		EventTypeToEventMapper: PatientEventFromType,
-	}
+func NewPatientEventStore(es store.EventStore) *patientEventStore {
+	repository := store.NewRepository(es, func() store.Aggregate { return &Patient{} }, PatientEventFromType)
+	repository.Types = patientEventTypes
+	repository.Upcasters = PatientUpcasters()
+
+	return &patientEventStore{Repository: repository}
+}
+
+// NewPatientEventStoreWithSnapshots creates a patient store that restores patients from
+// their latest snapshot and takes new snapshots according to the given policy
+func NewPatientEventStoreWithSnapshots(es store.EventStore, snapshots store.SnapshotStore, policy store.SnapshotPolicy) *patientEventStore {
+	pstore := NewPatientEventStore(es)
+	pstore.SnapshotStore = snapshots
+	pstore.SnapshotPolicy = policy
+
+	return pstore
 }
 
-func (es *patientEventStore) Find(guid store.EventID) (*Patient, error) {
-	var storeEvents []store.Event
-	events, err := es.EventStore.Find(guid)
+func (es *patientEventStore) Find(ctx context.Context, guid store.EventID) (*Patient, error) {
+	a, err := es.Load(ctx, guid)
 
 	if err != nil {
 		return nil, err
 	}
 
-	for _, e := range events {
-
-		tmp, err := es.EventTypeToEventMapper(e.Type)
-
-		if err != nil {
-			return nil, err
-		}
-
-		err = json.Unmarshal([]byte(e.Payload), &tmp)
+	return a.(*Patient), nil
+}
 
-		if err != nil {
-			return nil, err
-		}
+// FindAsOf rebuilds the patient as it was at the given point in time
+func (es *patientEventStore) FindAsOf(ctx context.Context, guid store.EventID, asOf time.Time) (*Patient, error) {
+	a, err := es.LoadAsOf(ctx, guid, asOf)
 
-		storeEvents = append(storeEvents, tmp)
+	if err != nil {
+		return nil, err
 	}
 
-	p := NewFromEvents(storeEvents)
-	return p, nil
+	return a.(*Patient), nil
 }
 
-func (es *patientEventStore) Update(p *Patient) error {
-	var events []store.StoreEvent
+func (es *patientEventStore) Update(ctx context.Context, p *Patient) error {
+	return es.Save(ctx, p)
+}
 
-	id := store.EventID(p.ID())
+// Archive moves the stream of a discharged patient out of the event store, it stays readable
+// by Find, see store.ArchivedEventStore. ErrPatientNotDischarged for a patient still in care
+func (es *patientEventStore) Archive(ctx context.Context, guid store.EventID) error {
+	archiver, ok := es.EventStore.(store.StreamArchiver)
 
-	for _, e := range p.Events() {
+	if !ok {
+		return fmt.Errorf("%w: stream archival", store.ErrNotSupported)
+	}
 
-		b, err := json.Marshal(e)
+	p, err := es.Find(ctx, guid)
 
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		return err
+	}
 
-		events = append(events, store.StoreEvent{Payload: store.EventPayload(b), Type: e.GetEventType(), ID: id})
+	if !p.Discharged() {
+		return ErrPatientNotDischarged
 	}
 
-	return es.EventStore.Update(id, p.Version(), events)
+	return archiver.ArchiveStream(ctx, guid)
 }
@@ -1,22 +1,31 @@
 package patient
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"my/esexample/store"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestPatientInStore(t *testing.T) {
+	ctx := context.Background()
+
 	// create patient
 	pstore := NewPatientEventStore(store.NewInMemStore())
 	pnew := New("uuid", "name", 66, "ward1")
 
-	if err := pstore.Update(pnew); err != nil {
+	if err := pstore.Update(ctx, pnew); err != nil {
 		t.Errorf("got expected error: %+v", err)
 	}
 
-	pfind, err := pstore.Find(store.EventID("uuid"))
+	pfind, err := pstore.Find(ctx, store.EventID("uuid"))
 
 	if err != nil {
 		t.Errorf("got expected error: %+v", err)
@@ -32,11 +41,11 @@ func TestPatientInStore(t *testing.T) {
 		t.Errorf("got expected error: %+v", err)
 	}
 
-	if err := pstore.Update(pfind); err != nil {
+	if err := pstore.Update(ctx, pfind); err != nil {
 		t.Errorf("got expected error: %+v", err)
 	}
 
-	pfind, err = pstore.Find(store.EventID("uuid"))
+	pfind, err = pstore.Find(ctx, store.EventID("uuid"))
 
 	if err != nil {
 		t.Errorf("got expected error: %+v", err)
@@ -53,11 +62,11 @@ func TestPatientInStore(t *testing.T) {
 		t.Errorf("got expected error: %+v", err)
 	}
 
-	if err := pstore.Update(pfind); err != nil {
+	if err := pstore.Update(ctx, pfind); err != nil {
 		t.Errorf("got expected error: %+v", err)
 	}
 
-	pfind, err = pstore.Find(store.EventID("uuid"))
+	pfind, err = pstore.Find(ctx, store.EventID("uuid"))
 
 	if err != nil {
 		t.Errorf("got expected error: %+v", err)
@@ -74,11 +83,11 @@ func TestPatientInStore(t *testing.T) {
 		t.Errorf("got expected error: %+v", err)
 	}
 
-	if err := pstore.Update(pfind); err != nil {
+	if err := pstore.Update(ctx, pfind); err != nil {
 		t.Errorf("got expected error: %+v", err)
 	}
 
-	pfind, err = pstore.Find(store.EventID("uuid"))
+	pfind, err = pstore.Find(ctx, store.EventID("uuid"))
 
 	if err != nil {
 		t.Errorf("got expected error: %+v", err)
@@ -88,16 +97,17 @@ func TestPatientInStore(t *testing.T) {
 }
 
 func TestOptimisticLockingInStore(t *testing.T) {
+	ctx := context.Background()
 
 	// create patient
 	pstore := NewPatientEventStore(store.NewInMemStore())
 	pnew := New("uuid", "name", 66, "ward1")
 
-	if err := pstore.Update(pnew); err != nil {
+	if err := pstore.Update(ctx, pnew); err != nil {
 		t.Errorf("got expected error: %+v", err)
 	}
 
-	pfind, err := pstore.Find(store.EventID("uuid"))
+	pfind, err := pstore.Find(ctx, store.EventID("uuid"))
 
 	if err != nil {
 		t.Errorf("got expected error: %+v", err)
@@ -107,7 +117,7 @@ func TestOptimisticLockingInStore(t *testing.T) {
 		t.Errorf("got expected error: %+v", err)
 	}
 
-	if err := pstore.Update(pfind); err != nil {
+	if err := pstore.Update(ctx, pfind); err != nil {
 		t.Errorf("got expected error: %+v", err)
 	}
 
@@ -117,7 +127,299 @@ func TestOptimisticLockingInStore(t *testing.T) {
 	}
 
 	// expect optimistic locking error
-	if err := pstore.Update(pfind); err == nil {
+	if err := pstore.Update(ctx, pfind); err == nil {
 		t.Errorf("expected optimistic lock error")
 	}
 }
+
+func TestPatientAsOfInStore(t *testing.T) {
+	ctx := context.Background()
+	pstore := NewPatientEventStore(store.NewInMemStore())
+
+	if err := pstore.Update(ctx, New("uuid", "name", 66, "ward1")); err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	admitted := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	pfind, err := pstore.Find(ctx, store.EventID("uuid"))
+
+	if err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	if err := pfind.Transfer("ward2"); err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	if err := pstore.Update(ctx, pfind); err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	pfind, err = pstore.FindAsOf(ctx, store.EventID("uuid"), admitted)
+
+	if err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, pfind.Ward(), WardNumber("ward1"))
+	assert.Equal(t, pfind.Version(), 1)
+}
+
+// rangeRecorder remembers the range of the last ranged read
+type rangeRecorder struct {
+	store.EventStore
+	last store.StreamRange
+}
+
+func (s *rangeRecorder) FindRange(ctx context.Context, guid store.EventID, r store.StreamRange) ([]store.StoreEvent, error) {
+	s.last = r
+	return s.EventStore.FindRange(ctx, guid, r)
+}
+
+func TestPatientFromSnapshotInStore(t *testing.T) {
+	ctx := context.Background()
+	memstore := store.NewInMemStore()
+	recorder := &rangeRecorder{EventStore: memstore}
+	pstore := NewPatientEventStoreWithSnapshots(recorder, memstore, store.EveryNEvents(2))
+
+	if err := pstore.Update(ctx, New("uuid", "name", 66, "ward1")); err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	if _, err := memstore.LatestSnapshot(ctx, "uuid"); err == nil {
+		t.Errorf("unexpected snapshot after one event")
+	}
+
+	for _, ward := range []WardNumber{"ward2", "ward3"} {
+		pfind, err := pstore.Find(ctx, store.EventID("uuid"))
+
+		if err != nil {
+			t.Errorf("got expected error: %+v", err)
+		}
+
+		if err := pfind.Transfer(ward); err != nil {
+			t.Errorf("got expected error: %+v", err)
+		}
+
+		if err := pstore.Update(ctx, pfind); err != nil {
+			t.Errorf("got expected error: %+v", err)
+		}
+	}
+
+	snapshot, err := memstore.LatestSnapshot(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, snapshot.Version, 2)
+
+	pfind, err := pstore.Find(ctx, store.EventID("uuid"))
+
+	if err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, recorder.last.AfterVersion, 2)
+	assert.Equal(t, pfind.Version(), 3)
+	assert.Equal(t, pfind.Ward(), WardNumber("ward3"))
+	assert.Equal(t, pfind.Name(), Name("name"))
+}
+
+func TestStaleSnapshotIgnoredInStore(t *testing.T) {
+	ctx := context.Background()
+	memstore := store.NewInMemStore()
+	recorder := &rangeRecorder{EventStore: memstore}
+	pstore := NewPatientEventStoreWithSnapshots(recorder, memstore, store.EveryNEvents(100))
+
+	if err := pstore.Update(ctx, New("uuid", "name", 66, "ward1")); err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	stale := store.Snapshot{ID: "uuid", Version: 1, SchemaVersion: PatientSnapshotSchemaVersion - 1, Payload: store.EventPayload(`{"room":"ward9"}`)}
+
+	if err := memstore.SaveSnapshot(ctx, stale); err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	pfind, err := pstore.Find(ctx, store.EventID("uuid"))
+
+	if err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, recorder.last.AfterVersion, 0)
+	assert.Equal(t, pfind.Ward(), WardNumber("ward1"))
+}
+
+func TestUpcastEventsInStore(t *testing.T) {
+	ctx := context.Background()
+	memstore := store.NewInMemStore()
+	pstore := NewPatientEventStore(memstore)
+
+	// a former layout of the admission, with the name split in two fields
+	pstore.Upcasters = PatientUpcasters().Register(PatientAdmittedEventType, 1, store.JSONUpcaster(func(fields map[string]interface{}) error {
+		fields["name"] = fmt.Sprintf("%v %v", fields["first_name"], fields["last_name"])
+		delete(fields, "first_name")
+		delete(fields, "last_name")
+		return nil
+	}))
+
+	old := store.StoreEvent{Type: PatientAdmittedEventType, Payload: store.EventPayload(`{"id":"uuid","first_name":"john","last_name":"doe","ward":"ward1","age":66}`)}
+
+	if err := memstore.Update(ctx, "uuid", 0, []store.StoreEvent{old}); err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	pfind, err := pstore.Find(ctx, store.EventID("uuid"))
+
+	if err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, pfind.Name(), Name("john doe"))
+	assert.Equal(t, pfind.Ward(), WardNumber("ward1"))
+
+	// the events written today record the latest schema version
+	if err := pfind.Transfer("ward2"); err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	if err := pstore.Update(ctx, pfind); err != nil {
+		t.Errorf("got expected error: %+v", err)
+	}
+
+	events, err := memstore.Find(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, events[0].SchemaVersion, 0)
+	assert.Equal(t, events[1].SchemaVersion, 1)
+	assert.Equal(t, pstore.Upcasters.Latest(PatientAdmittedEventType), 2)
+}
+
+func TestTypeNamesInStore(t *testing.T) {
+	ctx := context.Background()
+	memstore := store.NewInMemStore()
+	pstore := NewPatientEventStore(memstore)
+
+	if err := pstore.Update(ctx, New("uuid", "name", 66, "ward1")); err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	events, err := memstore.Find(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, events[0].Type, PatientAdmittedEventType)
+	assert.Equal(t, events[0].TypeName, PatientAdmittedTypeName)
+
+	// the admissions are read by name, as the code they were stored with
+	byName, _, err := memstore.GetEventsByType(ctx, store.TypeQuery{TypeNames: []string{PatientAdmittedTypeName}})
+
+	if err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, len(byName), 1)
+	assert.Equal(t, PatientEventTypes().Names(), []string{PatientAdmittedTypeName, PatientDischargedTypeName, PatientTransferredTypeName})
+}
+
+func TestErasedPatientInStore(t *testing.T) {
+	ctx := context.Background()
+	memstore := store.NewInMemStore()
+	keys, _ := store.NewFileKeyring("")
+	encrypted, err := store.NewEncryptedEventStore(memstore, keys, make([]byte, 32))
+
+	if err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	encrypted.Fields = PatientPersonalFields()
+	pstore := NewPatientEventStore(encrypted)
+
+	if err := pstore.Update(ctx, New("uuid", "Ann", 66, "ward1")); err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	// the name and the age are sealed, the ward is left in clear
+	events, _ := memstore.Find(ctx, "uuid")
+	assert.Equal(t, strings.Contains(string(events[0].Payload), "Ann"), false)
+	assert.Equal(t, strings.Contains(string(events[0].Payload), "ward1"), true)
+
+	p, err := pstore.Find(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, p.name, Name("Ann"))
+
+	if err := encrypted.Shred(ctx, "uuid"); err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	if _, err := pstore.Find(ctx, "uuid"); !errors.Is(err, store.ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+}
+
+func TestArchivedPatientInStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "archive")
+
+	if err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	memstore := store.NewInMemStore()
+	archive, _ := store.NewFileArchive(dir)
+	pstore := NewPatientEventStore(store.NewArchivedEventStore(memstore, archive))
+
+	p := New("uuid", "Ann", 66, "ward1")
+
+	if err := pstore.Update(ctx, p); err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	// the patients in care stay in the store
+	if err := pstore.Archive(ctx, "uuid"); !errors.Is(err, ErrPatientNotDischarged) {
+		t.Errorf("expected ErrPatientNotDischarged, got %+v", err)
+	}
+
+	p, _ = pstore.Find(ctx, "uuid")
+
+	if err := p.Discharge(); err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	if err := pstore.Update(ctx, p); err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	if err := pstore.Archive(ctx, "uuid"); err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	// the events left the store, the patient is read from the archive
+	if _, err := memstore.Find(ctx, "uuid"); !errors.Is(err, store.ErrDeleted) {
+		t.Errorf("expected ErrDeleted, got %+v", err)
+	}
+
+	p, err = pstore.Find(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("got expected error: %+v", err)
+	}
+
+	assert.Equal(t, p.name, Name("Ann"))
+	assert.Equal(t, p.Discharged(), true)
+}
@@ -6,6 +6,7 @@ import (
 )
 
 var ErrPatientDischarged = errors.New("patient already discharged")
+var ErrPatientNotDischarged = errors.New("patient not discharged")
 
 // type ID uuid.UUID
 type WardNumber string
@@ -23,6 +24,9 @@ type Patient struct {
 
 	changes []store.Event
 	version int
+
+	// how the patient was loaded, used by the snapshot policy
+	loaded store.LoadStats
 }
 
 // NewFromEvents is a helper method that creates a new patient
@@ -135,6 +139,16 @@ func (p Patient) Version() int {
 	return p.version
 }
 
+// ClearChanges forgets the uncommitted events once saved, leaving the version as is.
+func (p *Patient) ClearChanges() {
+	p.changes = nil
+}
+
+// LoadStats returns how the patient was loaded.
+func (p *Patient) LoadStats() *store.LoadStats {
+	return &p.loaded
+}
+
 func (p *Patient) raise(event store.Event) {
 	p.changes = append(p.changes, event)
 	p.On(event, true)
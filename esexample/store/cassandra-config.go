@@ -0,0 +1,361 @@
+package store
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+type CassandraEventStoreConfig struct {
+	Keyspace    string
+	WriteQuorum string
+	ReadQuorum  string
+	Hosts       []string
+	Port        int
+	Auth        CassandraAuth
+	TLS         CassandraTLS
+
+	// LocalDC routes the queries token aware to the nodes of this data center,
+	// falling back to the others. Without it they go token aware to all the nodes
+	LocalDC string
+
+	// consistency of the lightweight transactions of Update, SERIAL or LOCAL_SERIAL.
+	// LOCAL_SERIAL keeps them within LocalDC
+	SerialConsistency string
+
+	// Retries of a failed query, waiting from RetryMinBackoff up to RetryMaxBackoff in between
+	Retries         int
+	RetryMinBackoff time.Duration
+	RetryMaxBackoff time.Duration
+
+	// timeouts of the connection to a node and of the queries, the gocql defaults when 0
+	ConnectTimeout time.Duration
+	Timeout        time.Duration
+
+	// rows fetched at once by the queries, the gocql default when 0
+	PageSize int
+
+	TraceSession bool
+
+	// size of the time buckets of the index by type, one hour by default.
+	// It must be the same for all the stores writing to the keyspace
+	TypeBucketSize time.Duration
+
+	// MaxClockSkew bounds the difference between the clocks of the servers writing to the
+	// keyspace, which set the save times of the events. The readers by type leave out the
+	// events saved less than the index timeout, two seconds, plus MaxClockSkew ago, one second by default
+	MaxClockSkew time.Duration
+
+	// how often the store indexes the events whose index write failed, five minutes
+	// by default, never when negative, see RepairTypeIndex
+	IndexRepairInterval time.Duration
+
+	// how long the list of the types having events is kept by the readers of all the types,
+	// ten seconds by default, read on every query when negative. Such readers don't read past
+	// the settle window before the list was read, so a type listed late delays its events only
+	TypeListRefresh time.Duration
+
+	// SkipSchemaCheck lets the store start on a keyspace whose schema version
+	// is not CassandraSchemaVersion, see es-migrate
+	SkipSchemaCheck bool
+}
+
+// serialRead returns the consistency of the reads of the values written by lightweight
+// transactions: the serial consistency, SERIAL unless it is LOCAL_SERIAL
+func (config *CassandraEventStoreConfig) serialRead() gocql.Consistency {
+	if strings.EqualFold(config.SerialConsistency, "LOCAL_SERIAL") {
+		return gocql.Consistency(gocql.LocalSerial)
+	}
+	return gocql.Consistency(gocql.Serial)
+}
+
+// CassandraAuth are the credentials of the cluster. Each of them is given either
+// inline or as the path of a file holding it, such as a mounted secret
+type CassandraAuth struct {
+	Username     string
+	Password     string
+	UsernameFile string
+	PasswordFile string
+}
+
+// CassandraTLS encrypts the connections to the cluster
+type CassandraTLS struct {
+	Enabled bool
+
+	CAFile   string // authorities the certificates of the nodes are checked against, the system ones if empty
+	CertFile string // client certificate, for the clusters requiring one
+	KeyFile  string
+
+	ServerName         string // name expected in the certificates of the nodes, their address if empty
+	InsecureSkipVerify bool   // accept any certificate, for tests only
+}
+
+// credentials returns the user name and password, read from their files if so configured
+func (a CassandraAuth) credentials() (string, string, error) {
+	username, password := a.Username, a.Password
+
+	if a.UsernameFile != "" {
+		data, err := ioutil.ReadFile(a.UsernameFile)
+
+		if err != nil {
+			return "", "", invalidArgumentf("unable to read the user name: %v", err)
+		}
+
+		username = strings.TrimSpace(string(data))
+	}
+
+	if a.PasswordFile != "" {
+		data, err := ioutil.ReadFile(a.PasswordFile)
+
+		if err != nil {
+			return "", "", invalidArgumentf("unable to read the password: %v", err)
+		}
+
+		// passwords may end with spaces, only the newline of the file is dropped
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return username, password, nil
+}
+
+// parseConsistency reads a consistency level, the fallback when the name is empty
+func parseConsistency(name string, fallback gocql.Consistency) (gocql.Consistency, error) {
+	if name == "" {
+		return fallback, nil
+	}
+
+	var consistency gocql.Consistency
+
+	if err := consistency.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return fallback, invalidArgumentf("consistency %q", name)
+	}
+
+	return consistency, nil
+}
+
+// Validate checks the configuration without connecting to the cluster
+func (config *CassandraEventStoreConfig) Validate() error {
+	if len(config.Hosts) == 0 {
+		return invalidArgumentf("no Cassandra hosts")
+	}
+
+	for _, host := range config.Hosts {
+		if strings.TrimSpace(host) == "" {
+			return invalidArgumentf("empty Cassandra host in %v", config.Hosts)
+		}
+	}
+
+	if config.Port < 0 || config.Port > 65535 {
+		return invalidArgumentf("Cassandra port %d", config.Port)
+	}
+
+	if _, err := parseConsistency(config.ReadQuorum, gocql.Quorum); err != nil {
+		return err
+	}
+
+	if _, err := parseConsistency(config.WriteQuorum, gocql.Quorum); err != nil {
+		return err
+	}
+
+	if config.SerialConsistency != "" {
+		var serial gocql.SerialConsistency
+		if err := serial.UnmarshalText([]byte(strings.ToUpper(config.SerialConsistency))); err != nil {
+			return invalidArgumentf("serial consistency %q, expected SERIAL or LOCAL_SERIAL", config.SerialConsistency)
+		}
+	}
+
+	if config.Auth.Password != "" && config.Auth.PasswordFile != "" {
+		return invalidArgumentf("both a password and a password file")
+	}
+
+	if config.Auth.Username != "" && config.Auth.UsernameFile != "" {
+		return invalidArgumentf("both a user name and a user name file")
+	}
+
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return invalidArgumentf("a client certificate needs both its certificate and key files")
+	}
+
+	if config.Retries < 0 || config.RetryMinBackoff < 0 || config.RetryMaxBackoff < 0 {
+		return invalidArgumentf("negative retries or backoff")
+	}
+
+	if config.RetryMaxBackoff > 0 && config.RetryMinBackoff > config.RetryMaxBackoff {
+		return invalidArgumentf("retry backoff from %v up to %v", config.RetryMinBackoff, config.RetryMaxBackoff)
+	}
+
+	if config.ConnectTimeout < 0 || config.Timeout < 0 || config.PageSize < 0 {
+		return invalidArgumentf("negative timeout or page size")
+	}
+
+	if config.MaxClockSkew < 0 {
+		return invalidArgumentf("negative clock skew")
+	}
+
+	return nil
+}
+
+// newCluster configures the connection to the cluster, but not the keyspace
+func (config *CassandraEventStoreConfig) newCluster() (*gocql.ClusterConfig, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	cluster := gocql.NewCluster(config.Hosts...)
+
+	// set port if provided
+	if config.Port > 0 {
+		cluster.Port = config.Port
+	}
+
+	cluster.Consistency = gocql.Quorum
+
+	if config.SerialConsistency != "" {
+		cluster.SerialConsistency.UnmarshalText([]byte(strings.ToUpper(config.SerialConsistency)))
+	}
+
+	username, password, err := config.Auth.credentials()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "" || password != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: username, Password: password}
+	}
+
+	if config.TLS.Enabled {
+		cluster.SslOpts = &gocql.SslOptions{
+			Config: &tls.Config{
+				ServerName:         config.TLS.ServerName,
+				InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+			},
+			CaPath:                 config.TLS.CAFile,
+			CertPath:               config.TLS.CertFile,
+			KeyPath:                config.TLS.KeyFile,
+			EnableHostVerification: !config.TLS.InsecureSkipVerify,
+		}
+	}
+
+	if config.LocalDC != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(config.LocalDC))
+	} else {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.RoundRobinHostPolicy())
+	}
+
+	if config.Retries > 0 {
+		cluster.RetryPolicy = &gocql.ExponentialBackoffRetryPolicy{
+			NumRetries: config.Retries,
+			Min:        config.RetryMinBackoff,
+			Max:        config.RetryMaxBackoff,
+		}
+	}
+
+	if config.ConnectTimeout > 0 {
+		cluster.ConnectTimeout = config.ConnectTimeout
+	}
+
+	if config.Timeout > 0 {
+		cluster.Timeout = config.Timeout
+	}
+
+	if config.PageSize > 0 {
+		cluster.PageSize = config.PageSize
+	}
+
+	return cluster, nil
+}
+
+// CassandraEventStoreConfigFromEnv reads the configuration from the CASSANDRA_* variables
+// of the environment, see the Readme. lookup is os.LookupEnv, or the Lookup of the
+// configuration of the commands, see the package config
+func CassandraEventStoreConfigFromEnv(lookup func(key string) (string, bool)) (*CassandraEventStoreConfig, error) {
+	var err error
+
+	get := func(key, fallback string) string {
+		if value, ok := lookup(key); ok {
+			return value
+		}
+		return fallback
+	}
+
+	// the parse errors are kept, the first one is returned
+	parse := func(key string, fn func(value string) error) {
+		if value, ok := lookup(key); ok && value != "" && err == nil {
+			if perr := fn(value); perr != nil {
+				err = invalidArgumentf("%s=%q: %v", key, value, perr)
+			}
+		}
+	}
+
+	duration := func(key string, d *time.Duration) {
+		parse(key, func(value string) (perr error) {
+			*d, perr = time.ParseDuration(value)
+			return perr
+		})
+	}
+
+	integer := func(key string, n *int) {
+		parse(key, func(value string) (perr error) {
+			*n, perr = strconv.Atoi(value)
+			return perr
+		})
+	}
+
+	boolean := func(key string, b *bool) {
+		parse(key, func(value string) (perr error) {
+			*b, perr = strconv.ParseBool(value)
+			return perr
+		})
+	}
+
+	config := &CassandraEventStoreConfig{
+		Keyspace:          get("CASSANDRA_KEYSPACE", "eventstore"),
+		WriteQuorum:       strings.ToUpper(get("CASSANDRA_WRITE_QUORUM", "QUORUM")),
+		ReadQuorum:        strings.ToUpper(get("CASSANDRA_READ_QUORUM", "LOCAL_QUORUM")),
+		SerialConsistency: strings.ToUpper(get("CASSANDRA_SERIAL_CONSISTENCY", "")),
+		LocalDC:           get("CASSANDRA_LOCAL_DC", ""),
+		Auth: CassandraAuth{
+			Username:     get("CASSANDRA_USERNAME", ""),
+			Password:     get("CASSANDRA_PASSWORD", ""),
+			UsernameFile: get("CASSANDRA_USERNAME_FILE", ""),
+			PasswordFile: get("CASSANDRA_PASSWORD_FILE", ""),
+		},
+		TLS: CassandraTLS{
+			CAFile:     get("CASSANDRA_TLS_CA_FILE", ""),
+			CertFile:   get("CASSANDRA_TLS_CERT_FILE", ""),
+			KeyFile:    get("CASSANDRA_TLS_KEY_FILE", ""),
+			ServerName: get("CASSANDRA_TLS_SERVER_NAME", ""),
+		},
+	}
+
+	for _, host := range strings.Split(get("CASSANDRA_HOSTS", "localhost"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			config.Hosts = append(config.Hosts, host)
+		}
+	}
+
+	integer("CASSANDRA_PORT", &config.Port)
+	boolean("CASSANDRA_TLS", &config.TLS.Enabled)
+	boolean("CASSANDRA_TLS_INSECURE_SKIP_VERIFY", &config.TLS.InsecureSkipVerify)
+	integer("CASSANDRA_RETRIES", &config.Retries)
+	duration("CASSANDRA_RETRY_MIN_BACKOFF", &config.RetryMinBackoff)
+	duration("CASSANDRA_RETRY_MAX_BACKOFF", &config.RetryMaxBackoff)
+	duration("CASSANDRA_CONNECT_TIMEOUT", &config.ConnectTimeout)
+	duration("CASSANDRA_TIMEOUT", &config.Timeout)
+	integer("CASSANDRA_PAGE_SIZE", &config.PageSize)
+	duration("CASSANDRA_TYPE_BUCKET_SIZE", &config.TypeBucketSize)
+	duration("CASSANDRA_MAX_CLOCK_SKEW", &config.MaxClockSkew)
+	duration("CASSANDRA_INDEX_REPAIR_INTERVAL", &config.IndexRepairInterval)
+	duration("CASSANDRA_TYPE_LIST_REFRESH", &config.TypeListRefresh)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return config, config.Validate()
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// env is a lookup on a fixed environment
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := vars[key]
+		return value, ok
+	}
+}
+
+func TestCassandraConfigFromEnvDefaults(t *testing.T) {
+	config, err := CassandraEventStoreConfigFromEnv(env(nil))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if !reflect.DeepEqual(config.Hosts, []string{"localhost"}) || config.Keyspace != "eventstore" ||
+		config.WriteQuorum != "QUORUM" || config.ReadQuorum != "LOCAL_QUORUM" {
+		t.Errorf("unexpected defaults %+v", config)
+	}
+}
+
+func TestCassandraConfigFromEnv(t *testing.T) {
+	config, err := CassandraEventStoreConfigFromEnv(env(map[string]string{
+		"CASSANDRA_HOSTS":              "cassandra-1, cassandra-2,,cassandra-3",
+		"CASSANDRA_PORT":               "9142",
+		"CASSANDRA_READ_QUORUM":        "local_one",
+		"CASSANDRA_WRITE_QUORUM":       "each_quorum",
+		"CASSANDRA_SERIAL_CONSISTENCY": "local_serial",
+		"CASSANDRA_LOCAL_DC":           "dc1",
+		"CASSANDRA_USERNAME":           "store",
+		"CASSANDRA_PASSWORD":           "secret",
+		"CASSANDRA_TLS":                "true",
+		"CASSANDRA_TLS_CA_FILE":        "/etc/cassandra/ca.pem",
+		"CASSANDRA_TLS_SERVER_NAME":    "cassandra.internal",
+		"CASSANDRA_RETRIES":            "3",
+		"CASSANDRA_RETRY_MIN_BACKOFF":  "100ms",
+		"CASSANDRA_RETRY_MAX_BACKOFF":  "2s",
+		"CASSANDRA_CONNECT_TIMEOUT":    "5s",
+		"CASSANDRA_TIMEOUT":            "2s",
+		"CASSANDRA_PAGE_SIZE":          "500",
+		"CASSANDRA_TYPE_BUCKET_SIZE":   "10m",
+	}))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	expected := &CassandraEventStoreConfig{
+		Keyspace:          "eventstore",
+		WriteQuorum:       "EACH_QUORUM",
+		ReadQuorum:        "LOCAL_ONE",
+		Hosts:             []string{"cassandra-1", "cassandra-2", "cassandra-3"},
+		Port:              9142,
+		Auth:              CassandraAuth{Username: "store", Password: "secret"},
+		TLS:               CassandraTLS{Enabled: true, CAFile: "/etc/cassandra/ca.pem", ServerName: "cassandra.internal"},
+		LocalDC:           "dc1",
+		SerialConsistency: "LOCAL_SERIAL",
+		Retries:           3,
+		RetryMinBackoff:   100 * time.Millisecond,
+		RetryMaxBackoff:   2 * time.Second,
+		ConnectTimeout:    5 * time.Second,
+		Timeout:           2 * time.Second,
+		PageSize:          500,
+		TypeBucketSize:    10 * time.Minute,
+	}
+
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected %+v, got %+v", expected, config)
+	}
+}
+
+func TestCassandraConfigFromEnvInvalid(t *testing.T) {
+	cases := map[string]map[string]string{
+		"port":               {"CASSANDRA_PORT": "cql"},
+		"duration":           {"CASSANDRA_TIMEOUT": "2"},
+		"tls":                {"CASSANDRA_TLS": "maybe"},
+		"no hosts":           {"CASSANDRA_HOSTS": " , "},
+		"read quorum":        {"CASSANDRA_READ_QUORUM": "MOST"},
+		"serial consistency": {"CASSANDRA_SERIAL_CONSISTENCY": "QUORUM"},
+		"password twice":     {"CASSANDRA_PASSWORD": "secret", "CASSANDRA_PASSWORD_FILE": "/run/secrets/password"},
+		"certificate alone":  {"CASSANDRA_TLS_CERT_FILE": "/etc/cassandra/client.pem"},
+		"backoff":            {"CASSANDRA_RETRY_MIN_BACKOFF": "2s", "CASSANDRA_RETRY_MAX_BACKOFF": "1s"},
+	}
+
+	for name, vars := range cases {
+		if _, err := CassandraEventStoreConfigFromEnv(env(vars)); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%s: expected ErrInvalidArgument, got %+v", name, err)
+		}
+	}
+}
+
+func TestCassandraCredentialsFromFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cassandra-config")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "username"), []byte("store\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "password"), []byte("secret \n"), 0600)
+
+	config := &CassandraEventStoreConfig{
+		Hosts: []string{"localhost"},
+		Auth: CassandraAuth{
+			UsernameFile: filepath.Join(dir, "username"),
+			PasswordFile: filepath.Join(dir, "password"),
+		},
+	}
+
+	cluster, err := config.newCluster()
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	expected := gocql.PasswordAuthenticator{Username: "store", Password: "secret "}
+
+	if cluster.Authenticator != expected {
+		t.Errorf("expected %+v, got %+v", expected, cluster.Authenticator)
+	}
+
+	config.Auth.PasswordFile = filepath.Join(dir, "missing")
+
+	if _, err := config.newCluster(); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func TestCassandraCluster(t *testing.T) {
+	config := &CassandraEventStoreConfig{
+		Hosts:             []string{"cassandra-1", "cassandra-2"},
+		Port:              9142,
+		Keyspace:          "eventstore",
+		TLS:               CassandraTLS{Enabled: true, CAFile: "ca.pem", ServerName: "cassandra.internal"},
+		LocalDC:           "dc1",
+		SerialConsistency: "LOCAL_SERIAL",
+		Retries:           3,
+		RetryMinBackoff:   100 * time.Millisecond,
+		RetryMaxBackoff:   time.Second,
+		ConnectTimeout:    5 * time.Second,
+		Timeout:           2 * time.Second,
+		PageSize:          500,
+	}
+
+	cluster, err := config.newCluster()
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if !reflect.DeepEqual(cluster.Hosts, config.Hosts) || cluster.Port != 9142 || cluster.Keyspace != "" {
+		t.Errorf("unexpected hosts %v, port %d or keyspace %q", cluster.Hosts, cluster.Port, cluster.Keyspace)
+	}
+
+	if cluster.Authenticator != nil {
+		t.Errorf("unexpected authenticator %+v", cluster.Authenticator)
+	}
+
+	if cluster.SerialConsistency != gocql.LocalSerial {
+		t.Errorf("expected LOCAL_SERIAL, got %v", cluster.SerialConsistency)
+	}
+
+	if ssl := cluster.SslOpts; ssl == nil || ssl.CaPath != "ca.pem" || ssl.Config.ServerName != "cassandra.internal" || !ssl.EnableHostVerification {
+		t.Errorf("unexpected TLS options %+v", ssl)
+	}
+
+	if cluster.PoolConfig.HostSelectionPolicy == nil {
+		t.Errorf("expected a host selection policy")
+	}
+
+	expected := &gocql.ExponentialBackoffRetryPolicy{NumRetries: 3, Min: 100 * time.Millisecond, Max: time.Second}
+
+	if !reflect.DeepEqual(cluster.RetryPolicy, expected) {
+		t.Errorf("expected retry policy %+v, got %+v", expected, cluster.RetryPolicy)
+	}
+
+	if cluster.ConnectTimeout != 5*time.Second || cluster.Timeout != 2*time.Second || cluster.PageSize != 500 {
+		t.Errorf("unexpected timeouts %v, %v or page size %d", cluster.ConnectTimeout, cluster.Timeout, cluster.PageSize)
+	}
+
+	// without options the gocql defaults stay
+	defaults := gocql.NewCluster("localhost")
+	cluster, _ = (&CassandraEventStoreConfig{Hosts: []string{"localhost"}}).newCluster()
+
+	if cluster.SslOpts != nil || cluster.Timeout != defaults.Timeout || cluster.PageSize != defaults.PageSize ||
+		cluster.SerialConsistency != defaults.SerialConsistency || !reflect.DeepEqual(cluster.RetryPolicy, defaults.RetryPolicy) {
+		t.Errorf("unexpected defaults %+v", cluster)
+	}
+}
@@ -0,0 +1,1265 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// fakeCassandra is an in process stand in for the keyspace of a CassandraEventStore.
+// The tables are created from the migrations; the statements of the store are parsed
+// and run on rows kept in memory, with the semantics the store relies on: upserts,
+// static columns shared by the rows of a partition, clustering order, deletions of
+// partitions and of ranges of rows, and batches
+// whose lightweight transaction conditions apply all of their statements or none.
+// The schema statements of the migrations run on it too, the views are only recorded
+type fakeCassandra struct {
+	mutex  sync.Mutex
+	tables map[string]*fakeTable
+	views  map[string]bool
+	faults []fakeFault
+	reads  map[string]int // rows returned by table
+}
+
+// fakeFault makes the statements starting with prefix fail with err, the first times
+// ones only if times is set. A query returns rows rows before failing, as a paging query
+// timing out half way through; a write with applied set is applied before failing, as a
+// timeout whose write went through
+type fakeFault struct {
+	prefix  string
+	err     error
+	rows    int
+	applied bool
+	times   int
+}
+
+type fakeColumn struct {
+	name   string
+	ctype  string
+	static bool
+}
+
+type fakeTable struct {
+	name         string
+	columns      map[string]*fakeColumn
+	partitionKey []string
+	clustering   []string
+	descending   bool
+	partitions   map[string]*fakePartition
+}
+
+type fakePartition struct {
+	key    []interface{}
+	static map[string]interface{}
+	rows   []map[string]interface{} // in clustering order
+}
+
+// newEmptyFakeCassandra returns a fake keyspace with no tables
+func newEmptyFakeCassandra() *fakeCassandra {
+	return &fakeCassandra{tables: map[string]*fakeTable{}, views: map[string]bool{}, reads: map[string]int{}}
+}
+
+// newFakeCassandra returns a fake keyspace at CassandraSchemaVersion
+func newFakeCassandra() *fakeCassandra {
+	c := newEmptyFakeCassandra()
+
+	ddl := []string{schemaVersionTable}
+	for _, migration := range cassandraMigrations {
+		ddl = append(ddl, migration.Statements...)
+	}
+
+	for _, stmt := range ddl {
+		if err := c.define(stmt); err != nil && !columnExists(stmt, err) {
+			panic(err)
+		}
+	}
+
+	err := c.Exec(context.Background(), cqlQuery{
+		stmt:   `INSERT INTO schema_version (scope, version, description, applied) VALUES (?, ?, ?, toTimeStamp(now()))`,
+		values: []interface{}{schemaScope, CassandraSchemaVersion, "fake"},
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+// newFakeCassandraStore returns a CassandraEventStore running on a fake keyspace. The
+// readers by type don't settle: the writers share their clock and the index is written
+// before the updates return, unless a fault says otherwise. Without a settle window the
+// types are listed on every query, as the list is only safe to keep with one
+func newFakeCassandraStore(config *CassandraEventStoreConfig) (*CassandraEventStore, *fakeCassandra) {
+	c := newFakeCassandra()
+	es := newCassandraEventStore(c, config, gocql.Quorum, gocql.Quorum)
+	es.settleFloor = 0
+	es.typesRefresh = 0
+	return es, c
+}
+
+func (c *fakeCassandra) fail(fault fakeFault) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.faults = append(c.faults, fault)
+}
+
+func (c *fakeCassandra) heal() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.faults = nil
+}
+
+func (c *fakeCassandra) fault(stmts ...string) *fakeFault {
+	for i, f := range c.faults {
+		for _, stmt := range stmts {
+			if !strings.HasPrefix(stmt, f.prefix) {
+				continue
+			}
+
+			if f.times > 0 {
+				if f.times == 1 {
+					c.faults = append(c.faults[:i:i], c.faults[i+1:]...)
+				} else {
+					c.faults[i].times--
+				}
+			}
+
+			return &f
+		}
+	}
+	return nil
+}
+
+func (c *fakeCassandra) Iter(ctx context.Context, q cqlQuery) scanner {
+	if err := ctx.Err(); err != nil {
+		return &fakeIter{err: err}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s, err := c.parse(q)
+
+	if err != nil {
+		return &fakeIter{err: err}
+	}
+
+	if s.kind != "SELECT" {
+		return &fakeIter{err: fmt.Errorf("not a query: %s", q.stmt)}
+	}
+
+	rows := c.query(s)
+	f := c.fault(q.stmt)
+
+	if f != nil && f.rows < len(rows) {
+		rows = rows[:f.rows]
+	}
+
+	c.reads[s.table.name] += len(rows)
+
+	if f != nil {
+		return &fakeIter{rows: rows, err: f.err}
+	}
+
+	return &fakeIter{rows: rows}
+}
+
+func (c *fakeCassandra) Exec(ctx context.Context, q cqlQuery) error {
+	if isSchemaStatement(q.stmt) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		return c.define(q.stmt)
+	}
+
+	return c.ExecuteBatch(ctx, &cqlBatch{kind: gocql.UnloggedBatch, consistency: q.consistency, statements: []cqlQuery{q}})
+}
+
+func (c *fakeCassandra) ExecuteBatch(ctx context.Context, b *cqlBatch) error {
+	applied, err := c.execute(ctx, b, nil)
+
+	if err == nil && !applied {
+		err = errors.New("conditional statements must be run with ExecuteBatchCAS")
+	}
+
+	return err
+}
+
+func (c *fakeCassandra) ExecuteBatchCAS(ctx context.Context, b *cqlBatch, previous map[string]interface{}) (bool, error) {
+	if previous == nil {
+		previous = map[string]interface{}{}
+	}
+
+	return c.execute(ctx, b, previous)
+}
+
+// execute runs the statements of a batch: if any of their conditions is not met,
+// none is applied and previous, when given, is set to the values checked
+func (c *fakeCassandra) execute(ctx context.Context, b *cqlBatch, previous map[string]interface{}) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var statements []*fakeStatement
+	var stmts []string
+
+	for _, q := range b.statements {
+		s, err := c.parse(q)
+
+		if err != nil {
+			return false, err
+		}
+
+		if s.kind == "SELECT" {
+			return false, fmt.Errorf("a batch cannot hold queries: %s", q.stmt)
+		}
+
+		statements = append(statements, s)
+		stmts = append(stmts, q.stmt)
+	}
+
+	f := c.fault(stmts...)
+
+	if f != nil && !f.applied {
+		return false, f.err
+	}
+
+	conditional := false
+	for _, s := range statements {
+		conditional = conditional || s.ifNotExists || s.ifExists || len(s.conditions) > 0
+	}
+
+	// a lightweight transaction runs on a single partition
+	if conditional {
+		for _, s := range statements[1:] {
+			if s.table != statements[0].table || s.partitionKey() != statements[0].partitionKey() {
+				return false, errors.New("batch with conditions cannot span multiple tables or partitions")
+			}
+		}
+	}
+
+	if conditional && previous == nil {
+		return false, nil
+	}
+
+	applied := true
+
+	for _, s := range statements {
+		if !s.check(previous) {
+			applied = false
+		}
+	}
+
+	if !applied {
+		return false, nil
+	}
+
+	for _, s := range statements {
+		s.apply()
+	}
+
+	if f != nil {
+		return false, f.err
+	}
+
+	return true, nil
+}
+
+func (c *fakeCassandra) Close() {}
+
+func (c *fakeCassandra) Tables(keyspace string) (map[string][]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.tables) == 0 {
+		return nil, nil
+	}
+
+	tables := make(map[string][]string, len(c.tables))
+	for name, table := range c.tables {
+		for column := range table.columns {
+			tables[name] = append(tables[name], column)
+		}
+	}
+
+	return tables, nil
+}
+
+func (c *fakeCassandra) AwaitSchemaAgreement(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// fakeStatement is a parsed statement with its values bound
+type fakeStatement struct {
+	kind        string
+	table       *fakeTable
+	columns     []string
+	values      []interface{}
+	where       []fakePredicate
+	order       string
+	limit       int
+	distinct    bool // one row per partition, of its key and static columns
+	ifNotExists bool
+	ifExists    bool
+	conditions  []fakePredicate
+}
+
+type fakePredicate struct {
+	columns []string
+	op      string
+	values  []interface{}
+}
+
+// partitionKey returns the key of the partition the statement writes to
+func (s *fakeStatement) partitionKey() string {
+	key, _ := s.key(s.table.partitionKey)
+	return fakeKey(key)
+}
+
+// key returns the values of the given columns, from the inserted values or the equality predicates
+func (s *fakeStatement) key(columns []string) ([]interface{}, bool) {
+	values := make([]interface{}, len(columns))
+
+	for i, name := range columns {
+		found := false
+
+		for j, column := range s.columns {
+			if s.kind == "INSERT" && column == name {
+				values[i], found = s.values[j], true
+			}
+		}
+
+		for _, p := range s.where {
+			if len(p.columns) == 1 && p.columns[0] == name && p.op == "=" {
+				values[i], found = p.values[0], true
+			}
+		}
+
+		if !found {
+			return nil, false
+		}
+	}
+
+	return values, true
+}
+
+// target returns the partition and, for a statement on a row, the row it writes
+func (s *fakeStatement) target(create bool) (*fakePartition, map[string]interface{}) {
+	pk, _ := s.key(s.table.partitionKey)
+	p, ok := s.table.partitions[fakeKey(pk)]
+
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		p = &fakePartition{key: pk, static: map[string]interface{}{}}
+		s.table.partitions[fakeKey(pk)] = p
+	}
+
+	ck, isRow := s.key(s.table.clustering)
+
+	if !isRow || len(ck) == 0 {
+		return p, nil
+	}
+
+	i := sort.Search(len(p.rows), func(i int) bool { return s.table.compareRow(p.rows[i], ck) >= 0 })
+
+	if i < len(p.rows) && s.table.compareRow(p.rows[i], ck) == 0 {
+		return p, p.rows[i]
+	}
+
+	if !create {
+		return p, nil
+	}
+
+	row := map[string]interface{}{}
+	for j, name := range s.table.clustering {
+		row[name] = ck[j]
+	}
+
+	p.rows = append(p.rows, nil)
+	copy(p.rows[i+1:], p.rows[i:])
+	p.rows[i] = row
+
+	return p, row
+}
+
+// check tells whether the conditions of the statement are met, recording the values checked
+func (s *fakeStatement) check(previous map[string]interface{}) bool {
+	p, row := s.target(false)
+
+	value := func(name string) interface{} {
+		switch {
+		case p == nil:
+			return nil
+		case s.table.columns[name].static:
+			return p.static[name]
+		case row != nil:
+			return row[name]
+		}
+		return nil
+	}
+
+	exists := false
+
+	if _, isRow := s.key(s.table.clustering); isRow && len(s.table.clustering) > 0 {
+		exists = row != nil
+	} else {
+		exists = p != nil && len(p.static) > 0
+	}
+
+	if s.ifExists {
+		return exists
+	}
+
+	if s.ifNotExists {
+		if exists {
+			for name, column := range s.table.columns {
+				previous[name] = column.output(value(name))
+			}
+			if p != nil {
+				for i, name := range s.table.partitionKey {
+					previous[name] = s.table.columns[name].output(p.key[i])
+				}
+			}
+		}
+
+		return !exists
+	}
+
+	met := true
+
+	for _, cond := range s.conditions {
+		name := cond.columns[0]
+		previous[name] = s.table.columns[name].output(value(name))
+
+		if compareFake(value(name), cond.values[0]) != 0 {
+			met = false
+		}
+	}
+
+	return met
+}
+
+func (s *fakeStatement) apply() {
+	if s.kind == "DELETE" {
+		s.delete()
+		return
+	}
+
+	p, row := s.target(true)
+
+	for i, name := range s.columns {
+		column := s.table.columns[name]
+
+		switch {
+		case column.static:
+			p.static[name] = s.values[i]
+		case row != nil && !s.table.isKey(name):
+			row[name] = s.values[i]
+		}
+	}
+}
+
+// delete removes the partition when only its key is given, else the rows matching the predicates
+func (s *fakeStatement) delete() {
+	pk, _ := s.key(s.table.partitionKey)
+	p, ok := s.table.partitions[fakeKey(pk)]
+
+	if !ok {
+		return
+	}
+
+	if len(s.where) == len(s.table.partitionKey) {
+		delete(s.table.partitions, fakeKey(pk))
+		return
+	}
+
+	kept := p.rows[:0]
+
+	for _, row := range p.rows {
+		row := row
+		value := func(name string) interface{} {
+			if i := indexOf(s.table.partitionKey, name); i >= 0 {
+				return p.key[i]
+			}
+			return row[name]
+		}
+
+		if !s.matches(value) {
+			kept = append(kept, row)
+		}
+	}
+
+	p.rows = kept
+
+	if len(p.rows) == 0 && len(p.static) == 0 {
+		delete(s.table.partitions, fakeKey(pk))
+	}
+}
+
+func (t *fakeTable) isKey(name string) bool {
+	for _, k := range append(append([]string{}, t.partitionKey...), t.clustering...) {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// compareRow compares a row with the given clustering values, in clustering order
+func (t *fakeTable) compareRow(row map[string]interface{}, ck []interface{}) int {
+	for i, name := range t.clustering {
+		if c := compareFake(row[name], ck[i]); c != 0 {
+			if t.descending {
+				return -c
+			}
+			return c
+		}
+	}
+	return 0
+}
+
+// query runs a SELECT
+func (c *fakeCassandra) query(s *fakeStatement) [][]interface{} {
+	var partitions []*fakePartition
+
+	if pk, ok := s.key(s.table.partitionKey); ok {
+		if p, ok := s.table.partitions[fakeKey(pk)]; ok {
+			partitions = append(partitions, p)
+		}
+	} else {
+		keys := make([]string, 0, len(s.table.partitions))
+		for key := range s.table.partitions {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			partitions = append(partitions, s.table.partitions[key])
+		}
+	}
+
+	// the restrictions beyond the partition key
+	restricted := false
+	for _, p := range s.where {
+		for _, name := range p.columns {
+			restricted = restricted || !contains(s.table.partitionKey, name)
+		}
+	}
+
+	var result [][]interface{}
+
+	for _, p := range partitions {
+		rows := p.rows
+
+		// a partition with no rows reads as a row holding its static columns only
+		if len(rows) == 0 && len(p.static) > 0 && !restricted {
+			rows = []map[string]interface{}{{}}
+		}
+
+		if s.distinct && len(rows) > 0 {
+			rows = rows[:1]
+		}
+
+		if s.order != "" && (s.order == "DESC") != s.table.descending {
+			reversed := make([]map[string]interface{}, len(rows))
+			for i, row := range rows {
+				reversed[len(rows)-1-i] = row
+			}
+			rows = reversed
+		}
+
+		for _, row := range rows {
+			value := func(name string) interface{} {
+				if i := indexOf(s.table.partitionKey, name); i >= 0 {
+					return p.key[i]
+				}
+				if s.table.columns[name].static {
+					return p.static[name]
+				}
+				return row[name]
+			}
+
+			if !s.matches(value) {
+				continue
+			}
+
+			out := make([]interface{}, len(s.columns))
+			for i, name := range s.columns {
+				out[i] = copyFake(value(name))
+			}
+
+			result = append(result, out)
+
+			if s.limit > 0 && len(result) == s.limit {
+				return result
+			}
+		}
+	}
+
+	return result
+}
+
+func (s *fakeStatement) matches(value func(name string) interface{}) bool {
+	for _, p := range s.where {
+		left := make([]interface{}, len(p.columns))
+		for i, name := range p.columns {
+			left[i] = value(name)
+		}
+
+		c := 0
+		for i := range left {
+			if c = compareFake(left[i], p.values[i]); c != 0 {
+				break
+			}
+		}
+
+		ok := false
+		switch p.op {
+		case "=":
+			ok = c == 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareFake orders normalized values, null first
+func compareFake(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+
+	panic(fmt.Sprintf("values %v and %v cannot be compared", a, b))
+}
+
+func fakeKey(values []interface{}) string {
+	return fmt.Sprintf("%#v", values)
+}
+
+func copyFake(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]string:
+		return copyMetadata(v)
+	case []byte:
+		if v != nil {
+			return append([]byte{}, v...)
+		}
+	}
+	return v
+}
+
+func contains(names []string, name string) bool {
+	return indexOf(names, name) >= 0
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalize converts a bound value to the representation of the column:
+// int64 for numbers and timestamps in millis, string for text and UUIDs
+func (col *fakeColumn) normalize(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	switch col.ctype {
+	case "int", "bigint", "timestamp":
+		if t, ok := v.(time.Time); ok {
+			return t.UnixNano() / int64(time.Millisecond)
+		}
+		switch rv := reflect.ValueOf(v); rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return rv.Int()
+		}
+	case "text":
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+			return rv.String()
+		}
+	case "blob":
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			return append([]byte{}, rv.Bytes()...)
+		}
+	case "uuid":
+		switch v := v.(type) {
+		case gocql.UUID:
+			return v.String()
+		case string:
+			if u, err := gocql.ParseUUID(v); err == nil {
+				return u.String()
+			}
+			panic(fmt.Sprintf("invalid UUID %q for column %s", v, col.name))
+		}
+	case "map<text,text>":
+		if m, ok := v.(map[string]string); ok {
+			return copyMetadata(m)
+		}
+	}
+
+	panic(fmt.Sprintf("value %v of type %T for column %s of type %s", v, v, col.name, col.ctype))
+}
+
+// output converts a value of the column as gocql reads it into a map, null as the zero value
+func (col *fakeColumn) output(v interface{}) interface{} {
+	switch col.ctype {
+	case "int":
+		n, _ := v.(int64)
+		return int(n)
+	case "bigint":
+		n, _ := v.(int64)
+		return n
+	case "timestamp":
+		if n, ok := v.(int64); ok {
+			return time.Unix(0, n*int64(time.Millisecond))
+		}
+		return time.Time{}
+	case "uuid":
+		u, _ := gocql.ParseUUID(fmt.Sprint(v))
+		return u
+	case "text":
+		s, _ := v.(string)
+		return s
+	case "blob":
+		b, _ := v.([]byte)
+		return copyFake(b)
+	}
+	return copyFake(v)
+}
+
+// assignFake stores a value read by the fake, or by a test, in a Scan destination
+func assignFake(dest interface{}, v interface{}) {
+	switch d := dest.(type) {
+	case *int:
+		switch v := v.(type) {
+		case int:
+			*d = v
+		case int64:
+			*d = int(v)
+		default:
+			*d = 0
+		}
+	case *int64:
+		switch v := v.(type) {
+		case int:
+			*d = int64(v)
+		case int64:
+			*d = v
+		default:
+			*d = 0
+		}
+	case *string:
+		*d, _ = v.(string)
+	case *[]byte:
+		b, _ := v.([]byte)
+		*d, _ = copyFake(b).([]byte)
+	case *map[string]string:
+		m, _ := v.(map[string]string)
+		*d = copyMetadata(m)
+	case *time.Time:
+		*d = time.Time{}
+		if n, ok := v.(int64); ok {
+			*d = time.Unix(0, n*int64(time.Millisecond))
+		}
+	case *gocql.UUID:
+		*d, _ = gocql.ParseUUID(fmt.Sprint(v))
+	default:
+		panic(fmt.Sprintf("unsupported scan destination %T", dest))
+	}
+}
+
+// cqlTokens splits a statement into words, placeholders, literals and symbols
+func cqlTokens(stmt string) []string {
+	var tokens []string
+
+	isWord := func(c byte) bool {
+		return c == '_' || c == '.' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+
+	for i := 0; i < len(stmt); {
+		c := stmt[i]
+
+		switch {
+		case c == ' ' || c == '\n' || c == '\t' || c == '\r':
+			i++
+		case c == '\'':
+			j := strings.IndexByte(stmt[i+1:], '\'') + i + 1
+			tokens = append(tokens, stmt[i:j+1])
+			i = j + 1
+		case isWord(c):
+			j := i
+			for j < len(stmt) && isWord(stmt[j]) {
+				j++
+			}
+			tokens = append(tokens, stmt[i:j])
+			i = j
+		case (c == '<' || c == '>') && i+1 < len(stmt) && stmt[i+1] == '=':
+			tokens = append(tokens, stmt[i:i+2])
+			i += 2
+		default:
+			tokens = append(tokens, stmt[i:i+1])
+			i++
+		}
+	}
+
+	return tokens
+}
+
+// cqlParser reads the tokens of a statement, panicking with a cqlSyntaxError on unexpected ones
+type cqlParser struct {
+	tokens []string
+	pos    int
+	values []interface{}
+	bound  int
+}
+
+type cqlSyntaxError struct {
+	message string
+}
+
+func (p *cqlParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *cqlParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// accept consumes the given tokens, case insensitive, if they come next
+func (p *cqlParser) accept(tokens ...string) bool {
+	for i, token := range tokens {
+		if p.pos+i >= len(p.tokens) || !strings.EqualFold(p.tokens[p.pos+i], token) {
+			return false
+		}
+	}
+	p.pos += len(tokens)
+	return true
+}
+
+func (p *cqlParser) expect(tokens ...string) {
+	if !p.accept(tokens...) {
+		panic(cqlSyntaxError{fmt.Sprintf("expected %s at %q", strings.Join(tokens, " "), p.peek())})
+	}
+}
+
+// names reads a parenthesized list of names
+func (p *cqlParser) names() []string {
+	var names []string
+
+	p.expect("(")
+	for {
+		names = append(names, strings.ToLower(p.next()))
+		if p.accept(")") {
+			return names
+		}
+		p.expect(",")
+	}
+}
+
+// term reads a value: a placeholder, a literal, null or toTimeStamp(now())
+func (p *cqlParser) term() interface{} {
+	if p.accept("?") {
+		if p.bound >= len(p.values) {
+			panic(cqlSyntaxError{"not enough values bound"})
+		}
+		p.bound++
+		return p.values[p.bound-1]
+	}
+
+	if p.accept("toTimeStamp", "(", "now", "(", ")", ")") {
+		return time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	if p.accept("null") {
+		return nil
+	}
+
+	token := p.next()
+
+	if strings.HasPrefix(token, "'") {
+		return strings.Trim(token, "'")
+	}
+
+	n, err := strconv.ParseInt(token, 10, 64)
+
+	if err != nil {
+		panic(cqlSyntaxError{fmt.Sprintf("unexpected term %q", token)})
+	}
+
+	return n
+}
+
+func (p *cqlParser) terms() []interface{} {
+	var terms []interface{}
+
+	p.expect("(")
+	for {
+		terms = append(terms, p.term())
+		if p.accept(")") {
+			return terms
+		}
+		p.expect(",")
+	}
+}
+
+func (p *cqlParser) predicates(table *fakeTable) []fakePredicate {
+	var predicates []fakePredicate
+
+	for {
+		var predicate fakePredicate
+
+		if p.peek() == "(" {
+			predicate.columns = p.names()
+			predicate.op = p.next()
+			predicate.values = p.terms()
+		} else {
+			predicate.columns = []string{strings.ToLower(p.next())}
+			predicate.op = p.next()
+			predicate.values = []interface{}{p.term()}
+		}
+
+		for i, name := range predicate.columns {
+			predicate.values[i] = table.column(name).normalize(predicate.values[i])
+		}
+
+		predicates = append(predicates, predicate)
+
+		if !p.accept("AND") {
+			return predicates
+		}
+	}
+}
+
+func (c *fakeCassandra) table(name string) *fakeTable {
+	name = unqualified(name)
+	table, ok := c.tables[name]
+
+	if !ok {
+		panic(cqlSyntaxError{fmt.Sprintf("unconfigured table %s", name)})
+	}
+
+	return table
+}
+
+func (t *fakeTable) column(name string) *fakeColumn {
+	column, ok := t.columns[name]
+
+	if !ok {
+		panic(cqlSyntaxError{fmt.Sprintf("undefined column %s in table %s", name, t.name)})
+	}
+
+	return column
+}
+
+// parse parses the statements the store runs: SELECT, INSERT, UPDATE and DELETE, with their conditions
+func (c *fakeCassandra) parse(q cqlQuery) (s *fakeStatement, err error) {
+	p := &cqlParser{tokens: cqlTokens(q.stmt), values: q.values}
+	s = &fakeStatement{}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if syntax, ok := r.(cqlSyntaxError); ok {
+				s, err = nil, fmt.Errorf("%s: %s", syntax.message, q.stmt)
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	switch s.kind = strings.ToUpper(p.next()); s.kind {
+	case "SELECT":
+		s.distinct = p.accept("DISTINCT")
+
+		for {
+			s.columns = append(s.columns, strings.ToLower(p.next()))
+			if !p.accept(",") {
+				break
+			}
+		}
+
+		p.expect("FROM")
+		s.table = c.table(p.next())
+
+		for _, name := range s.columns {
+			column := s.table.column(name)
+
+			if s.distinct && !column.static && !contains(s.table.partitionKey, name) {
+				panic(cqlSyntaxError{fmt.Sprintf("SELECT DISTINCT of the non partition key column %s", name)})
+			}
+		}
+
+		if p.accept("WHERE") {
+			s.where = p.predicates(s.table)
+		}
+
+		if p.accept("ORDER", "BY") {
+			p.next()
+			s.order = "ASC"
+			if p.accept("DESC") {
+				s.order = "DESC"
+			}
+			p.accept("ASC")
+		}
+
+		if p.accept("LIMIT") {
+			limit := reflect.ValueOf(p.term())
+			s.limit = int(limit.Int())
+		}
+
+		p.accept("ALLOW", "FILTERING")
+
+	case "INSERT":
+		p.expect("INTO")
+		s.table = c.table(p.next())
+		s.columns = p.names()
+		p.expect("VALUES")
+		s.values = p.terms()
+
+		if len(s.values) != len(s.columns) {
+			panic(cqlSyntaxError{"unmatched columns and values"})
+		}
+
+		for i, name := range s.columns {
+			s.values[i] = s.table.column(name).normalize(s.values[i])
+		}
+
+		s.ifNotExists = p.accept("IF", "NOT", "EXISTS")
+
+	case "UPDATE":
+		s.table = c.table(p.next())
+		p.expect("SET")
+
+		for {
+			name := strings.ToLower(p.next())
+			p.expect("=")
+			s.columns = append(s.columns, name)
+			s.values = append(s.values, s.table.column(name).normalize(p.term()))
+			if !p.accept(",") {
+				break
+			}
+		}
+
+		p.expect("WHERE")
+		s.where = p.predicates(s.table)
+
+		if p.accept("IF", "EXISTS") {
+			s.ifExists = true
+		} else if p.accept("IF") {
+			s.conditions = p.predicates(s.table)
+		}
+
+	case "DELETE":
+		p.expect("FROM")
+		s.table = c.table(p.next())
+		p.expect("WHERE")
+		s.where = p.predicates(s.table)
+
+		if _, ok := s.key(s.table.partitionKey); !ok {
+			panic(cqlSyntaxError{"DELETE without the partition key"})
+		}
+
+	default:
+		panic(cqlSyntaxError{fmt.Sprintf("unsupported statement %s", s.kind)})
+	}
+
+	if p.pos != len(p.tokens) {
+		panic(cqlSyntaxError{fmt.Sprintf("unexpected %q", p.peek())})
+	}
+
+	if p.bound != len(p.values) {
+		panic(cqlSyntaxError{fmt.Sprintf("%d values bound, %d used", len(p.values), p.bound)})
+	}
+
+	return s, nil
+}
+
+// isSchemaStatement tells whether a statement changes the schema rather than the rows
+func isSchemaStatement(stmt string) bool {
+	for _, prefix := range []string{"CREATE ", "ALTER ", "DROP "} {
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(stmt)), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// define runs a statement of the migrations: CREATE KEYSPACE, CREATE TABLE, ALTER TABLE ... ADD,
+// CREATE and DROP MATERIALIZED VIEW, failing as Cassandra does when the column or table is there
+func (c *fakeCassandra) define(stmt string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if syntax, ok := r.(cqlSyntaxError); ok {
+				err = fmt.Errorf("%s: %s", syntax.message, stmt)
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	// the keyspace is the one of the fake whatever the statement says
+	stmt = strings.ReplaceAll(stmt, "{keyspace}.", "")
+	p := &cqlParser{tokens: cqlTokens(stmt)}
+
+	switch {
+	case p.accept("CREATE", "KEYSPACE"):
+	case p.accept("ALTER", "TABLE"):
+		return c.alterFakeTable(p)
+	case p.accept("CREATE", "MATERIALIZED", "VIEW", "IF", "NOT", "EXISTS"):
+		c.views[unqualified(p.next())] = true
+	case p.accept("DROP", "MATERIALIZED", "VIEW", "IF", "EXISTS"):
+		delete(c.views, unqualified(p.next()))
+	default:
+		table := parseFakeTable(stmt)
+		if _, ok := c.tables[table.name]; !ok {
+			c.tables[table.name] = table
+		}
+	}
+
+	return nil
+}
+
+// unqualified returns a table name without its keyspace
+func unqualified(name string) string {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(name)
+}
+
+// alterFakeTable adds the column of an ALTER TABLE ... ADD statement
+func (c *fakeCassandra) alterFakeTable(p *cqlParser) error {
+	t := c.table(p.next())
+	p.expect("ADD")
+
+	column := &fakeColumn{name: strings.ToLower(p.next())}
+	for p.peek() != "" && !strings.EqualFold(p.peek(), "STATIC") {
+		column.ctype += strings.ToLower(p.next())
+	}
+
+	column.static = p.accept("STATIC")
+
+	if _, ok := t.columns[column.name]; ok {
+		return invalidRequest(fmt.Sprintf("Invalid column name %s because it conflicts with an existing column", column.name))
+	}
+
+	t.columns[column.name] = column
+	return nil
+}
+
+// parseFakeTable creates a table from its CREATE TABLE statement
+func parseFakeTable(stmt string) *fakeTable {
+	p := &cqlParser{tokens: cqlTokens(stmt)}
+	p.expect("CREATE", "TABLE", "IF", "NOT", "EXISTS")
+
+	t := &fakeTable{name: unqualified(p.next()), columns: map[string]*fakeColumn{}, partitions: map[string]*fakePartition{}}
+	p.expect("(")
+
+	for !p.accept("PRIMARY", "KEY") {
+		column := &fakeColumn{name: strings.ToLower(p.next())}
+
+		// the type ends at the first comma out of angle brackets
+		depth := 0
+		for depth > 0 || (p.peek() != "," && !strings.EqualFold(p.peek(), "STATIC")) {
+			token := p.next()
+			switch token {
+			case "<":
+				depth++
+			case ">":
+				depth--
+			}
+			column.ctype += strings.ToLower(token)
+		}
+
+		column.static = p.accept("STATIC")
+		p.expect(",")
+		t.columns[column.name] = column
+	}
+
+	p.expect("(")
+
+	if p.peek() == "(" {
+		t.partitionKey = p.names()
+	} else {
+		t.partitionKey = []string{strings.ToLower(p.next())}
+	}
+
+	for p.accept(",") {
+		t.clustering = append(t.clustering, strings.ToLower(p.next()))
+	}
+
+	p.expect(")")
+	p.expect(")")
+
+	// without clustering columns the partition is a single row, held as static columns
+	if len(t.clustering) == 0 {
+		for _, column := range t.columns {
+			column.static = !t.isKey(column.name)
+		}
+	}
+
+	// the schema orders by the first clustering column only
+	if p.accept("WITH", "CLUSTERING", "ORDER", "BY") {
+		p.expect("(")
+		p.next()
+		t.descending = p.accept("DESC")
+		p.accept("ASC")
+		p.expect(")")
+	}
+
+	return t
+}
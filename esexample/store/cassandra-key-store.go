@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// The wrapped data keys of the aggregates are kept in aggregate_keys, the CassandraEventStore
+// being a KeyStore. A key is created with a lightweight transaction so that concurrent writers
+// of a new aggregate agree on a single key; shredding nulls the key and records the time, the
+// row left behind refuses any new key. Shredding is a lightweight transaction too: a plain write
+// is not ordered with the transactions of the partition, and could land before the creation of
+// the key it means to shred. The keys are read at the serial consistency, so that a key whose
+// creation or shredding is under way is never read from the replicas which missed it.
+// Cassandra purges the shredded value from the disks once the compaction of its tombstone
+// passed gc_grace_seconds
+
+// @see KeyStore.DataKey
+func (es *CassandraEventStore) DataKey(ctx context.Context, guid EventID) ([]byte, error) {
+	var key []byte
+	var shreddedAt time.Time
+
+	if _, err := gocql.ParseUUID(string(guid)); err != nil {
+		return nil, invalidArgumentf("aggregate id %q is not a UUID", guid)
+	}
+
+	iter := es.session.Iter(ctx, cqlQuery{
+		stmt:        `SELECT data_key, shredded FROM aggregate_keys WHERE id = ?`,
+		values:      []interface{}{string(guid)},
+		consistency: es.serialRead,
+	})
+
+	found := iter.Scan(&key, &shreddedAt)
+
+	if err := iter.Close(); err != nil {
+		return nil, cqlError(err)
+	}
+
+	switch {
+	case !found:
+		return nil, fmt.Errorf("%w: no data key for aggregate %s", ErrNotFound, guid)
+	case !shreddedAt.IsZero():
+		return nil, shredded(guid)
+	}
+
+	return key, nil
+}
+
+// @see KeyStore.CreateDataKey
+func (es *CassandraEventStore) CreateDataKey(ctx context.Context, guid EventID, wrapped []byte) ([]byte, error) {
+	if _, err := gocql.ParseUUID(string(guid)); err != nil {
+		return nil, invalidArgumentf("aggregate id %q is not a UUID", guid)
+	}
+
+	batch := &cqlBatch{kind: gocql.LoggedBatch, consistency: es.writeQuorum}
+	batch.Query(`INSERT INTO aggregate_keys (id, data_key) VALUES (?,?) IF NOT EXISTS`, string(guid), wrapped)
+
+	previous := map[string]interface{}{}
+	applied, err := es.session.ExecuteBatchCAS(ctx, batch, previous)
+
+	if err != nil {
+		return nil, cqlError(err)
+	}
+
+	if applied {
+		return wrapped, nil
+	}
+
+	if at, _ := previous["shredded"].(time.Time); !at.IsZero() {
+		return nil, shredded(guid)
+	}
+
+	key, _ := previous["data_key"].([]byte)
+
+	return key, nil
+}
+
+// @see KeyStore.ShredDataKey
+func (es *CassandraEventStore) ShredDataKey(ctx context.Context, guid EventID) error {
+	if _, err := gocql.ParseUUID(string(guid)); err != nil {
+		return invalidArgumentf("aggregate id %q is not a UUID", guid)
+	}
+
+	shred := func() (bool, error) {
+		return es.casKey(ctx, `UPDATE aggregate_keys SET data_key = null, shredded = toTimeStamp(now()) WHERE id = ? IF EXISTS`, string(guid))
+	}
+
+	if applied, err := shred(); err != nil || applied {
+		return err
+	}
+
+	// no key yet, the shredded row refuses the ones to come
+	if applied, err := es.casKey(ctx, `INSERT INTO aggregate_keys (id, shredded) VALUES (?, toTimeStamp(now())) IF NOT EXISTS`, string(guid)); err != nil || applied {
+		return err
+	}
+
+	// a key was created meanwhile, the rows of aggregate_keys are never deleted
+	_, err := shred()
+	return err
+}
+
+// casKey runs a lightweight transaction on aggregate_keys
+func (es *CassandraEventStore) casKey(ctx context.Context, stmt string, values ...interface{}) (bool, error) {
+	batch := &cqlBatch{kind: gocql.LoggedBatch, consistency: es.writeQuorum}
+	batch.Query(stmt, values...)
+
+	applied, err := es.session.ExecuteBatchCAS(ctx, batch, map[string]interface{}{})
+
+	if err != nil {
+		return false, cqlError(err)
+	}
+
+	return applied, nil
+}
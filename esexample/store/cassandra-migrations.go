@@ -0,0 +1,445 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+// CassandraSchemaVersion is the schema version this release of CassandraEventStore works with
+const CassandraSchemaVersion = 8
+
+// ErrIncompatibleSchema is returned when the keyspace schema is not the one this release works with
+var ErrIncompatibleSchema = errors.New("incompatible schema version")
+
+// CassandraMigration is a step of the keyspace schema. The statements may refer to the
+// keyspace as {keyspace}, they must be idempotent as a migration that failed half way
+// through is run again from its first statement
+type CassandraMigration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// the migrations in order of version, the last one is CassandraSchemaVersion
+var cassandraMigrations = []CassandraMigration{
+	{
+		Version:     1,
+		Description: "events and snapshots tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS {keyspace}.events (
+  id               UUID,
+  version          int,
+  type             int,
+  payload          text,
+  savetime         timestamp,
+  metadata         map<text, text>,
+  current_version  int STATIC,
+  PRIMARY KEY (id, version, savetime)
+)`,
+			// the events tables created before the metadata have no such column
+			`ALTER TABLE {keyspace}.events ADD metadata map<text, text>`,
+			`CREATE TABLE IF NOT EXISTS {keyspace}.snapshots (
+  id               UUID,
+  version          int,
+  schema_version   int,
+  payload          text,
+  savetime         timestamp,
+  PRIMARY KEY (id, version)
+) WITH CLUSTERING ORDER BY (version DESC)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "time bucketed index by type, run es-backfill on the keyspaces with events",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS {keyspace}.events_by_type_bucket (
+  type             int,
+  bucket           timestamp,
+  savetime         timestamp,
+  version          int,
+  id               UUID,
+  payload          text,
+  metadata         map<text, text>,
+  PRIMARY KEY ((type, bucket), savetime, version, id)
+)`,
+			`CREATE TABLE IF NOT EXISTS {keyspace}.event_type_buckets (
+  type             int,
+  bucket           timestamp,
+  PRIMARY KEY (type, bucket)
+)`,
+			`ALTER TABLE {keyspace}.events ADD index_pending int STATIC`,
+			// the view of the keyspaces created by createall.cql, replaced by the tables above
+			`DROP MATERIALIZED VIEW IF EXISTS {keyspace}.events_by_type`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "schema version of the events",
+		Statements: []string{
+			`ALTER TABLE {keyspace}.events ADD schema_version int`,
+			`ALTER TABLE {keyspace}.events_by_type_bucket ADD schema_version int`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "names of the event types",
+		Statements: []string{
+			`ALTER TABLE {keyspace}.events ADD type_name text`,
+			`ALTER TABLE {keyspace}.events_by_type_bucket ADD type_name text`,
+			`CREATE TABLE IF NOT EXISTS {keyspace}.event_type_codes (
+  type             int,
+  name             text,
+  PRIMARY KEY (type)
+)`,
+			`CREATE TABLE IF NOT EXISTS {keyspace}.event_type_names (
+  name             text,
+  type             int,
+  PRIMARY KEY (name)
+)`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "binary payloads with a content type",
+		Statements: []string{
+			`ALTER TABLE {keyspace}.events ADD content_type text`,
+			`ALTER TABLE {keyspace}.events ADD payload_bytes blob`,
+			`ALTER TABLE {keyspace}.events_by_type_bucket ADD content_type text`,
+			`ALTER TABLE {keyspace}.events_by_type_bucket ADD payload_bytes blob`,
+			`ALTER TABLE {keyspace}.snapshots ADD payload_bytes blob`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "data keys of the encrypted aggregates",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS {keyspace}.aggregate_keys (
+  id               UUID,
+  data_key         blob,
+  shredded         timestamp,
+  PRIMARY KEY (id)
+)`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "tombstones of the deleted streams",
+		Statements: []string{
+			`ALTER TABLE {keyspace}.events ADD deleted timestamp STATIC`,
+		},
+	},
+	{
+		Version:     8,
+		Description: "positions of the events in the index by type",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS {keyspace}.event_type_entries (
+  id               UUID,
+  version          int,
+  bucket           timestamp,
+  savetime         timestamp,
+  type             int,
+  PRIMARY KEY (id, version, bucket, savetime)
+)`,
+		},
+	},
+}
+
+// CassandraMigrations returns the migrations in order of version
+func CassandraMigrations() []CassandraMigration {
+	return append([]CassandraMigration(nil), cassandraMigrations...)
+}
+
+// the versions of the schema are recorded in a single partition, newest first
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS {keyspace}.schema_version (
+  scope            text,
+  version          int,
+  description      text,
+  applied          timestamp,
+  PRIMARY KEY (scope, version)
+) WITH CLUSTERING ORDER BY (version DESC)`
+
+const schemaScope = "eventstore"
+
+// KeyspaceReplication is the replication of the keyspace created by the migrations:
+// NetworkTopologyStrategy when DataCenters is set, SimpleStrategy with Factor otherwise
+type KeyspaceReplication struct {
+	Factor      int
+	DataCenters map[string]int // replication factor by data center
+}
+
+// cql returns the replication map of the CREATE KEYSPACE statement
+func (r KeyspaceReplication) cql() string {
+	if len(r.DataCenters) == 0 {
+		factor := r.Factor
+		if factor <= 0 {
+			factor = 1
+		}
+		return fmt.Sprintf("{'class': 'SimpleStrategy', 'replication_factor': %d}", factor)
+	}
+
+	dcs := make([]string, 0, len(r.DataCenters))
+	for dc := range r.DataCenters {
+		dcs = append(dcs, dc)
+	}
+	sort.Strings(dcs)
+
+	parts := []string{"'class': 'NetworkTopologyStrategy'"}
+	for _, dc := range dcs {
+		parts = append(parts, fmt.Sprintf("'%s': %d", dc, r.DataCenters[dc]))
+	}
+
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// Validate checks the replication factors
+func (r KeyspaceReplication) Validate() error {
+	if r.Factor < 0 {
+		return invalidArgumentf("replication factor %d", r.Factor)
+	}
+
+	for dc, factor := range r.DataCenters {
+		if dc == "" || strings.ContainsAny(dc, "'") || factor <= 0 {
+			return invalidArgumentf("replication factor %d of data center %q", factor, dc)
+		}
+	}
+
+	return nil
+}
+
+// the columns of the events table created by the former createall.cql, which recorded no schema version
+var baselineEventsColumns = []string{"id", "version", "type", "payload", "savetime", "current_version"}
+
+// schemaSession is the part of a Cassandra session used by CassandraMigrator, it runs
+// on *gocql.Session in production and on the fake keyspace in the tests
+type schemaSession interface {
+	cqlSession
+
+	// Tables returns the columns of the tables of the keyspace, nil if there is no such keyspace
+	Tables(keyspace string) (map[string][]string, error)
+
+	// AwaitSchemaAgreement waits for the schema to settle on all the nodes
+	AwaitSchemaAgreement(ctx context.Context) error
+}
+
+// CassandraMigrator brings the keyspace of a CassandraEventStoreConfig to CassandraSchemaVersion
+type CassandraMigrator struct {
+	session     schemaSession
+	keyspace    string
+	replication KeyspaceReplication
+
+	// DryRun prints the statements to Out instead of running them
+	DryRun bool
+	Out    io.Writer
+}
+
+// initializer for the migrator, the keyspace does not need to exist
+func NewCassandraMigrator(config *CassandraEventStoreConfig, replication KeyspaceReplication) (*CassandraMigrator, error) {
+	if err := replication.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Keyspace == "" || strings.ContainsAny(config.Keyspace, "\". ") {
+		return nil, invalidArgumentf("keyspace %q", config.Keyspace)
+	}
+
+	cluster, err := config.newCluster()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// schema changes are always written at quorum
+	cluster.Consistency = gocql.Quorum
+
+	session, err := cluster.CreateSession()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &CassandraMigrator{session: gocqlSession{session: session}, keyspace: config.Keyspace, replication: replication}, nil
+}
+
+// Version returns the current schema version of the keyspace, 0 if it has none. A keyspace
+// created by the former createall.cql has no schema_version table: it is adopted at version 0,
+// as long as its events table is the one createall.cql created, and all the migrations apply
+func (m *CassandraMigrator) Version(ctx context.Context) (int, error) {
+	tables, err := m.session.Tables(m.keyspace)
+
+	if err != nil {
+		return 0, cqlError(err)
+	}
+
+	if _, ok := tables["schema_version"]; ok {
+		return schemaVersion(ctx, m.session, m.keyspace)
+	}
+
+	if columns, ok := tables["events"]; ok {
+		found := make(map[string]bool, len(columns))
+		for _, name := range columns {
+			found[name] = true
+		}
+
+		for _, name := range baselineEventsColumns {
+			if !found[name] {
+				return 0, fmt.Errorf("%w: keyspace %s has an events table with no %s column and no schema version", ErrIncompatibleSchema, m.keyspace, name)
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// Migrate applies the migrations following the current schema version,
+// returning the versions applied (or printed, in dry run)
+func (m *CassandraMigrator) Migrate(ctx context.Context) ([]int, error) {
+	current, err := m.Version(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if current > CassandraSchemaVersion {
+		return nil, fmt.Errorf("%w: keyspace %s is at version %d, newer than %d", ErrIncompatibleSchema, m.keyspace, current, CassandraSchemaVersion)
+	}
+
+	pending := pendingMigrations(current)
+
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	setup := []string{
+		fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH REPLICATION = %s", m.keyspace, m.replication.cql()),
+		m.render(schemaVersionTable),
+	}
+
+	if err := m.run(ctx, "setup", setup); err != nil {
+		return nil, err
+	}
+
+	var applied []int
+
+	for _, migration := range pending {
+		statements := make([]string, 0, len(migration.Statements)+1)
+
+		for _, stmt := range migration.Statements {
+			statements = append(statements, m.render(stmt))
+		}
+
+		statements = append(statements, fmt.Sprintf(
+			"INSERT INTO %s.schema_version (scope, version, description, applied) VALUES ('%s', %d, '%s', toTimeStamp(now()))",
+			m.keyspace, schemaScope, migration.Version, strings.ReplaceAll(migration.Description, "'", "''")))
+
+		if err := m.run(ctx, fmt.Sprintf("version %d: %s", migration.Version, migration.Description), statements); err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, migration.Version)
+	}
+
+	return applied, nil
+}
+
+func (m *CassandraMigrator) render(stmt string) string {
+	return strings.ReplaceAll(stmt, "{keyspace}", m.keyspace)
+}
+
+// run executes the statements one at a time, waiting for the schema to settle on all the nodes
+func (m *CassandraMigrator) run(ctx context.Context, title string, statements []string) error {
+	if m.DryRun {
+		fmt.Fprintf(m.Out, "-- %s\n", title)
+		for _, stmt := range statements {
+			fmt.Fprintf(m.Out, "%s;\n\n", stmt)
+		}
+		return nil
+	}
+
+	for _, stmt := range statements {
+		if err := m.session.Exec(ctx, cqlQuery{stmt: stmt, consistency: gocql.Quorum}); err != nil && !columnExists(stmt, err) {
+			return fmt.Errorf("%s: %w", title, cqlError(err))
+		}
+
+		if err := m.session.AwaitSchemaAgreement(ctx); err != nil {
+			return fmt.Errorf("%s: %w", title, cqlError(err))
+		}
+	}
+
+	return nil
+}
+
+// the code of the invalid query errors, unexported by gocql
+const cqlErrInvalid = 0x2200
+
+// columnExists tells whether a statement adding a column failed because the column is there
+// already, which makes ALTER TABLE ... ADD idempotent as the migrations must be
+func columnExists(stmt string, err error) bool {
+	var requestErr gocql.RequestError
+
+	if !strings.HasPrefix(stmt, "ALTER TABLE") || !errors.As(err, &requestErr) || requestErr.Code() != cqlErrInvalid {
+		return false
+	}
+
+	// the wording differs between the releases of Cassandra
+	message := requestErr.Message()
+	return strings.Contains(message, "conflicts with an existing column") || strings.Contains(message, "already exists")
+}
+
+// Dispose closes the session of the migrator
+func (m *CassandraMigrator) Dispose() {
+	m.session.Close()
+}
+
+// pendingMigrations returns the migrations following the given version
+func pendingMigrations(current int) []CassandraMigration {
+	var pending []CassandraMigration
+
+	for _, migration := range cassandraMigrations {
+		if migration.Version > current {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending
+}
+
+// schemaVersion reads the latest schema version recorded in the keyspace
+func schemaVersion(ctx context.Context, session cqlSession, keyspace string) (int, error) {
+	var version int
+
+	iter := session.Iter(ctx, cqlQuery{
+		stmt:        fmt.Sprintf(`SELECT version FROM %s.schema_version WHERE scope = ? LIMIT 1`, keyspace),
+		values:      []interface{}{schemaScope},
+		consistency: gocql.Quorum,
+	})
+
+	// no row, no version
+	iter.Scan(&version)
+
+	if err := iter.Close(); err != nil {
+		return 0, cqlError(err)
+	}
+
+	return version, nil
+}
+
+// checkSchemaVersion refuses to work on a keyspace which is not at CassandraSchemaVersion
+func checkSchemaVersion(ctx context.Context, session cqlSession, keyspace string) error {
+	version, err := schemaVersion(ctx, session, keyspace)
+
+	if err != nil {
+		return fmt.Errorf("%w: unable to read the schema version of keyspace %s, was it created with es-migrate? %v", ErrIncompatibleSchema, keyspace, err)
+	}
+
+	if version != CassandraSchemaVersion {
+		return fmt.Errorf("%w: keyspace %s is at version %d, expected %d", ErrIncompatibleSchema, keyspace, version, CassandraSchemaVersion)
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestCassandraMigrationsAreOrdered(t *testing.T) {
+	migrations := CassandraMigrations()
+
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %d has version %d", i, migration.Version)
+		}
+
+		for _, stmt := range migration.Statements {
+			// adding a column is made idempotent by columnExists
+			if !strings.Contains(stmt, "IF NOT EXISTS {keyspace}.") && !strings.Contains(stmt, "IF EXISTS {keyspace}.") && !strings.HasPrefix(stmt, "ALTER TABLE {keyspace}.") {
+				t.Errorf("migration %d: statement is not idempotent or not keyspace qualified: %s", migration.Version, stmt)
+			}
+		}
+	}
+
+	if migrations[len(migrations)-1].Version != CassandraSchemaVersion {
+		t.Errorf("the last migration is not CassandraSchemaVersion %d", CassandraSchemaVersion)
+	}
+
+	if pending := pendingMigrations(1); len(pending) != CassandraSchemaVersion-1 || pending[0].Version != 2 {
+		t.Errorf("unexpected pending migrations %+v", pending)
+	}
+}
+
+func TestKeyspaceReplication(t *testing.T) {
+	if cql := (KeyspaceReplication{}).cql(); cql != "{'class': 'SimpleStrategy', 'replication_factor': 1}" {
+		t.Errorf("unexpected replication %s", cql)
+	}
+
+	r := KeyspaceReplication{DataCenters: map[string]int{"dc2": 2, "dc1": 3}}
+
+	if cql := r.cql(); cql != "{'class': 'NetworkTopologyStrategy', 'dc1': 3, 'dc2': 2}" {
+		t.Errorf("unexpected replication %s", cql)
+	}
+
+	r = KeyspaceReplication{DataCenters: map[string]int{"dc1": 0}}
+
+	if err := r.Validate(); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func TestMigratorDryRun(t *testing.T) {
+	var out bytes.Buffer
+	m := &CassandraMigrator{keyspace: "ks", DryRun: true, Out: &out}
+
+	if err := m.run(context.Background(), "version 1", []string{m.render("CREATE TABLE IF NOT EXISTS {keyspace}.t (k int PRIMARY KEY)")}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if out.String() != "-- version 1\nCREATE TABLE IF NOT EXISTS ks.t (k int PRIMARY KEY);\n\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+// invalidRequest is a gocql.RequestError as returned by Cassandra for an invalid query
+type invalidRequest string
+
+func (e invalidRequest) Code() int       { return cqlErrInvalid }
+func (e invalidRequest) Message() string { return string(e) }
+func (e invalidRequest) Error() string   { return string(e) }
+
+func TestColumnExists(t *testing.T) {
+	alter := "ALTER TABLE ks.events ADD metadata map<text, text>"
+
+	if !columnExists(alter, invalidRequest("Invalid column name metadata because it conflicts with an existing column")) {
+		t.Errorf("expected the column to exist")
+	}
+
+	if !columnExists(alter, fmt.Errorf("wrapped: %w", invalidRequest("Column with name 'metadata' already exists"))) {
+		t.Errorf("expected the column to exist")
+	}
+
+	if columnExists(alter, invalidRequest("Undefined column name")) || columnExists(alter, errors.New("already exists")) {
+		t.Errorf("expected another error")
+	}
+
+	if columnExists("CREATE TABLE ks.t (k int PRIMARY KEY)", invalidRequest("already exists")) {
+		t.Errorf("expected another error for a statement not adding a column")
+	}
+}
+
+// the keyspace created by the former createall.cql, which recorded no schema version
+var baselineKeyspace = []string{
+	`CREATE KEYSPACE IF NOT EXISTS eventstore WITH REPLICATION = {'class': 'SimpleStrategy', 'replication_factor': 1}`,
+	`CREATE TABLE IF NOT EXISTS eventstore.events (
+  id               UUID,
+  version          int,
+  type             int,
+  payload          text,
+  savetime         timestamp,
+  current_version  int STATIC,
+  PRIMARY KEY (id, version, savetime)
+)`,
+	`CREATE MATERIALIZED VIEW IF NOT EXISTS eventstore.events_by_type AS
+  SELECT id, version, type, payload, savetime FROM eventstore.events WHERE type IS NOT NULL AND version IS NOT NULL AND savetime IS NOT NULL
+PRIMARY KEY (type, savetime, version, id)`,
+}
+
+func TestMigrateBaselineKeyspace(t *testing.T) {
+	ctx := context.Background()
+	cassandra := newEmptyFakeCassandra()
+
+	for _, stmt := range baselineKeyspace {
+		if err := cassandra.Exec(ctx, cqlQuery{stmt: stmt}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	batch := &cqlBatch{}
+	batch.Query(`INSERT INTO events (id, current_version) VALUES (?, ?)`, "fade87a1-9df9-46bb-aae6-63b2b763094d", 1)
+	batch.Query(`INSERT INTO events (id, version, type, payload, savetime) VALUES (?, ?, ?, ?, ?)`, "fade87a1-9df9-46bb-aae6-63b2b763094d", 1, 11, `{"n":1}`, time.Now())
+
+	if err := cassandra.ExecuteBatch(ctx, batch); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	m := &CassandraMigrator{session: cassandra, keyspace: "eventstore"}
+
+	if version, err := m.Version(ctx); err != nil || version != 0 {
+		t.Fatalf("unexpected version %d, error %+v", version, err)
+	}
+
+	applied, err := m.Migrate(ctx)
+
+	if err != nil || len(applied) != CassandraSchemaVersion {
+		t.Fatalf("unexpected versions applied %v, error %+v", applied, err)
+	}
+
+	if cassandra.views["events_by_type"] {
+		t.Errorf("the materialized view was not dropped")
+	}
+
+	if _, ok := cassandra.tables["events"].columns["metadata"]; !ok {
+		t.Errorf("the metadata column was not added")
+	}
+
+	if err := checkSchemaVersion(ctx, cassandra, "eventstore"); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	// the migrations are not run twice
+	if applied, err := m.Migrate(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("unexpected versions applied %v, error %+v", applied, err)
+	}
+
+	// the events saved before the migrations are read by the store
+	es := newCassandraEventStore(cassandra, &CassandraEventStoreConfig{}, gocql.Quorum, gocql.Quorum)
+
+	if events, err := es.Find(ctx, "fade87a1-9df9-46bb-aae6-63b2b763094d"); err != nil || len(events) != 1 || string(events[0].Payload) != `{"n":1}` {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+}
+
+func TestMigrateUnknownKeyspace(t *testing.T) {
+	ctx := context.Background()
+	cassandra := newEmptyFakeCassandra()
+
+	// an events table neither created by createall.cql nor by the migrations
+	if err := cassandra.Exec(ctx, cqlQuery{stmt: `CREATE TABLE IF NOT EXISTS eventstore.events (id UUID, payload text, PRIMARY KEY (id))`}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	m := &CassandraMigrator{session: cassandra, keyspace: "eventstore"}
+
+	if _, err := m.Migrate(ctx); !errors.Is(err, ErrIncompatibleSchema) {
+		t.Errorf("expected ErrIncompatibleSchema, got %+v", err)
+	}
+
+	// an empty keyspace gets all the migrations
+	m = &CassandraMigrator{session: newEmptyFakeCassandra(), keyspace: "eventstore"}
+
+	if applied, err := m.Migrate(ctx); err != nil || len(applied) != CassandraSchemaVersion {
+		t.Errorf("unexpected versions applied %v, error %+v", applied, err)
+	}
+}
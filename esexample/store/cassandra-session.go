@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gocql/gocql"
+)
+
+// cqlSession is the part of a Cassandra session used by CassandraEventStore. It runs
+// on *gocql.Session in production and on an in process fake in the tests, which is
+// why statements and batches are plain values rather than gocql types
+type cqlSession interface {
+	// Iter runs a query, the rows are read through the returned scanner
+	Iter(ctx context.Context, q cqlQuery) scanner
+
+	// Exec runs a statement returning no rows
+	Exec(ctx context.Context, q cqlQuery) error
+
+	// ExecuteBatch runs a batch without conditions
+	ExecuteBatch(ctx context.Context, b *cqlBatch) error
+
+	// ExecuteBatchCAS runs a batch with lightweight transaction conditions. When they
+	// are not met nothing is applied and previous holds the values they were checked against
+	ExecuteBatchCAS(ctx context.Context, b *cqlBatch, previous map[string]interface{}) (bool, error)
+
+	Close()
+}
+
+// cqlQuery is a statement with its bound values
+type cqlQuery struct {
+	stmt        string
+	values      []interface{}
+	consistency gocql.Consistency
+	pageSize    int // 0 for the session default
+}
+
+// cqlBatch is a list of statements run as a batch
+type cqlBatch struct {
+	kind        gocql.BatchType
+	consistency gocql.Consistency
+	statements  []cqlQuery
+}
+
+// Query adds a statement to the batch
+func (b *cqlBatch) Query(stmt string, values ...interface{}) {
+	b.statements = append(b.statements, cqlQuery{stmt: stmt, values: values})
+}
+
+// gocqlSession runs the queries on a gocql session
+type gocqlSession struct {
+	session *gocql.Session
+}
+
+func (s gocqlSession) query(ctx context.Context, q cqlQuery) *gocql.Query {
+	query := s.session.Query(q.stmt, q.values...).WithContext(ctx).Consistency(q.consistency)
+
+	if q.pageSize > 0 {
+		query = query.PageSize(q.pageSize)
+	}
+
+	return query
+}
+
+func (s gocqlSession) batch(ctx context.Context, b *cqlBatch) *gocql.Batch {
+	batch := s.session.NewBatch(b.kind).WithContext(ctx)
+	batch.SetConsistency(b.consistency)
+
+	for _, q := range b.statements {
+		batch.Query(q.stmt, q.values...)
+	}
+
+	return batch
+}
+
+func (s gocqlSession) Iter(ctx context.Context, q cqlQuery) scanner {
+	return s.query(ctx, q).Iter()
+}
+
+func (s gocqlSession) Exec(ctx context.Context, q cqlQuery) error {
+	return s.query(ctx, q).Exec()
+}
+
+func (s gocqlSession) ExecuteBatch(ctx context.Context, b *cqlBatch) error {
+	return s.session.ExecuteBatch(s.batch(ctx, b))
+}
+
+func (s gocqlSession) ExecuteBatchCAS(ctx context.Context, b *cqlBatch, previous map[string]interface{}) (bool, error) {
+	applied, iter, err := s.session.MapExecuteBatchCAS(s.batch(ctx, b), previous)
+
+	if iter != nil {
+		iter.Close()
+	}
+
+	return applied, err
+}
+
+func (s gocqlSession) Tables(keyspace string) (map[string][]string, error) {
+	metadata, err := s.session.KeyspaceMetadata(keyspace)
+
+	if errors.Is(err, gocql.ErrKeyspaceDoesNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string][]string, len(metadata.Tables))
+	for name, table := range metadata.Tables {
+		tables[name] = table.OrderedColumns
+	}
+
+	return tables, nil
+}
+
+func (s gocqlSession) AwaitSchemaAgreement(ctx context.Context) error {
+	return s.session.AwaitSchemaAgreement(ctx)
+}
+
+func (s gocqlSession) Close() {
+	s.session.Close()
+}
@@ -1,8 +1,12 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -10,133 +14,614 @@ import (
 	"github.com/gocql/gocql"
 )
 
-type CassandraEventStoreConfig struct {
-	Keyspace    string
-	WriteQuorum string
-	ReadQuorum  string
-	Hosts       []string
-	Port        int
-	Auth        struct {
-		Username string
-		Password string
-	}
-	TraceSession bool
-}
-
 type CassandraEventStore struct {
-	session     *gocql.Session
+	session     cqlSession
 	config      *CassandraEventStoreConfig
 	readQuorum  gocql.Consistency
 	writeQuorum gocql.Consistency
+	serialRead  gocql.Consistency // reads of the values written by lightweight transactions only
+
+	// the bindings of the type names recorded in the keyspace, see bindTypeNames
+	typeMutex sync.Mutex
+	typeNames *typeDirectory
+
+	// shortest settle window of the reads by type, see indexByType
+	settleFloor time.Duration
+
+	// the types having events and when they were listed, see eventTypes
+	typesMutex   sync.Mutex
+	types        []EventType
+	typesListed  time.Time
+	typesRefresh time.Duration
+
+	// closed by Dispose to stop the repairs of the index by type
+	stop chan struct{}
+}
+
+// scanner is the subset of *gocql.Iter used by the read paths
+type scanner interface {
+	Scan(dest ...interface{}) bool
+	Close() error
 }
 
 // @see EventStore.Find
-func (es *CassandraEventStore) Find(guid EventID) ([]StoreEvent, error) {
-	var events []StoreEvent
-	var event string
-	var etype int
+func (es *CassandraEventStore) Find(ctx context.Context, guid EventID) ([]StoreEvent, error) {
+	return es.FindRange(ctx, guid, StreamRange{})
+}
 
+// @see EventStore.FindRange
+func (es *CassandraEventStore) FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error) {
 	// ATTENTION: we need to parse the guid into the atual type we use in the table
 	stringGuid := string(guid)
 
-	iter := es.session.
-		Query(`SELECT type, payload FROM events WHERE id = ?`, stringGuid).
-		Consistency(es.readQuorum).
-		Iter()
+	if _, err := gocql.ParseUUID(stringGuid); err != nil {
+		return nil, invalidArgumentf("aggregate id %q is not a UUID", stringGuid)
+	}
+
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	stmt, values := streamQuery(stringGuid, r)
+
+	events, currentVersion, err := readStream(guid, r, es.read(ctx, stmt, values...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if currentVersion > 0 {
+		return events, nil
+	}
+
+	// nothing at all was read: either the aggregate doesn't exist or,
+	// for a ranged read, none of its events matched the range
+	if r.IsZero() {
+		return nil, notFound(guid)
+	}
+
+	if currentVersion, err = es.currentVersion(ctx, stringGuid); err != nil {
+		return nil, err
+	}
+
+	if currentVersion == 0 {
+		return nil, notFound(guid)
+	}
 
-	for iter.Scan(&etype, &event) {
-		events = append(events, StoreEvent{ID: EventID(guid), Type: EventType(etype), Payload: EventPayload(event)})
+	if err := checkComplete(guid, r, nil, currentVersion); err != nil {
+		return nil, err
 	}
 
-	return events, nil
+	return []StoreEvent{}, nil
 }
 
-func (es *CassandraEventStore) Update(guid EventID, expectedVersion int, events []StoreEvent) error {
-	batch := es.session.NewBatch(gocql.UnloggedBatch)
-	quorum := es.writeQuorum
-	numbEvents := len(events)
-	newVersion := expectedVersion + numbEvents
+// streamQuery pushes the range down into predicates on the clustering
+// columns of the events table. The time bound is not: the save times of a
+// stream may go back when the clocks of its writers disagree, so readStream
+// stops at the first version saved past it
+func streamQuery(guid string, r StreamRange) (string, []interface{}) {
+	stmt := `SELECT version, type, payload, savetime, metadata, current_version, schema_version, type_name, content_type, payload_bytes, deleted FROM events WHERE id = ?`
+	values := []interface{}{guid}
+
+	if r.AfterVersion > 0 {
+		stmt += ` AND version > ?`
+		values = append(values, r.AfterVersion)
+	}
+
+	if r.UpToVersion > 0 {
+		stmt += ` AND version <= ?`
+		values = append(values, r.UpToVersion)
+	}
+
+	if r.lastFirst() {
+		stmt += ` ORDER BY version DESC LIMIT 1`
+	}
+
+	return stmt, values
+}
+
+// lastFirst tells whether the last event of the range is read alone, from the end of
+// the stream. A time bounded read has to go through the versions in order to stop
+func (r StreamRange) lastFirst() bool {
+	return r.LastOnly && r.AsOf == 0
+}
+
+// currentVersion reads the static columns of the stream, a DeletedError if it is deleted
+func (es *CassandraEventStore) currentVersion(ctx context.Context, guid string) (int, error) {
+	var currentVersion int
+	var deleted time.Time
+
+	iter := es.read(ctx, `SELECT current_version, deleted FROM events WHERE id = ? LIMIT 1`, guid)
+
+	iter.Scan(&currentVersion, &deleted)
+
+	if err := iter.Close(); err != nil {
+		return 0, cqlError(err)
+	}
+
+	if !deleted.IsZero() {
+		return 0, NewDeletedError(EventID(guid), currentVersion, deleted.UnixNano()/int64(time.Millisecond))
+	}
+
+	return currentVersion, nil
+}
+
+// readStream collects the events of one aggregate and makes sure that the
+// whole range was read: versions must be contiguous and reach current_version
+// (or the upper bound of the range, or the first version saved after AsOf),
+// otherwise rebuilding the aggregate would silently lose events. The current
+// version is 0 when no row was read at all, a deleted stream is a DeletedError
+func readStream(guid EventID, r StreamRange, iter scanner) ([]StoreEvent, int, error) {
+	var events []StoreEvent
+	var version, etype, currentVersion, schemaVersion int
+	var event, typeName, contentType string
+	var blob []byte
+	var savetime int64
+	var metadata map[string]string
+	var deleted time.Time
+
+	next := r.AfterVersion + 1
+	stopped := false
+
+	for iter.Scan(&version, &etype, &event, &savetime, &metadata, &currentVersion, &schemaVersion, &typeName, &contentType, &blob, &deleted) {
+		// a partition holding only the static column has no events yet
+		if version == 0 {
+			continue
+		}
+
+		if !r.lastFirst() && version != next {
+			iter.Close()
+			return nil, 0, unavailable(fmt.Errorf("aggregate %s: expected version %d, read %d", guid, next, version))
+		}
+
+		// the events after the first one saved past the time bound are not part of the stream as it was then
+		if r.AsOf > 0 && savetime > r.AsOf {
+			stopped = true
+			break
+		}
+
+		events = append(events, StoreEvent{ID: guid, Version: version, Type: EventType(etype), TypeName: typeName, SchemaVersion: schemaVersion, ContentType: contentType, Payload: storedPayload(event, blob), TimeStamp: savetime, Metadata: metadata})
+		metadata, blob = nil, nil
+		schemaVersion = 0
+		typeName, contentType = "", ""
+		next++
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, 0, cqlError(err)
+	}
+
+	if currentVersion == 0 {
+		return nil, 0, nil
+	}
+
+	if !deleted.IsZero() {
+		return nil, 0, NewDeletedError(guid, currentVersion, deleted.UnixNano()/int64(time.Millisecond))
+	}
+
+	if !stopped {
+		if err := checkComplete(guid, r, events, currentVersion); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if r.LastOnly && len(events) > 1 {
+		events = events[len(events)-1:]
+	}
+
+	if events == nil {
+		events = []StoreEvent{}
+	}
+
+	return events, currentVersion, nil
+}
+
+// checkComplete verifies that the events read reach the end of the range
+func checkComplete(guid EventID, r StreamRange, events []StoreEvent, currentVersion int) error {
+	upper := currentVersion
+
+	if r.UpToVersion > 0 && r.UpToVersion < upper {
+		upper = r.UpToVersion
+	}
+
+	if upper <= r.AfterVersion {
+		return nil
+	}
+
+	if len(events) == 0 {
+		return unavailable(fmt.Errorf("aggregate %s: read no events of (%d, %d]", guid, r.AfterVersion, upper))
+	}
+
+	if last := events[len(events)-1].Version; last != upper {
+		return unavailable(fmt.Errorf("aggregate %s: read up to version %d of %d", guid, last, upper))
+	}
+
+	return nil
+}
+
+func (es *CassandraEventStore) Update(ctx context.Context, guid EventID, expectedVersion int, events []StoreEvent) error {
+	if err := validateUpdate(guid, expectedVersion, events); err != nil {
+		return err
+	}
 
 	// ATTENTION: we need to parse the guid into the actual type we use in the table
 	stringGuid := string(guid)
 
-	batch.SetConsistency(quorum)
+	if _, err := gocql.ParseUUID(stringGuid); err != nil {
+		return invalidArgumentf("aggregate id %q is not a UUID", stringGuid)
+	}
+
+	// the names are bound before the events are written, a name left bound is harmless
+	bindings, _ := typeBindings(events)
+
+	if err := es.bindTypeNames(ctx, bindings); err != nil {
+		return err
+	}
+
+	applied, casMap, savetime, err := es.appendEvents(ctx, stringGuid, expectedVersion, events)
+
+	if err != nil {
+		return err
+	}
+
+	actual := -1
+	if v, ok := casMap["current_version"].(int); ok {
+		actual = v
+	}
+
+	// the index of the former update is pending: it is repaired before this one goes in
+	if pending, _ := casMap["index_pending"].(int); !applied && pending > 0 && actual == expectedVersion {
+		if err := es.repairIndex(ctx, stringGuid, pending); err != nil {
+			return err
+		}
+
+		if applied, casMap, savetime, err = es.appendEvents(ctx, stringGuid, expectedVersion, events); err != nil {
+			return err
+		}
+
+		if v, ok := casMap["current_version"].(int); ok {
+			actual = v
+		}
+	}
+
+	if !applied {
+		if deleted, _ := casMap["deleted"].(time.Time); !deleted.IsZero() {
+			return NewDeletedError(guid, actual, deleted.UnixNano()/int64(time.Millisecond))
+		}
+		return NewConcurrencyError(guid, expectedVersion, actual)
+	}
+
+	es.indexByType(stringGuid, expectedVersion+1, events, savetime)
+
+	return nil
+}
+
+// appendEvents runs the conditional batch saving the events and marking their index pending,
+// returning whether it was applied, the values its conditions were checked against and the save time
+func (es *CassandraEventStore) appendEvents(ctx context.Context, guid string, expectedVersion int, events []StoreEvent) (bool, map[string]interface{}, int64, error) {
+	batch := &cqlBatch{kind: gocql.UnloggedBatch, consistency: es.writeQuorum}
+	numbEvents := len(events)
+	newVersion := expectedVersion + numbEvents
+
 	if expectedVersion == 0 {
-		batch.Query("INSERT INTO events (id, current_version) VALUES (?,?) IF NOT EXISTS", stringGuid, numbEvents)
+		batch.Query("INSERT INTO events (id, current_version, index_pending) VALUES (?,?,?) IF NOT EXISTS", guid, numbEvents, 1)
 	} else {
-		batch.Query("UPDATE events SET current_version = ? WHERE id = ? IF current_version = ?", newVersion, stringGuid, expectedVersion)
+		batch.Query("UPDATE events SET current_version = ?, index_pending = ? WHERE id = ? IF current_version = ? AND deleted = null AND index_pending = null",
+			newVersion, expectedVersion+1, guid, expectedVersion)
 	}
 
-	stmt := "INSERT INTO events (id, version, type, payload, savetime) VALUES (?,?,?,?,toTimeStamp(now()))"
+	// the save time is set here, so that the events and their index by type agree
+	savetime := nowMillis()
+	stmt := "INSERT INTO events (id, version, type, type_name, schema_version, content_type, payload_bytes, metadata, savetime) VALUES (?,?,?,?,?,?,?,?,?)"
 
 	for i, event := range events {
 		eventVersion := expectedVersion + 1 + i
-		batch.Query(stmt, stringGuid, eventVersion, event.Type, event.Payload)
+		batch.Query(stmt, guid, eventVersion, event.Type, event.TypeName, event.SchemaVersion, event.ContentType, []byte(event.Payload), event.Metadata, savetime)
 	}
 
 	// here we can get an error only if we are unable to run the query or it is invalid
 	casMap := make(map[string]interface{})
-	applied, _, err := es.session.MapExecuteBatchCAS(batch, casMap)
+	applied, err := es.session.ExecuteBatchCAS(ctx, batch, casMap)
 
 	if err != nil {
-		return fmt.Errorf("CQL ERROR: %+v", err)
+		return false, nil, 0, cqlError(err)
 	}
 
-	if !applied {
-		return fmt.Errorf("%+v", "optimistic locking failed")
+	return applied, casMap, savetime, nil
+}
+
+// @see EventStore.GetEventsByType
+func (es *CassandraEventStore) GetEventsByType(ctx context.Context, query TypeQuery) ([]StoreEvent, Cursor, error) {
+	if err := query.validate(); err != nil {
+		return nil, query.After, err
 	}
 
-	return nil
+	query, err := resolveTypeNames(ctx, es, query)
+
+	if err != nil {
+		return nil, query.After, err
+	}
+
+	if query.BatchSize <= 0 {
+		query.BatchSize = 1000 // TODO: set a default value at CassandraEventStore level
+	}
+
+	types := query.types()
+	now := time.Now()
+
+	// all the types are read as of the time they were listed, as a type listed
+	// later may have events before the ones read
+	if types == nil {
+		if types, now, err = es.eventTypes(ctx); err != nil {
+			return nil, query.After, err
+		}
+	}
+
+	// the index of an update is written after its events, within the settle floor
+	if query.Settle < es.settleFloor {
+		query.Settle = es.settleFloor
+	}
+
+	settleLimit := query.settleLimit(now)
+
+	if len(types) == 1 {
+		return es.readType(ctx, types[0], query.After, settleLimit, query.BatchSize)
+	}
+
+	// the types are merged as they are read: once the batch is full, the following
+	// types are read up to its last event only, their later events can't make the batch
+	var events []StoreEvent
+
+	for _, etype := range types {
+		page, _, err := es.readType(ctx, etype, query.After, settleLimit, query.BatchSize)
+
+		if err != nil {
+			return nil, query.After, err
+		}
+
+		events = append(events, page...)
+		sortByPosition(events)
+
+		if len(events) >= query.BatchSize {
+			events = events[:query.BatchSize]
+			settleLimit = events[len(events)-1].TimeStamp
+		}
+	}
+
+	next := query.After
+	if len(events) > 0 {
+		next = events[len(events)-1].Cursor
+	}
+
+	return events, next, nil
 }
 
-func (es *CassandraEventStore) GetEventsByType(etype EventType, sinceMillis int64, batchSize int) (events []StoreEvent, latest int64, theError error) {
-	var payload string
+// readType reads the events of a type following the cursor, in the order of the index
+func (es *CassandraEventStore) readType(ctx context.Context, etype EventType, after Cursor, settleLimit int64, batchSize int) ([]StoreEvent, Cursor, error) {
+	position, _ := after.Decode()
+
+	stmt, values := bucketsQuery(etype, position, settleLimit, es.bucketSize())
+	buckets := es.read(ctx, stmt, values...)
+
+	return readBuckets(after, batchSize, buckets, func(bucket int64, limit int) ([]StoreEvent, error) {
+		stmt, values := byTypeQuery(etype, bucket, position, settleLimit, limit)
+		events, _, err := readByType(etype, after, es.read(ctx, stmt, values...))
+		return events, err
+	})
+}
+
+// sortByPosition orders events of several types as the index orders the ones of a type
+func sortByPosition(events []StoreEvent) {
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+
+		if a.TimeStamp != b.TimeStamp {
+			return a.TimeStamp < b.TimeStamp
+		}
+
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+
+		return a.ID < b.ID
+	})
+}
+
+// eventTypes lists the types having events, from the partitions of event_type_buckets, with
+// the time they were listed at. The list is kept for typesRefresh, as listing the partitions
+// scans the whole table
+func (es *CassandraEventStore) eventTypes(ctx context.Context) ([]EventType, time.Time, error) {
+	es.typesMutex.Lock()
+	types, listed := es.types, es.typesListed
+	es.typesMutex.Unlock()
+
+	if !listed.IsZero() && time.Since(listed) < es.typesRefresh {
+		return types, listed, nil
+	}
+
+	listed = time.Now()
+	iter := es.read(ctx, `SELECT DISTINCT type FROM event_type_buckets`)
+
+	types = nil
+	var etype int
+
+	for iter.Scan(&etype) {
+		types = append(types, EventType(etype))
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, listed, cqlError(err)
+	}
+
+	es.typesMutex.Lock()
+	if listed.After(es.typesListed) {
+		es.types, es.typesListed = types, listed
+	}
+	es.typesMutex.Unlock()
+
+	return types, listed, nil
+}
+
+// byTypeQuery builds the CQL reading the events of a type bucket following a position.
+// The index is clustered by (savetime, version, id), which orders the events
+// saved in the same millisecond, so no event is ever skipped between pages
+func byTypeQuery(etype EventType, bucket int64, after Position, settleLimit int64, batchSize int) (string, []interface{}) {
+	stmt := `SELECT savetime, version, payload, id, metadata, schema_version, type_name, content_type, payload_bytes FROM events_by_type_bucket WHERE type = ? AND bucket = ?`
+	values := []interface{}{etype, bucket}
+
+	switch {
+	case after.IsTimeOnly() && after.SaveTime > 0:
+		stmt += ` AND savetime >= ?`
+		values = append(values, after.SaveTime)
+	case !after.IsTimeOnly():
+		stmt += ` AND (savetime, version, id) > (?, ?, ?)`
+		values = append(values, after.SaveTime, after.Version, string(after.ID))
+	}
+
+	if settleLimit > 0 {
+		stmt += ` AND savetime <= ?`
+		values = append(values, settleLimit)
+	}
+
+	stmt += ` LIMIT ?`
+	values = append(values, batchSize)
+
+	return stmt, values
+}
+
+// readByType collects a page of events of the given type. A page is only
+// returned if the iterator completed, a failed read never looks like an empty page
+func readByType(etype EventType, after Cursor, iter scanner) ([]StoreEvent, Cursor, error) {
+	var events []StoreEvent
+	var savetime int64
+	var version, schemaVersion int
+	var payload, typeName, contentType string
+	var blob []byte
 	var id string
-	var query *gocql.Query
+	var metadata map[string]string
+
+	for iter.Scan(&savetime, &version, &payload, &id, &metadata, &schemaVersion, &typeName, &contentType, &blob) {
+		cursor := EncodeCursor(Position{SaveTime: savetime, Version: version, ID: EventID(id)})
+		events = append(events, StoreEvent{ID: EventID(id), Version: version, Type: etype, TypeName: typeName, SchemaVersion: schemaVersion, ContentType: contentType, Payload: storedPayload(payload, blob), TimeStamp: savetime, Metadata: metadata, Cursor: cursor})
+		metadata, blob = nil, nil
+		schemaVersion = 0
+		typeName, contentType = "", ""
+	}
 
-	if batchSize <= 0 {
-		batchSize = 1000 // TODO: set a default value at CassandraEventStore level
+	if err := iter.Close(); err != nil {
+		return nil, after, cqlError(err)
 	}
 
-	if sinceMillis > 0 {
-		query = es.session.Query(`SELECT savetime, payload, id FROM events_by_type WHERE type=? AND savetime > ? LIMIT ?`, etype, sinceMillis, batchSize)
-	} else {
-		query = es.session.Query(`SELECT savetime, payload, id FROM events_by_type WHERE type=? LIMIT ?`, etype, batchSize)
+	next := after
+	if len(events) > 0 {
+		next = events[len(events)-1].Cursor
+	}
+
+	return events, next, nil
+}
+
+// storedPayload returns the payload of a row, read from its blob or, for the rows
+// written before the payloads were bytes, from its text
+func storedPayload(text string, blob []byte) EventPayload {
+	if blob != nil {
+		return EventPayload(blob)
+	}
+	return EventPayload(text)
+}
+
+// @see SnapshotStore.SaveSnapshot
+func (es *CassandraEventStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	if err := validateSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	if _, err := gocql.ParseUUID(string(snapshot.ID)); err != nil {
+		return invalidArgumentf("aggregate id %q is not a UUID", snapshot.ID)
 	}
 
-	iter := query.Consistency(es.readQuorum).Iter()
+	err := es.write(ctx, `INSERT INTO snapshots (id, version, schema_version, payload_bytes, savetime) VALUES (?,?,?,?,toTimeStamp(now()))`,
+		string(snapshot.ID), snapshot.Version, snapshot.SchemaVersion, []byte(snapshot.Payload))
 
-	for iter.Scan(&latest, &payload, &id) {
-		events = append(events, StoreEvent{ID: EventID(id), Type: etype, Payload: EventPayload(payload), TimeStamp: latest})
+	if err != nil {
+		return cqlError(err)
 	}
 
-	return events, latest, nil
+	return nil
 }
 
-// initializer for event store
-func NewCassandraEventStore(config *CassandraEventStoreConfig) (*CassandraEventStore, error) {
+// @see SnapshotStore.LatestSnapshot
+func (es *CassandraEventStore) LatestSnapshot(ctx context.Context, guid EventID) (*Snapshot, error) {
+	var payload string
+	var blob []byte
 
-	cluster := gocql.NewCluster(config.Hosts...)
-	cluster.Keyspace = config.Keyspace
+	if _, err := gocql.ParseUUID(string(guid)); err != nil {
+		return nil, invalidArgumentf("aggregate id %q is not a UUID", guid)
+	}
+
+	snapshot := &Snapshot{ID: guid}
+
+	// snapshots are clustered by descending version, the first row is the latest
+	iter := es.read(ctx, `SELECT version, schema_version, payload, savetime, payload_bytes FROM snapshots WHERE id = ? LIMIT 1`, string(guid))
+
+	found := iter.Scan(&snapshot.Version, &snapshot.SchemaVersion, &payload, &snapshot.TimeStamp, &blob)
 
-	// set port if provided
-	if config.Port > 0 {
-		cluster.Port = config.Port
+	if err := iter.Close(); err != nil {
+		return nil, cqlError(err)
 	}
 
-	cluster.Consistency = gocql.Quorum
-	// cluster.SerialConsistency = gocql.LocalSerial
+	if !found {
+		return nil, fmt.Errorf("%w: no snapshot of aggregate %s", ErrNotFound, guid)
+	}
+
+	snapshot.Payload = storedPayload(payload, blob)
+
+	return snapshot, nil
+}
 
-	var readQuorum gocql.Consistency
-	if err := readQuorum.UnmarshalText([]byte(strings.ToUpper(config.ReadQuorum))); err != nil {
-		readQuorum = gocql.Quorum
+// read runs a query at the read consistency
+func (es *CassandraEventStore) read(ctx context.Context, stmt string, values ...interface{}) scanner {
+	return es.session.Iter(ctx, cqlQuery{stmt: stmt, values: values, consistency: es.readQuorum})
+}
+
+// write runs a statement at the write consistency
+func (es *CassandraEventStore) write(ctx context.Context, stmt string, values ...interface{}) error {
+	return es.session.Exec(ctx, cqlQuery{stmt: stmt, values: values, consistency: es.writeQuorum})
+}
+
+// cqlError maps the errors returned by gocql into the store errors
+func cqlError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	switch err.(type) {
+	case *gocql.RequestErrUnavailable, *gocql.RequestErrReadTimeout, *gocql.RequestErrWriteTimeout:
+		return unavailable(err)
 	}
 
-	var writeQuorum gocql.Consistency
-	if err := writeQuorum.UnmarshalText([]byte(strings.ToUpper(config.WriteQuorum))); err != nil {
-		writeQuorum = gocql.Quorum
+	switch err {
+	case gocql.ErrNoConnections, gocql.ErrTimeoutNoResponse, gocql.ErrConnectionClosed,
+		gocql.ErrTooManyTimeouts, gocql.ErrSessionClosed, gocql.ErrUnavailable:
+		return unavailable(err)
+	}
+
+	return fmt.Errorf("CQL ERROR: %+v", err)
+}
+
+// initializer for event store
+func NewCassandraEventStore(config *CassandraEventStoreConfig) (*CassandraEventStore, error) {
+
+	cluster, err := config.newCluster()
+
+	if err != nil {
+		return nil, err
 	}
 
+	cluster.Keyspace = config.Keyspace
+
+	readQuorum, _ := parseConsistency(config.ReadQuorum, gocql.Quorum)
+	writeQuorum, _ := parseConsistency(config.WriteQuorum, gocql.Quorum)
+
 	session, err := cluster.CreateSession()
 
 	if err != nil {
@@ -148,10 +633,37 @@ func NewCassandraEventStore(config *CassandraEventStoreConfig) (*CassandraEventS
 		session.SetTrace(tracer)
 	}
 
-	return &CassandraEventStore{session: session, config: config, readQuorum: readQuorum, writeQuorum: writeQuorum}, nil
+	es := newCassandraEventStore(gocqlSession{session: session}, config, readQuorum, writeQuorum)
+
+	if !config.SkipSchemaCheck {
+		if err := checkSchemaVersion(context.Background(), es.session, config.Keyspace); err != nil {
+			es.Dispose()
+			return nil, err
+		}
+	}
+
+	interval := config.IndexRepairInterval
+	if interval == 0 {
+		interval = defaultIndexRepairInterval
+	}
+
+	if interval > 0 {
+		es.stop = make(chan struct{})
+		go es.repairLoop(interval)
+	}
+
+	return es, nil
+}
+
+func newCassandraEventStore(session cqlSession, config *CassandraEventStoreConfig, readQuorum gocql.Consistency, writeQuorum gocql.Consistency) *CassandraEventStore {
+	return &CassandraEventStore{session: session, config: config, readQuorum: readQuorum, writeQuorum: writeQuorum, serialRead: config.serialRead(), typeNames: newTypeDirectory(), settleFloor: config.settleFloor(), typesRefresh: config.typeListRefresh()}
 }
 
 // Add events to the store and send them down the channel
 func (es *CassandraEventStore) Dispose() {
+	if es.stop != nil {
+		close(es.stop)
+	}
+
 	es.session.Close()
 }
@@ -0,0 +1,812 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// fakeIter replays rows and then fails with err, like a gocql.Iter
+// whose paging query timed out half way through
+type fakeIter struct {
+	rows [][]interface{}
+	err  error
+}
+
+func (it *fakeIter) Scan(dest ...interface{}) bool {
+	if len(it.rows) == 0 {
+		return false
+	}
+
+	row := it.rows[0]
+	it.rows = it.rows[1:]
+
+	// the rows of the former schema lack the trailing columns, read as null
+	for i, d := range dest {
+		if i < len(row) {
+			assignFake(d, row[i])
+		}
+	}
+
+	return true
+}
+
+func (it *fakeIter) Close() error {
+	return it.err
+}
+
+func streamRows(n int, currentVersion int) [][]interface{} {
+	var rows [][]interface{}
+	for v := 1; v <= n; v++ {
+		rows = append(rows, []interface{}{v, 1, "{}", int64(1000 + v), nil, currentVersion})
+	}
+	return rows
+}
+
+func TestReadStream(t *testing.T) {
+	events, currentVersion, err := readStream("uuid", StreamRange{}, &fakeIter{rows: streamRows(3, 3)})
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if len(events) != 3 || currentVersion != 3 {
+		t.Fatalf("expected 3 events, got %d at version %d", len(events), currentVersion)
+	}
+
+	for i, e := range events {
+		if e.Version != i+1 || e.TimeStamp != int64(1001+i) {
+			t.Errorf("unexpected version or save time in %+v", e)
+		}
+	}
+}
+
+func TestReadStreamEmpty(t *testing.T) {
+	events, currentVersion, err := readStream("uuid", StreamRange{}, &fakeIter{})
+
+	if err != nil || events != nil || currentVersion != 0 {
+		t.Errorf("expected nothing read, got %d events at version %d, error %+v", len(events), currentVersion, err)
+	}
+}
+
+func TestReadStreamNeverTruncates(t *testing.T) {
+	readTimeout := &gocql.RequestErrReadTimeout{}
+
+	cases := map[string]*fakeIter{
+		"failure after some rows":  {rows: streamRows(2, 5), err: readTimeout},
+		"failure before any row":   {err: readTimeout},
+		"rows missing at the end":  {rows: streamRows(2, 5)},
+		"rows missing in between":  {rows: append(streamRows(1, 3), []interface{}{3, 1, "{}", int64(1003), nil, 3})},
+		"only the static row read": {rows: [][]interface{}{{0, 0, "", int64(0), nil, 4}}},
+	}
+
+	for name, iter := range cases {
+		events, _, err := readStream("uuid", StreamRange{}, iter)
+
+		if err == nil || events != nil {
+			t.Errorf("%s: expected a failed read, got %d events and error %+v", name, len(events), err)
+		}
+
+		if !errors.Is(err, ErrUnavailable) {
+			t.Errorf("%s: expected ErrUnavailable, got %+v", name, err)
+		}
+	}
+}
+
+func TestReadStreamRange(t *testing.T) {
+	rows := streamRows(6, 6)
+
+	events, _, err := readStream("uuid", StreamRange{AfterVersion: 2, UpToVersion: 4}, &fakeIter{rows: rows[2:4]})
+
+	if err != nil || len(events) != 2 || events[0].Version != 3 {
+		t.Errorf("unexpected range read %+v, error %+v", events, err)
+	}
+
+	events, _, err = readStream("uuid", StreamRange{LastOnly: true}, &fakeIter{rows: rows[5:]})
+
+	if err != nil || len(events) != 1 || events[0].Version != 6 {
+		t.Errorf("unexpected last event read %+v, error %+v", events, err)
+	}
+
+	// the last event read must be the last one of the stream
+	if _, _, err = readStream("uuid", StreamRange{LastOnly: true}, &fakeIter{rows: rows[4:5]}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %+v", err)
+	}
+
+	// an upper bound stops the read before current_version
+	if _, _, err = readStream("uuid", StreamRange{UpToVersion: 4}, &fakeIter{rows: rows[:3]}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %+v", err)
+	}
+
+	// a time bound read stops at the first version saved past it, but does not skip versions
+	if events, _, err = readStream("uuid", StreamRange{AsOf: 1003}, &fakeIter{rows: rows[:4]}); err != nil || len(events) != 3 {
+		t.Errorf("unexpected time bound read %+v, error %+v", events, err)
+	}
+
+	if _, _, err = readStream("uuid", StreamRange{AsOf: 1003}, &fakeIter{rows: rows[:3]}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("truncated: expected ErrUnavailable, got %+v", err)
+	}
+
+	if _, _, err = readStream("uuid", StreamRange{AsOf: 1003}, &fakeIter{rows: append(rows[:1:1], rows[2])}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %+v", err)
+	}
+}
+
+func TestStreamQuery(t *testing.T) {
+	stmt, values := streamQuery("uuid", StreamRange{AfterVersion: 2, UpToVersion: 5, LastOnly: true})
+
+	expected := `SELECT version, type, payload, savetime, metadata, current_version, schema_version, type_name, content_type, payload_bytes, deleted FROM events WHERE id = ?` +
+		` AND version > ? AND version <= ? ORDER BY version DESC LIMIT 1`
+
+	if stmt != expected {
+		t.Errorf("unexpected statement %s", stmt)
+	}
+
+	if len(values) != 3 {
+		t.Errorf("unexpected values %+v", values)
+	}
+
+	// the time bound is applied while reading the versions in order
+	if stmt, _ := streamQuery("uuid", StreamRange{AsOf: 1000, LastOnly: true}); strings.Contains(stmt, "savetime <=") || strings.Contains(stmt, "DESC") {
+		t.Errorf("unexpected statement %s", stmt)
+	}
+}
+
+// the save times of a stream go back when the clocks of its writers disagree
+func TestCassandraAsOfNonMonotonic(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	stmts := []cqlQuery{{stmt: `INSERT INTO events (id, current_version) VALUES (?,?)`, values: []interface{}{string(fakeUUID), 3}}}
+
+	for version, savetime := range map[int]int64{1: 1000, 2: 3000, 3: 2000} {
+		stmts = append(stmts, cqlQuery{
+			stmt:   `INSERT INTO events (id, version, type, payload_bytes, savetime) VALUES (?,?,?,?,?)`,
+			values: []interface{}{string(fakeUUID), version, 1, []byte("{}"), savetime},
+		})
+	}
+
+	for _, stmt := range stmts {
+		if err := cassandra.Exec(ctx, stmt); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	for _, r := range []StreamRange{{AsOf: 2500}, {AsOf: 2500, LastOnly: true}} {
+		if events, err := es.FindRange(ctx, fakeUUID, r); err != nil || len(events) != 1 || events[0].Version != 1 {
+			t.Errorf("%+v: unexpected events %+v, error %+v", r, events, err)
+		}
+	}
+
+	if events, err := es.FindRange(ctx, fakeUUID, StreamRange{AsOf: 3000, LastOnly: true}); err != nil || len(events) != 1 || events[0].Version != 3 {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+}
+
+func TestReadByTypeNeverTruncates(t *testing.T) {
+	iter := &fakeIter{
+		rows: [][]interface{}{{int64(10), 1, "{}", "uuid1", nil}, {int64(20), 1, "{}", "uuid2", nil}},
+		err:  gocql.ErrTimeoutNoResponse,
+	}
+
+	after := CursorFrom(5)
+	events, next, err := readByType(1, after, iter)
+
+	if !errors.Is(err, ErrUnavailable) || events != nil {
+		t.Errorf("expected a failed read, got %d events and error %+v", len(events), err)
+	}
+
+	if next != after {
+		t.Errorf("expected position to stay at %s, got %s", after, next)
+	}
+}
+
+func TestReadByTypeCursor(t *testing.T) {
+	iter := &fakeIter{rows: [][]interface{}{{int64(10), 1, "{}", "uuid1", nil}, {int64(10), 2, "{}", "uuid1", nil}}}
+
+	events, next, err := readByType(1, "", iter)
+
+	if err != nil || len(events) != 2 {
+		t.Fatalf("unexpected read %+v, error %+v", events, err)
+	}
+
+	p, err := next.Decode()
+
+	if err != nil || p != (Position{SaveTime: 10, Version: 2, ID: "uuid1"}) {
+		t.Errorf("unexpected position %+v, error %+v", p, err)
+	}
+}
+
+func TestByTypeQuery(t *testing.T) {
+	cases := []struct {
+		after    Position
+		settle   int64
+		expected string
+		values   int
+	}{
+		{Position{}, 0, ``, 3},
+		{Position{SaveTime: 10}, 0, ` AND savetime >= ?`, 4},
+		{Position{SaveTime: 10, Version: 2, ID: "uuid"}, 0, ` AND (savetime, version, id) > (?, ?, ?)`, 6},
+		{Position{SaveTime: 10, Version: 2, ID: "uuid"}, 20, ` AND (savetime, version, id) > (?, ?, ?) AND savetime <= ?`, 7},
+	}
+
+	for _, c := range cases {
+		stmt, values := byTypeQuery(1, 0, c.after, c.settle, 10)
+		expected := `SELECT savetime, version, payload, id, metadata, schema_version, type_name, content_type, payload_bytes FROM events_by_type_bucket WHERE type = ? AND bucket = ?` + c.expected + ` LIMIT ?`
+
+		if stmt != expected || len(values) != c.values {
+			t.Errorf("unexpected statement %s with values %+v", stmt, values)
+		}
+	}
+}
+
+func TestBucketsQuery(t *testing.T) {
+	stmt, values := bucketsQuery(1, Position{SaveTime: 3*3600*1000 + 5}, 5*3600*1000+5, time.Hour)
+
+	if stmt != `SELECT bucket FROM event_type_buckets WHERE type = ? AND bucket >= ? AND bucket <= ?` {
+		t.Errorf("unexpected statement %s", stmt)
+	}
+
+	if len(values) != 3 || values[1] != int64(3*3600*1000) || values[2] != int64(5*3600*1000) {
+		t.Errorf("unexpected values %+v", values)
+	}
+}
+
+func TestReadBucketsFillsTheBatch(t *testing.T) {
+	buckets := &fakeIter{rows: [][]interface{}{{int64(0)}, {int64(3600000)}, {int64(7200000)}}}
+	read := map[int64]int{}
+
+	events, next, err := readBuckets("", 3, buckets, func(bucket int64, limit int) ([]StoreEvent, error) {
+		read[bucket] = limit
+		cursor := EncodeCursor(Position{SaveTime: bucket + 1, Version: 1, ID: "uuid"})
+		page := []StoreEvent{{Version: 1, TimeStamp: bucket + 1, Cursor: cursor}, {Version: 2, TimeStamp: bucket + 1, Cursor: cursor}}
+		if limit < len(page) {
+			page = page[:limit]
+		}
+		return page, nil
+	})
+
+	if err != nil || len(events) != 3 {
+		t.Fatalf("unexpected events %+v, error %+v", events, err)
+	}
+
+	// the second bucket is asked for the rest of the batch, the third one is not read
+	if len(read) != 2 || read[0] != 3 || read[3600000] != 1 {
+		t.Errorf("unexpected bucket reads %+v", read)
+	}
+
+	if next != events[2].Cursor {
+		t.Errorf("unexpected cursor %s", next)
+	}
+
+	buckets = &fakeIter{rows: [][]interface{}{{int64(0)}}}
+	_, next, err = readBuckets("after", 3, buckets, func(bucket int64, limit int) ([]StoreEvent, error) {
+		return nil, unavailable(errors.New("timeout"))
+	})
+
+	if !errors.Is(err, ErrUnavailable) || next != "after" {
+		t.Errorf("expected a failed read at the same cursor, got %s and %+v", next, err)
+	}
+}
+
+const fakeUUID = "0d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f50"
+
+func TestCassandraUpdateConditions(t *testing.T) {
+	ctx := context.Background()
+	es, _ := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}, {Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// IF NOT EXISTS and IF current_version = ? both report the current version
+	for _, expected := range []int{0, 1, 3} {
+		err := es.Update(ctx, fakeUUID, expected, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}})
+
+		var conflict *ConcurrencyError
+		if !errors.As(err, &conflict) || conflict.Expected != expected || conflict.Actual != 2 {
+			t.Errorf("expected version %d: unexpected error %+v", expected, err)
+		}
+	}
+
+	// the condition on a missing partition reads a null version
+	err := es.Update(ctx, "1d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f50", 1, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}})
+
+	var conflict *ConcurrencyError
+	if !errors.As(err, &conflict) || conflict.Actual != 0 {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	if err := es.Update(ctx, fakeUUID, 2, []StoreEvent{{Type: 2, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, err := es.Find(ctx, fakeUUID)
+
+	if err != nil || len(events) != 3 || events[2].Type != 2 {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+}
+
+func TestCassandraErrorMapping(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	cassandra.fail(fakeFault{prefix: "UPDATE events", err: &gocql.RequestErrWriteTimeout{}})
+	cassandra.fail(fakeFault{prefix: "SELECT version", err: gocql.ErrNoConnections})
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.Update(ctx, fakeUUID, 1, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("write timeout: expected ErrUnavailable, got %+v", err)
+	}
+
+	if _, err := es.Find(ctx, fakeUUID); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("no connections: expected ErrUnavailable, got %+v", err)
+	}
+
+	cancelled, cancelFunc := context.WithCancel(ctx)
+	cancelFunc()
+
+	if err := es.Update(cancelled, fakeUUID, 1, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled: expected context.Canceled, got %+v", err)
+	}
+
+	cassandra.heal()
+	cassandra.fail(fakeFault{prefix: "SELECT", err: errors.New("syntax error")})
+
+	if _, err := es.Find(ctx, fakeUUID); err == nil || errors.Is(err, ErrUnavailable) {
+		t.Errorf("syntax error: expected a CQL error, got %+v", err)
+	}
+}
+
+// a write timeout does not tell whether the batch was applied: once it was,
+// retrying the update conflicts with the events already in
+func TestCassandraUpdateTimeoutApplied(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	cassandra.fail(fakeFault{prefix: "INSERT INTO events (id, current_version, index_pending)", err: &gocql.RequestErrWriteTimeout{}, applied: true, times: 1})
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got %+v", err)
+	}
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); !errors.Is(err, ErrConcurrencyConflict) {
+		t.Errorf("expected a conflict on retry, got %+v", err)
+	}
+
+	if events, err := es.Find(ctx, fakeUUID); err != nil || len(events) != 1 {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+}
+
+func TestCassandraFindNeverTruncates(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}, {Type: 1, Payload: EventPayload("{}")}, {Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	cassandra.fail(fakeFault{prefix: "SELECT version", err: &gocql.RequestErrReadTimeout{}, rows: 2})
+
+	if events, err := es.Find(ctx, fakeUUID); !errors.Is(err, ErrUnavailable) || events != nil {
+		t.Errorf("expected a failed read, got %+v and %+v", events, err)
+	}
+}
+
+func TestCassandraEventsByTypeAcrossBuckets(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{TypeBucketSize: time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		guid := EventID(fmt.Sprintf("0d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f5%d", i))
+
+		if err := es.Update(ctx, guid, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}, {Type: 1, Payload: EventPayload("{}")}}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if n := len(cassandra.tables["event_type_buckets"].partitions[fakeKey([]interface{}{int64(1)})].rows); n != 3 {
+		t.Fatalf("expected 3 buckets, got %d", n)
+	}
+
+	var read []StoreEvent
+	after := Cursor("")
+
+	for page := 0; page < 10; page++ {
+		events, next, err := es.GetEventsByType(ctx, TypeQuery{Type: 1, After: after, BatchSize: 4})
+
+		if err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		read = append(read, events...)
+		after = next
+	}
+
+	if len(read) != 6 {
+		t.Fatalf("expected 6 events, got %+v", read)
+	}
+
+	for i, e := range read {
+		if e.ID != EventID(fmt.Sprintf("0d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f5%d", i/2)) || e.Version != i%2+1 {
+			t.Errorf("unexpected event %d: %+v", i, e)
+		}
+	}
+}
+
+func TestCassandraEventsOfAllTypesMerged(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	for i := 0; i < 3; i++ {
+		guid := EventID(fmt.Sprintf("0d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f5%d", i))
+		events := make([]StoreEvent, 5)
+
+		for j := range events {
+			events[j] = StoreEvent{Type: EventType(i + 1), Payload: EventPayload("{}")}
+		}
+
+		if err := es.Update(ctx, guid, 0, events); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	cassandra.reads = map[string]int{}
+
+	events, after, err := es.GetEventsByType(ctx, TypeQuery{AllTypes: true, BatchSize: 5})
+
+	if err != nil || len(events) != 5 || events[4].Type != 1 {
+		t.Fatalf("unexpected events %+v, error %+v", events, err)
+	}
+
+	// the later types are not read past the full batch of the first one
+	if n := cassandra.reads["events_by_type_bucket"]; n != 5 {
+		t.Errorf("expected 5 events read, got %d", n)
+	}
+
+	read := events
+
+	for page := 0; page < 10; page++ {
+		events, next, err := es.GetEventsByType(ctx, TypeQuery{AllTypes: true, After: after, BatchSize: 4})
+
+		if err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		read = append(read, events...)
+		after = next
+	}
+
+	if len(read) != 15 {
+		t.Fatalf("expected 15 events, got %+v", read)
+	}
+
+	for i, e := range read {
+		if e.Type != EventType(i/5+1) || e.Version != i%5+1 {
+			t.Errorf("unexpected event %d: %+v", i, e)
+		}
+	}
+}
+
+// the readers of all the types keep the list of types and don't read past it
+func TestCassandraTypeListKept(t *testing.T) {
+	ctx := context.Background()
+	es, _ := newFakeCassandraStore(&CassandraEventStoreConfig{})
+	es.typesRefresh = time.Hour
+
+	if err := es.Update(ctx, "0d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f50", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	events, after, err := es.GetEventsByType(ctx, TypeQuery{AllTypes: true, Settle: time.Millisecond})
+
+	if err != nil || len(events) != 1 {
+		t.Fatalf("unexpected events %+v, error %+v", events, err)
+	}
+
+	if err := es.Update(ctx, "0d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f51", 0, []StoreEvent{{Type: 2, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	// the event of the type not listed yet is left for later, not skipped
+	if events, next, err := es.GetEventsByType(ctx, TypeQuery{AllTypes: true, After: after, Settle: time.Millisecond}); err != nil || len(events) != 0 || next != after {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+
+	if len(es.types) != 1 {
+		t.Errorf("expected the list of types kept, got %v", es.types)
+	}
+
+	es.typesListed = es.typesListed.Add(-2 * time.Hour)
+
+	if events, _, err := es.GetEventsByType(ctx, TypeQuery{AllTypes: true, After: after, Settle: time.Millisecond}); err != nil || len(events) != 1 || events[0].Type != 2 {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+}
+
+func TestCassandraIndexRetriedAndBackfilled(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	// the index write is retried when it fails after the events are in
+	cassandra.fail(fakeFault{prefix: "INSERT INTO events_by_type_bucket", err: gocql.ErrTimeoutNoResponse, times: 1})
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}, {Type: 2, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if events, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 2}); err != nil || len(events) != 1 {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+
+	// an index lost altogether is rebuilt from the events table
+	for _, table := range []string{"events_by_type_bucket", "event_type_entries", "event_type_buckets"} {
+		cassandra.tables[table].partitions = map[string]*fakePartition{}
+	}
+
+	if indexed, err := es.BackfillTypeIndex(ctx, nil); err != nil || indexed != 2 {
+		t.Fatalf("unexpected backfill of %d events, error %+v", indexed, err)
+	}
+
+	for _, etype := range []EventType{1, 2} {
+		events, _, err := es.GetEventsByType(ctx, TypeQuery{Type: etype})
+
+		if err != nil || len(events) != 1 || events[0].ID != fakeUUID {
+			t.Errorf("type %d: unexpected events %+v, error %+v", etype, events, err)
+		}
+	}
+}
+
+// indexPending returns the pending index marker of the stream in the fake, 0 if none
+func indexPending(cassandra *fakeCassandra, guid EventID) int64 {
+	p := cassandra.tables["events"].partitions[fakeKey([]interface{}{string(guid)})]
+	pending, _ := p.static["index_pending"].(int64)
+	return pending
+}
+
+func TestCassandraIndexRepairedByNextUpdate(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	// the events are committed, their index is left pending
+	cassandra.fail(fakeFault{prefix: "INSERT INTO events_by_type_bucket", err: errors.New("server error")})
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if events, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1}); err != nil || len(events) != 0 || indexPending(cassandra, fakeUUID) != 1 {
+		t.Fatalf("unexpected events %+v, error %+v", events, err)
+	}
+
+	cassandra.heal()
+
+	// the next update of the stream indexes them first
+	if err := es.Update(ctx, fakeUUID, 1, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1})
+
+	if err != nil || len(events) != 2 || events[0].Version != 1 || events[1].Version != 2 {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+
+	if pending := indexPending(cassandra, fakeUUID); pending != 0 {
+		t.Errorf("marker left at %d", pending)
+	}
+}
+
+func TestCassandraIndexRepairedLate(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	_, cursor, err := es.GetEventsByType(ctx, TypeQuery{Type: 1})
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// an update saved an hour ago whose index write failed, the reader went past its position
+	late := "1d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f50"
+	savetime := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+
+	for _, stmt := range []cqlQuery{
+		{stmt: `INSERT INTO events (id, current_version, index_pending) VALUES (?,?,?)`, values: []interface{}{late, 1, 1}},
+		{stmt: `INSERT INTO events (id, version, type, payload_bytes, savetime) VALUES (?,?,?,?,?)`, values: []interface{}{late, 1, 1, []byte("{}"), savetime}},
+	} {
+		if err := cassandra.Exec(ctx, stmt); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	if repaired, err := es.RepairTypeIndex(ctx); err != nil || repaired != 1 {
+		t.Fatalf("unexpected repair of %d streams, error %+v", repaired, err)
+	}
+
+	events, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1, After: cursor})
+
+	if err != nil || len(events) != 1 || events[0].ID != EventID(late) || events[0].TimeStamp <= savetime {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+
+	// nothing is left to repair
+	if repaired, err := es.RepairTypeIndex(ctx); err != nil || repaired != 0 || indexPending(cassandra, EventID(late)) != 0 {
+		t.Errorf("unexpected repair of %d streams, error %+v", repaired, err)
+	}
+}
+
+// the events moved by a repair are neither indexed again by a backfill nor left at their save time
+func TestCassandraIndexRepairedThenBackfilled(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	late := "1d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f50"
+	savetime := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+
+	for _, stmt := range []cqlQuery{
+		{stmt: `INSERT INTO events (id, current_version, index_pending) VALUES (?,?,?)`, values: []interface{}{late, 1, 1}},
+		{stmt: `INSERT INTO events (id, version, type, payload_bytes, savetime) VALUES (?,?,?,?,?)`, values: []interface{}{late, 1, 1, []byte("{}"), savetime}},
+	} {
+		if err := cassandra.Exec(ctx, stmt); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	if err := es.repairIndex(ctx, late, 1); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if indexed, err := es.BackfillTypeIndex(ctx, nil); err != nil || indexed != 0 {
+		t.Fatalf("unexpected backfill of %d events, error %+v", indexed, err)
+	}
+
+	events, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1})
+
+	if err != nil || len(events) != 1 || events[0].TimeStamp <= savetime {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+}
+
+// the readers by type wait for the index writes and the clocks of the writers
+func TestCassandraSettleFloor(t *testing.T) {
+	ctx := context.Background()
+	es := newCassandraEventStore(newFakeCassandra(), &CassandraEventStoreConfig{MaxClockSkew: 2 * time.Second}, gocql.Quorum, gocql.Quorum)
+
+	if es.settleFloor != indexTimeout+2*time.Second {
+		t.Errorf("unexpected settle floor %v", es.settleFloor)
+	}
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if events, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1}); err != nil || len(events) != 0 {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+}
+
+func TestCassandraSchemaCheck(t *testing.T) {
+	ctx := context.Background()
+	cassandra := newFakeCassandra()
+
+	if err := checkSchemaVersion(ctx, cassandra, "eventstore"); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	cassandra.tables["schema_version"].partitions = map[string]*fakePartition{}
+
+	if err := checkSchemaVersion(ctx, cassandra, "eventstore"); !errors.Is(err, ErrIncompatibleSchema) {
+		t.Errorf("expected ErrIncompatibleSchema, got %+v", err)
+	}
+}
+
+func TestCassandraReadsTextPayloads(t *testing.T) {
+	ctx := context.Background()
+	es, _ := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, _ := es.Find(ctx, fakeUUID)
+
+	// the row as a former release wrote it, with a text payload and no recorded index entry
+	err := es.write(ctx, `INSERT INTO events (id, version, savetime, payload, payload_bytes) VALUES (?,?,?,?,?)`,
+		string(fakeUUID), 1, events[0].TimeStamp, `{"text":true}`, nil)
+
+	if err == nil {
+		err = es.write(ctx, `DELETE FROM event_type_entries WHERE id = ?`, string(fakeUUID))
+	}
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if events, err := es.Find(ctx, fakeUUID); err != nil || len(events) != 1 || string(events[0].Payload) != `{"text":true}` {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+
+	// the backfill indexes it as bytes
+	if _, err := es.BackfillTypeIndex(ctx, nil); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if events, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1}); err != nil || len(events) != 1 || string(events[0].Payload) != `{"text":true}` {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+}
+
+// the entries of a purged stream are deleted where they were written, whatever the bucket size now
+func TestCassandraPurgeIndexEntries(t *testing.T) {
+	ctx := context.Background()
+	es, cassandra := newFakeCassandraStore(&CassandraEventStoreConfig{TypeBucketSize: time.Minute})
+
+	if err := es.Update(ctx, fakeUUID, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// an event indexed before the positions were recorded, in a bucket of a former size
+	savetime := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+	bucket := bucketOf(savetime, time.Second)
+
+	for _, stmt := range []cqlQuery{
+		{stmt: `INSERT INTO events (id, version, type, payload_bytes, savetime) VALUES (?,?,?,?,?)`, values: []interface{}{string(fakeUUID), 2, 2, []byte("{}"), savetime}},
+		{stmt: `UPDATE events SET current_version = ? WHERE id = ?`, values: []interface{}{2, string(fakeUUID)}},
+		{stmt: `INSERT INTO events_by_type_bucket (type, bucket, savetime, version, id) VALUES (?,?,?,?,?)`, values: []interface{}{2, bucket, savetime, 2, string(fakeUUID)}},
+		{stmt: `INSERT INTO event_type_buckets (type, bucket) VALUES (?,?)`, values: []interface{}{2, bucket}},
+		{stmt: `INSERT INTO event_type_buckets (type, bucket) VALUES (?,?)`, values: []interface{}{2, bucket + 1000}},
+	} {
+		if err := cassandra.Exec(ctx, stmt); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	es.config.TypeBucketSize = 24 * time.Hour
+
+	if err := es.DeleteStream(ctx, fakeUUID, 2); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.PurgeStream(ctx, fakeUUID); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	for _, table := range []string{"events_by_type_bucket", "event_type_entries"} {
+		for _, p := range cassandra.tables[table].partitions {
+			if len(p.rows) > 0 {
+				t.Errorf("%s: entries left %+v", table, p.rows)
+			}
+		}
+	}
+}
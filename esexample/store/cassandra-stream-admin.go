@@ -0,0 +1,190 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// The tombstone of a stream is the static deleted column of its partition, written with a
+// lightweight transaction on current_version like the updates, which check it in turn.
+// Purging deletes the rows of the events but not the static columns, so that the tombstone
+// and the current version outlive them; the entries of the index by type are deleted one
+// by one, at the bucket and position recorded in event_type_entries when they were written.
+// The entries written before event_type_entries are looked for at the save time of their
+// event, in the buckets of their type listed in event_type_buckets
+
+// @see StreamDeleter.DeleteStream
+func (es *CassandraEventStore) DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error {
+	if _, err := gocql.ParseUUID(string(guid)); err != nil {
+		return invalidArgumentf("aggregate id %q is not a UUID", guid)
+	}
+
+	if expectedVersion < 0 {
+		return invalidArgumentf("deletion of aggregate %s at version %d", guid, expectedVersion)
+	}
+
+	batch := &cqlBatch{kind: gocql.LoggedBatch, consistency: es.writeQuorum}
+	batch.Query(`UPDATE events SET deleted = toTimeStamp(now()) WHERE id = ? IF current_version = ? AND deleted = null`, string(guid), expectedVersion)
+
+	previous := map[string]interface{}{}
+	applied, err := es.session.ExecuteBatchCAS(ctx, batch, previous)
+
+	if err != nil {
+		return cqlError(err)
+	}
+
+	if applied {
+		return nil
+	}
+
+	actual, _ := previous["current_version"].(int)
+
+	if deleted, _ := previous["deleted"].(time.Time); !deleted.IsZero() {
+		return nil
+	}
+
+	if actual == 0 {
+		return notFound(guid)
+	}
+
+	return NewConcurrencyError(guid, expectedVersion, actual)
+}
+
+// @see StreamDeleter.Tombstone
+func (es *CassandraEventStore) Tombstone(ctx context.Context, guid EventID) (*DeletedError, error) {
+	if _, err := gocql.ParseUUID(string(guid)); err != nil {
+		return nil, invalidArgumentf("aggregate id %q is not a UUID", guid)
+	}
+
+	currentVersion, err := es.currentVersion(ctx, string(guid))
+
+	var deleted *DeletedError
+
+	switch {
+	case errors.As(err, &deleted):
+		return deleted, nil
+	case err != nil:
+		return nil, err
+	case currentVersion == 0:
+		return nil, notFound(guid)
+	}
+
+	return nil, nil
+}
+
+// @see StreamDeleter.PurgeStream
+func (es *CassandraEventStore) PurgeStream(ctx context.Context, guid EventID) error {
+	deleted, err := es.Tombstone(ctx, guid)
+
+	if err != nil {
+		return err
+	}
+
+	if deleted == nil {
+		return invalidArgumentf("aggregate %s is not deleted", guid)
+	}
+
+	recorded, err := es.purgeRecordedEntries(ctx, guid)
+
+	if err != nil {
+		return err
+	}
+
+	iter := es.read(ctx, `SELECT version, type, savetime FROM events WHERE id = ?`, string(guid))
+
+	var version, etype int
+	var savetime int64
+
+	for iter.Scan(&version, &etype, &savetime) {
+		// the row of the static columns, and the events whose entries were recorded
+		if version == 0 || recorded[version] {
+			continue
+		}
+
+		if err := es.purgeUnrecordedEntry(ctx, guid, version, EventType(etype), savetime); err != nil {
+			iter.Close()
+			return fmt.Errorf("aggregate %s version %d: %w", guid, version, cqlError(err))
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return cqlError(err)
+	}
+
+	// the positions of the entries go last, so that a purge failing before is done again
+	for _, stmt := range []string{
+		`DELETE FROM events WHERE id = ? AND version > 0`,
+		`DELETE FROM snapshots WHERE id = ?`,
+		`DELETE FROM event_type_entries WHERE id = ?`,
+	} {
+		if err := es.write(ctx, stmt, string(guid)); err != nil {
+			return cqlError(err)
+		}
+	}
+
+	return nil
+}
+
+// purgeRecordedEntries deletes the entries of the stream in the index by type at their recorded
+// positions, returning the versions having some. A version may have several entries, when its
+// index write landed after it was repaired at a later position
+func (es *CassandraEventStore) purgeRecordedEntries(ctx context.Context, guid EventID) (map[int]bool, error) {
+	iter := es.read(ctx, `SELECT version, bucket, savetime, type FROM event_type_entries WHERE id = ?`, string(guid))
+
+	recorded := map[int]bool{}
+
+	var version, etype int
+	var bucket, savetime int64
+
+	for iter.Scan(&version, &bucket, &savetime, &etype) {
+		err := es.write(ctx, `DELETE FROM events_by_type_bucket WHERE type = ? AND bucket = ? AND savetime = ? AND version = ? AND id = ?`,
+			etype, bucket, savetime, version, string(guid))
+
+		if err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("aggregate %s version %d: %w", guid, version, cqlError(err))
+		}
+
+		recorded[version] = true
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, cqlError(err)
+	}
+
+	return recorded, nil
+}
+
+// purgeUnrecordedEntry deletes the entry of an event indexed before its position was recorded,
+// at its save time then. The bucket size may have changed since: the entry is looked for in
+// the buckets of its type listed in event_type_buckets, from its save time backwards
+func (es *CassandraEventStore) purgeUnrecordedEntry(ctx context.Context, guid EventID, version int, etype EventType, savetime int64) error {
+	buckets := es.read(ctx, `SELECT bucket FROM event_type_buckets WHERE type = ? AND bucket <= ? ORDER BY bucket DESC`, etype, savetime)
+
+	var bucket int64
+
+	for buckets.Scan(&bucket) {
+		entry := es.read(ctx, `SELECT version FROM events_by_type_bucket WHERE type = ? AND bucket = ? AND savetime = ? AND version = ? AND id = ?`,
+			etype, bucket, savetime, version, string(guid))
+
+		found := entry.Scan(new(int))
+
+		if err := entry.Close(); err != nil {
+			buckets.Close()
+			return err
+		}
+
+		if found {
+			buckets.Close()
+
+			return es.write(ctx, `DELETE FROM events_by_type_bucket WHERE type = ? AND bucket = ? AND savetime = ? AND version = ? AND id = ?`,
+				etype, bucket, savetime, version, string(guid))
+		}
+	}
+
+	return buckets.Close()
+}
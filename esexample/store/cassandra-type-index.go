@@ -0,0 +1,434 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/gocql/gocql"
+	"github.com/rs/zerolog/log"
+)
+
+// The events by type are indexed in events_by_type_bucket, partitioned by (type, bucket)
+// so that no partition grows without bounds. A bucket is the start of its time window:
+// the save time truncated to the configured bucket size. event_type_buckets lists the
+// buckets of each type, so that the readers walk the non-empty buckets only, and
+// event_type_entries the bucket and position of the entries of each stream, so that
+// purging the stream finds them whatever the bucket size they were written with.
+//
+// A conditional batch cannot span partitions, so the index is written after the events.
+// The batch saving them also sets the static index_pending column of the stream to the
+// first version saved, cleared once they are indexed: the stream can't be updated again
+// while it is set, the update first repairs the index. The index of an update is only
+// written at the position of its events until indexTimeout after their save time, and
+// the readers by type never come closer to the present than indexTimeout plus the clock
+// skew of the servers: an event missing from the index past that is indexed at the time
+// of its repair instead, so that the readers which went past its position still get it
+
+const (
+	defaultTypeBucketSize = time.Hour
+
+	// time left to write the index of an update at the position of its events, short as
+	// the readers by type wait for it: a write that takes longer is repaired later on
+	indexTimeout = 2 * time.Second
+
+	defaultMaxClockSkew        = time.Second
+	defaultIndexRepairInterval = 5 * time.Minute
+	defaultTypeListRefresh     = 10 * time.Second
+)
+
+// bucketOf returns the bucket of the given save time in millis
+func bucketOf(millis int64, size time.Duration) int64 {
+	width := int64(size / time.Millisecond)
+	return millis - millis%width
+}
+
+func (es *CassandraEventStore) bucketSize() time.Duration {
+	if es.config.TypeBucketSize > 0 {
+		return es.config.TypeBucketSize
+	}
+	return defaultTypeBucketSize
+}
+
+// typeListRefresh returns how long the list of the types having events is kept
+func (config *CassandraEventStoreConfig) typeListRefresh() time.Duration {
+	if config.TypeListRefresh == 0 {
+		return defaultTypeListRefresh
+	}
+	return config.TypeListRefresh
+}
+
+// settleFloor returns the shortest settle window of the readers by type
+func (config *CassandraEventStoreConfig) settleFloor() time.Duration {
+	if config.MaxClockSkew > 0 {
+		return indexTimeout + config.MaxClockSkew
+	}
+	return indexTimeout + defaultMaxClockSkew
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// indexDeadline returns the time after which the events saved at savetime can't be
+// indexed at their position anymore, as the readers may have gone past it
+func indexDeadline(savetime int64) time.Time {
+	return time.Unix(0, savetime*int64(time.Millisecond)).Add(indexTimeout)
+}
+
+// indexByType adds the events of an update to the index by type, then clears the marker
+// the update set. The events are already committed: when the index can't be written in
+// time the marker stays, and the stream is repaired by its next update or RepairTypeIndex
+// rather than the update failing, since retrying it would only get a concurrency conflict
+func (es *CassandraEventStore) indexByType(guid string, first int, events []StoreEvent, savetime int64) {
+	ctx, cancelFunc := context.WithDeadline(context.Background(), indexDeadline(savetime))
+	defer cancelFunc()
+
+	// only the failures which may not last are retried
+	write := func() error {
+		err := es.writeIndex(ctx, guid, first, events, savetime, savetime)
+
+		if err != nil && !errors.Is(cqlError(err), ErrUnavailable) {
+			return backoff.Permanent(err)
+		}
+
+		return err
+	}
+
+	err := backoff.Retry(write, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+
+	if err == nil {
+		err = es.clearPendingIndex(ctx, guid, first)
+	}
+
+	if err != nil {
+		log.Warn().Msgf("aggregate %s: events %d to %d saved, their index by type is left to repair: %+v",
+			guid, first, first+len(events)-1, err)
+	}
+}
+
+// writeIndex writes the entries of the events of the stream from version first on, at the given
+// position. When it is not the save time of the events, the entries at their save time are deleted
+// by the same batch: a write of the update that lands late is older, the deletion shadows it
+func (es *CassandraEventStore) writeIndex(ctx context.Context, guid string, first int, events []StoreEvent, savetime, position int64) error {
+	batch := &cqlBatch{kind: gocql.LoggedBatch, consistency: es.writeQuorum}
+	bucket := bucketOf(position, es.bucketSize())
+	saveBucket := bucketOf(savetime, es.bucketSize())
+
+	registered := map[EventType]bool{}
+
+	for i, e := range events {
+		if position != savetime {
+			batch.Query(`DELETE FROM events_by_type_bucket WHERE type = ? AND bucket = ? AND savetime = ? AND version = ? AND id = ?`,
+				e.Type, saveBucket, savetime, first+i, guid)
+			batch.Query(`DELETE FROM event_type_entries WHERE id = ? AND version = ? AND bucket = ? AND savetime = ?`,
+				guid, first+i, saveBucket, savetime)
+		}
+
+		batch.Query(`INSERT INTO events_by_type_bucket (type, bucket, savetime, version, id, type_name, schema_version, content_type, payload_bytes, metadata) VALUES (?,?,?,?,?,?,?,?,?,?)`,
+			e.Type, bucket, position, first+i, guid, e.TypeName, e.SchemaVersion, e.ContentType, []byte(e.Payload), e.Metadata)
+		batch.Query(`INSERT INTO event_type_entries (id, version, bucket, savetime, type) VALUES (?,?,?,?,?)`,
+			guid, first+i, bucket, position, e.Type)
+
+		if !registered[e.Type] {
+			batch.Query(`INSERT INTO event_type_buckets (type, bucket) VALUES (?,?)`, e.Type, bucket)
+			registered[e.Type] = true
+		}
+	}
+
+	return es.session.ExecuteBatch(ctx, batch)
+}
+
+// clearPendingIndex clears the marker of the stream if it is still the given one. It is
+// a lightweight transaction, as are the updates setting it
+func (es *CassandraEventStore) clearPendingIndex(ctx context.Context, guid string, pending int) error {
+	batch := &cqlBatch{kind: gocql.LoggedBatch, consistency: es.writeQuorum}
+	batch.Query(`UPDATE events SET index_pending = null WHERE id = ? IF index_pending = ?`, guid, pending)
+
+	if _, err := es.session.ExecuteBatchCAS(ctx, batch, map[string]interface{}{}); err != nil {
+		return cqlError(err)
+	}
+
+	return nil
+}
+
+// repairIndex indexes the events of the update marked pending on the stream, then clears
+// the marker. Past their index deadline, the events not indexed already go at the time
+// of the repair: a reader may have gone past their position
+func (es *CassandraEventStore) repairIndex(ctx context.Context, guid string, pending int) error {
+	iter := es.read(ctx, `SELECT version, type, type_name, schema_version, content_type, payload, payload_bytes, metadata, savetime FROM events WHERE id = ? AND version >= ?`, guid, pending)
+
+	var events []StoreEvent
+	var version, etype, schemaVersion int
+	var payload, typeName, contentType string
+	var blob []byte
+	var metadata map[string]string
+	var savetime int64
+
+	for iter.Scan(&version, &etype, &typeName, &schemaVersion, &contentType, &payload, &blob, &metadata, &savetime) {
+		// the events of an update share its save time, the ones of the next updates are indexed already
+		if len(events) > 0 && savetime != events[0].TimeStamp {
+			break
+		}
+
+		events = append(events, StoreEvent{ID: EventID(guid), Version: version, Type: EventType(etype), TypeName: typeName, SchemaVersion: schemaVersion, ContentType: contentType, Payload: storedPayload(payload, blob), TimeStamp: savetime, Metadata: metadata})
+		metadata, blob = nil, nil
+		schemaVersion = 0
+		typeName, contentType = "", ""
+	}
+
+	if err := iter.Close(); err != nil {
+		return cqlError(err)
+	}
+
+	// a purged stream has no events left to index
+	if len(events) > 0 {
+		position := events[0].TimeStamp
+		indexed := false
+
+		if time.Now().After(indexDeadline(position)) {
+			var err error
+
+			if indexed, err = es.isIndexed(ctx, events[0]); err != nil {
+				return err
+			}
+
+			position = nowMillis()
+		}
+
+		if !indexed {
+			writeCtx, cancelFunc := context.WithDeadline(ctx, indexDeadline(position))
+			err := es.writeIndex(writeCtx, guid, events[0].Version, events, events[0].TimeStamp, position)
+			cancelFunc()
+
+			if err != nil {
+				return fmt.Errorf("aggregate %s: repairing the index of version %d: %w", guid, pending, cqlError(err))
+			}
+		}
+	}
+
+	return es.clearPendingIndex(ctx, guid, pending)
+}
+
+// isIndexed tells whether the entry of the event is in the index, at its position or moved there
+// by an earlier repair: the entries of an update are written by a logged batch, all of them or none
+func (es *CassandraEventStore) isIndexed(ctx context.Context, e StoreEvent) (bool, error) {
+	if recorded, err := es.hasEntry(ctx, string(e.ID), e.Version); err != nil || recorded {
+		return recorded, err
+	}
+
+	// the entries written before their positions were recorded
+	iter := es.read(ctx, `SELECT version FROM events_by_type_bucket WHERE type = ? AND bucket = ? AND savetime = ? AND version = ? AND id = ?`,
+		e.Type, bucketOf(e.TimeStamp, es.bucketSize()), e.TimeStamp, e.Version, string(e.ID))
+
+	var version int
+	found := iter.Scan(&version)
+
+	if err := iter.Close(); err != nil {
+		return false, cqlError(err)
+	}
+
+	return found, nil
+}
+
+// hasEntry tells whether the position of the entry of the event is recorded in event_type_entries
+func (es *CassandraEventStore) hasEntry(ctx context.Context, guid string, version int) (bool, error) {
+	iter := es.read(ctx, `SELECT version FROM event_type_entries WHERE id = ? AND version = ? LIMIT 1`, guid, version)
+
+	found := iter.Scan(new(int))
+
+	if err := iter.Close(); err != nil {
+		return false, cqlError(err)
+	}
+
+	return found, nil
+}
+
+// RepairTypeIndex indexes the events of the streams marked pending by an update whose index
+// write failed, and not updated since. The stores opened by NewCassandraEventStore run it
+// every IndexRepairInterval; it reads the static columns of all the streams
+func (es *CassandraEventStore) RepairTypeIndex(ctx context.Context) (int, error) {
+	iter := es.session.Iter(ctx, cqlQuery{
+		stmt:        `SELECT DISTINCT id, index_pending FROM events`,
+		consistency: es.readQuorum,
+		pageSize:    1000,
+	})
+
+	var id gocql.UUID
+	var pending int
+	repaired := 0
+
+	for iter.Scan(&id, &pending) {
+		if pending == 0 {
+			continue
+		}
+
+		if err := es.repairIndex(ctx, id.String(), pending); err != nil {
+			iter.Close()
+			return repaired, err
+		}
+
+		repaired++
+		pending = 0
+	}
+
+	if err := iter.Close(); err != nil {
+		return repaired, cqlError(err)
+	}
+
+	return repaired, nil
+}
+
+// repairLoop runs RepairTypeIndex every interval until the store is disposed
+func (es *CassandraEventStore) repairLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-es.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), interval)
+		repaired, err := es.RepairTypeIndex(ctx)
+		cancelFunc()
+
+		switch {
+		case err != nil:
+			log.Error().Msgf("repair of the index by type failed after %d streams: %+v", repaired, err)
+		case repaired > 0:
+			log.Info().Msgf("index by type repaired on %d streams", repaired)
+		}
+	}
+}
+
+// bucketsQuery builds the CQL listing the buckets of a type that may hold events after the position
+func bucketsQuery(etype EventType, after Position, settleLimit int64, size time.Duration) (string, []interface{}) {
+	stmt := `SELECT bucket FROM event_type_buckets WHERE type = ?`
+	values := []interface{}{etype}
+
+	if after.SaveTime > 0 {
+		stmt += ` AND bucket >= ?`
+		values = append(values, bucketOf(after.SaveTime, size))
+	}
+
+	if settleLimit > 0 {
+		stmt += ` AND bucket <= ?`
+		values = append(values, bucketOf(settleLimit, size))
+	}
+
+	return stmt, values
+}
+
+// readBuckets walks the buckets in order, reading events until the batch is full
+func readBuckets(after Cursor, batchSize int, buckets scanner, read func(bucket int64, limit int) ([]StoreEvent, error)) ([]StoreEvent, Cursor, error) {
+	var events []StoreEvent
+	var bucket int64
+
+	for len(events) < batchSize && buckets.Scan(&bucket) {
+		page, err := read(bucket, batchSize-len(events))
+
+		if err != nil {
+			buckets.Close()
+			return nil, after, err
+		}
+
+		events = append(events, page...)
+	}
+
+	if err := buckets.Close(); err != nil {
+		return nil, after, cqlError(err)
+	}
+
+	next := after
+	if len(events) > 0 {
+		next = events[len(events)-1].Cursor
+	}
+
+	return events, next, nil
+}
+
+// BackfillTypeIndex indexes by type all the events of the events table at their save time,
+// but for the ones whose entry is recorded already, moved by a repair maybe. It is idempotent,
+// so it can be run again after a failure or to repair the entries whose write failed.
+// progress, if not nil, is called with the number of events indexed so far
+func (es *CassandraEventStore) BackfillTypeIndex(ctx context.Context, progress func(indexed int)) (int, error) {
+	iter := es.session.Iter(ctx, cqlQuery{
+		stmt:        `SELECT id, version, type, type_name, schema_version, content_type, payload, payload_bytes, metadata, savetime FROM events`,
+		consistency: es.readQuorum,
+		pageSize:    1000,
+	})
+
+	var id gocql.UUID
+	var version int
+	var etype, schemaVersion int
+	var payload, typeName, contentType string
+	var blob []byte
+	var metadata map[string]string
+	var savetime time.Time
+
+	registered := map[[2]int64]bool{}
+	indexed := 0
+
+	for iter.Scan(&id, &version, &etype, &typeName, &schemaVersion, &contentType, &payload, &blob, &metadata, &savetime) {
+		// the rows of an aggregate without events only hold the static column
+		if version == 0 {
+			continue
+		}
+
+		recorded, err := es.hasEntry(ctx, id.String(), version)
+
+		if err != nil {
+			iter.Close()
+			return indexed, fmt.Errorf("aggregate %s version %d: %w", id, version, err)
+		}
+
+		if recorded {
+			metadata, blob = nil, nil
+			schemaVersion = 0
+			typeName, contentType = "", ""
+			continue
+		}
+
+		millis := savetime.UnixNano() / int64(time.Millisecond)
+		bucket := bucketOf(millis, es.bucketSize())
+
+		// the text payloads of the events written before the payloads were bytes are indexed as bytes
+		err = es.write(ctx, `INSERT INTO events_by_type_bucket (type, bucket, savetime, version, id, type_name, schema_version, content_type, payload_bytes, metadata) VALUES (?,?,?,?,?,?,?,?,?,?)`,
+			etype, bucket, millis, version, id, typeName, schemaVersion, contentType, []byte(storedPayload(payload, blob)), metadata)
+
+		if err == nil {
+			err = es.write(ctx, `INSERT INTO event_type_entries (id, version, bucket, savetime, type) VALUES (?,?,?,?,?)`,
+				id, version, bucket, millis, etype)
+		}
+
+		if err == nil && !registered[[2]int64{int64(etype), bucket}] {
+			err = es.write(ctx, `INSERT INTO event_type_buckets (type, bucket) VALUES (?,?)`, etype, bucket)
+			registered[[2]int64{int64(etype), bucket}] = true
+		}
+
+		if err != nil {
+			iter.Close()
+			return indexed, fmt.Errorf("aggregate %s version %d: %w", id, version, cqlError(err))
+		}
+
+		indexed++
+		metadata, blob = nil, nil
+		schemaVersion = 0
+		typeName, contentType = "", ""
+
+		if progress != nil && indexed%1000 == 0 {
+			progress(indexed)
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return indexed, cqlError(err)
+	}
+
+	return indexed, nil
+}
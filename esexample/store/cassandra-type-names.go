@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+
+	"github.com/gocql/gocql"
+)
+
+// The names of the event types are bound to their codes in event_type_codes and
+// event_type_names, each written with a lightweight transaction so that concurrent
+// writers agree on a single binding. The code is claimed first: a name whose code
+// belongs to another name is never recorded. The bindings already recorded are
+// cached, so that the transactions are only run for the first events of a type
+
+// bindTypeNames records the bindings of the names of the events, refusing the ones that collide
+func (es *CassandraEventStore) bindTypeNames(ctx context.Context, bindings map[string]EventType) error {
+	for name, code := range bindings {
+		es.typeMutex.Lock()
+		err := es.typeNames.check(map[string]EventType{name: code})
+		known := es.typeNames.codes[name] == code
+		es.typeMutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		if known {
+			continue
+		}
+
+		if err := es.claim(ctx, `INSERT INTO event_type_codes (type, name) VALUES (?,?) IF NOT EXISTS`, name, code, code, name); err != nil {
+			return err
+		}
+
+		if err := es.claim(ctx, `INSERT INTO event_type_names (name, type) VALUES (?,?) IF NOT EXISTS`, name, code, name, code); err != nil {
+			return err
+		}
+
+		es.typeMutex.Lock()
+		es.typeNames.bind(map[string]EventType{name: code})
+		es.typeMutex.Unlock()
+	}
+
+	return nil
+}
+
+// claim runs the insert of a binding, which is refused if the row holds another binding
+func (es *CassandraEventStore) claim(ctx context.Context, stmt string, name string, code EventType, values ...interface{}) error {
+	batch := &cqlBatch{kind: gocql.LoggedBatch, consistency: es.writeQuorum}
+	batch.Query(stmt, values...)
+
+	previous := map[string]interface{}{}
+	applied, err := es.session.ExecuteBatchCAS(ctx, batch, previous)
+
+	if err != nil {
+		return cqlError(err)
+	}
+
+	if applied {
+		return nil
+	}
+
+	boundName, _ := previous["name"].(string)
+	boundCode, _ := previous["type"].(int)
+
+	if boundName != name || EventType(boundCode) != code {
+		return typeConflict(name, code, boundName, EventType(boundCode))
+	}
+
+	return nil
+}
+
+// @see EventTypeDirectory.EventTypeCodes
+func (es *CassandraEventStore) EventTypeCodes(ctx context.Context, names []string) (map[string]EventType, error) {
+	bound := map[string]EventType{}
+
+	for _, name := range names {
+		es.typeMutex.Lock()
+		code, ok := es.typeNames.codes[name]
+		es.typeMutex.Unlock()
+
+		if ok {
+			bound[name] = code
+			continue
+		}
+
+		var etype int
+		iter := es.read(ctx, `SELECT type FROM event_type_names WHERE name = ?`, name)
+		found := iter.Scan(&etype)
+
+		if err := iter.Close(); err != nil {
+			return nil, cqlError(err)
+		}
+
+		// a binding is for good, it can be cached as soon as it is read
+		if found {
+			bound[name] = EventType(etype)
+
+			es.typeMutex.Lock()
+			es.typeNames.bind(map[string]EventType{name: EventType(etype)})
+			es.typeMutex.Unlock()
+		}
+	}
+
+	return bound, nil
+}
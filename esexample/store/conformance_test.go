@@ -0,0 +1,367 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"my/esexample/store"
+	"my/esexample/store/storetest"
+	"my/esexample/storegrpc"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	_ "modernc.org/sqlite"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func TestMemStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.EventStore {
+		return store.NewInMemStore()
+	})
+}
+
+func TestFileStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.EventStore {
+		dir, err := ioutil.TempDir("", "file-store")
+
+		if err != nil {
+			t.Fatalf("unable to create the directory: %+v", err)
+		}
+
+		es, err := store.NewFileEventStore(&store.FileEventStoreConfig{Dir: dir, Fsync: store.FsyncNever})
+
+		if err != nil {
+			t.Fatalf("unable to open the store: %+v", err)
+		}
+
+		t.Cleanup(func() {
+			es.Close()
+			os.RemoveAll(dir)
+		})
+
+		return es
+	})
+}
+
+func TestSQLStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.EventStore {
+		db, err := sql.Open("sqlite", ":memory:")
+
+		if err != nil {
+			t.Fatalf("unable to open the database: %+v", err)
+		}
+
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+
+		if err := store.CreateSQLiteSchema(context.Background(), db); err != nil {
+			t.Fatalf("unable to create the schema: %+v", err)
+		}
+
+		return store.NewSQLEventStore(db)
+	})
+}
+
+// the payloads encrypted over the memory store, the patient fields of some types only
+func TestEncryptedStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.EventStore {
+		keys, _ := store.NewFileKeyring("")
+		es, err := store.NewEncryptedEventStore(store.NewInMemStore(), keys, make([]byte, 32))
+
+		if err != nil {
+			t.Fatalf("unable to open the store: %+v", err)
+		}
+
+		es.Fields["patient.admitted"] = []string{"name", "age"}
+
+		return es
+	})
+}
+
+// the streams archived out of the memory store
+func TestArchivedStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.EventStore {
+		dir, err := ioutil.TempDir("", "archive")
+
+		if err != nil {
+			t.Fatalf("unable to create the directory: %+v", err)
+		}
+
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		archive, err := store.NewFileArchive(dir)
+
+		if err != nil {
+			t.Fatalf("unable to open the archive: %+v", err)
+		}
+
+		return store.NewArchivedEventStore(store.NewInMemStore(), archive)
+	})
+}
+
+// the gRPC client against a server running in process
+func TestGrpcStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.EventStore {
+		listener := bufconn.Listen(1 << 20)
+		server := grpc.NewServer()
+		es := store.NewInMemStore()
+		storegrpc.RegisterEventStoreServiceServer(server, store.NewGrpcEventStoreServer(es))
+		storegrpc.RegisterEventStoreAdminServiceServer(server, store.NewGrpcEventStoreAdminServer(es))
+
+		go server.Serve(listener)
+
+		conn, err := grpc.Dial("bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.Dial() }),
+			grpc.WithInsecure())
+
+		if err != nil {
+			t.Fatalf("unable to dial the server: %+v", err)
+		}
+
+		t.Cleanup(func() {
+			conn.Close()
+			server.Stop()
+		})
+
+		client := store.NewGrpcEventStore(&store.GrpcEventStoreConfig{Host: "bufnet"})
+		client.Client = storegrpc.NewEventStoreServiceClient(conn)
+		client.AdminClient = storegrpc.NewEventStoreAdminServiceClient(conn)
+
+		return client
+	})
+}
+
+// the HTTP client against a server running in process
+func TestRemoteStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.EventStore {
+		handler := store.NewRemoteEventStoreHandler(store.NewInMemStore())
+
+		router := gin.New()
+		handler.Register(router)
+		server := httptest.NewServer(router)
+		t.Cleanup(server.Close)
+
+		adminRouter := gin.New()
+		handler.RegisterAdmin(adminRouter)
+		admin := httptest.NewServer(adminRouter)
+		t.Cleanup(admin.Close)
+
+		return store.NewRemoteEventStore(&store.RemoteEventStoreConfig{Host: server.URL, AdminHost: admin.URL})
+	})
+}
+
+// the Cassandra store on an in process fake of its keyspace
+func TestFakeCassandraStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.EventStore {
+		return store.NewFakeCassandraEventStore()
+	})
+}
+
+// runs against the keyspace of CASSANDRA_TEST_KEYSPACE, eventstore_test by default,
+// on the hosts of CASSANDRA_TEST_HOSTS when set. The keyspace must be migrated
+func TestCassandraStoreConformance(t *testing.T) {
+	hosts := os.Getenv("CASSANDRA_TEST_HOSTS")
+
+	if hosts == "" {
+		t.Skip("CASSANDRA_TEST_HOSTS not set")
+	}
+
+	keyspace := os.Getenv("CASSANDRA_TEST_KEYSPACE")
+	if keyspace == "" {
+		keyspace = "eventstore_test"
+	}
+
+	es, err := store.NewCassandraEventStore(&store.CassandraEventStoreConfig{
+		Hosts:       strings.Split(hosts, ","),
+		Keyspace:    keyspace,
+		WriteQuorum: "QUORUM",
+		ReadQuorum:  "QUORUM",
+	})
+
+	if err != nil {
+		t.Fatalf("unable to connect: %+v", err)
+	}
+
+	defer es.Dispose()
+
+	storetest.Run(t, func(t *testing.T) store.EventStore { return es })
+}
+
+// the servers purge the deleted streams only once their retention elapsed
+func TestRemotePurgeRetained(t *testing.T) {
+	ctx := context.Background()
+	handler := store.NewRemoteEventStoreHandler(store.NewInMemStore())
+	handler.Retention = time.Hour
+
+	router := gin.New()
+	handler.Register(router)
+	handler.RegisterAdmin(router)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	es := store.NewRemoteEventStore(&store.RemoteEventStoreConfig{Host: server.URL, AdminHost: server.URL})
+
+	if err := es.Update(ctx, "uuid", 0, []store.StoreEvent{{Type: 1, Payload: store.EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.DeleteStream(ctx, "uuid", 1); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.PurgeStream(ctx, "uuid"); !errors.Is(err, store.ErrRetained) {
+		t.Errorf("expected ErrRetained, got %+v", err)
+	}
+
+	if _, err := es.Find(ctx, "uuid"); !errors.Is(err, store.ErrDeleted) {
+		t.Errorf("expected ErrDeleted, got %+v", err)
+	}
+}
+
+// the commands retiring the streams are off the public routes and service, and the
+// clients refuse them without an admin address
+func TestAdminCommandsApart(t *testing.T) {
+	ctx := context.Background()
+	memStore := store.NewInMemStore()
+
+	if err := memStore.Update(ctx, "uuid", 0, []store.StoreEvent{{Type: 1, Payload: store.EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	router := gin.New()
+	store.NewRemoteEventStoreHandler(memStore).Register(router)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodDelete, "/api/v1/events/uuid/1"},
+		{http.MethodPost, "/api/v1/streams/uuid/purge"},
+		{http.MethodPost, "/api/v1/streams/uuid/archive"},
+	} {
+		request, _ := http.NewRequest(route.method, server.URL+route.path, nil)
+		resp, err := http.DefaultClient.Do(request)
+
+		if err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s: expected 404, got %d", route.method, route.path, resp.StatusCode)
+		}
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	storegrpc.RegisterEventStoreServiceServer(grpcServer, store.NewGrpcEventStoreServer(memStore))
+
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithInsecure())
+
+	if err != nil {
+		t.Fatalf("unable to dial the server: %+v", err)
+	}
+
+	defer conn.Close()
+
+	if _, err := storegrpc.NewEventStoreAdminServiceClient(conn).DeleteStream(ctx, &storegrpc.DeleteStreamRequest{Id: "uuid", Version: 1}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected Unimplemented, got %+v", err)
+	}
+
+	grpcStore := store.NewGrpcEventStore(&store.GrpcEventStoreConfig{Host: "bufnet"})
+	grpcStore.Client = storegrpc.NewEventStoreServiceClient(conn)
+	remoteStore := store.NewRemoteEventStore(&store.RemoteEventStoreConfig{Host: server.URL})
+
+	for _, deleter := range []store.StreamDeleter{grpcStore, remoteStore} {
+		if err := deleter.DeleteStream(ctx, "uuid", 1); !errors.Is(err, store.ErrAdminDisabled) {
+			t.Errorf("%T: expected ErrAdminDisabled, got %+v", deleter, err)
+		}
+	}
+
+	if _, err := memStore.Find(ctx, "uuid"); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+}
+
+// queryRecorder records the queries by type of the subscriptions it serves
+type queryRecorder struct {
+	store.EventStore
+	queries chan store.TypeQuery
+}
+
+func (r *queryRecorder) GetEventsByType(ctx context.Context, query store.TypeQuery) ([]store.StoreEvent, store.Cursor, error) {
+	r.queries <- query
+	return r.EventStore.GetEventsByType(ctx, query)
+}
+
+// the subscriptions settle as asked, or as the server says when they don't ask
+func TestGrpcSubscribeSettle(t *testing.T) {
+	recorder := &queryRecorder{EventStore: store.NewInMemStore(), queries: make(chan store.TypeQuery, 100)}
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	storegrpc.RegisterEventStoreServiceServer(server, store.NewGrpcEventStoreServer(recorder))
+
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithInsecure())
+
+	if err != nil {
+		t.Fatalf("unable to dial the server: %+v", err)
+	}
+
+	defer conn.Close()
+
+	client := storegrpc.NewEventStoreServiceClient(conn)
+
+	for _, request := range []*storegrpc.SubscribeRequest{
+		{Types: []int32{1}},
+		{Types: []int32{1}, SettleMillis: 50, BatchSize: 10},
+	} {
+		ctx, cancelFunc := context.WithCancel(context.Background())
+
+		if _, err := client.Subscribe(ctx, request); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		query := <-recorder.queries
+		cancelFunc()
+
+		settle, batchSize := store.DefaultSubscriptionSettle, 100
+		if request.SettleMillis > 0 {
+			settle, batchSize = 50*time.Millisecond, 10
+		}
+
+		if query.Settle != settle || query.BatchSize != batchSize {
+			t.Errorf("request %+v: unexpected query %+v", request, query)
+		}
+	}
+}
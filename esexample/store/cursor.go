@@ -0,0 +1,203 @@
+package store
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cursor is an opaque continuation token marking a position in the events of a type.
+// The empty cursor is the position before the first event
+type Cursor string
+
+// Position is the decoded form of a Cursor. Events are ordered by (SaveTime, Version, ID),
+// which is unique even for events saved in the same millisecond. Stores that keep a global
+// commit sequence also record Seq and order by it instead
+type Position struct {
+	SaveTime int64
+	Version  int
+	ID       EventID
+	Seq      int64
+}
+
+const cursorPrefix = "c1"
+
+// EncodeCursor returns the cursor for the given position
+func EncodeCursor(p Position) Cursor {
+	raw := fmt.Sprintf("%s:%d:%d:%d:%s", cursorPrefix, p.SaveTime, p.Version, p.Seq, p.ID)
+	return Cursor(base64.RawURLEncoding.EncodeToString([]byte(raw)))
+}
+
+// CursorFrom returns a cursor selecting the events saved at or after the given time in millis
+func CursorFrom(millis int64) Cursor {
+	if millis <= 0 {
+		return ""
+	}
+	return EncodeCursor(Position{SaveTime: millis})
+}
+
+// CursorAt returns a cursor selecting the events saved at or after t
+func CursorAt(t time.Time) Cursor {
+	return CursorFrom(t.UnixNano() / int64(time.Millisecond))
+}
+
+// Decode returns the position of the cursor, ErrInvalidArgument if it is malformed
+func (c Cursor) Decode() (Position, error) {
+	var p Position
+
+	if c == "" {
+		return p, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(string(c))
+
+	if err != nil {
+		return p, invalidArgumentf("malformed cursor %q", c)
+	}
+
+	fields := strings.SplitN(string(raw), ":", 5)
+
+	if len(fields) != 5 || fields[0] != cursorPrefix {
+		return p, invalidArgumentf("malformed cursor %q", c)
+	}
+
+	var errs [3]error
+	p.SaveTime, errs[0] = strconv.ParseInt(fields[1], 10, 64)
+	p.Version, errs[1] = strconv.Atoi(fields[2])
+	p.Seq, errs[2] = strconv.ParseInt(fields[3], 10, 64)
+	p.ID = EventID(fields[4])
+
+	for _, err := range errs {
+		if err != nil {
+			return p, invalidArgumentf("malformed cursor %q", c)
+		}
+	}
+
+	return p, nil
+}
+
+// IsTimeOnly tells whether the position only bounds the save time, as returned by CursorFrom
+func (p Position) IsTimeOnly() bool {
+	return p.Version == 0 && p.Seq == 0 && p.ID == ""
+}
+
+// TypeQuery describes a read of the events of a given type, of several types or of all of them.
+// The events of several types come as one stream in the order of the store, and a cursor is a
+// position in that order whatever the types selected: a cursor of a read by Type continues a
+// read by Types, and the other way around
+type TypeQuery struct {
+	Type      EventType
+	Types     []EventType // several types read as one stream, in place of Type
+	TypeNames []string    // types selected by name, with Types or in place of Type
+	AllTypes  bool        // the events of all the types, in place of Type
+	After     Cursor      // continue after this position, empty to start from the first event
+	BatchSize int         // maximum number of events returned, 0 for the store default
+
+	// Settle leaves out the events saved less than Settle ago. Writes are not
+	// visible in save time order: an event can become visible after a later one
+	// was already read. Waiting for the writes to settle keeps the cursor from
+	// moving past an event that is about to show up. The Cassandra store never
+	// settles less than the deadline of its index writes plus the clock skew of
+	// its nodes, 3s by default, whatever the query asks for
+	Settle time.Duration
+}
+
+// types returns the types selected by the query, nil when it selects all of them
+func (q TypeQuery) types() []EventType {
+	if q.AllTypes {
+		return nil
+	}
+
+	if len(q.Types) == 0 {
+		return []EventType{q.Type}
+	}
+
+	seen := make(map[EventType]bool, len(q.Types))
+	types := make([]EventType, 0, len(q.Types))
+
+	for _, etype := range q.Types {
+		if !seen[etype] {
+			seen[etype] = true
+			types = append(types, etype)
+		}
+	}
+
+	return types
+}
+
+// resolve folds the names of the query into its types, as the codes bound to them
+// in the store or TypeCode for the names no event was written with yet
+func (q TypeQuery) resolve(bound map[string]EventType) TypeQuery {
+	if len(q.TypeNames) == 0 {
+		return q
+	}
+
+	types := append([]EventType(nil), q.Types...)
+
+	if len(types) == 0 && q.Type != 0 {
+		types = append(types, q.Type)
+	}
+
+	for _, name := range q.TypeNames {
+		code, ok := bound[name]
+
+		if !ok {
+			code = TypeCode(name)
+		}
+
+		types = append(types, code)
+	}
+
+	q.Types = types
+	q.TypeNames = nil
+
+	return q
+}
+
+// selects tells whether the query reads the events of the given type
+func (q TypeQuery) selects(etype EventType) bool {
+	if q.AllTypes {
+		return true
+	}
+
+	if len(q.Types) == 0 {
+		return etype == q.Type
+	}
+
+	for _, t := range q.Types {
+		if t == etype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate rejects the queries whose selection of types is ambiguous
+func (q TypeQuery) validate() error {
+	if q.AllTypes && (len(q.Types) > 0 || len(q.TypeNames) > 0) {
+		return invalidArgumentf("both all types and the types %v %v selected", q.Types, q.TypeNames)
+	}
+
+	for _, name := range q.TypeNames {
+		if !validTypeName(name) {
+			return invalidArgumentf("event type name %q", name)
+		}
+	}
+
+	if _, err := q.After.Decode(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// settleLimit returns the latest save time visible to the query, 0 for no limit
+func (q TypeQuery) settleLimit(now time.Time) int64 {
+	if q.Settle <= 0 {
+		return 0
+	}
+	return now.Add(-q.Settle).UnixNano() / int64(time.Millisecond)
+}
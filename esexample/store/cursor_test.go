@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	p := Position{SaveTime: 1000, Version: 3, ID: "uuid:with:colons", Seq: 7}
+
+	decoded, err := EncodeCursor(p).Decode()
+
+	if err != nil || decoded != p {
+		t.Errorf("unexpected position %+v, error %+v", decoded, err)
+	}
+
+	if p, err := CursorFrom(1000).Decode(); err != nil || !p.IsTimeOnly() || p.SaveTime != 1000 {
+		t.Errorf("unexpected time only position %+v, error %+v", p, err)
+	}
+
+	for _, c := range []Cursor{"not base64!", Cursor(EncodeCursor(p)[2:]), "YzI6MTowOjA6"} {
+		if _, err := c.Decode(); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("expected ErrInvalidArgument for %q, got %+v", c, err)
+		}
+	}
+}
+
+// events saved in the same millisecond must not be skipped between pages
+func TestMemStorePagesWithoutGaps(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+
+	if err := es.Update(ctx, "uuid1", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}, {Type: 1, Payload: EventPayload("{}")}, {Type: 2, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.Update(ctx, "uuid2", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	var read []StoreEvent
+	after := Cursor("")
+
+	for i := 0; i < 10; i++ {
+		events, next, err := es.GetEventsByType(ctx, TypeQuery{Type: 1, After: after, BatchSize: 1})
+
+		if err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		if len(events) == 0 {
+			if next != after {
+				t.Errorf("expected cursor to stay at %s, got %s", after, next)
+			}
+			break
+		}
+
+		read = append(read, events...)
+		after = next
+	}
+
+	if len(read) != 3 || read[0].Version != 1 || read[1].Version != 2 || read[2].ID != "uuid2" {
+		t.Errorf("unexpected events %+v", read)
+	}
+
+	// a time only cursor includes the events saved at that time
+	events, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1, After: CursorFrom(read[0].TimeStamp)})
+
+	if err != nil || len(events) != 3 {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+}
+
+func TestMemStoreSettle(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, next, err := es.GetEventsByType(ctx, TypeQuery{Type: 1, Settle: time.Hour})
+
+	if err != nil || len(events) != 0 || next != "" {
+		t.Errorf("expected no settled events, got %+v at %s, error %+v", events, next, err)
+	}
+
+	if _, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1, After: "garbage"}); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func TestTypeQueryTypes(t *testing.T) {
+	cases := []struct {
+		query TypeQuery
+		types []EventType
+		path  string
+	}{
+		{TypeQuery{Type: 3}, []EventType{3}, "3"},
+		{TypeQuery{Type: 3, Types: []EventType{1, 2, 1}}, []EventType{1, 2}, "1,2,1"},
+		{TypeQuery{AllTypes: true}, nil, "all"},
+		{TypeQuery{TypeNames: []string{"patient.admitted"}}, []EventType{7}, "patient.admitted"},
+		{TypeQuery{Type: 3, TypeNames: []string{"patient.admitted", "patient.left"}}, []EventType{3, 7, TypeCode("patient.left")}, "3,patient.admitted,patient.left"},
+	}
+
+	// the names are read as the codes they are bound to, or as TypeCode when not bound
+	bound := map[string]EventType{"patient.admitted": 7}
+
+	for _, c := range cases {
+		if types := c.query.resolve(bound).types(); !reflect.DeepEqual(types, c.types) {
+			t.Errorf("%+v: expected types %v, got %v", c.query, c.types, types)
+		}
+
+		if path := c.query.formatTypes(); path != c.path {
+			t.Errorf("%+v: expected path %q, got %q", c.query, c.path, path)
+		}
+
+		var parsed TypeQuery
+
+		if err := parsed.parseTypes(c.path); err != nil || !reflect.DeepEqual(parsed.resolve(bound).types(), c.types) {
+			t.Errorf("%q: expected types %v, got %v, error %+v", c.path, c.types, parsed.resolve(bound).types(), err)
+		}
+	}
+
+	var parsed TypeQuery
+
+	if err := parsed.parseTypes("1,admitted"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+}
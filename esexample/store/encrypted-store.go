@@ -0,0 +1,501 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The payloads of an EncryptedEventStore are sealed with AES-256-GCM under a data key of
+// their aggregate, the data keys themselves sealed by the key encryption key (KEK) of the
+// store and kept in a KeyStore: rotating the KEK only means unwrapping and wrapping the data
+// keys again, and shredding the data key of an aggregate makes its whole history unreadable
+// while the log stays append only. Each payload is bound to its aggregate and version, so
+// that a sealed payload can't be passed off as another event
+
+const (
+	// the content type of a payload sealed as a whole ends with encryptedSuffix, on top of
+	// gzipSuffix when it was compressed
+	encryptedSuffix = "+encrypted"
+
+	// the content type of a JSON payload with some of its fields sealed ends with fieldsSuffix,
+	// the sealed fields being gathered in the sealedField member of the payload
+	fieldsSuffix = "+encrypted-fields"
+	sealedField  = "$sealed"
+
+	dataKeySize = 32
+)
+
+// EncryptedEventStore seals the payloads of the events, and of the snapshots, of another store
+// with the data key of their aggregate, created on the first update of the aggregate.
+// The events of the types named in Fields only have these top level fields of their JSON
+// payload sealed, the other fields staying readable by whoever reads the store directly;
+// the other events, and the compressed or non JSON payloads, are sealed as a whole.
+// Find, FindRange and GetEventsByType open the payloads. The events of a shredded aggregate are
+// returned with Shredded set and without their sealed part, its updates fail with ErrShredded.
+// The events written in clear, before the store was encrypted, are returned as they are
+type EncryptedEventStore struct {
+	Keys   KeyStore
+	Fields map[string][]string // the sealed fields by type name
+
+	es  EventStore
+	kek cipher.AEAD
+}
+
+// initializer for an encrypting store on es, kek being the AES-256 key encryption key
+func NewEncryptedEventStore(es EventStore, keys KeyStore, kek []byte) (*EncryptedEventStore, error) {
+	if len(kek) != dataKeySize {
+		return nil, invalidArgumentf("key encryption key of %d bytes, expected %d", len(kek), dataKeySize)
+	}
+
+	aead, err := newAEAD(kek)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedEventStore{Keys: keys, Fields: map[string][]string{}, es: es, kek: aead}, nil
+}
+
+// Shred deletes the data key of the aggregate for good: its events stay in the log, unreadable
+func (es *EncryptedEventStore) Shred(ctx context.Context, guid EventID) error {
+	if guid == "" {
+		return invalidArgumentf("empty aggregate id")
+	}
+
+	return es.Keys.ShredDataKey(ctx, guid)
+}
+
+// @see EventStore.Find
+func (es *EncryptedEventStore) Find(ctx context.Context, guid EventID) ([]StoreEvent, error) {
+	events, err := es.es.Find(ctx, guid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return es.open(ctx, events)
+}
+
+// @see EventStore.FindRange
+func (es *EncryptedEventStore) FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error) {
+	events, err := es.es.FindRange(ctx, guid, r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return es.open(ctx, events)
+}
+
+// @see EventStore.GetEventsByType
+func (es *EncryptedEventStore) GetEventsByType(ctx context.Context, query TypeQuery) ([]StoreEvent, Cursor, error) {
+	events, next, err := es.es.GetEventsByType(ctx, query)
+
+	if err != nil {
+		return nil, query.After, err
+	}
+
+	if events, err = es.open(ctx, events); err != nil {
+		return nil, query.After, err
+	}
+
+	return events, next, nil
+}
+
+// @see EventStore.Update
+func (es *EncryptedEventStore) Update(ctx context.Context, guid EventID, expectedVersion int, events []StoreEvent) error {
+	if err := validateUpdate(guid, expectedVersion, events); err != nil {
+		return err
+	}
+
+	key, err := es.dataKey(ctx, guid, true)
+
+	// the key of a purged stream is shredded, its tombstone tells why it can't be written
+	if deleter, ok := es.es.(StreamDeleter); ok && errors.Is(err, ErrShredded) {
+		if deleted, _ := deleter.Tombstone(ctx, guid); deleted != nil {
+			return deleted
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]StoreEvent, len(events))
+
+	for i, e := range events {
+		// the versions the store is about to give to the events
+		if sealed[i], err = es.seal(key, guid, expectedVersion+i+1, e); err != nil {
+			return err
+		}
+	}
+
+	return es.es.Update(ctx, guid, expectedVersion, sealed)
+}
+
+// @see SnapshotStore.SaveSnapshot
+func (es *EncryptedEventStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	snapshots, ok := es.es.(SnapshotStore)
+
+	if !ok {
+		return fmt.Errorf("%w: snapshots", ErrNotSupported)
+	}
+
+	if err := validateSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	key, err := es.dataKey(ctx, snapshot.ID, true)
+
+	if err != nil {
+		return err
+	}
+
+	if snapshot.Payload, err = sealPayload(key, snapshot.Payload, snapshotData(snapshot.ID, snapshot.Version)); err != nil {
+		return err
+	}
+
+	return snapshots.SaveSnapshot(ctx, snapshot)
+}
+
+// @see SnapshotStore.LatestSnapshot. A snapshot which does not open, written in clear
+// or under a shredded key, is reported missing: the aggregate is rebuilt from its events
+func (es *EncryptedEventStore) LatestSnapshot(ctx context.Context, guid EventID) (*Snapshot, error) {
+	snapshots, ok := es.es.(SnapshotStore)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: snapshots", ErrNotSupported)
+	}
+
+	snapshot, err := snapshots.LatestSnapshot(ctx, guid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := es.dataKey(ctx, guid, false)
+
+	if errors.Is(err, ErrShredded) || errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w: no readable snapshot of aggregate %s", ErrNotFound, guid)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot.Payload, err = openPayload(key, snapshot.Payload, snapshotData(guid, snapshot.Version)); err != nil {
+		return nil, fmt.Errorf("%w: no readable snapshot of aggregate %s", ErrNotFound, guid)
+	}
+
+	return snapshot, nil
+}
+
+// @see StreamDeleter.DeleteStream
+func (es *EncryptedEventStore) DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error {
+	deleter, ok := es.es.(StreamDeleter)
+
+	if !ok {
+		return fmt.Errorf("%w: stream deletion", ErrNotSupported)
+	}
+
+	return deleter.DeleteStream(ctx, guid, expectedVersion)
+}
+
+// @see StreamDeleter.Tombstone
+func (es *EncryptedEventStore) Tombstone(ctx context.Context, guid EventID) (*DeletedError, error) {
+	deleter, ok := es.es.(StreamDeleter)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: stream deletion", ErrNotSupported)
+	}
+
+	return deleter.Tombstone(ctx, guid)
+}
+
+// @see StreamDeleter.PurgeStream. The data key of the aggregate is shredded as well,
+// so that the copies of its events left in the backups can't be read anymore
+func (es *EncryptedEventStore) PurgeStream(ctx context.Context, guid EventID) error {
+	deleter, ok := es.es.(StreamDeleter)
+
+	if !ok {
+		return fmt.Errorf("%w: stream deletion", ErrNotSupported)
+	}
+
+	if err := deleter.PurgeStream(ctx, guid); err != nil {
+		return err
+	}
+
+	return es.Shred(ctx, guid)
+}
+
+// @see StreamArchiver.ArchiveStream, the events are archived sealed
+func (es *EncryptedEventStore) ArchiveStream(ctx context.Context, guid EventID) error {
+	archiver, ok := es.es.(StreamArchiver)
+
+	if !ok {
+		return fmt.Errorf("%w: stream archival", ErrNotSupported)
+	}
+
+	return archiver.ArchiveStream(ctx, guid)
+}
+
+// @see EventTypeDirectory.EventTypeCodes
+func (es *EncryptedEventStore) EventTypeCodes(ctx context.Context, names []string) (map[string]EventType, error) {
+	if directory, ok := es.es.(EventTypeDirectory); ok {
+		return directory.EventTypeCodes(ctx, names)
+	}
+
+	return map[string]EventType{}, nil
+}
+
+// @see ChangeNotifier.Changed, a nil channel when the store does not notify
+func (es *EncryptedEventStore) Changed() <-chan struct{} {
+	if notifier, ok := es.es.(ChangeNotifier); ok {
+		return notifier.Changed()
+	}
+
+	return nil
+}
+
+// dataKey returns the cipher of the data key of the aggregate, creating the key when create is set
+func (es *EncryptedEventStore) dataKey(ctx context.Context, guid EventID, create bool) (cipher.AEAD, error) {
+	wrapped, err := es.Keys.DataKey(ctx, guid)
+
+	if errors.Is(err, ErrNotFound) && create {
+		key := make([]byte, dataKeySize)
+
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+
+		if wrapped, err = sealPayload(es.kek, key, []byte(guid)); err != nil {
+			return nil, err
+		}
+
+		wrapped, err = es.Keys.CreateDataKey(ctx, guid, wrapped)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := openPayload(es.kek, wrapped, []byte(guid))
+
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping the data key of aggregate %s: %w", guid, err)
+	}
+
+	return newAEAD(key)
+}
+
+// seal seals the payload of an event, or the fields of its type
+func (es *EncryptedEventStore) seal(key cipher.AEAD, guid EventID, version int, e StoreEvent) (StoreEvent, error) {
+	data := eventData(guid, version)
+	fields := es.Fields[e.TypeName]
+
+	if len(fields) > 0 && (e.ContentType == "" || e.ContentType == ContentTypeJSON) {
+		if payload, ok, err := sealFields(key, e.Payload, fields, data); err != nil || ok {
+			e.Payload = payload
+			e.ContentType += fieldsSuffix
+			return e, err
+		}
+	}
+
+	payload, err := sealPayload(key, e.Payload, data)
+
+	if err != nil {
+		return e, err
+	}
+
+	// an empty content type is kept empty, for the reader to tell the legacy payloads
+	e.Payload = payload
+	e.ContentType += encryptedSuffix
+
+	return e, nil
+}
+
+// open opens the payloads of the events, reading the key of each aggregate once
+func (es *EncryptedEventStore) open(ctx context.Context, events []StoreEvent) ([]StoreEvent, error) {
+	keys := map[EventID]cipher.AEAD{}
+	opened := make([]StoreEvent, 0, len(events))
+
+	for _, e := range events {
+		sealedWhole := strings.HasSuffix(e.ContentType, encryptedSuffix)
+
+		if !sealedWhole && !strings.HasSuffix(e.ContentType, fieldsSuffix) {
+			opened = append(opened, e)
+			continue
+		}
+
+		key, ok := keys[e.ID]
+
+		if !ok {
+			var err error
+
+			// a shredded aggregate has a nil key
+			if key, err = es.dataKey(ctx, e.ID, false); err != nil && !errors.Is(err, ErrShredded) {
+				return nil, err
+			}
+
+			keys[e.ID] = key
+		}
+
+		var err error
+		data := eventData(e.ID, e.Version)
+
+		switch {
+		case sealedWhole:
+			e.ContentType = strings.TrimSuffix(e.ContentType, encryptedSuffix)
+			if key != nil {
+				e.Payload, err = openPayload(key, e.Payload, data)
+			} else {
+				e.Payload = nil
+			}
+		default:
+			e.ContentType = strings.TrimSuffix(e.ContentType, fieldsSuffix)
+			e.Payload, err = openFields(key, e.Payload, data)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decrypting event %s version %d: %w", e.ID, e.Version, err)
+		}
+
+		e.Shredded = key == nil
+		opened = append(opened, e)
+	}
+
+	return opened, nil
+}
+
+// sealFields moves the fields of a JSON object into its sealedField member, sealed.
+// ok is false when the payload is not an object or has none of the fields
+func sealFields(key cipher.AEAD, payload EventPayload, fields []string, data []byte) (EventPayload, bool, error) {
+	var members map[string]json.RawMessage
+
+	if err := json.Unmarshal(payload, &members); err != nil || members == nil {
+		return payload, false, nil
+	}
+
+	if _, ok := members[sealedField]; ok {
+		return nil, false, invalidArgumentf("payload with a %s member", sealedField)
+	}
+
+	selected := map[string]json.RawMessage{}
+
+	for _, field := range fields {
+		if value, ok := members[field]; ok {
+			selected[field] = value
+			delete(members, field)
+		}
+	}
+
+	if len(selected) == 0 {
+		return payload, false, nil
+	}
+
+	plain, err := json.Marshal(selected)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	sealed, err := sealPayload(key, plain, data)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if members[sealedField], err = json.Marshal(sealed); err != nil {
+		return nil, false, err
+	}
+
+	b, err := json.Marshal(members)
+
+	return EventPayload(b), true, err
+}
+
+// openFields puts back the fields sealed by sealFields, or drops them when the key is nil
+func openFields(key cipher.AEAD, payload EventPayload, data []byte) (EventPayload, error) {
+	var members map[string]json.RawMessage
+
+	if err := json.Unmarshal(payload, &members); err != nil {
+		return nil, err
+	}
+
+	var sealed []byte
+
+	if err := json.Unmarshal(members[sealedField], &sealed); err != nil {
+		return nil, err
+	}
+
+	delete(members, sealedField)
+
+	if key != nil {
+		plain, err := openPayload(key, sealed, data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var selected map[string]json.RawMessage
+
+		if err := json.Unmarshal(plain, &selected); err != nil {
+			return nil, err
+		}
+
+		for field, value := range selected {
+			members[field] = value
+		}
+	}
+
+	b, err := json.Marshal(members)
+
+	return EventPayload(b), err
+}
+
+// sealPayload seals the plain text under the key, the random nonce ahead of the cipher text
+func sealPayload(key cipher.AEAD, plain []byte, data []byte) ([]byte, error) {
+	nonce := make([]byte, key.NonceSize(), key.NonceSize()+len(plain)+key.Overhead())
+
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return key.Seal(nonce, nonce, plain, data), nil
+}
+
+// openPayload opens a payload sealed by sealPayload
+func openPayload(key cipher.AEAD, sealed []byte, data []byte) ([]byte, error) {
+	if len(sealed) < key.NonceSize() {
+		return nil, errors.New("sealed payload shorter than its nonce")
+	}
+
+	return key.Open(nil, sealed[:key.NonceSize()], sealed[key.NonceSize():], data)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// eventData is the additional data the payload of an event is bound to
+func eventData(guid EventID, version int) []byte {
+	return []byte(fmt.Sprintf("event/%s/%d", guid, version))
+}
+
+// snapshotData is the additional data the payload of a snapshot is bound to
+func snapshotData(guid EventID, version int) []byte {
+	return []byte(fmt.Sprintf("snapshot/%s/%d", guid, version))
+}
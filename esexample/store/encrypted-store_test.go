@@ -0,0 +1,353 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+func newEncryptedTestStore(t *testing.T) (*EncryptedEventStore, *MemEventStore) {
+	keys, err := NewFileKeyring("")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	inner := NewInMemStore()
+	es, err := NewEncryptedEventStore(inner, keys, bytes.Repeat([]byte{7}, 32))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	es.Fields["patient.admitted"] = []string{"name", "age"}
+
+	return es, inner
+}
+
+func TestEncryptedStoreSealsPayloads(t *testing.T) {
+	ctx := context.Background()
+	es, inner := newEncryptedTestStore(t)
+
+	events := []StoreEvent{
+		{Type: 1, TypeName: "patient.admitted", ContentType: ContentTypeJSON, Payload: EventPayload(`{"age":42,"name":"Ann","ward":3}`)},
+		{Type: 2, TypeName: "patient.transferred", ContentType: ContentTypeJSON, Payload: EventPayload(`{"new_ward":4}`)},
+	}
+
+	if err := es.Update(ctx, "uuid", 0, events); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	stored, _ := inner.Find(ctx, "uuid")
+
+	// the fields of the admission are sealed, the ward left in clear
+	if payload := string(stored[0].Payload); stored[0].ContentType != ContentTypeJSON+fieldsSuffix ||
+		strings.Contains(payload, `"name"`) || strings.Contains(payload, `"age"`) || !strings.Contains(payload, `"ward":3`) {
+		t.Errorf("unexpected stored event %+v", stored[0])
+	}
+
+	if stored[1].ContentType != ContentTypeJSON+encryptedSuffix || strings.Contains(string(stored[1].Payload), "new_ward") {
+		t.Errorf("unexpected stored event %+v", stored[1])
+	}
+
+	found, err := es.Find(ctx, "uuid")
+
+	if err != nil || len(found) != 2 {
+		t.Fatalf("unexpected events %+v, error %+v", found, err)
+	}
+
+	for i, e := range found {
+		if string(e.Payload) != string(events[i].Payload) || e.ContentType != ContentTypeJSON || e.Shredded {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+
+	byType, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1})
+
+	if err != nil || len(byType) != 1 || string(byType[0].Payload) != string(events[0].Payload) {
+		t.Errorf("unexpected events %+v, error %+v", byType, err)
+	}
+}
+
+// the commands the wrapped store can't carry out are not supported, not internal errors
+func TestEncryptedStoreNotSupported(t *testing.T) {
+	ctx := context.Background()
+	keys, _ := NewFileKeyring("")
+	es, err := NewEncryptedEventStore(struct{ EventStore }{NewInMemStore()}, keys, bytes.Repeat([]byte{7}, 32))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.DeleteStream(ctx, "uuid", 1); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("deletion: expected ErrNotSupported, got %+v", err)
+	}
+
+	if err := es.SaveSnapshot(ctx, Snapshot{ID: "uuid", Version: 1}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("snapshot: expected ErrNotSupported, got %+v", err)
+	}
+}
+
+func TestEncryptedStoreReadsClearEvents(t *testing.T) {
+	ctx := context.Background()
+	es, inner := newEncryptedTestStore(t)
+
+	// written before the store was encrypted
+	if err := inner.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload(`{"name":"Ann"}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.Update(ctx, "uuid", 1, []StoreEvent{{Type: 2, Payload: EventPayload(`{"new_ward":4}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	found, err := es.Find(ctx, "uuid")
+
+	if err != nil || len(found) != 2 || string(found[0].Payload) != `{"name":"Ann"}` || string(found[1].Payload) != `{"new_ward":4}` || found[1].ContentType != "" {
+		t.Errorf("unexpected events %+v, error %+v", found, err)
+	}
+}
+
+func TestEncryptedPayloadsBoundToTheirEvent(t *testing.T) {
+	key, _ := newAEAD(bytes.Repeat([]byte{1}, 32))
+	sealed, err := sealPayload(key, []byte(`{}`), eventData("uuid", 1))
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if _, err := openPayload(key, sealed, eventData("uuid", 2)); err == nil {
+		t.Error("expected the payload of version 1 not to open as version 2")
+	}
+
+	if _, err := openPayload(key, sealed, eventData("other", 1)); err == nil {
+		t.Error("expected the payload not to open as the event of another aggregate")
+	}
+
+	if _, err := NewEncryptedEventStore(NewInMemStore(), nil, []byte("short")); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func TestShreddedAggregate(t *testing.T) {
+	ctx := context.Background()
+	es, _ := newEncryptedTestStore(t)
+
+	events := []StoreEvent{
+		{Type: 1, TypeName: "patient.admitted", Payload: EventPayload(`{"age":42,"name":"Ann","ward":3}`)},
+		{Type: 2, Payload: EventPayload(`{"new_ward":4}`)},
+	}
+
+	if err := es.Update(ctx, "uuid", 0, events); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.SaveSnapshot(ctx, Snapshot{ID: "uuid", Version: 2, SchemaVersion: 1, Payload: EventPayload("4")}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if snapshot, err := es.LatestSnapshot(ctx, "uuid"); err != nil || string(snapshot.Payload) != "4" {
+		t.Fatalf("unexpected snapshot %+v, error %+v", snapshot, err)
+	}
+
+	if err := es.Shred(ctx, "uuid"); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	found, err := es.Find(ctx, "uuid")
+
+	if err != nil || len(found) != 2 {
+		t.Fatalf("unexpected events %+v, error %+v", found, err)
+	}
+
+	// the fields in clear are left, the sealed payloads are gone
+	if !found[0].Shredded || string(found[0].Payload) != `{"ward":3}` || !found[1].Shredded || found[1].Payload != nil {
+		t.Errorf("unexpected events %+v", found)
+	}
+
+	if byType, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 2}); err != nil || len(byType) != 1 || !byType[0].Shredded {
+		t.Errorf("unexpected events %+v, error %+v", byType, err)
+	}
+
+	if err := es.Update(ctx, "uuid", 2, events[1:]); !errors.Is(err, ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+
+	if _, err := es.LatestSnapshot(ctx, "uuid"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+
+	// the aggregate can't be loaded anymore
+	if _, err := newCounterRepository(es).Load(ctx, "uuid"); !errors.Is(err, ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+}
+
+func TestFileKeyring(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "keyring")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring.json")
+	keys, err := NewFileKeyring(path)
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if _, err := keys.DataKey(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+
+	// the first key created wins
+	for _, wrapped := range []string{"first", "second"} {
+		if key, err := keys.CreateDataKey(ctx, "a", []byte(wrapped)); err != nil || string(key) != "first" {
+			t.Errorf("unexpected key %q, error %+v", key, err)
+		}
+	}
+
+	if _, err := keys.CreateDataKey(ctx, "b", []byte("b")); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := keys.ShredDataKey(ctx, "b"); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	reopened, err := NewFileKeyring(path)
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if key, err := reopened.DataKey(ctx, "a"); err != nil || string(key) != "first" {
+		t.Errorf("unexpected key %q, error %+v", key, err)
+	}
+
+	if _, err := reopened.DataKey(ctx, "b"); !errors.Is(err, ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+
+	if _, err := reopened.CreateDataKey(ctx, "b", []byte("again")); !errors.Is(err, ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+
+	// the shredded key is not left in the file
+	if data, _ := ioutil.ReadFile(path); bytes.Contains(data, []byte(`"b":"Yg=="`)) {
+		t.Errorf("shredded key left in %s", data)
+	}
+}
+
+// two processes share a keyring, as a server and es-shred do
+func TestFileKeyringShared(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "keyring")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring.json")
+	server, _ := NewFileKeyring(path)
+	shredder, _ := NewFileKeyring(path)
+
+	if _, err := server.CreateDataKey(ctx, "a", []byte("a")); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := shredder.ShredDataKey(ctx, "a"); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// the server reads the shredding and keeps it when saving its own keys
+	if _, err := server.DataKey(ctx, "a"); !errors.Is(err, ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+
+	if _, err := server.CreateDataKey(ctx, "b", []byte("b")); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	reopened, _ := NewFileKeyring(path)
+
+	if _, err := reopened.DataKey(ctx, "a"); !errors.Is(err, ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+
+	if key, err := shredder.DataKey(ctx, "b"); err != nil || string(key) != "b" {
+		t.Errorf("unexpected key %q, error %+v", key, err)
+	}
+}
+
+func TestCassandraKeyStore(t *testing.T) {
+	ctx := context.Background()
+	es, _ := newFakeCassandraStore(&CassandraEventStoreConfig{})
+
+	if _, err := es.DataKey(ctx, fakeUUID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+
+	for _, wrapped := range []string{"first", "second"} {
+		if key, err := es.CreateDataKey(ctx, fakeUUID, []byte(wrapped)); err != nil || string(key) != "first" {
+			t.Errorf("unexpected key %q, error %+v", key, err)
+		}
+	}
+
+	if key, err := es.DataKey(ctx, fakeUUID); err != nil || string(key) != "first" {
+		t.Errorf("unexpected key %q, error %+v", key, err)
+	}
+
+	if err := es.ShredDataKey(ctx, fakeUUID); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if _, err := es.DataKey(ctx, fakeUUID); !errors.Is(err, ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+
+	if _, err := es.CreateDataKey(ctx, fakeUUID, []byte("again")); !errors.Is(err, ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+
+	if _, err := es.DataKey(ctx, "not-a-uuid"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+
+	// an aggregate shredded before it got a key never gets one, shredding again does nothing
+	other := EventID("1d8f5a6e-3f4c-4f0e-9b8e-6a1c2d3e4f50")
+
+	for i := 0; i < 2; i++ {
+		if err := es.ShredDataKey(ctx, other); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	if _, err := es.CreateDataKey(ctx, other, []byte("first")); !errors.Is(err, ErrShredded) {
+		t.Errorf("expected ErrShredded, got %+v", err)
+	}
+
+	// the keys are read at the serial consistency of the transactions writing them
+	if es.serialRead != gocql.Consistency(gocql.Serial) {
+		t.Errorf("unexpected consistency %v", es.serialRead)
+	}
+
+	local, _ := newFakeCassandraStore(&CassandraEventStoreConfig{SerialConsistency: "local_serial"})
+
+	if local.serialRead != gocql.Consistency(gocql.LocalSerial) {
+		t.Errorf("unexpected consistency %v", local.serialRead)
+	}
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrConcurrencyConflict is returned when the expected version of an
+	// aggregate does not match the version found in the store
+	ErrConcurrencyConflict = errors.New("concurrency conflict")
+
+	// ErrNotFound is returned when the requested aggregate has no events
+	ErrNotFound = errors.New("not found")
+
+	// ErrInvalidArgument is returned when a request is malformed
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrUnavailable is returned when the store can't be reached or
+	// can't satisfy the requested consistency; the call may be retried
+	ErrUnavailable = errors.New("store unavailable")
+
+	// ErrShredded is returned when the data key of an aggregate was shredded:
+	// its payloads can't be decrypted anymore and its stream can't grow
+	ErrShredded = errors.New("shredded")
+
+	// ErrDeleted is returned when the stream of an aggregate was deleted, see DeletedError
+	ErrDeleted = errors.New("deleted")
+
+	// ErrRetained is returned when a deleted stream is purged before its retention elapsed
+	ErrRetained = errors.New("retained")
+
+	// ErrAdminDisabled is returned by the clients for the commands retiring the streams
+	// when no admin address of the server is configured
+	ErrAdminDisabled = errors.New("admin commands disabled")
+
+	// ErrNotSupported is returned for a command the store can't carry out, such as
+	// deleting the streams of a store wrapping one without stream deletion
+	ErrNotSupported = errors.New("not supported")
+)
+
+// ConcurrencyError carries the versions involved in an optimistic locking failure.
+// It matches ErrConcurrencyConflict with errors.Is
+type ConcurrencyError struct {
+	ID       EventID
+	Expected int
+	Actual   int // -1 when the store can't tell
+}
+
+func (e *ConcurrencyError) Error() string {
+	if e.Actual < 0 {
+		return fmt.Sprintf("%v: aggregate %s expected at version %d", ErrConcurrencyConflict, e.ID, e.Expected)
+	}
+	return fmt.Sprintf("%v: aggregate %s expected at version %d, found %d", ErrConcurrencyConflict, e.ID, e.Expected, e.Actual)
+}
+
+func (e *ConcurrencyError) Is(target error) bool {
+	return target == ErrConcurrencyConflict
+}
+
+// NewConcurrencyError returns the error reported when an aggregate is not at the expected version
+func NewConcurrencyError(guid EventID, expected int, actual int) error {
+	return &ConcurrencyError{ID: guid, Expected: expected, Actual: actual}
+}
+
+// DeletedError carries the tombstone of a deleted stream. It matches ErrDeleted with errors.Is
+type DeletedError struct {
+	ID        EventID
+	Version   int   // version of the stream when it was deleted
+	TimeStamp int64 // deletion time in millis
+}
+
+func (e *DeletedError) Error() string {
+	return fmt.Sprintf("%v: aggregate %s deleted at version %d on %s", ErrDeleted, e.ID, e.Version, time.Unix(0, e.TimeStamp*int64(time.Millisecond)).UTC().Format(time.RFC3339))
+}
+
+func (e *DeletedError) Is(target error) bool {
+	return target == ErrDeleted
+}
+
+// NewDeletedError returns the error reported when the stream of an aggregate is deleted
+func NewDeletedError(guid EventID, version int, deleted int64) error {
+	return &DeletedError{ID: guid, Version: version, TimeStamp: deleted}
+}
+
+// remoteError keeps the message received over the wire while still
+// matching the sentinel error it was mapped to
+type remoteError struct {
+	sentinel error
+	message  string
+}
+
+func (e *remoteError) Error() string {
+	return e.message
+}
+
+func (e *remoteError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func invalidArgumentf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidArgument, fmt.Sprintf(format, args...))
+}
+
+func notFound(guid EventID) error {
+	return fmt.Errorf("%w: aggregate %s", ErrNotFound, guid)
+}
+
+func unavailable(err error) error {
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
+
+// validateUpdate checks the arguments shared by every EventStore.Update implementation
+func validateUpdate(guid EventID, expectedVersion int, events []StoreEvent) error {
+	if guid == "" {
+		return invalidArgumentf("empty aggregate id")
+	}
+
+	if expectedVersion < 0 {
+		return invalidArgumentf("negative expected version %d", expectedVersion)
+	}
+
+	if len(events) == 0 {
+		return invalidArgumentf("no events to store for aggregate %s", guid)
+	}
+
+	for _, e := range events {
+		if e.SchemaVersion < 0 {
+			return invalidArgumentf("negative schema version %d of an event of aggregate %s", e.SchemaVersion, guid)
+		}
+	}
+
+	if _, err := typeBindings(events); err != nil {
+		return fmt.Errorf("aggregate %s: %w", guid, err)
+	}
+
+	return nil
+}
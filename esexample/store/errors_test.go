@@ -0,0 +1,103 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestMemStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+
+	if _, err := es.Find(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+
+	if err := es.Update(ctx, "uuid", 0, nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+
+	events := []StoreEvent{{ID: "uuid", Type: 1, Payload: EventPayload("{}")}}
+
+	if err := es.Update(ctx, "uuid", 0, events); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	err := es.Update(ctx, "uuid", 0, events)
+
+	var conflict *ConcurrencyError
+	if !errors.Is(err, ErrConcurrencyConflict) || !errors.As(err, &conflict) {
+		t.Fatalf("expected ConcurrencyError, got %+v", err)
+	}
+
+	if conflict.Expected != 0 || conflict.Actual != 1 {
+		t.Errorf("unexpected versions in %+v", conflict)
+	}
+}
+
+func TestErrorsSurviveGrpc(t *testing.T) {
+	for _, sentinel := range []error{ErrNotFound, ErrInvalidArgument, ErrUnavailable, ErrConcurrencyConflict, ErrShredded, ErrRetained, context.DeadlineExceeded} {
+		err := fromGrpcError(GrpcStatusError(sentinel))
+
+		if !errors.Is(err, sentinel) {
+			t.Errorf("expected %v after round trip, got %+v", sentinel, err)
+		}
+	}
+
+	err := fromGrpcError(GrpcStatusError(NewConcurrencyError("uuid", 3, 5)))
+
+	var conflict *ConcurrencyError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected ConcurrencyError, got %+v", err)
+	}
+
+	if *conflict != (ConcurrencyError{ID: "uuid", Expected: 3, Actual: 5}) {
+		t.Errorf("unexpected conflict %+v", conflict)
+	}
+
+	var deleted *DeletedError
+	if err := fromGrpcError(GrpcStatusError(NewDeletedError("uuid", 4, 1000))); !errors.As(err, &deleted) || !errors.Is(err, ErrDeleted) {
+		t.Fatalf("expected DeletedError, got %+v", err)
+	}
+
+	if *deleted != (DeletedError{ID: "uuid", Version: 4, TimeStamp: 1000}) {
+		t.Errorf("unexpected tombstone %+v", deleted)
+	}
+}
+
+func TestErrorsSurviveHTTP(t *testing.T) {
+	roundTrip := func(err error) error {
+		status, body := NewHTTPError(err)
+		data, _ := json.Marshal(body)
+		return errorFromResponse(&http.Response{StatusCode: status, Body: ioutil.NopCloser(bytes.NewReader(data))})
+	}
+
+	for _, sentinel := range []error{ErrNotFound, ErrInvalidArgument, ErrUnavailable, ErrConcurrencyConflict, ErrShredded, ErrRetained, context.DeadlineExceeded} {
+		if err := roundTrip(sentinel); !errors.Is(err, sentinel) {
+			t.Errorf("expected %v after round trip, got %+v", sentinel, err)
+		}
+	}
+
+	var conflict *ConcurrencyError
+	if err := roundTrip(NewConcurrencyError("uuid", 3, 5)); !errors.As(err, &conflict) {
+		t.Fatalf("expected ConcurrencyError, got %+v", err)
+	}
+
+	if *conflict != (ConcurrencyError{ID: "uuid", Expected: 3, Actual: 5}) {
+		t.Errorf("unexpected conflict %+v", conflict)
+	}
+
+	var deleted *DeletedError
+	if err := roundTrip(NewDeletedError("uuid", 4, 1000)); !errors.As(err, &deleted) {
+		t.Fatalf("expected DeletedError, got %+v", err)
+	}
+
+	if *deleted != (DeletedError{ID: "uuid", Version: 4, TimeStamp: 1000}) {
+		t.Errorf("unexpected tombstone %+v", deleted)
+	}
+}
@@ -1,14 +1,23 @@
 package store
 
+import "context"
+
 type EventStore interface {
 	// find all events for given ID (aggregate).
 	// returns event list as well as aggregate version
-	Find(guid EventID) ([]StoreEvent, error)
+	Find(ctx context.Context, guid EventID) ([]StoreEvent, error)
+
+	// find the events of an aggregate within the given range, for incremental
+	// rehydration and point in time views. An aggregate whose events all fall
+	// outside the range gives an empty list, an unknown aggregate ErrNotFound
+	FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error)
 
 	// Update an aggregate with new events. If the version specified
 	// does not match with the version in the Event Store, an error is returned
-	Update(guid EventID, expectedVersion int, events []StoreEvent) error
+	Update(ctx context.Context, guid EventID, expectedVersion int, events []StoreEvent) error
 
-	// Get events of a given type from Event Store
-	GetEventsByType(etype EventType, since int64, batchSize int) ([]StoreEvent, int64, error)
+	// Get events of a given type, of several types or of all types from Event Store, following
+	// the position of query.After. returns the events as well as the cursor to continue from,
+	// which is query.After when there are no new events
+	GetEventsByType(ctx context.Context, query TypeQuery) ([]StoreEvent, Cursor, error)
 }
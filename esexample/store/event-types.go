@@ -0,0 +1,315 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+// The event types are known by stable names, as "patient.admitted", and stored by code.
+// The code of a name is TypeCode(name) unless it was registered with a code of its own,
+// as the types written before the names were. The stores record the name with the events
+// and bind each name to the code of its first event, for good: an event whose name is
+// bound to another code, or whose code is bound to another name, is refused. A query
+// by name reads the code the name is bound to, or TypeCode(name) if no event of the type
+// was written yet
+
+// the codes below are left to the types registered with a code of their own
+const reservedTypeCodes = 1 << 16
+
+var typeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)+$`)
+
+// validTypeName tells whether the name is made of dotted lowercase words, as "patient.admitted"
+func validTypeName(name string) bool {
+	return typeNamePattern.MatchString(name)
+}
+
+// TypeCode returns the code of an event type derived from its name, out of the reserved codes
+func TypeCode(name string) EventType {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	code := EventType(h.Sum32() & 0x7fffffff)
+
+	if code < reservedTypeCodes {
+		code += reservedTypeCodes
+	}
+
+	return code
+}
+
+// RegisteredType is an event type known by its name
+type RegisteredType struct {
+	Name  string       // stable name of the type, as "patient.admitted"
+	Code  EventType    // code of the type in the store, TypeCode(Name) when 0
+	New   func() Event // a blank event of the type, to decode into
+	Codec EventCodec   // codec of the payloads, the one of the repository when nil
+}
+
+// EventTypeRegistry maps the names of the event types to their codes, Go types and codecs
+type EventTypeRegistry struct {
+	byName   map[string]*RegisteredType
+	byCode   map[EventType]*RegisteredType
+	byGoType map[reflect.Type]*RegisteredType
+}
+
+// initializer for an empty registry
+func NewEventTypeRegistry() *EventTypeRegistry {
+	return &EventTypeRegistry{
+		byName:   map[string]*RegisteredType{},
+		byCode:   map[EventType]*RegisteredType{},
+		byGoType: map[reflect.Type]*RegisteredType{},
+	}
+}
+
+// Register adds an event type, refusing a name, a code or a Go type already registered
+func (r *EventTypeRegistry) Register(t RegisteredType) error {
+	if !validTypeName(t.Name) {
+		return invalidArgumentf("event type name %q", t.Name)
+	}
+
+	if t.Code == 0 {
+		t.Code = TypeCode(t.Name)
+	}
+
+	if t.New == nil {
+		return invalidArgumentf("event type %s without a constructor", t.Name)
+	}
+
+	e := t.New()
+	goType := reflect.TypeOf(e)
+
+	if e.GetEventType() != t.Code {
+		return invalidArgumentf("event type %s registered with code %d, its events have code %d", t.Name, t.Code, e.GetEventType())
+	}
+
+	if other, ok := r.byName[t.Name]; ok {
+		return invalidArgumentf("event type %s registered twice, with codes %d and %d", t.Name, other.Code, t.Code)
+	}
+
+	if other, ok := r.byCode[t.Code]; ok {
+		return invalidArgumentf("event types %s and %s have the same code %d", other.Name, t.Name, t.Code)
+	}
+
+	if other, ok := r.byGoType[goType]; ok {
+		return invalidArgumentf("event types %s and %s have the same Go type %v", other.Name, t.Name, goType)
+	}
+
+	r.byName[t.Name] = &t
+	r.byCode[t.Code] = &t
+	r.byGoType[goType] = &t
+
+	return nil
+}
+
+// MustRegister registers the types, panicking on a collision, as done at startup
+func (r *EventTypeRegistry) MustRegister(types ...RegisteredType) *EventTypeRegistry {
+	for _, t := range types {
+		if err := r.Register(t); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// CheckBindings refuses the types whose names the store bound to other codes, as the events
+// of such a type could not be saved, so that the collision fails at startup. The stores not
+// recording the names of the types have nothing to check
+func (r *EventTypeRegistry) CheckBindings(ctx context.Context, es EventStore) error {
+	directory, ok := es.(EventTypeDirectory)
+
+	if !ok || len(r.byName) == 0 {
+		return nil
+	}
+
+	bound, err := directory.EventTypeCodes(ctx, r.Names())
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range r.Names() {
+		if code, ok := bound[name]; ok && code != r.byName[name].Code {
+			return typeConflict(name, r.byName[name].Code, name, code)
+		}
+	}
+
+	return nil
+}
+
+// Lookup returns the type of the given code
+func (r *EventTypeRegistry) Lookup(code EventType) (RegisteredType, bool) {
+	if t, ok := r.byCode[code]; ok {
+		return *t, true
+	}
+	return RegisteredType{}, false
+}
+
+// LookupName returns the type of the given name
+func (r *EventTypeRegistry) LookupName(name string) (RegisteredType, bool) {
+	if t, ok := r.byName[name]; ok {
+		return *t, true
+	}
+	return RegisteredType{}, false
+}
+
+// Names returns the names of the registered types, sorted
+func (r *EventTypeRegistry) Names() []string {
+	names := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Mapper returns the mapper of the codes of the registered types to their events
+func (r *EventTypeRegistry) Mapper() EventTypeToEventMapper {
+	return func(code EventType) (Event, error) {
+		t, ok := r.byCode[code]
+
+		if !ok {
+			return nil, fmt.Errorf("Event type not found %d", code)
+		}
+
+		return t.New(), nil
+	}
+}
+
+// EventTypeDirectory is implemented by the stores recording the names of the event types
+type EventTypeDirectory interface {
+	// EventTypeCodes returns the codes the names are bound to, leaving out the names not bound yet
+	EventTypeCodes(ctx context.Context, names []string) (map[string]EventType, error)
+}
+
+// ResolveTypeNames returns the codes of the named types in the store, TypeCode for the
+// names not bound yet or when the store does not record the names
+func ResolveTypeNames(ctx context.Context, es EventStore, names []string) (map[string]EventType, error) {
+	bound := map[string]EventType{}
+
+	for _, name := range names {
+		if !validTypeName(name) {
+			return nil, invalidArgumentf("event type name %q", name)
+		}
+	}
+
+	if directory, ok := es.(EventTypeDirectory); ok && len(names) > 0 {
+		var err error
+
+		if bound, err = directory.EventTypeCodes(ctx, names); err != nil {
+			return nil, err
+		}
+	}
+
+	codes := make(map[string]EventType, len(names))
+
+	for _, name := range names {
+		if code, ok := bound[name]; ok {
+			codes[name] = code
+		} else {
+			codes[name] = TypeCode(name)
+		}
+	}
+
+	return codes, nil
+}
+
+// resolveTypeNames folds the names selected by the query into its types
+func resolveTypeNames(ctx context.Context, directory EventTypeDirectory, query TypeQuery) (TypeQuery, error) {
+	if len(query.TypeNames) == 0 {
+		return query, nil
+	}
+
+	bound, err := directory.EventTypeCodes(ctx, query.TypeNames)
+
+	if err != nil {
+		return query, err
+	}
+
+	return query.resolve(bound), nil
+}
+
+// typeBindings returns the names of the events bound to their codes,
+// refusing a name given with two codes or a code with two names
+func typeBindings(events []StoreEvent) (map[string]EventType, error) {
+	bindings := map[string]EventType{}
+	names := map[EventType]string{}
+
+	for _, e := range events {
+		if e.TypeName == "" {
+			continue
+		}
+
+		if !validTypeName(e.TypeName) {
+			return nil, invalidArgumentf("event type name %q", e.TypeName)
+		}
+
+		if code, ok := bindings[e.TypeName]; ok && code != e.Type {
+			return nil, invalidArgumentf("event type %s given with codes %d and %d", e.TypeName, code, e.Type)
+		}
+
+		if name, ok := names[e.Type]; ok && name != e.TypeName {
+			return nil, invalidArgumentf("event types %s and %s given with the same code %d", name, e.TypeName, e.Type)
+		}
+
+		bindings[e.TypeName] = e.Type
+		names[e.Type] = e.TypeName
+	}
+
+	return bindings, nil
+}
+
+// typeConflict is the error of a name bound to another code, or of a code bound to another name
+func typeConflict(name string, code EventType, boundName string, boundCode EventType) error {
+	if boundName != name {
+		return invalidArgumentf("event type code %d is bound to %s, not to %s", code, boundName, name)
+	}
+	return invalidArgumentf("event type %s is bound to code %d, not to %d", name, boundCode, code)
+}
+
+// typeDirectory is the directory of the stores keeping it in memory, not safe for concurrent use
+type typeDirectory struct {
+	codes map[string]EventType
+	names map[EventType]string
+}
+
+func newTypeDirectory() *typeDirectory {
+	return &typeDirectory{codes: map[string]EventType{}, names: map[EventType]string{}}
+}
+
+// check refuses the bindings which collide with the ones of the directory
+func (d *typeDirectory) check(bindings map[string]EventType) error {
+	for name, code := range bindings {
+		if bound, ok := d.codes[name]; ok && bound != code {
+			return typeConflict(name, code, name, bound)
+		}
+
+		if bound, ok := d.names[code]; ok && bound != name {
+			return typeConflict(name, code, bound, code)
+		}
+	}
+
+	return nil
+}
+
+func (d *typeDirectory) bind(bindings map[string]EventType) {
+	for name, code := range bindings {
+		d.codes[name] = code
+		d.names[code] = name
+	}
+}
+
+func (d *typeDirectory) lookup(names []string) map[string]EventType {
+	bound := map[string]EventType{}
+
+	for _, name := range names {
+		if code, ok := d.codes[name]; ok {
+			bound[name] = code
+		}
+	}
+
+	return bound
+}
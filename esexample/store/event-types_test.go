@@ -0,0 +1,203 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// otherEvent is an event of any code, to collide with the registered types
+type otherEvent struct{ code EventType }
+
+func (e *otherEvent) GetEventType() EventType { return e.code }
+
+func counterType() RegisteredType {
+	return RegisteredType{Name: "counter.incremented", Code: counterIncrementedType, New: func() Event { return &counterIncremented{} }}
+}
+
+func TestEventTypeRegistry(t *testing.T) {
+	named := TypeCode("other.named")
+	r := NewEventTypeRegistry().MustRegister(
+		counterType(),
+		RegisteredType{Name: "other.named", New: func() Event { return &otherEvent{code: named} }},
+	)
+
+	if c, ok := r.LookupName("counter.incremented"); !ok || c.Code != counterIncrementedType {
+		t.Errorf("unexpected type %+v", c)
+	}
+
+	if o, ok := r.Lookup(named); !ok || o.Name != "other.named" {
+		t.Errorf("unexpected type %+v", o)
+	}
+
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"counter.incremented", "other.named"}) {
+		t.Errorf("unexpected names %v", names)
+	}
+
+	if e, err := r.Mapper()(counterIncrementedType); err != nil || reflect.TypeOf(e) != reflect.TypeOf(&counterIncremented{}) {
+		t.Errorf("unexpected event %+v, error %+v", e, err)
+	}
+
+	if _, err := r.Mapper()(9); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	collisions := map[string]RegisteredType{
+		"name":       {Name: "counter.incremented", Code: 9, New: func() Event { return &otherEvent{code: 9} }},
+		"code":       {Name: "other.code", Code: counterIncrementedType, New: func() Event { return &otherEvent{code: counterIncrementedType} }},
+		"Go type":    {Name: "other.go_type", Code: 9, New: func() Event { return &otherEvent{code: 9} }},
+		"bad name":   {Name: "Other", Code: 9, New: func() Event { return &otherEvent{code: 9} }},
+		"wrong code": {Name: "other.wrong_code", Code: 8, New: func() Event { return &otherEvent{code: 9} }},
+		"no New":     {Name: "other.no_new", Code: 9},
+	}
+
+	for collision, rt := range collisions {
+		if err := r.Register(rt); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%s: expected ErrInvalidArgument, got %+v", collision, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic registering a collision")
+		}
+	}()
+
+	NewEventTypeRegistry().MustRegister(counterType(), counterType())
+}
+
+// the registries are independent, the store refuses a name bound to another code by any of them
+func TestEventTypesOfSeveralRegistries(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+
+	first := NewEventTypeRegistry().MustRegister(RegisteredType{Name: "shared.first", Code: 70001, New: func() Event { return &otherEvent{code: 70001} }})
+	second := NewEventTypeRegistry().MustRegister(RegisteredType{Name: "shared.first", Code: 70002, New: func() Event { return &otherEvent{code: 70002} }})
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 70001, TypeName: "shared.first", Payload: EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := first.CheckBindings(ctx, es); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	if err := second.CheckBindings(ctx, es); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func TestCheckTypeBindings(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+	r := NewEventTypeRegistry().MustRegister(counterType())
+
+	if err := r.CheckBindings(ctx, es); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	// the name was bound to another code by another writer of the store
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 5, TypeName: "counter.incremented", Payload: EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := r.CheckBindings(ctx, es); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+
+	repository := newCounterRepository(es)
+	repository.Types = r
+
+	if err := repository.CheckTypes(ctx); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func TestTypeCode(t *testing.T) {
+	for _, name := range []string{"patient.admitted", "patient.discharged", "a.b"} {
+		code := TypeCode(name)
+
+		if code != TypeCode(name) || code < reservedTypeCodes {
+			t.Errorf("unexpected code %d of %s", code, name)
+		}
+	}
+
+	if TypeCode("patient.admitted") == TypeCode("patient.discharged") {
+		t.Errorf("expected distinct codes")
+	}
+}
+
+func TestResolveTypeNames(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, TypeName: "counter.incremented", Payload: EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	codes, err := ResolveTypeNames(ctx, es, []string{"counter.incremented", "counter.reset"})
+
+	if err != nil || codes["counter.incremented"] != 1 || codes["counter.reset"] != TypeCode("counter.reset") {
+		t.Errorf("unexpected codes %v, error %+v", codes, err)
+	}
+
+	if _, err := ResolveTypeNames(ctx, es, []string{"counter"}); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+
+	// two names for a code in a single update
+	events := []StoreEvent{{Type: 1, TypeName: "counter.incremented", Payload: EventPayload(`{}`)}, {Type: 1, TypeName: "counter.reset", Payload: EventPayload(`{}`)}}
+
+	if err := es.Update(ctx, "other", 0, events); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func TestRepositoryTypeNames(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+	r := newCounterRepository(es)
+
+	incremented := counterType()
+	incremented.Codec = upperCodec{}
+	r.Types = NewEventTypeRegistry().MustRegister(incremented)
+	r.EventTypeToEventMapper = nil
+
+	// an event written before the type was named
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: counterIncrementedType, Payload: EventPayload(`{"ID":"UUID","BY":2}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	a, err := r.Load(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	c := a.(*counter)
+	c.increment(1)
+
+	if err := r.Save(ctx, c); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, _ := es.Find(ctx, "uuid")
+
+	if len(events) != 2 || events[1].TypeName != "counter.incremented" || string(events[1].Payload) != `{"ID":"UUID","BY":1}` {
+		t.Errorf("unexpected events %+v", events)
+	}
+
+	if a, err := r.Load(ctx, "uuid"); err != nil || a.(*counter).total != 3 {
+		t.Errorf("unexpected counter %+v, error %+v", a, err)
+	}
+
+	// a name the registry does not know fails the load
+	if err := es.Update(ctx, "uuid", 2, []StoreEvent{{Type: 9, TypeName: "counter.reset", Payload: EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if _, err := r.Load(ctx, "uuid"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,7 @@
+package store
+
+// NewFakeCassandraEventStore returns a CassandraEventStore on an in process fake of its keyspace
+func NewFakeCassandraEventStore() *CassandraEventStore {
+	es, _ := newFakeCassandraStore(&CassandraEventStoreConfig{})
+	return es
+}
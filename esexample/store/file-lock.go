@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file at path, created when missing, waiting for
+// the other processes holding it. The lock is released by the returned function, or when
+// the process exits
+func lockFile(path string) (func() error, error) {
+	return flockFile(path, syscall.LOCK_EX)
+}
+
+// tryLockFile takes the lock of lockFile, failing at once when another holder has it
+func tryLockFile(path string) (func() error, error) {
+	unlock, err := flockFile(path, syscall.LOCK_EX|syscall.LOCK_NB)
+
+	if err == syscall.EWOULDBLOCK {
+		return nil, fmt.Errorf("%s is locked by another store", path)
+	}
+
+	return unlock, err
+}
+
+func flockFile(path string, how int) (func() error, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file.Close, nil
+}
@@ -0,0 +1,22 @@
+package store
+
+import (
+	"os"
+)
+
+// lockFile creates the file at path but does not lock it: the files of the
+// stores are owned by a single process on Windows
+func lockFile(path string) (func() error, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return file.Close, nil
+}
+
+// tryLockFile creates the file at path, as lockFile
+func tryLockFile(path string) (func() error, error) {
+	return lockFile(path)
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The stream index and the by-type index are kept in memory and persisted in
+// streams.idx and types.idx. Every update appends a record with its entries to
+// both; compaction rewrites each file as a single record holding the whole index.
+// A record covers the log up to End: on recovery the log after the covered
+// position is replayed, the log being the only source of truth
+
+const (
+	streamIndexFile = "streams.idx"
+	typeIndexFile   = "types.idx"
+)
+
+// typeEntry locates an event of a type, with what is needed to filter it without reading it
+type typeEntry struct {
+	Seq  int64       `json:"q"`
+	Time int64       `json:"t"`
+	Loc  logLocation `json:"l"`
+}
+
+// fileIndexRecord is a record of an index file, either the entries of an update
+// or, once compacted, the whole index
+type fileIndexRecord struct {
+	End       logPosition               `json:"end"`
+	Seq       int64                     `json:"seq,omitempty"` // commit sequence reached, kept when the last events are purged
+	Streams   map[EventID][]logLocation `json:"streams,omitempty"`
+	Snapshots map[EventID]logLocation   `json:"snapshots,omitempty"`
+	Deleted   map[EventID]DeletedError  `json:"deleted,omitempty"`
+	Types     map[EventType][]typeEntry `json:"types,omitempty"`
+	Names     map[string]EventType      `json:"names,omitempty"`
+}
+
+// fileIndex is the in memory index of the log
+type fileIndex struct {
+	streams   map[EventID][]logLocation
+	snapshots map[EventID]logLocation
+	deleted   map[EventID]DeletedError
+	types     map[EventType][]typeEntry
+	names     *typeDirectory
+	seq       int64
+}
+
+func newFileIndex() *fileIndex {
+	return &fileIndex{
+		streams:   map[EventID][]logLocation{},
+		snapshots: map[EventID]logLocation{},
+		deleted:   map[EventID]DeletedError{},
+		types:     map[EventType][]typeEntry{},
+		names:     newTypeDirectory(),
+	}
+}
+
+// merge adds the entries of an index record, which follow the ones already in
+func (idx *fileIndex) merge(record *fileIndexRecord) {
+	for id, locs := range record.Streams {
+		idx.streams[id] = append(idx.streams[id], locs...)
+	}
+
+	for id, loc := range record.Snapshots {
+		idx.snapshots[id] = loc
+	}
+
+	for id, deleted := range record.Deleted {
+		idx.deleted[id] = deleted
+	}
+
+	if record.Seq > idx.seq {
+		idx.seq = record.Seq
+	}
+
+	for etype, entries := range record.Types {
+		idx.types[etype] = append(idx.types[etype], entries...)
+
+		if last := entries[len(entries)-1].Seq; last > idx.seq {
+			idx.seq = last
+		}
+	}
+
+	idx.names.bind(record.Names)
+}
+
+// add indexes a record of the log, returning the index records of the entries added
+func (idx *fileIndex) add(record *fileLogRecord, offset logPosition, end logPosition) (streams *fileIndexRecord, types *fileIndexRecord) {
+	streams = &fileIndexRecord{End: end, Streams: map[EventID][]logLocation{}, Snapshots: map[EventID]logLocation{}, Deleted: map[EventID]DeletedError{}}
+	types = &fileIndexRecord{End: end, Types: map[EventType][]typeEntry{}, Names: map[string]EventType{}}
+
+	if s := record.Snapshot; s != nil {
+		streams.Snapshots[s.ID] = logLocation{Segment: offset.Segment, Offset: offset.Offset}
+	}
+
+	// the sequence is never taken back, even once the events of the stream are purged
+	if d := record.Deleted; d != nil {
+		streams.Deleted[d.ID] = *d
+		streams.Seq = record.Seq
+	}
+
+	for i, e := range record.Events {
+		loc := logLocation{Segment: offset.Segment, Offset: offset.Offset, Index: i}
+		streams.Streams[e.ID] = append(streams.Streams[e.ID], loc)
+		types.Types[e.Type] = append(types.Types[e.Type], typeEntry{Seq: record.Seq + int64(i), Time: e.TimeStamp, Loc: loc})
+
+		if e.TypeName != "" {
+			types.Names[e.TypeName] = e.Type
+		}
+	}
+
+	idx.merge(streams)
+	idx.merge(types)
+
+	return streams, types
+}
+
+// indexFile is an index file open for appending
+type indexFile struct {
+	path string
+	file *os.File
+	size int64
+}
+
+// loadIndexFile reads the records of an index file. A torn record ends the file
+func loadIndexFile(path string) ([]*fileIndexRecord, []int64, error) {
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []*fileIndexRecord
+	var ends []int64
+
+	_, err = scanRecords(file, 0, info.Size(), func(offset int64, data []byte) error {
+		var record fileIndexRecord
+
+		// a record that does not decode is as good as torn
+		if err := json.Unmarshal(data, &record); err != nil {
+			return errTornRecord
+		}
+
+		records = append(records, &record)
+		ends = append(ends, offset+recordHeaderSize+int64(len(data)))
+		return nil
+	})
+
+	if err != nil && err != errTornRecord {
+		return nil, nil, err
+	}
+
+	return records, ends, nil
+}
+
+// openIndexFile opens an index file for appending after its first size bytes
+func openIndexFile(path string, size int64) (*indexFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &indexFile{path: path, file: file, size: size}, nil
+}
+
+func (f *indexFile) append(record *fileIndexRecord) error {
+	data, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	buf := encodeRecord(data)
+
+	if _, err := f.file.WriteAt(buf, f.size); err != nil {
+		f.file.Truncate(f.size)
+		return err
+	}
+
+	f.size += int64(len(buf))
+
+	return nil
+}
+
+// rewrite replaces the content of the file with the record, atomically
+func (f *indexFile) rewrite(record *fileIndexRecord) error {
+	data, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+	buf := encodeRecord(data)
+
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(tmp, os.O_RDWR, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := os.Rename(tmp, f.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := syncDir(filepath.Dir(f.path)); err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file.Close()
+	f.file = file
+	f.size = int64(len(buf))
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The files of a FileEventStore are sequences of records framed as
+//
+//	[length uint32][crc32c of data uint32][data]
+//
+// A record cut short or failing its checksum is a torn write: it ends the
+// valid part of the file and is truncated away on recovery
+
+const recordHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errTornRecord = errors.New("torn record")
+
+func encodeRecord(data []byte) []byte {
+	buf := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[recordHeaderSize:], data)
+	return buf
+}
+
+// readRecord reads the data of the record at offset of a file of the given size
+func readRecord(r io.ReaderAt, offset int64, size int64) ([]byte, error) {
+	if size-offset < recordHeaderSize {
+		return nil, errTornRecord
+	}
+
+	var header [recordHeaderSize]byte
+
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+
+	if length > size-offset-recordHeaderSize {
+		return nil, errTornRecord
+	}
+
+	data := make([]byte, length)
+
+	if _, err := r.ReadAt(data, offset+recordHeaderSize); err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errTornRecord
+	}
+
+	return data, nil
+}
+
+// scanRecords calls fn for each record from offset on, returning the end of the last valid one
+func scanRecords(r io.ReaderAt, offset int64, size int64, fn func(offset int64, data []byte) error) (int64, error) {
+	for offset < size {
+		data, err := readRecord(r, offset, size)
+
+		if err == errTornRecord {
+			return offset, nil
+		}
+
+		if err != nil {
+			return offset, err
+		}
+
+		if err := fn(offset, data); err != nil {
+			return offset, err
+		}
+
+		offset += recordHeaderSize + int64(len(data))
+	}
+
+	return offset, nil
+}
+
+// logPosition is a position in the log, the end of a record
+type logPosition struct {
+	Segment int   `json:"s"`
+	Offset  int64 `json:"o"`
+}
+
+func (p logPosition) before(other logPosition) bool {
+	return p.Segment < other.Segment || (p.Segment == other.Segment && p.Offset < other.Offset)
+}
+
+// logLocation is the location of an event: the record of its commit and its index within it
+type logLocation struct {
+	Segment int   `json:"s"`
+	Offset  int64 `json:"o"`
+	Index   int   `json:"i,omitempty"`
+}
+
+// fileLogRecord is a record of the log: the events of an update, a snapshot or a tombstone
+type fileLogRecord struct {
+	Seq      int64         `json:"seq,omitempty"` // commit sequence of the first event, of the last one before a tombstone
+	Events   []StoreEvent  `json:"events,omitempty"`
+	Snapshot *Snapshot     `json:"snapshot,omitempty"`
+	Deleted  *DeletedError `json:"deleted,omitempty"` // tombstone of a stream
+	Binary   bool          `json:"bin,omitempty"`     // the payloads are base64, they were text before they were bytes
+}
+
+// textEvent and textSnapshot read the payloads of the records written when they were text
+type textEvent struct {
+	StoreEvent
+	Payload string `json:"payload"`
+}
+
+type textSnapshot struct {
+	Snapshot
+	Payload string `json:"payload"`
+}
+
+// UnmarshalJSON reads the records with either payloads
+func (r *fileLogRecord) UnmarshalJSON(data []byte) error {
+	var probe struct {
+		Binary bool `json:"bin"`
+	}
+
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+
+	if probe.Binary {
+		type binaryRecord fileLogRecord
+		return json.Unmarshal(data, (*binaryRecord)(r))
+	}
+
+	var text struct {
+		Seq      int64         `json:"seq"`
+		Events   []textEvent   `json:"events"`
+		Snapshot *textSnapshot `json:"snapshot"`
+	}
+
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+
+	*r = fileLogRecord{Seq: text.Seq}
+
+	for _, e := range text.Events {
+		e.StoreEvent.Payload = EventPayload(e.Payload)
+		r.Events = append(r.Events, e.StoreEvent)
+	}
+
+	if s := text.Snapshot; s != nil {
+		s.Snapshot.Payload = EventPayload(s.Payload)
+		r.Snapshot = &s.Snapshot
+	}
+
+	return nil
+}
+
+const segmentSuffix = ".log"
+
+func segmentName(dir string, segment int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d%s", segment, segmentSuffix))
+}
+
+// listSegments returns the numbers of the log segments in dir, in order
+func listSegments(dir string) ([]int, error) {
+	infos, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+
+	for _, info := range infos {
+		name := info.Name()
+
+		if info.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(name, segmentSuffix))
+
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, n)
+	}
+
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+// segment is an open log segment
+type segment struct {
+	file *os.File
+	size int64
+}
+
+func openSegment(dir string, n int) (*segment, error) {
+	file, err := os.OpenFile(segmentName(dir, n), os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &segment{file: file, size: info.Size()}, nil
+}
+
+// append writes the record at the end of the segment. A failed write is truncated
+// away, so that the segment never holds a torn record while the store runs
+func (s *segment) append(record []byte) (int64, error) {
+	offset := s.size
+
+	if _, err := s.file.WriteAt(record, offset); err != nil {
+		s.file.Truncate(offset)
+		return 0, err
+	}
+
+	s.size += int64(len(record))
+
+	return offset, nil
+}
+
+// rewriteSegment writes to a temporary file the records of the segment but the dropped ones,
+// returning its path, empty when no record is dropped
+func rewriteSegment(dir string, n int, s *segment, drop func(data []byte) (bool, error)) (string, error) {
+	dropped := false
+
+	_, err := scanRecords(s.file, 0, s.size, func(_ int64, data []byte) error {
+		d, err := drop(data)
+		dropped = dropped || d
+		return err
+	})
+
+	if err != nil || !dropped {
+		return "", err
+	}
+
+	tmp := segmentName(dir, n) + ".tmp"
+	file, err := os.Create(tmp)
+
+	if err != nil {
+		return "", err
+	}
+
+	w := bufio.NewWriter(file)
+
+	_, err = scanRecords(s.file, 0, s.size, func(_ int64, data []byte) error {
+		if d, err := drop(data); err != nil || d {
+			return err
+		}
+
+		_, err := w.Write(encodeRecord(data))
+		return err
+	})
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return tmp, nil
+}
+
+// syncDir makes the creation and renaming of files in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,959 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FsyncPolicy tells when the log is flushed to disk
+type FsyncPolicy int
+
+const (
+	// FsyncAlways flushes every update before returning, nothing acknowledged is ever lost
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval flushes every FsyncInterval, a crash loses at most the updates of the interval
+	FsyncInterval
+	// FsyncNever leaves flushing to the operating system
+	FsyncNever
+)
+
+// ParseFsyncPolicy reads a policy among always, interval and never
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return FsyncAlways, nil
+	case "interval":
+		return FsyncInterval, nil
+	case "never":
+		return FsyncNever, nil
+	}
+
+	return FsyncAlways, invalidArgumentf("fsync policy %q, expected always, interval or never", s)
+}
+
+const (
+	defaultSegmentSize   = 64 << 20
+	defaultFsyncInterval = time.Second
+	defaultCompactEvery  = 10000
+
+	// the file locked by the open store in its directory
+	lockFileName = "LOCK"
+)
+
+type FileEventStoreConfig struct {
+	Dir           string        // directory of the log and index files, created if missing
+	SegmentSize   int64         // size after which a new log segment is started, 64MB by default
+	Fsync         FsyncPolicy   // when the log is flushed to disk
+	FsyncInterval time.Duration // interval of FsyncInterval, one second by default
+	CompactEvery  int           // number of updates after which the index files are compacted
+}
+
+// FileEventStore keeps the events in an append-only log of segment files in a
+// local directory, with a stream index and a by-type index. It is safe for
+// concurrent use within a process; the directory is locked while the store is
+// open, a second store fails to open it. On open, torn writes at the end of the log are truncated away
+// and the indexes are brought up to date with the log. Deleting a stream appends its
+// tombstone to the log; purging it rewrites the segments holding its events and snapshots
+type FileEventStore struct {
+	config *FileEventStoreConfig
+
+	mutex    sync.RWMutex
+	segments map[int]*segment
+	active   int // number of the segment being appended to
+	index    *fileIndex
+	streams  *indexFile
+	types    *indexFile
+	updates  int           // updates since the last compaction
+	dirty    bool          // appended to since the last fsync
+	changed  chan struct{} // closed and replaced on every update, see Changed
+	closed   chan struct{}
+	wg       sync.WaitGroup
+	unlock   func() error // releases the lock of the directory
+}
+
+// @see EventStore.Find
+func (es *FileEventStore) Find(ctx context.Context, guid EventID) ([]StoreEvent, error) {
+	return es.FindRange(ctx, guid, StreamRange{})
+}
+
+// @see EventStore.FindRange
+func (es *FileEventStore) FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	if tombstone, ok := es.index.deleted[guid]; ok {
+		return nil, &tombstone
+	}
+
+	locs, ok := es.index.streams[guid]
+
+	if !ok {
+		return nil, notFound(guid)
+	}
+
+	// versions are positions in the stream, the events out of range are not even read
+	from, to := r.AfterVersion, len(locs)
+	if r.UpToVersion > 0 && r.UpToVersion < to {
+		to = r.UpToVersion
+	}
+
+	result := []StoreEvent{}
+	reader := es.reader()
+
+	for v := from; v < to; v++ {
+		e, err := reader.read(locs[v])
+
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Includes(e) {
+			result = append(result, e)
+		}
+	}
+
+	if r.LastOnly && len(result) > 1 {
+		result = result[len(result)-1:]
+	}
+
+	return result, nil
+}
+
+// @see EventStore.Update
+func (es *FileEventStore) Update(ctx context.Context, guid EventID, expectedVersion int, events []StoreEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateUpdate(guid, expectedVersion, events); err != nil {
+		return err
+	}
+
+	bindings, _ := typeBindings(events)
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	if tombstone, ok := es.index.deleted[guid]; ok {
+		return &tombstone
+	}
+
+	if actual := len(es.index.streams[guid]); actual != expectedVersion {
+		return NewConcurrencyError(guid, expectedVersion, actual)
+	}
+
+	if err := es.index.names.check(bindings); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	record := &fileLogRecord{Seq: es.index.seq + 1}
+
+	for i, e := range events {
+		e.ID = guid
+		e.Version = expectedVersion + 1 + i
+		e.TimeStamp = now
+		e.Metadata = copyMetadata(e.Metadata)
+		e.Cursor = ""
+		record.Events = append(record.Events, e)
+	}
+
+	if err := es.write(record); err != nil {
+		return err
+	}
+
+	// wake up whoever is waiting for new events
+	close(es.changed)
+	es.changed = make(chan struct{})
+
+	return nil
+}
+
+// Changed returns a channel which is closed by the next successful Update
+func (es *FileEventStore) Changed() <-chan struct{} {
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	return es.changed
+}
+
+// @see EventStore.GetEventsByType
+func (es *FileEventStore) GetEventsByType(ctx context.Context, query TypeQuery) ([]StoreEvent, Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, query.After, err
+	}
+
+	if err := query.validate(); err != nil {
+		return nil, query.After, err
+	}
+
+	after, _ := query.After.Decode()
+
+	batchSize := query.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	settleLimit := query.settleLimit(time.Now())
+	result := []StoreEvent{}
+	next := query.After
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	types := query.resolve(es.index.names.lookup(query.TypeNames)).types()
+
+	if types == nil {
+		for etype := range es.index.types {
+			types = append(types, etype)
+		}
+	}
+
+	var selected []typeEntry
+
+	// entries by type are in commit order
+	for _, etype := range types {
+		count := 0
+
+		for _, entry := range es.index.types[etype] {
+			if count >= batchSize {
+				break
+			}
+
+			if settleLimit > 0 && entry.Time > settleLimit {
+				break
+			}
+
+			if after.Seq > 0 && entry.Seq <= after.Seq || after.Seq == 0 && entry.Time < after.SaveTime {
+				continue
+			}
+
+			selected = append(selected, entry)
+			count++
+		}
+	}
+
+	// the entries of several types are merged in commit order
+	if len(types) > 1 {
+		sort.Slice(selected, func(i, j int) bool { return selected[i].Seq < selected[j].Seq })
+
+		if len(selected) > batchSize {
+			selected = selected[:batchSize]
+		}
+	}
+
+	reader := es.reader()
+
+	for _, entry := range selected {
+		e, err := reader.read(entry.Loc)
+
+		if err != nil {
+			return nil, query.After, err
+		}
+
+		e.Cursor = EncodeCursor(Position{SaveTime: e.TimeStamp, Version: e.Version, ID: e.ID, Seq: entry.Seq})
+		result = append(result, e)
+		next = e.Cursor
+	}
+
+	return result, next, nil
+}
+
+// @see EventTypeDirectory.EventTypeCodes
+func (es *FileEventStore) EventTypeCodes(ctx context.Context, names []string) (map[string]EventType, error) {
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	return es.index.names.lookup(names), nil
+}
+
+// @see SnapshotStore.SaveSnapshot
+func (es *FileEventStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	// only the latest snapshot is ever read back
+	if loc, ok := es.index.snapshots[snapshot.ID]; ok {
+		record, err := es.reader().record(loc)
+
+		if err != nil {
+			return err
+		}
+
+		if record.Snapshot.Version > snapshot.Version {
+			return nil
+		}
+	}
+
+	snapshot.TimeStamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return es.write(&fileLogRecord{Snapshot: &snapshot})
+}
+
+// @see SnapshotStore.LatestSnapshot
+func (es *FileEventStore) LatestSnapshot(ctx context.Context, guid EventID) (*Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	loc, ok := es.index.snapshots[guid]
+
+	if !ok {
+		return nil, fmt.Errorf("%w: no snapshot of aggregate %s", ErrNotFound, guid)
+	}
+
+	record, err := es.reader().record(loc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Snapshot, nil
+}
+
+// @see StreamDeleter.DeleteStream, the tombstone is a record of the log
+func (es *FileEventStore) DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if guid == "" || expectedVersion < 0 {
+		return invalidArgumentf("deletion of aggregate %q at version %d", guid, expectedVersion)
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	if _, ok := es.index.deleted[guid]; ok {
+		return nil
+	}
+
+	locs, ok := es.index.streams[guid]
+
+	if !ok {
+		return notFound(guid)
+	}
+
+	if len(locs) != expectedVersion {
+		return NewConcurrencyError(guid, expectedVersion, len(locs))
+	}
+
+	return es.write(&fileLogRecord{Seq: es.index.seq, Deleted: &DeletedError{ID: guid, Version: expectedVersion, TimeStamp: time.Now().UnixNano() / int64(time.Millisecond)}})
+}
+
+// @see StreamDeleter.Tombstone
+func (es *FileEventStore) Tombstone(ctx context.Context, guid EventID) (*DeletedError, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	if tombstone, ok := es.index.deleted[guid]; ok {
+		return &tombstone, nil
+	}
+
+	if _, ok := es.index.streams[guid]; !ok {
+		return nil, notFound(guid)
+	}
+
+	return nil, nil
+}
+
+// @see StreamDeleter.PurgeStream. The segments holding the events or snapshots of the stream
+// are rewritten without them, its tombstone is kept. The index files are removed before the
+// segments are replaced, so that a crash in between rebuilds them from the log
+func (es *FileEventStore) PurgeStream(ctx context.Context, guid EventID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	_, hasEvents := es.index.streams[guid]
+
+	if _, ok := es.index.deleted[guid]; !ok {
+		if !hasEvents {
+			return notFound(guid)
+		}
+		return invalidArgumentf("aggregate %s is not deleted", guid)
+	}
+
+	if _, hasSnapshot := es.index.snapshots[guid]; !hasEvents && !hasSnapshot {
+		return nil
+	}
+
+	numbers := make([]int, 0, len(es.segments))
+	for n := range es.segments {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	rewritten := map[int]string{}
+
+	defer func() {
+		for _, tmp := range rewritten {
+			os.Remove(tmp)
+		}
+	}()
+
+	for _, n := range numbers {
+		tmp, err := rewriteSegment(es.config.Dir, n, es.segments[n], purgedRecord(guid))
+
+		if err != nil {
+			return unavailable(fmt.Errorf("purging aggregate %s from log segment %d: %w", guid, n, err))
+		}
+
+		if tmp != "" {
+			rewritten[n] = tmp
+		}
+	}
+
+	for _, f := range []*indexFile{es.streams, es.types} {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return unavailable(fmt.Errorf("purging aggregate %s: %w", guid, err))
+		}
+	}
+
+	err := es.replaceSegments(rewritten)
+
+	// the index is rebuilt from the log as it is now, whether all the segments were replaced or not
+	es.index = newFileIndex()
+
+	if replayErr := es.replay(logPosition{Segment: numbers[0]}); err == nil {
+		err = replayErr
+	}
+
+	if err != nil {
+		return unavailable(fmt.Errorf("purging aggregate %s: %w", guid, err))
+	}
+
+	if err := es.compact(); err != nil {
+		log.Warn().Msgf("FileEventStore: unable to compact the indexes: %+v", err)
+	}
+
+	return nil
+}
+
+// purgedRecord tells whether a record of the log holds events or a snapshot of the aggregate
+func purgedRecord(guid EventID) func(data []byte) (bool, error) {
+	return func(data []byte) (bool, error) {
+		// most records don't mention the aggregate at all
+		if !bytes.Contains(data, []byte(guid)) {
+			return false, nil
+		}
+
+		var record fileLogRecord
+
+		if err := json.Unmarshal(data, &record); err != nil {
+			return false, err
+		}
+
+		return len(record.Events) > 0 && record.Events[0].ID == guid || record.Snapshot != nil && record.Snapshot.ID == guid, nil
+	}
+}
+
+// replaceSegments renames the rewritten segments over the former ones, the mutex must be held
+func (es *FileEventStore) replaceSegments(rewritten map[int]string) error {
+	if err := syncDir(es.config.Dir); err != nil {
+		return err
+	}
+
+	for n, tmp := range rewritten {
+		file, err := os.OpenFile(tmp, os.O_RDWR, 0644)
+
+		if err != nil {
+			return err
+		}
+
+		info, err := file.Stat()
+
+		if err == nil {
+			err = os.Rename(tmp, segmentName(es.config.Dir, n))
+		}
+
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		es.segments[n].file.Close()
+		es.segments[n] = &segment{file: file, size: info.Size()}
+	}
+
+	return syncDir(es.config.Dir)
+}
+
+// write appends a record to the log and indexes it, the mutex must be held
+func (es *FileEventStore) write(record *fileLogRecord) error {
+	record.Binary = true
+	data, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	buf := encodeRecord(data)
+
+	if s := es.segments[es.active]; s.size > 0 && s.size+int64(len(buf)) > es.config.SegmentSize {
+		if err := es.roll(); err != nil {
+			return err
+		}
+	}
+
+	s := es.segments[es.active]
+	offset, err := s.append(buf)
+
+	if err != nil {
+		return unavailable(fmt.Errorf("writing the log: %w", err))
+	}
+
+	es.dirty = true
+
+	if es.config.Fsync == FsyncAlways {
+		if err := es.sync(); err != nil {
+			s.file.Truncate(offset)
+			s.size = offset
+			return unavailable(fmt.Errorf("flushing the log: %w", err))
+		}
+	}
+
+	at := logPosition{Segment: es.active, Offset: offset}
+	end := logPosition{Segment: es.active, Offset: s.size}
+	streams, types := es.index.add(record, at, end)
+
+	// the indexes are rebuilt from the log on recovery, failing to write them is not fatal
+	if err := es.streams.append(streams); err != nil {
+		log.Warn().Msgf("FileEventStore: unable to write %s: %+v", es.streams.path, err)
+	}
+
+	if err := es.types.append(types); err != nil {
+		log.Warn().Msgf("FileEventStore: unable to write %s: %+v", es.types.path, err)
+	}
+
+	es.updates++
+
+	if es.updates >= es.config.CompactEvery {
+		if err := es.compact(); err != nil {
+			log.Warn().Msgf("FileEventStore: unable to compact the indexes: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// roll seals the active segment and starts a new one
+func (es *FileEventStore) roll() error {
+	if err := es.sync(); err != nil {
+		return unavailable(fmt.Errorf("flushing the log: %w", err))
+	}
+
+	s, err := openSegment(es.config.Dir, es.active+1)
+
+	if err != nil {
+		return unavailable(fmt.Errorf("starting a log segment: %w", err))
+	}
+
+	if err := syncDir(es.config.Dir); err != nil {
+		s.file.Close()
+		return unavailable(fmt.Errorf("starting a log segment: %w", err))
+	}
+
+	es.active++
+	es.segments[es.active] = s
+
+	return nil
+}
+
+// sync flushes the active segment, the mutex must be held
+func (es *FileEventStore) sync() error {
+	if !es.dirty {
+		return nil
+	}
+
+	if err := es.segments[es.active].file.Sync(); err != nil {
+		return err
+	}
+
+	es.dirty = false
+
+	return nil
+}
+
+// Compact rewrites each index file as a single record holding the whole index
+func (es *FileEventStore) Compact() error {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	return es.compact()
+}
+
+func (es *FileEventStore) compact() error {
+	end := logPosition{Segment: es.active, Offset: es.segments[es.active].size}
+
+	// an index must never cover more than what is on disk
+	if err := es.sync(); err != nil {
+		return err
+	}
+
+	streams := &fileIndexRecord{End: end, Seq: es.index.seq, Streams: es.index.streams, Snapshots: es.index.snapshots, Deleted: es.index.deleted}
+	if err := es.streams.rewrite(streams); err != nil {
+		return err
+	}
+
+	if err := es.types.rewrite(&fileIndexRecord{End: end, Types: es.index.types, Names: es.index.names.codes}); err != nil {
+		return err
+	}
+
+	es.updates = 0
+
+	return nil
+}
+
+// Close flushes and compacts the store, which cannot be used any longer
+func (es *FileEventStore) Close() error {
+	close(es.closed)
+	es.wg.Wait()
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	err := es.compact()
+
+	for _, s := range es.segments {
+		s.file.Close()
+	}
+
+	es.streams.file.Close()
+	es.types.file.Close()
+	es.unlock()
+
+	return err
+}
+
+// Dispose closes the store, logging the errors
+func (es *FileEventStore) Dispose() {
+	if err := es.Close(); err != nil {
+		log.Error().Msgf("FileEventStore: closing %s: %+v", es.config.Dir, err)
+	}
+}
+
+// syncEvery flushes the log periodically, for FsyncInterval
+func (es *FileEventStore) syncEvery(interval time.Duration) {
+	defer es.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-es.closed:
+			return
+		case <-ticker.C:
+		}
+
+		es.mutex.Lock()
+		if err := es.sync(); err != nil {
+			log.Error().Msgf("FileEventStore: flushing the log: %+v", err)
+		}
+		es.mutex.Unlock()
+	}
+}
+
+// logReader reads the events of the log, decoding each record once
+type logReader struct {
+	es      *FileEventStore
+	loc     logLocation
+	decoded *fileLogRecord
+}
+
+func (es *FileEventStore) reader() *logReader {
+	return &logReader{es: es}
+}
+
+func (r *logReader) record(loc logLocation) (*fileLogRecord, error) {
+	if r.decoded != nil && r.loc.Segment == loc.Segment && r.loc.Offset == loc.Offset {
+		return r.decoded, nil
+	}
+
+	s, ok := r.es.segments[loc.Segment]
+
+	if !ok {
+		return nil, fmt.Errorf("log segment %d is missing", loc.Segment)
+	}
+
+	data, err := readRecord(s.file, loc.Offset, s.size)
+
+	if err != nil {
+		return nil, fmt.Errorf("reading log segment %d at %d: %w", loc.Segment, loc.Offset, err)
+	}
+
+	var record fileLogRecord
+
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("reading log segment %d at %d: %w", loc.Segment, loc.Offset, err)
+	}
+
+	r.loc, r.decoded = loc, &record
+
+	return &record, nil
+}
+
+func (r *logReader) read(loc logLocation) (StoreEvent, error) {
+	record, err := r.record(loc)
+
+	if err != nil {
+		return StoreEvent{}, err
+	}
+
+	if loc.Index >= len(record.Events) {
+		return StoreEvent{}, fmt.Errorf("log segment %d at %d has no event %d", loc.Segment, loc.Offset, loc.Index)
+	}
+
+	e := record.Events[loc.Index]
+	e.Metadata = copyMetadata(e.Metadata)
+	e.Payload = copyPayload(e.Payload)
+
+	return e, nil
+}
+
+// recover opens the log segments, truncates a torn write at the end of the log
+// and brings the indexes up to date with it
+func (es *FileEventStore) recover() error {
+	numbers, err := listSegments(es.config.Dir)
+
+	if err != nil {
+		return err
+	}
+
+	if len(numbers) == 0 {
+		numbers = []int{1}
+	}
+
+	for _, n := range numbers {
+		s, err := openSegment(es.config.Dir, n)
+
+		if err != nil {
+			return err
+		}
+
+		es.segments[n] = s
+	}
+
+	es.active = numbers[len(numbers)-1]
+	last := es.segments[es.active]
+
+	valid, err := scanRecords(last.file, 0, last.size, func(int64, []byte) error { return nil })
+
+	if err != nil {
+		return err
+	}
+
+	if valid < last.size {
+		log.Warn().Msgf("FileEventStore: truncating a torn write of %d bytes at the end of segment %d", last.size-valid, es.active)
+
+		if err := last.file.Truncate(valid); err != nil {
+			return err
+		}
+
+		last.size = valid
+	}
+
+	logEnd := logPosition{Segment: es.active, Offset: last.size}
+
+	streamRecords, streamEnds, err := loadIndexFile(filepath.Join(es.config.Dir, streamIndexFile))
+
+	if err != nil {
+		return err
+	}
+
+	typeRecords, typeEnds, err := loadIndexFile(filepath.Join(es.config.Dir, typeIndexFile))
+
+	if err != nil {
+		return err
+	}
+
+	// the two indexes may have been cut at different updates, only what both cover is kept
+	start := logPosition{Segment: numbers[0]}
+	covered := start
+
+	if len(streamRecords) > 0 && len(typeRecords) > 0 {
+		covered = streamRecords[len(streamRecords)-1].End
+
+		if end := typeRecords[len(typeRecords)-1].End; end.before(covered) {
+			covered = end
+		}
+	}
+
+	// indexes ahead of the log refer to writes that were lost, they are rebuilt from scratch
+	if logEnd.before(covered) {
+		log.Warn().Msgf("FileEventStore: the indexes are ahead of the log, rebuilding them")
+		covered = start
+	}
+
+	streamSize := keepCovered(es.index, streamRecords, streamEnds, covered)
+	typeSize := keepCovered(es.index, typeRecords, typeEnds, covered)
+
+	if es.streams, err = openIndexFile(filepath.Join(es.config.Dir, streamIndexFile), streamSize); err != nil {
+		return err
+	}
+
+	if es.types, err = openIndexFile(filepath.Join(es.config.Dir, typeIndexFile), typeSize); err != nil {
+		return err
+	}
+
+	if covered == logEnd {
+		return nil
+	}
+
+	if err := es.replay(covered); err != nil {
+		return err
+	}
+
+	return es.compact()
+}
+
+// keepCovered merges the index records covered by the position, returning the size of the file they take
+func keepCovered(index *fileIndex, records []*fileIndexRecord, ends []int64, covered logPosition) int64 {
+	var size int64
+
+	for i, record := range records {
+		if covered.before(record.End) {
+			break
+		}
+
+		index.merge(record)
+		size = ends[i]
+	}
+
+	return size
+}
+
+// replay indexes the records of the log following the given position
+func (es *FileEventStore) replay(from logPosition) error {
+	for n := from.Segment; n <= es.active; n++ {
+		s, ok := es.segments[n]
+
+		if !ok {
+			continue
+		}
+
+		offset := int64(0)
+		if n == from.Segment {
+			offset = from.Offset
+		}
+
+		end, err := scanRecords(s.file, offset, s.size, func(offset int64, data []byte) error {
+			var record fileLogRecord
+
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("log segment %d at %d: %w", n, offset, err)
+			}
+
+			next := logPosition{Segment: n, Offset: offset + recordHeaderSize + int64(len(data))}
+			es.index.add(&record, logPosition{Segment: n, Offset: offset}, next)
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if end < s.size {
+			return fmt.Errorf("log segment %d is corrupt at %d", n, end)
+		}
+	}
+
+	return nil
+}
+
+// initializer for event store
+func NewFileEventStore(config *FileEventStoreConfig) (*FileEventStore, error) {
+	cfg := *config
+
+	if cfg.Dir == "" {
+		return nil, invalidArgumentf("no directory for the file event store")
+	}
+
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = defaultSegmentSize
+	}
+
+	if cfg.FsyncInterval <= 0 {
+		cfg.FsyncInterval = defaultFsyncInterval
+	}
+
+	if cfg.CompactEvery <= 0 {
+		cfg.CompactEvery = defaultCompactEvery
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	unlock, err := tryLockFile(filepath.Join(cfg.Dir, lockFileName))
+
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", cfg.Dir, err)
+	}
+
+	es := &FileEventStore{
+		config:   &cfg,
+		segments: map[int]*segment{},
+		index:    newFileIndex(),
+		changed:  make(chan struct{}),
+		closed:   make(chan struct{}),
+		unlock:   unlock,
+	}
+
+	if err := es.recover(); err != nil {
+		for _, s := range es.segments {
+			s.file.Close()
+		}
+		for _, f := range []*indexFile{es.streams, es.types} {
+			if f != nil {
+				f.file.Close()
+			}
+		}
+		unlock()
+		return nil, fmt.Errorf("opening %s: %w", cfg.Dir, err)
+	}
+
+	if cfg.Fsync == FsyncInterval {
+		es.wg.Add(1)
+		go es.syncEvery(cfg.FsyncInterval)
+	}
+
+	return es, nil
+}
@@ -0,0 +1,403 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func openFileStore(t *testing.T, dir string, config FileEventStoreConfig) *FileEventStore {
+	config.Dir = dir
+	es, err := NewFileEventStore(&config)
+
+	if err != nil {
+		t.Fatalf("unable to open the store: %+v", err)
+	}
+
+	return es
+}
+
+func fillFileStore(t *testing.T, es EventStore, aggregates int) {
+	ctx := context.Background()
+
+	for i := 0; i < aggregates; i++ {
+		guid := EventID(string(rune('a' + i)))
+
+		if err := es.Update(ctx, guid, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}, {Type: 2, Payload: EventPayload("{}"), Metadata: map[string]string{"k": "v"}}}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		if err := es.Update(ctx, guid, 2, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+}
+
+func checkFileStore(t *testing.T, es EventStore, aggregates int) {
+	ctx := context.Background()
+
+	for i := 0; i < aggregates; i++ {
+		guid := EventID(string(rune('a' + i)))
+		events, err := es.Find(ctx, guid)
+
+		if err != nil || len(events) != 3 || events[1].Metadata["k"] != "v" || events[2].Version != 3 {
+			t.Fatalf("unexpected events of %s: %+v, error %+v", guid, events, err)
+		}
+	}
+
+	var read []StoreEvent
+	after := Cursor("")
+
+	for {
+		events, next, err := es.GetEventsByType(ctx, TypeQuery{Type: 1, After: after, BatchSize: 3})
+
+		if err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		read = append(read, events...)
+		after = next
+	}
+
+	if len(read) != 2*aggregates {
+		t.Errorf("expected %d events of type 1, got %d", 2*aggregates, len(read))
+	}
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file-store")
+	defer os.RemoveAll(dir)
+
+	// small segments and frequent compactions, to go through both while writing
+	config := FileEventStoreConfig{SegmentSize: 256, CompactEvery: 3}
+
+	es := openFileStore(t, dir, config)
+	fillFileStore(t, es, 5)
+	checkFileStore(t, es, 5)
+
+	if err := es.Update(context.Background(), "a", 1, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); !errors.Is(err, ErrConcurrencyConflict) {
+		t.Errorf("expected a conflict, got %+v", err)
+	}
+
+	if err := es.SaveSnapshot(context.Background(), Snapshot{ID: "a", Version: 3, Payload: EventPayload("{}")}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.Close(); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if segments, _ := listSegments(dir); len(segments) < 2 {
+		t.Errorf("expected the log to be segmented, got %v", segments)
+	}
+
+	es = openFileStore(t, dir, config)
+	defer es.Close()
+
+	checkFileStore(t, es, 5)
+
+	if s, err := es.LatestSnapshot(context.Background(), "a"); err != nil || s.Version != 3 {
+		t.Errorf("unexpected snapshot %+v, error %+v", s, err)
+	}
+
+	// the sequence goes on after a reopen
+	if err := es.Update(context.Background(), "z", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, _, _ := es.GetEventsByType(context.Background(), TypeQuery{Type: 1, BatchSize: 100})
+
+	if last := events[len(events)-1]; last.ID != "z" {
+		t.Errorf("unexpected last event %+v", last)
+	}
+}
+
+func TestFileStoreLocksItsDirectory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file-store")
+	defer os.RemoveAll(dir)
+
+	es := openFileStore(t, dir, FileEventStoreConfig{})
+
+	if other, err := NewFileEventStore(&FileEventStoreConfig{Dir: dir}); err == nil {
+		other.Close()
+		t.Errorf("expected the directory locked")
+	}
+
+	es.Close()
+
+	openFileStore(t, dir, FileEventStoreConfig{}).Close()
+}
+
+func TestFileStoreTruncatesTornWrites(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file-store")
+	defer os.RemoveAll(dir)
+
+	es := openFileStore(t, dir, FileEventStoreConfig{Fsync: FsyncNever})
+	fillFileStore(t, es, 2)
+
+	// a crash in the middle of the last update: the store is not closed
+	// and the last record of the log is cut short
+	segment := es.segments[es.active]
+	size := segment.size
+	segment.file.Truncate(size - 5)
+
+	// the lock of the directory goes with the process
+	es.unlock()
+
+	es = openFileStore(t, dir, FileEventStoreConfig{})
+	defer es.Close()
+
+	events, err := es.Find(context.Background(), "b")
+
+	if err != nil || len(events) != 2 {
+		t.Fatalf("expected the last update to be lost, got %+v, error %+v", events, err)
+	}
+
+	// the aggregate goes on from the version that survived
+	if err := es.Update(context.Background(), "b", 2, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	checkFileStore(t, es, 2)
+}
+
+func TestFileStoreRebuildsIndexes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file-store")
+	defer os.RemoveAll(dir)
+
+	es := openFileStore(t, dir, FileEventStoreConfig{})
+	fillFileStore(t, es, 3)
+	es.Close()
+
+	cases := map[string]func(){
+		"missing index": func() { os.Remove(filepath.Join(dir, typeIndexFile)) },
+		"garbage index": func() { ioutil.WriteFile(filepath.Join(dir, streamIndexFile), []byte("garbage"), 0644) },
+		"index ahead":   func() { os.Truncate(segmentName(dir, 1), 0) },
+	}
+
+	for _, name := range []string{"missing index", "garbage index"} {
+		cases[name]()
+
+		es = openFileStore(t, dir, FileEventStoreConfig{})
+		checkFileStore(t, es, 3)
+		es.Close()
+	}
+
+	// the log lost everything the indexes refer to
+	cases["index ahead"]()
+
+	es = openFileStore(t, dir, FileEventStoreConfig{})
+	defer es.Close()
+
+	if _, err := es.Find(context.Background(), "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file-store")
+	defer os.RemoveAll(dir)
+
+	es := openFileStore(t, dir, FileEventStoreConfig{})
+	defer es.Close()
+
+	fillFileStore(t, es, 4)
+
+	records, _, _ := loadIndexFile(filepath.Join(dir, streamIndexFile))
+
+	if len(records) != 8 {
+		t.Errorf("expected a record per update, got %d", len(records))
+	}
+
+	if err := es.Compact(); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	records, _, _ = loadIndexFile(filepath.Join(dir, streamIndexFile))
+
+	if len(records) != 1 || len(records[0].Streams) != 4 {
+		t.Errorf("expected a single record, got %+v", records)
+	}
+
+	checkFileStore(t, es, 4)
+}
+
+func TestFileStoreKeepsTypeNames(t *testing.T) {
+	ctx := context.Background()
+	dir, _ := ioutil.TempDir("", "file-store")
+	defer os.RemoveAll(dir)
+
+	es := openFileStore(t, dir, FileEventStoreConfig{})
+
+	if err := es.Update(ctx, "a", 0, []StoreEvent{{Type: 1, TypeName: "patient.admitted", Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.Compact(); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	es.Close()
+
+	// the bindings are read back from the indexes, then from the log once the indexes are gone
+	for _, rebuild := range []bool{false, true} {
+		if rebuild {
+			os.Remove(filepath.Join(dir, typeIndexFile))
+		}
+
+		es = openFileStore(t, dir, FileEventStoreConfig{})
+
+		if codes, _ := es.EventTypeCodes(ctx, []string{"patient.admitted"}); codes["patient.admitted"] != 1 {
+			t.Errorf("unexpected codes %v", codes)
+		}
+
+		if err := es.Update(ctx, "b", 0, []StoreEvent{{Type: 2, TypeName: "patient.admitted", Payload: EventPayload("{}")}}); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("expected ErrInvalidArgument, got %+v", err)
+		}
+
+		es.Close()
+	}
+}
+
+func TestFileStoreKeepsTombstones(t *testing.T) {
+	ctx := context.Background()
+	dir, _ := ioutil.TempDir("", "file-store")
+	defer os.RemoveAll(dir)
+
+	es := openFileStore(t, dir, FileEventStoreConfig{})
+
+	if err := es.Update(ctx, "a", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.DeleteStream(ctx, "a", 1); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.Compact(); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	es.Close()
+
+	// the tombstones are read back from the indexes, then from the log once the indexes are gone
+	for _, rebuild := range []bool{false, true} {
+		if rebuild {
+			os.Remove(filepath.Join(dir, streamIndexFile))
+		}
+
+		es = openFileStore(t, dir, FileEventStoreConfig{})
+
+		var deleted *DeletedError
+
+		if _, err := es.Find(ctx, "a"); !errors.As(err, &deleted) || deleted.Version != 1 {
+			t.Errorf("expected a DeletedError, got %+v", err)
+		}
+
+		if events, _, _ := es.GetEventsByType(ctx, TypeQuery{Type: 1}); len(events) != 1 {
+			t.Errorf("unexpected events %+v", events)
+		}
+
+		es.Close()
+	}
+}
+
+func TestFileStorePurge(t *testing.T) {
+	ctx := context.Background()
+	dir, _ := ioutil.TempDir("", "file-store")
+	defer os.RemoveAll(dir)
+
+	// small segments, so that the stream spreads over several of them
+	es := openFileStore(t, dir, FileEventStoreConfig{SegmentSize: 256})
+	fillFileStore(t, es, 2)
+
+	for v := 0; v < 4; v++ {
+		if err := es.Update(ctx, "z", v, []StoreEvent{{Type: 1, Payload: EventPayload(`{"secret":"hidden"}`)}}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		if err := es.SaveSnapshot(ctx, Snapshot{ID: "z", Version: v + 1, Payload: EventPayload(`{"secret":"hidden"}`)}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	seq := es.index.seq
+
+	if err := es.DeleteStream(ctx, "z", 4); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.PurgeStream(ctx, "z"); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+
+	for _, path := range segments {
+		if data, _ := ioutil.ReadFile(path); strings.Contains(string(data), "hidden") {
+			t.Errorf("%s still holds the purged stream", path)
+		}
+	}
+
+	es.Close()
+
+	// the purged stream stays deleted, from the indexes and from the log once the indexes are gone
+	for _, rebuild := range []bool{false, true} {
+		if rebuild {
+			os.Remove(filepath.Join(dir, streamIndexFile))
+			os.Remove(filepath.Join(dir, typeIndexFile))
+		}
+
+		es = openFileStore(t, dir, FileEventStoreConfig{SegmentSize: 256})
+		checkFileStore(t, es, 2)
+
+		if _, err := es.Find(ctx, "z"); !errors.Is(err, ErrDeleted) {
+			t.Errorf("expected ErrDeleted, got %+v", err)
+		}
+
+		if _, err := es.LatestSnapshot(ctx, "z"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %+v", err)
+		}
+
+		// the commit sequence goes on after the purged events, the cursors past them stay valid
+		if es.index.seq != seq {
+			t.Errorf("expected the sequence at %d, got %d", seq, es.index.seq)
+		}
+
+		es.Close()
+	}
+}
+
+func TestFileLogRecordPayloads(t *testing.T) {
+	// a record written when the payloads were text
+	var record fileLogRecord
+	legacy := `{"seq":3,"events":[{"id":"a","version":1,"payload":"{\"n\":1}","type":1,"time":10}],"snapshot":{"id":"a","version":1,"schema_version":1,"payload":"{}","time":10}}`
+
+	if err := json.Unmarshal([]byte(legacy), &record); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if record.Seq != 3 || len(record.Events) != 1 || string(record.Events[0].Payload) != `{"n":1}` || record.Events[0].Type != 1 || string(record.Snapshot.Payload) != "{}" {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	// the records written today hold bytes
+	record = fileLogRecord{Seq: 4, Events: []StoreEvent{{ID: "a", Payload: EventPayload{0xff, 0x00}}}, Binary: true}
+	data, _ := json.Marshal(&record)
+
+	var read fileLogRecord
+
+	if err := json.Unmarshal(data, &read); err != nil || !reflect.DeepEqual(read, record) {
+		t.Errorf("unexpected record %+v, error %+v", read, err)
+	}
+}
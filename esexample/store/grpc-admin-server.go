@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"my/esexample/storegrpc"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GrpcEventStoreAdminServer serves the commands retiring the streams of an EventStore,
+// registered on a server of its own so that they are not reachable by the clients of
+// GrpcEventStoreServer. The deleted streams are only purged once their deletion is
+// older than Retention, see PurgeAfter
+type GrpcEventStoreAdminServer struct {
+	EventStore EventStore
+	Retention  time.Duration
+	storegrpc.UnimplementedEventStoreAdminServiceServer
+}
+
+func (me *GrpcEventStoreAdminServer) DeleteStream(c context.Context, in *storegrpc.DeleteStreamRequest) (*storegrpc.UpdateResponse, error) {
+	log.Info().Msgf("DeleteStream: %v at %d", in.Id, in.Version)
+
+	deleter, ok := me.EventStore.(StreamDeleter)
+
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "stream deletion not supported by the event store")
+	}
+
+	if err := deleter.DeleteStream(c, EventID(in.Id), int(in.Version)); err != nil {
+		return nil, GrpcStatusError(err)
+	}
+
+	return &storegrpc.UpdateResponse{Success: true}, nil
+}
+
+func (me *GrpcEventStoreAdminServer) PurgeStream(c context.Context, in *storegrpc.StreamRequest) (*storegrpc.UpdateResponse, error) {
+	log.Info().Msgf("PurgeStream: %v", in.Id)
+
+	if _, ok := me.EventStore.(StreamDeleter); !ok {
+		return nil, status.Error(codes.Unimplemented, "stream deletion not supported by the event store")
+	}
+
+	if err := PurgeAfter(c, me.EventStore, EventID(in.Id), me.Retention); err != nil {
+		return nil, GrpcStatusError(err)
+	}
+
+	return &storegrpc.UpdateResponse{Success: true}, nil
+}
+
+func (me *GrpcEventStoreAdminServer) ArchiveStream(c context.Context, in *storegrpc.StreamRequest) (*storegrpc.UpdateResponse, error) {
+	log.Info().Msgf("ArchiveStream: %v", in.Id)
+
+	archiver, ok := me.EventStore.(StreamArchiver)
+
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "stream archival not supported by the event store")
+	}
+
+	if err := archiver.ArchiveStream(c, EventID(in.Id)); err != nil {
+		return nil, GrpcStatusError(err)
+	}
+
+	return &storegrpc.UpdateResponse{Success: true}, nil
+}
+
+// initializer for the admin server of an event store
+func NewGrpcEventStoreAdminServer(es EventStore) *GrpcEventStoreAdminServer {
+	return &GrpcEventStoreAdminServer{EventStore: es}
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	errorDomain            = "eventstore"
+	concurrencyErrorReason = "CONCURRENCY_CONFLICT"
+	deletedErrorReason     = "DELETED"
+	retainedErrorReason    = "RETAINED"
+)
+
+// GrpcStatusError converts an error returned by an EventStore into a gRPC status error,
+// so that the client can map it back with errors.Is
+func GrpcStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var conflict *ConcurrencyError
+	var deleted *DeletedError
+
+	switch {
+	case errors.As(err, &conflict):
+		return detailedStatus(codes.Aborted, err, concurrencyErrorReason, map[string]string{
+			"id":       string(conflict.ID),
+			"expected": strconv.Itoa(conflict.Expected),
+			"actual":   strconv.Itoa(conflict.Actual),
+		})
+	case errors.As(err, &deleted):
+		return detailedStatus(codes.NotFound, err, deletedErrorReason, map[string]string{
+			"id":      string(deleted.ID),
+			"version": strconv.Itoa(deleted.Version),
+			"deleted": strconv.FormatInt(deleted.TimeStamp, 10),
+		})
+	case errors.Is(err, ErrRetained):
+		return detailedStatus(codes.FailedPrecondition, err, retainedErrorReason, nil)
+	case errors.Is(err, ErrConcurrencyConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrInvalidArgument):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, ErrShredded):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrNotSupported):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// detailedStatus returns the status error of the given code, with the reason of the error in its details
+func detailedStatus(code codes.Code, err error, reason string, metadata map[string]string) error {
+	st := status.New(code, err.Error())
+	detailed, derr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   errorDomain,
+		Metadata: metadata,
+	})
+	if derr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// errorInfo returns the details of a status error with the given reason, nil if it has none
+func errorInfo(st *status.Status, reason string) *errdetails.ErrorInfo {
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == reason {
+			return info
+		}
+	}
+	return nil
+}
+
+// fromGrpcError maps a gRPC status error back into the store errors
+func fromGrpcError(err error) error {
+	st, ok := status.FromError(err)
+
+	if !ok {
+		return err
+	}
+
+	switch st.Code() {
+	case codes.Aborted:
+		if info := errorInfo(st, concurrencyErrorReason); info != nil {
+			expected, _ := strconv.Atoi(info.Metadata["expected"])
+			actual, aerr := strconv.Atoi(info.Metadata["actual"])
+			if aerr != nil {
+				actual = -1
+			}
+			return NewConcurrencyError(EventID(info.Metadata["id"]), expected, actual)
+		}
+		return &remoteError{sentinel: ErrConcurrencyConflict, message: st.Message()}
+	case codes.NotFound:
+		if info := errorInfo(st, deletedErrorReason); info != nil {
+			version, _ := strconv.Atoi(info.Metadata["version"])
+			deleted, _ := strconv.ParseInt(info.Metadata["deleted"], 10, 64)
+			return NewDeletedError(EventID(info.Metadata["id"]), version, deleted)
+		}
+		return &remoteError{sentinel: ErrNotFound, message: st.Message()}
+	case codes.InvalidArgument:
+		return &remoteError{sentinel: ErrInvalidArgument, message: st.Message()}
+	case codes.Unavailable:
+		return &remoteError{sentinel: ErrUnavailable, message: st.Message()}
+	case codes.FailedPrecondition:
+		if errorInfo(st, retainedErrorReason) != nil {
+			return &remoteError{sentinel: ErrRetained, message: st.Message()}
+		}
+		return &remoteError{sentinel: ErrShredded, message: st.Message()}
+	case codes.Unimplemented:
+		return &remoteError{sentinel: ErrNotSupported, message: st.Message()}
+	case codes.DeadlineExceeded:
+		return &remoteError{sentinel: context.DeadlineExceeded, message: st.Message()}
+	case codes.Canceled:
+		return &remoteError{sentinel: context.Canceled, message: st.Message()}
+	}
+
+	return err
+}
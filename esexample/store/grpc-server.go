@@ -0,0 +1,266 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"my/esexample/storegrpc"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GrpcEventStoreServer serves an EventStore to GrpcEventStore clients. The subscriptions
+// not asking for a settle window wait Settle for the writes to settle. The commands
+// retiring the streams are served apart, by GrpcEventStoreAdminServer
+type GrpcEventStoreServer struct {
+	EventStore EventStore
+	Settle     time.Duration
+	storegrpc.UnimplementedEventStoreServiceServer
+}
+
+func (me *GrpcEventStoreServer) FindByID(c context.Context, in *storegrpc.FindByIDRequest) (*storegrpc.FindResponse, error) {
+	log.Info().Msgf("FindByID: %v", in.Id)
+
+	events, err := me.EventStore.FindRange(c, EventID(in.Id), StreamRange{
+		AfterVersion: int(in.AfterVersion),
+		UpToVersion:  int(in.UpToVersion),
+		AsOf:         in.AsOf,
+		LastOnly:     in.LastOnly,
+	})
+
+	if err != nil {
+		return nil, GrpcStatusError(err)
+	}
+
+	var findResponseEvents []*storegrpc.FindResponse_Event
+
+	for _, e := range events {
+		findResponseEvents = append(findResponseEvents, toGrpcEvent(e))
+	}
+
+	result := &storegrpc.FindResponse{Success: true, Events: findResponseEvents}
+
+	return result, nil
+}
+
+func (me *GrpcEventStoreServer) FindByType(c context.Context, in *storegrpc.FindByTypeRequest) (*storegrpc.FindResponse, error) {
+	log.Debug().Msgf("FindByTYPE: %v", in.Type)
+
+	query := TypeQuery{
+		Type:      EventType(in.Type),
+		After:     Cursor(in.Cursor),
+		BatchSize: int(in.BatchSize),
+		Settle:    time.Duration(in.SettleMillis) * time.Millisecond,
+		AllTypes:  in.AllTypes,
+		TypeNames: in.TypeNames,
+	}
+
+	for _, etype := range in.Types {
+		query.Types = append(query.Types, EventType(etype))
+	}
+
+	// legacy clients page by save time, which skips events saved in the same millisecond
+	if query.After == "" && in.Since > 0 {
+		query.After = CursorFrom(in.Since + 1)
+	}
+
+	events, next, err := me.EventStore.GetEventsByType(c, query)
+	if err != nil {
+		return nil, GrpcStatusError(err)
+	}
+
+	var findResponseEvents []*storegrpc.FindResponse_Event
+
+	for _, e := range events {
+		findResponseEvents = append(findResponseEvents, toGrpcEvent(e))
+	}
+
+	latest := in.Since
+	if len(events) > 0 {
+		latest = events[len(events)-1].TimeStamp
+	}
+
+	result := &storegrpc.FindResponse{
+		Success: true,
+		Events:  findResponseEvents,
+		Latest:  latest,
+		Cursor:  string(next),
+	}
+
+	return result, nil
+}
+
+func (me *GrpcEventStoreServer) Update(c context.Context, in *storegrpc.UpdateRequest) (*storegrpc.UpdateResponse, error) {
+	log.Info().Msgf("Update: %v", in.Id)
+
+	var events []StoreEvent
+
+	for _, e := range in.Events {
+		events = append(events, StoreEvent{
+			ID:            EventID(in.Id),
+			Payload:       EventPayload(e.Payload),
+			ContentType:   e.ContentType,
+			Type:          EventType(e.Type),
+			TypeName:      e.TypeName,
+			SchemaVersion: int(e.SchemaVersion),
+			Metadata:      e.Metadata,
+		})
+	}
+
+	err := me.EventStore.Update(c, EventID(in.Id), int(in.Version), events)
+
+	if err != nil {
+		return nil, GrpcStatusError(err)
+	}
+
+	response := &storegrpc.UpdateResponse{
+		Success: true,
+	}
+
+	return response, nil
+}
+
+func (me *GrpcEventStoreServer) SaveSnapshot(c context.Context, in *storegrpc.SaveSnapshotRequest) (*storegrpc.UpdateResponse, error) {
+	log.Info().Msgf("SaveSnapshot: %v", in.Snapshot.GetId())
+
+	snapshots, ok := me.EventStore.(SnapshotStore)
+
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "snapshots not supported by the event store")
+	}
+
+	err := snapshots.SaveSnapshot(c, Snapshot{
+		ID:            EventID(in.Snapshot.GetId()),
+		Version:       int(in.Snapshot.GetVersion()),
+		SchemaVersion: int(in.Snapshot.GetSchemaVersion()),
+		Payload:       EventPayload(in.Snapshot.GetPayload()),
+	})
+
+	if err != nil {
+		return nil, GrpcStatusError(err)
+	}
+
+	return &storegrpc.UpdateResponse{Success: true}, nil
+}
+
+func (me *GrpcEventStoreServer) FindSnapshot(c context.Context, in *storegrpc.FindSnapshotRequest) (*storegrpc.FindSnapshotResponse, error) {
+	log.Info().Msgf("FindSnapshot: %v", in.Id)
+
+	snapshots, ok := me.EventStore.(SnapshotStore)
+
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "snapshots not supported by the event store")
+	}
+
+	snapshot, err := snapshots.LatestSnapshot(c, EventID(in.Id))
+
+	if err != nil {
+		return nil, GrpcStatusError(err)
+	}
+
+	result := &storegrpc.FindSnapshotResponse{
+		Success: true,
+		Snapshot: &storegrpc.Snapshot{
+			Id:            string(snapshot.ID),
+			Version:       int32(snapshot.Version),
+			SchemaVersion: int32(snapshot.SchemaVersion),
+			Payload:       snapshot.Payload,
+			Savetime:      snapshot.TimeStamp,
+		},
+	}
+
+	return result, nil
+}
+
+func (me *GrpcEventStoreServer) Subscribe(in *storegrpc.SubscribeRequest, stream storegrpc.EventStoreService_SubscribeServer) error {
+	log.Info().Msgf("Subscribe: %v %v", in.Types, in.TypeNames)
+
+	positions := map[EventType]Cursor{}
+
+	for _, t := range in.Types {
+		positions[EventType(t)] = CursorFrom(in.Since)
+	}
+
+	codes, err := ResolveTypeNames(stream.Context(), me.EventStore, in.TypeNames)
+
+	if err != nil {
+		return GrpcStatusError(err)
+	}
+
+	for _, t := range codes {
+		positions[t] = CursorFrom(in.Since)
+	}
+
+	for t, after := range in.Cursors {
+		positions[EventType(t)] = Cursor(after)
+	}
+
+	opts := SubscriptionOptions{
+		Heartbeat: time.Duration(in.HeartbeatMillis) * time.Millisecond,
+		BatchSize: int(in.BatchSize),
+		Settle:    time.Duration(in.SettleMillis) * time.Millisecond,
+	}
+
+	if opts.Settle <= 0 {
+		opts.Settle = me.Settle
+	}
+
+	err = Subscribe(stream.Context(), me.EventStore, positions, opts, func(e *StoreEvent) error {
+		if e == nil {
+			return stream.Send(&storegrpc.SubscribeResponse{Heartbeat: true})
+		}
+
+		return stream.Send(&storegrpc.SubscribeResponse{Event: toGrpcEvent(*e)})
+	})
+
+	log.Info().Msgf("Subscribe: %v ended: %v", in.Types, err)
+
+	return GrpcStatusError(err)
+}
+
+func (me *GrpcEventStoreServer) FindTombstone(c context.Context, in *storegrpc.StreamRequest) (*storegrpc.TombstoneResponse, error) {
+	deleter, ok := me.EventStore.(StreamDeleter)
+
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "stream deletion not supported by the event store")
+	}
+
+	deleted, err := deleter.Tombstone(c, EventID(in.Id))
+
+	if err != nil {
+		return nil, GrpcStatusError(err)
+	}
+
+	result := &storegrpc.TombstoneResponse{Success: true}
+
+	if deleted != nil {
+		result.Deleted = true
+		result.Version = int32(deleted.Version)
+		result.DeletedAt = deleted.TimeStamp
+	}
+
+	return result, nil
+}
+
+func toGrpcEvent(e StoreEvent) *storegrpc.FindResponse_Event {
+	return &storegrpc.FindResponse_Event{
+		Id:            string(e.ID),
+		Type:          int32(e.Type),
+		TypeName:      e.TypeName,
+		Payload:       e.Payload,
+		ContentType:   e.ContentType,
+		Savetime:      e.TimeStamp,
+		Version:       int32(e.Version),
+		Metadata:      e.Metadata,
+		Cursor:        string(e.Cursor),
+		SchemaVersion: int32(e.SchemaVersion),
+		Shredded:      e.Shredded,
+	}
+}
+
+// initializer for the server of an event store
+func NewGrpcEventStoreServer(es EventStore) *GrpcEventStoreServer {
+	return &GrpcEventStoreServer{EventStore: es, Settle: DefaultSubscriptionSettle}
+}
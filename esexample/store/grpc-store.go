@@ -2,11 +2,15 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"my/esexample/storegrpc"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const defaultTimeout = 2000 * time.Millisecond
@@ -14,48 +18,68 @@ const defaultTimeout = 2000 * time.Millisecond
 type GrpcEventStoreConfig struct {
 	Host            string
 	TimeoutInMillis int
+	// AdminHost is the admin address of the server, serving the commands retiring the
+	// streams. These commands fail with ErrAdminDisabled when it is empty
+	AdminHost string
 }
 
 type GrpcEventStore struct {
-	Config  *GrpcEventStoreConfig
-	Client  storegrpc.EventStoreServiceClient
-	Timeout time.Duration
+	Config      *GrpcEventStoreConfig
+	Client      storegrpc.EventStoreServiceClient
+	AdminClient storegrpc.EventStoreAdminServiceClient
+	Timeout     time.Duration
 }
 
-func (es *GrpcEventStore) Find(guid EventID) ([]StoreEvent, error) {
+func (es *GrpcEventStore) Find(ctx context.Context, guid EventID) ([]StoreEvent, error) {
+	return es.FindRange(ctx, guid, StreamRange{})
+}
+
+func (es *GrpcEventStore) FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error) {
 	client, err := es.getClient()
 
 	if err != nil {
 		return nil, err
 	}
 
-	request := &storegrpc.FindByIDRequest{Id: string(guid)}
+	request := &storegrpc.FindByIDRequest{
+		Id:           string(guid),
+		AfterVersion: int32(r.AfterVersion),
+		UpToVersion:  int32(r.UpToVersion),
+		AsOf:         r.AsOf,
+		LastOnly:     r.LastOnly,
+	}
 
-	ctx, cancelFunc := es.createContext()
+	ctx, cancelFunc := es.createContext(ctx)
 	defer cancelFunc()
 	response, err := client.FindByID(ctx, request)
 
 	if err != nil {
-		return nil, err
+		return nil, fromGrpcError(err)
 	}
 
 	if !response.Success {
 		return nil, fmt.Errorf("ERROR: %+v", response.Error)
 	}
 
-	var result []StoreEvent
+	result := []StoreEvent{}
 
 	for _, e := range response.Events {
 		result = append(result, StoreEvent{
-			ID:      EventID(e.Id),
-			Payload: EventPayload(e.Payload),
-			Type:    EventType(e.Type)})
+			ID:            EventID(e.Id),
+			Version:       int(e.Version),
+			Payload:       EventPayload(e.Payload),
+			ContentType:   e.ContentType,
+			Type:          EventType(e.Type),
+			TypeName:      e.TypeName,
+			SchemaVersion: int(e.SchemaVersion),
+			TimeStamp:     e.Savetime,
+			Metadata:      e.Metadata})
 	}
 
 	return result, nil
 }
 
-func (es *GrpcEventStore) Update(guid EventID, expectedVersion int, events []StoreEvent) error {
+func (es *GrpcEventStore) Update(ctx context.Context, guid EventID, expectedVersion int, events []StoreEvent) error {
 	client, err := es.getClient()
 
 	if err != nil {
@@ -66,8 +90,12 @@ func (es *GrpcEventStore) Update(guid EventID, expectedVersion int, events []Sto
 
 	for _, e := range events {
 		updateRequestEvents = append(updateRequestEvents, &storegrpc.UpdateRequest_Event{
-			Type:    int32(e.Type),
-			Payload: string(e.Payload),
+			Type:          int32(e.Type),
+			TypeName:      e.TypeName,
+			SchemaVersion: int32(e.SchemaVersion),
+			Payload:       e.Payload,
+			ContentType:   e.ContentType,
+			Metadata:      e.Metadata,
 		})
 	}
 
@@ -76,12 +104,12 @@ func (es *GrpcEventStore) Update(guid EventID, expectedVersion int, events []Sto
 		Version: int32(expectedVersion),
 		Events:  updateRequestEvents}
 
-	ctx, cancelFunc := es.createContext()
+	ctx, cancelFunc := es.createContext(ctx)
 	defer cancelFunc()
 	response, err := client.Update(ctx, request)
 
 	if err != nil {
-		return err
+		return fromGrpcError(err)
 	}
 
 	if !response.Success {
@@ -91,7 +119,8 @@ func (es *GrpcEventStore) Update(guid EventID, expectedVersion int, events []Sto
 	return nil
 }
 
-func (es *GrpcEventStore) GetEventsByType(etype EventType, sinceMillis int64, batchSize int) (events []StoreEvent, latest int64, theError error) {
+func (es *GrpcEventStore) GetEventsByType(ctx context.Context, query TypeQuery) (events []StoreEvent, next Cursor, theError error) {
+	next = query.After
 	client, err := es.getClient()
 
 	if err != nil {
@@ -100,17 +129,24 @@ func (es *GrpcEventStore) GetEventsByType(etype EventType, sinceMillis int64, ba
 	}
 
 	request := &storegrpc.FindByTypeRequest{
-		Type:      int32(etype),
-		Since:     sinceMillis,
-		BatchSize: int32(batchSize),
+		Type:         int32(query.Type),
+		Cursor:       string(query.After),
+		BatchSize:    int32(query.BatchSize),
+		SettleMillis: int32(query.Settle / time.Millisecond),
+		AllTypes:     query.AllTypes,
+		TypeNames:    query.TypeNames,
 	}
 
-	ctx, cancelFunc := es.createContext()
+	for _, etype := range query.Types {
+		request.Types = append(request.Types, int32(etype))
+	}
+
+	ctx, cancelFunc := es.createContext(ctx)
 	defer cancelFunc()
 	response, err := client.FindByType(ctx, request)
 
 	if err != nil {
-		theError = err
+		theError = fromGrpcError(err)
 		return
 	}
 
@@ -120,20 +156,271 @@ func (es *GrpcEventStore) GetEventsByType(etype EventType, sinceMillis int64, ba
 	}
 
 	for _, e := range response.Events {
-		events = append(events, StoreEvent{
-			ID:        EventID(e.Id),
-			Payload:   EventPayload(e.Payload),
-			Type:      EventType(e.Type),
-			TimeStamp: e.Savetime})
+		events = append(events, fromGrpcEvent(e))
 	}
 
-	latest = response.Latest
+	next = Cursor(response.Cursor)
 
 	return
 }
 
-func (es *GrpcEventStore) createContext() (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), es.Timeout)
+func fromGrpcEvent(e *storegrpc.FindResponse_Event) StoreEvent {
+	return StoreEvent{
+		ID:            EventID(e.Id),
+		Version:       int(e.Version),
+		Payload:       EventPayload(e.Payload),
+		ContentType:   e.ContentType,
+		Type:          EventType(e.Type),
+		TypeName:      e.TypeName,
+		SchemaVersion: int(e.SchemaVersion),
+		TimeStamp:     e.Savetime,
+		Metadata:      e.Metadata,
+		Cursor:        Cursor(e.Cursor),
+		Shredded:      e.Shredded}
+}
+
+func (es *GrpcEventStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	client, err := es.getClient()
+
+	if err != nil {
+		return err
+	}
+
+	request := &storegrpc.SaveSnapshotRequest{
+		Snapshot: &storegrpc.Snapshot{
+			Id:            string(snapshot.ID),
+			Version:       int32(snapshot.Version),
+			SchemaVersion: int32(snapshot.SchemaVersion),
+			Payload:       snapshot.Payload,
+		}}
+
+	ctx, cancelFunc := es.createContext(ctx)
+	defer cancelFunc()
+	response, err := client.SaveSnapshot(ctx, request)
+
+	if err != nil {
+		return fromGrpcError(err)
+	}
+
+	if !response.Success {
+		return fmt.Errorf("ERROR: %+v", response.Error)
+	}
+
+	return nil
+}
+
+func (es *GrpcEventStore) LatestSnapshot(ctx context.Context, guid EventID) (*Snapshot, error) {
+	client, err := es.getClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancelFunc := es.createContext(ctx)
+	defer cancelFunc()
+	response, err := client.FindSnapshot(ctx, &storegrpc.FindSnapshotRequest{Id: string(guid)})
+
+	if err != nil {
+		return nil, fromGrpcError(err)
+	}
+
+	if !response.Success {
+		return nil, fmt.Errorf("ERROR: %+v", response.Error)
+	}
+
+	s := response.Snapshot
+
+	return &Snapshot{
+		ID:            EventID(s.Id),
+		Version:       int(s.Version),
+		SchemaVersion: int(s.SchemaVersion),
+		Payload:       EventPayload(s.Payload),
+		TimeStamp:     s.Savetime}, nil
+}
+
+// @see StreamDeleter.DeleteStream
+func (es *GrpcEventStore) DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error {
+	return es.streamCommand(ctx, func(ctx context.Context, client storegrpc.EventStoreAdminServiceClient) (*storegrpc.UpdateResponse, error) {
+		return client.DeleteStream(ctx, &storegrpc.DeleteStreamRequest{Id: string(guid), Version: int32(expectedVersion)})
+	})
+}
+
+// @see StreamDeleter.Tombstone
+func (es *GrpcEventStore) Tombstone(ctx context.Context, guid EventID) (*DeletedError, error) {
+	client, err := es.getClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancelFunc := es.createContext(ctx)
+	defer cancelFunc()
+	response, err := client.FindTombstone(ctx, &storegrpc.StreamRequest{Id: string(guid)})
+
+	if err != nil {
+		return nil, fromGrpcError(err)
+	}
+
+	if !response.Success {
+		return nil, fmt.Errorf("ERROR: %+v", response.Error)
+	}
+
+	if !response.Deleted {
+		return nil, nil
+	}
+
+	return &DeletedError{ID: guid, Version: int(response.Version), TimeStamp: response.DeletedAt}, nil
+}
+
+// @see StreamDeleter.PurgeStream. The server purges the stream only once its deletion
+// is older than the retention it is configured with, ErrRetained before that
+func (es *GrpcEventStore) PurgeStream(ctx context.Context, guid EventID) error {
+	return es.streamCommand(ctx, func(ctx context.Context, client storegrpc.EventStoreAdminServiceClient) (*storegrpc.UpdateResponse, error) {
+		return client.PurgeStream(ctx, &storegrpc.StreamRequest{Id: string(guid)})
+	})
+}
+
+// @see StreamArchiver.ArchiveStream
+func (es *GrpcEventStore) ArchiveStream(ctx context.Context, guid EventID) error {
+	return es.streamCommand(ctx, func(ctx context.Context, client storegrpc.EventStoreAdminServiceClient) (*storegrpc.UpdateResponse, error) {
+		return client.ArchiveStream(ctx, &storegrpc.StreamRequest{Id: string(guid)})
+	})
+}
+
+// streamCommand runs one of the commands on a stream on the admin address of the server
+func (es *GrpcEventStore) streamCommand(ctx context.Context, call func(ctx context.Context, client storegrpc.EventStoreAdminServiceClient) (*storegrpc.UpdateResponse, error)) error {
+	client, err := es.getAdminClient()
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelFunc := es.createContext(ctx)
+	defer cancelFunc()
+	response, err := call(ctx, client)
+
+	if err != nil {
+		return fromGrpcError(err)
+	}
+
+	if !response.Success {
+		return fmt.Errorf("ERROR: %+v", response.Error)
+	}
+
+	return nil
+}
+
+// Subscribe streams the events of the given types saved after the given cursors,
+// see store.Subscribe. The subscription survives disconnections: it reconnects with
+// exponential backoff and resumes after the last event delivered to the handler.
+// A stream that stays silent for longer than stalledHeartbeats heartbeats is considered broken
+func (es *GrpcEventStore) Subscribe(ctx context.Context, positions map[EventType]Cursor, handler SubscriptionHandler) error {
+	client, err := es.getClient()
+
+	if err != nil {
+		return err
+	}
+
+	current := make(map[EventType]Cursor, len(positions))
+	for etype, after := range positions {
+		current[etype] = after
+	}
+
+	boff := backoff.NewExponentialBackOff()
+	boff.MaxElapsedTime = 0
+	boff.MaxInterval = 10 * time.Second
+
+	for {
+		err := es.subscribeOnce(ctx, client, current, boff, handler)
+
+		var herr *handlerError
+
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.As(err, &herr):
+			return herr.err
+		case errors.Is(err, ErrInvalidArgument), status.Code(err) == codes.Unimplemented:
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(boff.NextBackOff()):
+		}
+	}
+}
+
+const stalledHeartbeats = 3
+
+// handlerError tells a failure of the subscription handler from a failure of the stream
+type handlerError struct {
+	err error
+}
+
+func (e *handlerError) Error() string {
+	return e.err.Error()
+}
+
+func (es *GrpcEventStore) subscribeOnce(ctx context.Context, client storegrpc.EventStoreServiceClient, current map[EventType]Cursor, boff backoff.BackOff, handler SubscriptionHandler) error {
+	streamCtx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	request := &storegrpc.SubscribeRequest{
+		Cursors:         map[int32]string{},
+		HeartbeatMillis: int32(defaultHeartbeat / time.Millisecond),
+	}
+
+	for etype, after := range current {
+		request.Types = append(request.Types, int32(etype))
+		request.Cursors[int32(etype)] = string(after)
+	}
+
+	stream, err := client.Subscribe(streamCtx, request)
+
+	if err != nil {
+		return fromGrpcError(err)
+	}
+
+	// cancel the stream if neither events nor heartbeats are received
+	stalled := time.AfterFunc(stalledHeartbeats*defaultHeartbeat, cancelFunc)
+	defer stalled.Stop()
+
+	for {
+		response, err := stream.Recv()
+
+		if err != nil {
+			if ctx.Err() == nil && streamCtx.Err() != nil {
+				return unavailable(fmt.Errorf("subscription stalled"))
+			}
+			return fromGrpcError(err)
+		}
+
+		stalled.Reset(stalledHeartbeats * defaultHeartbeat)
+		boff.Reset()
+
+		var event *StoreEvent
+
+		if e := response.Event; !response.Heartbeat && e != nil {
+			se := fromGrpcEvent(e)
+			event = &se
+		}
+
+		if err := handler(event); err != nil {
+			return &handlerError{err: err}
+		}
+
+		if event != nil {
+			current[event.Type] = event.Cursor
+		}
+	}
+}
+
+// createContext bounds the caller's context with the configured timeout,
+// so the earliest of the two deadlines wins
+func (es *GrpcEventStore) createContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, es.Timeout)
 }
 
 func (es *GrpcEventStore) getClient() (storegrpc.EventStoreServiceClient, error) {
@@ -153,6 +440,27 @@ func (es *GrpcEventStore) getClient() (storegrpc.EventStoreServiceClient, error)
 	return es.Client, nil
 }
 
+func (es *GrpcEventStore) getAdminClient() (storegrpc.EventStoreAdminServiceClient, error) {
+
+	if es.AdminClient != nil {
+		return es.AdminClient, nil
+	}
+
+	if es.Config.AdminHost == "" {
+		return nil, ErrAdminDisabled
+	}
+
+	conn, err := grpc.Dial(es.Config.AdminHost, grpc.WithInsecure())
+
+	if err != nil {
+		return nil, err
+	}
+
+	es.AdminClient = storegrpc.NewEventStoreAdminServiceClient(conn)
+
+	return es.AdminClient, nil
+}
+
 // initializer for event store
 func NewGrpcEventStore(config *GrpcEventStoreConfig) *GrpcEventStore {
 
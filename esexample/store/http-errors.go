@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// HTTPError is the JSON body returned by the HTTP event store on failure
+type HTTPError struct {
+	Error    string  `json:"error"`
+	ID       EventID `json:"id,omitempty"`
+	Expected *int    `json:"expected,omitempty"`
+	Actual   *int    `json:"actual,omitempty"`
+	Version  *int    `json:"version,omitempty"` // the version of a deleted stream
+	Deleted  int64   `json:"deleted,omitempty"` // the time of its deletion in millis
+}
+
+// NewHTTPError converts an error returned by an EventStore into
+// the HTTP status code and body that the client maps back
+func NewHTTPError(err error) (int, *HTTPError) {
+	body := &HTTPError{Error: err.Error()}
+	var conflict *ConcurrencyError
+	var deleted *DeletedError
+
+	switch {
+	case errors.As(err, &conflict):
+		body.ID = conflict.ID
+		body.Expected = &conflict.Expected
+		body.Actual = &conflict.Actual
+		return http.StatusConflict, body
+	case errors.As(err, &deleted):
+		body.ID = deleted.ID
+		body.Version = &deleted.Version
+		body.Deleted = deleted.TimeStamp
+		return http.StatusNotFound, body
+	case errors.Is(err, ErrRetained):
+		return http.StatusPreconditionFailed, body
+	case errors.Is(err, ErrConcurrencyConflict):
+		return http.StatusConflict, body
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, body
+	case errors.Is(err, ErrInvalidArgument):
+		return http.StatusBadRequest, body
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable, body
+	case errors.Is(err, ErrShredded):
+		return http.StatusGone, body
+	case errors.Is(err, ErrNotSupported):
+		return http.StatusNotImplemented, body
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, body
+	}
+
+	return http.StatusInternalServerError, body
+}
+
+// errorFromResponse maps a failed HTTP response back into the store errors
+func errorFromResponse(resp *http.Response) error {
+	data, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return err
+	}
+
+	var body HTTPError
+	if err := json.Unmarshal(data, &body); err != nil || body.Error == "" {
+		body.Error = string(data)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusConflict:
+		if body.Expected != nil && body.Actual != nil {
+			return NewConcurrencyError(body.ID, *body.Expected, *body.Actual)
+		}
+		return &remoteError{sentinel: ErrConcurrencyConflict, message: body.Error}
+	case http.StatusNotFound:
+		if body.Version != nil && body.Deleted != 0 {
+			return NewDeletedError(body.ID, *body.Version, body.Deleted)
+		}
+		return &remoteError{sentinel: ErrNotFound, message: body.Error}
+	case http.StatusPreconditionFailed:
+		return &remoteError{sentinel: ErrRetained, message: body.Error}
+	case http.StatusBadRequest:
+		return &remoteError{sentinel: ErrInvalidArgument, message: body.Error}
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return &remoteError{sentinel: ErrUnavailable, message: body.Error}
+	case http.StatusGone:
+		return &remoteError{sentinel: ErrShredded, message: body.Error}
+	case http.StatusNotImplemented:
+		return &remoteError{sentinel: ErrNotSupported, message: body.Error}
+	case http.StatusGatewayTimeout:
+		return &remoteError{sentinel: context.DeadlineExceeded, message: body.Error}
+	}
+
+	return errors.New(body.Error)
+}
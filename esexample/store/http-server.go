@@ -0,0 +1,278 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RemoteEventStoreHandler serves an EventStore to RemoteEventStore clients. The deleted
+// streams are only purged once their deletion is older than Retention, see PurgeAfter
+type RemoteEventStoreHandler struct {
+	EventStore EventStore
+	Retention  time.Duration
+}
+
+// TombstoneResult is the tombstone of a stream, Deleted is 0 when the stream is not deleted
+type TombstoneResult struct {
+	Version int   `json:"version,omitempty"`
+	Deleted int64 `json:"deleted,omitempty"`
+}
+
+// Register adds the routes of the API to the router
+func (me *RemoteEventStoreHandler) Register(r gin.IRoutes) {
+	r.GET("/api/v1/events/:uuid", me.HandleFindEventsByUUID)
+	r.POST("/api/v1/events/:uuid/:version", me.HandleUpdateEventByUUID)
+	r.GET("/api/v1/types/:type", me.HandleFindEventsByType)
+	r.GET("/api/v1/snapshots/:uuid", me.HandleFindSnapshot)
+	r.POST("/api/v1/snapshots/:uuid", me.HandleSaveSnapshot)
+	r.GET("/api/v1/streams/:uuid/tombstone", me.HandleFindTombstone)
+}
+
+// RegisterAdmin adds the routes of the commands retiring the streams to the router,
+// which must not be reachable by the clients of the routes added by Register
+func (me *RemoteEventStoreHandler) RegisterAdmin(r gin.IRoutes) {
+	r.DELETE("/api/v1/events/:uuid/:version", me.HandleDeleteStream)
+	r.POST("/api/v1/streams/:uuid/purge", me.HandlePurgeStream)
+	r.POST("/api/v1/streams/:uuid/archive", me.HandleArchiveStream)
+}
+
+// HandleFindEventsByUUID ...
+func (me *RemoteEventStoreHandler) HandleFindEventsByUUID(c *gin.Context) {
+	uuid := c.Param("uuid")
+	streamRange, err := ParseStreamRange(c.Request.URL.Query())
+
+	if err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	events, err := me.EventStore.FindRange(c.Request.Context(), EventID(uuid), streamRange)
+
+	if err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	result := &FindEventsByTypeResult{
+		Events: events,
+	}
+
+	if len(events) > 0 {
+		result.Latest = events[len(events)-1].TimeStamp
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// HandleFindEventsByType ...
+func (me *RemoteEventStoreHandler) HandleFindEventsByType(c *gin.Context) {
+	query, err := ParseTypeQuery(0, c.Request.URL.Query())
+
+	if err == nil {
+		err = query.parseTypes(c.Param("type"))
+	}
+
+	if err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	if query.BatchSize <= 0 {
+		query.BatchSize = 100
+	}
+
+	events, next, err := me.EventStore.GetEventsByType(c.Request.Context(), query)
+
+	if err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	result := &FindEventsByTypeResult{
+		Events: events,
+		Cursor: next,
+	}
+
+	if len(events) > 0 {
+		result.Latest = events[len(events)-1].TimeStamp
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// HandleUpdateEventByUUID ...
+func (me *RemoteEventStoreHandler) HandleUpdateEventByUUID(c *gin.Context) {
+	uuid := c.Param("uuid")
+	sversion := c.Param("version")
+
+	// check whether version is an integer
+	iversion, err := strconv.Atoi(sversion)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	jsondata, err := ioutil.ReadAll(c.Request.Body)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// parse all input data
+	var events []StoreEvent
+
+	err = json.Unmarshal(jsondata, &events)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = me.EventStore.Update(c.Request.Context(), EventID(uuid), iversion, events)
+
+	if err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// HandleSaveSnapshot ...
+func (me *RemoteEventStoreHandler) HandleSaveSnapshot(c *gin.Context) {
+	snapshots, ok := me.EventStore.(SnapshotStore)
+
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "snapshots not supported by the event store"})
+		return
+	}
+
+	var snapshot Snapshot
+
+	if err := c.ShouldBindJSON(&snapshot); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	snapshot.ID = EventID(c.Param("uuid"))
+
+	if err := snapshots.SaveSnapshot(c.Request.Context(), snapshot); err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// HandleFindSnapshot ...
+func (me *RemoteEventStoreHandler) HandleFindSnapshot(c *gin.Context) {
+	snapshots, ok := me.EventStore.(SnapshotStore)
+
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "snapshots not supported by the event store"})
+		return
+	}
+
+	snapshot, err := snapshots.LatestSnapshot(c.Request.Context(), EventID(c.Param("uuid")))
+
+	if err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// HandleDeleteStream ...
+func (me *RemoteEventStoreHandler) HandleDeleteStream(c *gin.Context) {
+	deleter, ok := me.EventStore.(StreamDeleter)
+
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "stream deletion not supported by the event store"})
+		return
+	}
+
+	version, err := strconv.Atoi(c.Param("version"))
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := deleter.DeleteStream(c.Request.Context(), EventID(c.Param("uuid")), version); err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// HandleFindTombstone ...
+func (me *RemoteEventStoreHandler) HandleFindTombstone(c *gin.Context) {
+	deleter, ok := me.EventStore.(StreamDeleter)
+
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "stream deletion not supported by the event store"})
+		return
+	}
+
+	deleted, err := deleter.Tombstone(c.Request.Context(), EventID(c.Param("uuid")))
+
+	if err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	result := &TombstoneResult{}
+
+	if deleted != nil {
+		result.Version = deleted.Version
+		result.Deleted = deleted.TimeStamp
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// HandlePurgeStream ...
+func (me *RemoteEventStoreHandler) HandlePurgeStream(c *gin.Context) {
+	if _, ok := me.EventStore.(StreamDeleter); !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "stream deletion not supported by the event store"})
+		return
+	}
+
+	if err := PurgeAfter(c.Request.Context(), me.EventStore, EventID(c.Param("uuid")), me.Retention); err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// HandleArchiveStream ...
+func (me *RemoteEventStoreHandler) HandleArchiveStream(c *gin.Context) {
+	archiver, ok := me.EventStore.(StreamArchiver)
+
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "stream archival not supported by the event store"})
+		return
+	}
+
+	if err := archiver.ArchiveStream(c.Request.Context(), EventID(c.Param("uuid"))); err != nil {
+		c.JSON(NewHTTPError(err))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// initializer for the handler of an event store
+func NewRemoteEventStoreHandler(es EventStore) *RemoteEventStoreHandler {
+	return &RemoteEventStoreHandler{EventStore: es}
+}
@@ -2,15 +2,23 @@ package store
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type RemoteEventStoreConfig struct {
 	Host string
+	// AdminHost is the admin address of the server, serving the commands retiring the
+	// streams. These commands fail with ErrAdminDisabled when it is empty
+	AdminHost string
 }
 
 type RemoteEventStore struct {
@@ -20,18 +28,34 @@ type RemoteEventStore struct {
 type FindEventsByTypeResult struct {
 	Events []StoreEvent `json:"events"`
 	Latest int64        `json:"latest"`
+	Cursor Cursor       `json:"cursor,omitempty"`
 }
 
 // @see EventStore.Find
-func (es *RemoteEventStore) Find(guid EventID) ([]StoreEvent, error) {
+func (es *RemoteEventStore) Find(ctx context.Context, guid EventID) ([]StoreEvent, error) {
+	return es.FindRange(ctx, guid, StreamRange{})
+}
+
+// @see EventStore.FindRange
+func (es *RemoteEventStore) FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error) {
 	api := fmt.Sprintf("%s/api/v1/events/%s", es.config.Host, guid)
 
-	resp, err := http.Get(api)
+	if query := r.queryValues().Encode(); query != "" {
+		api += "?" + query
+	}
+
+	resp, err := es.do(ctx, http.MethodGet, api, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorFromResponse(resp)
+	}
+
 	jsondata, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
@@ -48,7 +72,7 @@ func (es *RemoteEventStore) Find(guid EventID) ([]StoreEvent, error) {
 	return tmp.Events, nil
 }
 
-func (es *RemoteEventStore) Update(guid EventID, expectedVersion int, events []StoreEvent) error {
+func (es *RemoteEventStore) Update(ctx context.Context, guid EventID, expectedVersion int, events []StoreEvent) error {
 	api := fmt.Sprintf("%s/api/v1/events/%s/%d", es.config.Host, guid, expectedVersion)
 
 	var eventsArray []string
@@ -64,35 +88,50 @@ func (es *RemoteEventStore) Update(guid EventID, expectedVersion int, events []S
 	}
 
 	jsondata := fmt.Sprintf("[%s]", strings.Join(eventsArray, ","))
-	resp, err := http.Post(api, "application/json", bytes.NewBuffer([]byte(jsondata)))
+	resp, err := es.do(ctx, http.MethodPost, api, bytes.NewBuffer([]byte(jsondata)))
 
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		fullerror, err := ioutil.ReadAll(resp.Body)
-
-		if err != nil {
-			return err
-		}
+	defer resp.Body.Close()
 
-		return fmt.Errorf("%s", fullerror)
+	if resp.StatusCode != http.StatusOK {
+		return errorFromResponse(resp)
 	}
 
 	return nil
 }
 
-func (es *RemoteEventStore) GetEventsByType(etype EventType, sinceMillis int64, batchSize int) (events []StoreEvent, latest int64, theError error) {
-	api := fmt.Sprintf("%s/api/v1/types/%d?size=%d&since=%d", es.config.Host, int(etype), batchSize, sinceMillis)
+// @see EventStore.GetEventsByType
+func (es *RemoteEventStore) GetEventsByType(ctx context.Context, query TypeQuery) (events []StoreEvent, next Cursor, theError error) {
+	next = query.After
+
+	// the path holds either all or the types, check that the query is not ambiguous
+	if theError = query.validate(); theError != nil {
+		return
+	}
+
+	api := fmt.Sprintf("%s/api/v1/types/%s", es.config.Host, query.formatTypes())
+
+	if values := query.queryValues().Encode(); values != "" {
+		api += "?" + values
+	}
 
-	resp, err := http.Get(api)
+	resp, err := es.do(ctx, http.MethodGet, api, nil)
 
 	if err != nil {
 		theError = err
 		return
 	}
 
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		theError = errorFromResponse(resp)
+		return
+	}
+
 	// read all the response bytes
 	jsondata, err := ioutil.ReadAll(resp.Body)
 
@@ -110,7 +149,323 @@ func (es *RemoteEventStore) GetEventsByType(etype EventType, sinceMillis int64,
 		return
 	}
 
-	return findResult.Events, findResult.Latest, nil
+	return findResult.Events, findResult.Cursor, nil
+}
+
+// do sends the request bound to ctx, so that a cancelled caller
+// also aborts the HTTP round trip
+func (es *RemoteEventStore) do(ctx context.Context, method string, api string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, api, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+// @see SnapshotStore.SaveSnapshot
+func (es *RemoteEventStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	api := fmt.Sprintf("%s/api/v1/snapshots/%s", es.config.Host, snapshot.ID)
+
+	jsondata, err := json.Marshal(snapshot)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := es.do(ctx, http.MethodPost, api, bytes.NewBuffer(jsondata))
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errorFromResponse(resp)
+	}
+
+	return nil
+}
+
+// @see SnapshotStore.LatestSnapshot
+func (es *RemoteEventStore) LatestSnapshot(ctx context.Context, guid EventID) (*Snapshot, error) {
+	api := fmt.Sprintf("%s/api/v1/snapshots/%s", es.config.Host, guid)
+
+	resp, err := es.do(ctx, http.MethodGet, api, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorFromResponse(resp)
+	}
+
+	jsondata, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(jsondata, &snapshot); err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// @see StreamDeleter.DeleteStream
+func (es *RemoteEventStore) DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error {
+	return es.streamCommand(ctx, http.MethodDelete, fmt.Sprintf("/api/v1/events/%s/%d", guid, expectedVersion))
+}
+
+// @see StreamDeleter.Tombstone
+func (es *RemoteEventStore) Tombstone(ctx context.Context, guid EventID) (*DeletedError, error) {
+	api := fmt.Sprintf("%s/api/v1/streams/%s/tombstone", es.config.Host, guid)
+
+	resp, err := es.do(ctx, http.MethodGet, api, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorFromResponse(resp)
+	}
+
+	jsondata, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result TombstoneResult
+	if err := json.Unmarshal(jsondata, &result); err != nil {
+		return nil, err
+	}
+
+	if result.Deleted == 0 {
+		return nil, nil
+	}
+
+	return &DeletedError{ID: guid, Version: result.Version, TimeStamp: result.Deleted}, nil
+}
+
+// @see StreamDeleter.PurgeStream. The server purges the stream only once its deletion
+// is older than the retention it is configured with, ErrRetained before that
+func (es *RemoteEventStore) PurgeStream(ctx context.Context, guid EventID) error {
+	return es.streamCommand(ctx, http.MethodPost, fmt.Sprintf("/api/v1/streams/%s/purge", guid))
+}
+
+// @see StreamArchiver.ArchiveStream
+func (es *RemoteEventStore) ArchiveStream(ctx context.Context, guid EventID) error {
+	return es.streamCommand(ctx, http.MethodPost, fmt.Sprintf("/api/v1/streams/%s/archive", guid))
+}
+
+// streamCommand sends one of the commands on a stream, which have no body, to the
+// admin address of the server
+func (es *RemoteEventStore) streamCommand(ctx context.Context, method string, path string) error {
+	if es.config.AdminHost == "" {
+		return ErrAdminDisabled
+	}
+
+	resp, err := es.do(ctx, method, es.config.AdminHost+path, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errorFromResponse(resp)
+	}
+
+	return nil
+}
+
+// queryValues encodes the range as the query parameters of the find by id API
+func (r StreamRange) queryValues() url.Values {
+	values := url.Values{}
+
+	if r.AfterVersion > 0 {
+		values.Set("after", strconv.Itoa(r.AfterVersion))
+	}
+
+	if r.UpToVersion > 0 {
+		values.Set("upto", strconv.Itoa(r.UpToVersion))
+	}
+
+	if r.AsOf > 0 {
+		values.Set("asof", strconv.FormatInt(r.AsOf, 10))
+	}
+
+	if r.LastOnly {
+		values.Set("last", "true")
+	}
+
+	return values
+}
+
+// ParseStreamRange decodes the query parameters of the find by id API
+func ParseStreamRange(values url.Values) (StreamRange, error) {
+	var r StreamRange
+	var err error
+
+	if v := values.Get("after"); v != "" {
+		if r.AfterVersion, err = strconv.Atoi(v); err != nil {
+			return r, invalidArgumentf("after: %v", err)
+		}
+	}
+
+	if v := values.Get("upto"); v != "" {
+		if r.UpToVersion, err = strconv.Atoi(v); err != nil {
+			return r, invalidArgumentf("upto: %v", err)
+		}
+	}
+
+	if v := values.Get("asof"); v != "" {
+		if r.AsOf, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return r, invalidArgumentf("asof: %v", err)
+		}
+	}
+
+	if v := values.Get("last"); v != "" {
+		if r.LastOnly, err = strconv.ParseBool(v); err != nil {
+			return r, invalidArgumentf("last: %v", err)
+		}
+	}
+
+	return r, r.Validate()
+}
+
+// queryValues encodes the query as the query parameters of the find by type API
+func (q TypeQuery) queryValues() url.Values {
+	values := url.Values{}
+
+	if q.After != "" {
+		values.Set("cursor", string(q.After))
+	}
+
+	if q.BatchSize > 0 {
+		values.Set("size", strconv.Itoa(q.BatchSize))
+	}
+
+	if q.Settle > 0 {
+		values.Set("settle", strconv.FormatInt(int64(q.Settle/time.Millisecond), 10))
+	}
+
+	return values
+}
+
+// formatTypes returns the types of the query as in the path of the find by type API:
+// a type, a comma separated list of types and type names, or all
+func (q TypeQuery) formatTypes() string {
+	if q.AllTypes {
+		return "all"
+	}
+
+	var types []string
+
+	if len(q.Types) == 0 && (q.Type != 0 || len(q.TypeNames) == 0) {
+		types = append(types, strconv.Itoa(int(q.Type)))
+	}
+
+	for _, etype := range q.Types {
+		types = append(types, strconv.Itoa(int(etype)))
+	}
+
+	types = append(types, q.TypeNames...)
+
+	return strings.Join(types, ",")
+}
+
+// parseTypes sets the types of the query from the path of the find by type API, see formatTypes
+func (q *TypeQuery) parseTypes(s string) error {
+	if s == "all" {
+		q.AllTypes = true
+		return nil
+	}
+
+	var types []EventType
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+
+		if validTypeName(field) {
+			q.TypeNames = append(q.TypeNames, field)
+			continue
+		}
+
+		etype, err := strconv.Atoi(field)
+
+		if err != nil {
+			return invalidArgumentf("event type %q", field)
+		}
+
+		types = append(types, EventType(etype))
+	}
+
+	if len(types) == 1 {
+		q.Type = types[0]
+	} else {
+		q.Types = types
+	}
+
+	return nil
+}
+
+// ParseTypeQuery decodes the query parameters of the find by type API. The legacy
+// since parameter selects the events saved after the given time in millis
+func ParseTypeQuery(etype EventType, values url.Values) (TypeQuery, error) {
+	q := TypeQuery{Type: etype, After: Cursor(values.Get("cursor"))}
+
+	if v := values.Get("since"); v != "" && q.After == "" {
+		since, err := strconv.ParseInt(v, 10, 64)
+
+		if err != nil {
+			return q, invalidArgumentf("since: %v", err)
+		}
+
+		q.After = CursorFrom(since + 1)
+	}
+
+	if v := values.Get("size"); v != "" {
+		size, err := strconv.Atoi(v)
+
+		if err != nil {
+			return q, invalidArgumentf("size: %v", err)
+		}
+
+		q.BatchSize = size
+	}
+
+	if v := values.Get("settle"); v != "" {
+		settle, err := strconv.ParseInt(v, 10, 64)
+
+		if err != nil {
+			return q, invalidArgumentf("settle: %v", err)
+		}
+
+		q.Settle = time.Duration(settle) * time.Millisecond
+	}
+
+	if _, err := q.After.Decode(); err != nil {
+		return q, err
+	}
+
+	return q, nil
 }
 
 // initializer for event store
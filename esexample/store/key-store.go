@@ -0,0 +1,259 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The data keys of the aggregates are kept wrapped by the key encryption key of the
+// EncryptedEventStore, so that the key store alone reveals nothing. Shredding the key of
+// an aggregate is for good: its payloads can't be decrypted anymore and it can't get a new
+// key, so that the erasure of a subject is not undone by writing to its stream again
+
+// KeyStore keeps the wrapped data key of each aggregate
+type KeyStore interface {
+	// DataKey returns the wrapped data key of the aggregate, ErrNotFound if it has none
+	// and ErrShredded if it was shredded
+	DataKey(ctx context.Context, guid EventID) ([]byte, error)
+
+	// CreateDataKey records the wrapped data key of an aggregate without one and returns the
+	// key the aggregate ends up with, the one of a concurrent writer that came first.
+	// ErrShredded if the key of the aggregate was shredded
+	CreateDataKey(ctx context.Context, guid EventID, wrapped []byte) ([]byte, error)
+
+	// ShredDataKey deletes the data key of the aggregate for good, whether it has one or not
+	ShredDataKey(ctx context.Context, guid EventID) error
+}
+
+func shredded(guid EventID) error {
+	return fmt.Errorf("%w: data key of aggregate %s", ErrShredded, guid)
+}
+
+// FileKeyring is a KeyStore in a JSON file rewritten on every change, for development and
+// single node setups. The changes are made under a lock of the file, on its latest content,
+// so that es-shred may shred a key while a server uses the keyring; the reads pick up the
+// changes of the other processes from the file when it was replaced. An empty Path keeps
+// the keys in memory only
+type FileKeyring struct {
+	Path string
+
+	mutex  sync.Mutex
+	ring   fileKeyringData
+	loaded os.FileInfo // the file the keys were read from, nil if none was
+}
+
+// fileKeyringData is the content of the file, the keys base64 encoded
+type fileKeyringData struct {
+	Keys     map[EventID][]byte `json:"keys"`
+	Shredded map[EventID]int64  `json:"shredded"` // time of the shredding in millis
+}
+
+// initializer for a keyring, reading the keys of its file when it exists
+func NewFileKeyring(path string) (*FileKeyring, error) {
+	k := &FileKeyring{Path: path}
+	k.ring.Keys = map[EventID][]byte{}
+	k.ring.Shredded = map[EventID]int64{}
+
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// reload reads the keys of the file again when it was replaced since they were read.
+// The file is replaced atomically, so it is read without taking its lock
+func (k *FileKeyring) reload() error {
+	if k.Path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(k.Path)
+
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case k.loaded != nil && os.SameFile(info, k.loaded) && info.ModTime().Equal(k.loaded.ModTime()):
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(k.Path)
+
+	if err != nil {
+		return err
+	}
+
+	var ring fileKeyringData
+
+	if err := json.Unmarshal(data, &ring); err != nil {
+		return fmt.Errorf("reading keyring %s: %w", k.Path, err)
+	}
+
+	if ring.Keys == nil {
+		ring.Keys = map[EventID][]byte{}
+	}
+
+	if ring.Shredded == nil {
+		ring.Shredded = map[EventID]int64{}
+	}
+
+	k.ring, k.loaded = ring, info
+
+	return nil
+}
+
+// lock takes the lock of the file of the keyring and reloads its keys, for a change
+func (k *FileKeyring) lock() (func() error, error) {
+	if k.Path == "" {
+		return func() error { return nil }, nil
+	}
+
+	unlock, err := lockFile(k.Path + ".lock")
+
+	if err != nil {
+		return nil, fmt.Errorf("locking keyring %s: %w", k.Path, err)
+	}
+
+	if err := k.reload(); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	return unlock, nil
+}
+
+// @see KeyStore.DataKey
+func (k *FileKeyring) DataKey(ctx context.Context, guid EventID) ([]byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := k.ring.Shredded[guid]; ok {
+		return nil, shredded(guid)
+	}
+
+	key, ok := k.ring.Keys[guid]
+
+	if !ok {
+		return nil, fmt.Errorf("%w: no data key for aggregate %s", ErrNotFound, guid)
+	}
+
+	return append([]byte{}, key...), nil
+}
+
+// @see KeyStore.CreateDataKey
+func (k *FileKeyring) CreateDataKey(ctx context.Context, guid EventID, wrapped []byte) ([]byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	unlock, err := k.lock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlock()
+
+	if _, ok := k.ring.Shredded[guid]; ok {
+		return nil, shredded(guid)
+	}
+
+	if key, ok := k.ring.Keys[guid]; ok {
+		return append([]byte{}, key...), nil
+	}
+
+	k.ring.Keys[guid] = append([]byte{}, wrapped...)
+
+	if err := k.save(); err != nil {
+		delete(k.ring.Keys, guid)
+		return nil, err
+	}
+
+	return wrapped, nil
+}
+
+// @see KeyStore.ShredDataKey
+func (k *FileKeyring) ShredDataKey(ctx context.Context, guid EventID) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	unlock, err := k.lock()
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	if _, ok := k.ring.Shredded[guid]; ok {
+		return nil
+	}
+
+	key, had := k.ring.Keys[guid]
+
+	delete(k.ring.Keys, guid)
+	k.ring.Shredded[guid] = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := k.save(); err != nil {
+		if had {
+			k.ring.Keys[guid] = key
+		}
+		delete(k.ring.Shredded, guid)
+		return err
+	}
+
+	return nil
+}
+
+// save replaces the file with the keys, atomically, so that a shredded key is not left behind
+func (k *FileKeyring) save() error {
+	if k.Path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(&k.ring)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := k.Path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(tmp, os.O_RDWR, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, k.Path); err != nil {
+		return err
+	}
+
+	// the keys are the ones of the new file
+	if info, err := os.Stat(k.Path); err == nil {
+		k.loaded = info
+	}
+
+	return syncDir(filepath.Dir(k.Path))
+}
@@ -1,23 +1,93 @@
 package store
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
+// MemEventStore keeps the events in memory, it is safe for concurrent use.
+// Concurrent updates of an aggregate behave as in CassandraEventStore:
+// one of them is applied, the others get a ConcurrencyError
 type MemEventStore struct {
+	mutex        sync.RWMutex
 	eventsByGuid map[EventID][]StoreEvent
 	eventsByType map[EventType][]StoreEvent
+	snapshots    map[EventID]Snapshot
+	tombstones   map[EventID]DeletedError
+	typeNames    *typeDirectory
+	seq          int64         // commit sequence of the last event, orders the events by type
+	changed      chan struct{} // closed and replaced on every update, see Changed
 }
 
 // @see EventStore.Find
-func (es *MemEventStore) Find(guid EventID) ([]StoreEvent, error) {
-	result := es.eventsByGuid[guid]
+func (es *MemEventStore) Find(ctx context.Context, guid EventID) ([]StoreEvent, error) {
+	return es.FindRange(ctx, guid, StreamRange{})
+}
+
+// @see EventStore.FindRange
+func (es *MemEventStore) FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	if tombstone, ok := es.tombstones[guid]; ok {
+		return nil, &tombstone
+	}
+
+	events, ok := es.eventsByGuid[guid]
+
+	if !ok {
+		return nil, notFound(guid)
+	}
+
+	result := []StoreEvent{}
+	for _, e := range events {
+		if r.Includes(e) {
+			e.Metadata = copyMetadata(e.Metadata)
+			e.Payload = copyPayload(e.Payload)
+			result = append(result, e)
+		}
+	}
+
+	if r.LastOnly && len(result) > 1 {
+		result = result[len(result)-1:]
+	}
+
 	return result, nil
 }
 
 // @see EventStore.Update
-func (es *MemEventStore) Update(guid EventID, expectedVersion int, events []StoreEvent) error {
+func (es *MemEventStore) Update(ctx context.Context, guid EventID, expectedVersion int, events []StoreEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateUpdate(guid, expectedVersion, events); err != nil {
+		return err
+	}
+
+	bindings, _ := typeBindings(events)
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	if err := es.typeNames.check(bindings); err != nil {
+		return err
+	}
+
+	if tombstone, ok := es.tombstones[guid]; ok {
+		return &tombstone
+	}
 
 	// create a list of the event instance if missing
 	eventsListByGuid, okByGuid := es.eventsByGuid[guid]
@@ -28,14 +98,21 @@ func (es *MemEventStore) Update(guid EventID, expectedVersion int, events []Stor
 
 	// naive implementation
 	if len(eventsListByGuid) == expectedVersion {
-		for _, e := range events {
+		now := time.Now().UnixNano() / int64(time.Millisecond)
 
-			if e.TimeStamp == 0 {
-				e.TimeStamp = time.Now().UnixNano() / int64(time.Millisecond)
-			}
+		for i, e := range events {
+			e.ID = guid
+			e.Version = expectedVersion + 1 + i
+			e.TimeStamp = now
+			e.Metadata = copyMetadata(e.Metadata)
+			e.Payload = copyPayload(e.Payload)
+			e.Cursor = ""
 
 			es.eventsByGuid[guid] = append(es.eventsByGuid[guid], e)
 
+			es.seq++
+			e.Cursor = EncodeCursor(Position{SaveTime: e.TimeStamp, Version: e.Version, ID: guid, Seq: es.seq})
+
 			if evts, ok := es.eventsByType[e.Type]; ok {
 				es.eventsByType[e.Type] = append(evts, e)
 			} else {
@@ -43,30 +120,268 @@ func (es *MemEventStore) Update(guid EventID, expectedVersion int, events []Stor
 			}
 		}
 	} else {
-		return fmt.Errorf("OPTIMISTIC LOCKING EXCEPTION - client has version %v, but store %v", expectedVersion, len(eventsListByGuid))
+		return NewConcurrencyError(guid, expectedVersion, len(eventsListByGuid))
 	}
+
+	es.typeNames.bind(bindings)
+
+	// wake up whoever is waiting for new events
+	close(es.changed)
+	es.changed = make(chan struct{})
+
 	return nil
 }
 
+// Changed returns a channel which is closed by the next successful Update
+func (es *MemEventStore) Changed() <-chan struct{} {
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	return es.changed
+}
+
 // @see EventStore.GetEventsByType
-func (es *MemEventStore) GetEventsByType(etype EventType, since int64, batchSize int) ([]StoreEvent, int64, error) {
-	events := es.eventsByType[etype]
+func (es *MemEventStore) GetEventsByType(ctx context.Context, query TypeQuery) ([]StoreEvent, Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, query.After, err
+	}
+
+	if err := query.validate(); err != nil {
+		return nil, query.After, err
+	}
+
+	after, _ := query.After.Decode()
+
+	batchSize := query.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	settleLimit := query.settleLimit(time.Now())
 	result := []StoreEvent{}
-	next := 0
-	latestTime := int64(0)
-	for _, e := range events {
-		if since == 0 || e.TimeStamp > since {
+	next := query.After
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	types := query.resolve(es.typeNames.lookup(query.TypeNames)).types()
+
+	if types == nil {
+		for etype := range es.eventsByType {
+			types = append(types, etype)
+		}
+	}
+
+	// events by type are in commit order, their cursor carries the sequence
+	for _, etype := range types {
+		selected := 0
+
+		for _, e := range es.eventsByType[etype] {
+			if selected >= batchSize {
+				break
+			}
+
+			if settleLimit > 0 && e.TimeStamp > settleLimit {
+				break
+			}
+
+			if !isAfter(e, after) {
+				continue
+			}
+
+			e.Metadata = copyMetadata(e.Metadata)
+			e.Payload = copyPayload(e.Payload)
 			result = append(result, e)
-			latestTime = e.TimeStamp
-			next++
+			selected++
 		}
+	}
+
+	// the events of several types are merged in commit order
+	if len(types) > 1 {
+		sort.Slice(result, func(i, j int) bool { return seqOf(result[i]) < seqOf(result[j]) })
 
-		if next >= batchSize {
-			break
+		if len(result) > batchSize {
+			result = result[:batchSize]
 		}
 	}
 
-	return result, latestTime, nil
+	if len(result) > 0 {
+		next = result[len(result)-1].Cursor
+	}
+
+	return result, next, nil
+}
+
+// @see EventTypeDirectory.EventTypeCodes
+func (es *MemEventStore) EventTypeCodes(ctx context.Context, names []string) (map[string]EventType, error) {
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	return es.typeNames.lookup(names), nil
+}
+
+// seqOf returns the commit sequence of an event of a sequence ordered store
+func seqOf(e StoreEvent) int64 {
+	p, _ := e.Cursor.Decode()
+	return p.Seq
+}
+
+// isAfter tells whether an event of a sequence ordered store follows the position
+func isAfter(e StoreEvent, after Position) bool {
+	if after.Seq > 0 {
+		return seqOf(e) > after.Seq
+	}
+
+	return e.TimeStamp >= after.SaveTime
+}
+
+// @see SnapshotStore.SaveSnapshot
+func (es *MemEventStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	// only the latest snapshot is ever read back
+	if latest, ok := es.snapshots[snapshot.ID]; ok && latest.Version > snapshot.Version {
+		return nil
+	}
+
+	snapshot.TimeStamp = time.Now().UnixNano() / int64(time.Millisecond)
+	snapshot.Payload = copyPayload(snapshot.Payload)
+	es.snapshots[snapshot.ID] = snapshot
+
+	return nil
+}
+
+// @see SnapshotStore.LatestSnapshot
+func (es *MemEventStore) LatestSnapshot(ctx context.Context, guid EventID) (*Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	es.mutex.RLock()
+	snapshot, ok := es.snapshots[guid]
+	es.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: no snapshot of aggregate %s", ErrNotFound, guid)
+	}
+
+	snapshot.Payload = copyPayload(snapshot.Payload)
+
+	return &snapshot, nil
+}
+
+// @see StreamDeleter.DeleteStream
+func (es *MemEventStore) DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if guid == "" || expectedVersion < 0 {
+		return invalidArgumentf("deletion of aggregate %q at version %d", guid, expectedVersion)
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	if _, ok := es.tombstones[guid]; ok {
+		return nil
+	}
+
+	events, ok := es.eventsByGuid[guid]
+
+	if !ok {
+		return notFound(guid)
+	}
+
+	if len(events) != expectedVersion {
+		return NewConcurrencyError(guid, expectedVersion, len(events))
+	}
+
+	es.tombstones[guid] = DeletedError{ID: guid, Version: expectedVersion, TimeStamp: time.Now().UnixNano() / int64(time.Millisecond)}
+
+	return nil
+}
+
+// @see StreamDeleter.Tombstone
+func (es *MemEventStore) Tombstone(ctx context.Context, guid EventID) (*DeletedError, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	if tombstone, ok := es.tombstones[guid]; ok {
+		return &tombstone, nil
+	}
+
+	if _, ok := es.eventsByGuid[guid]; !ok {
+		return nil, notFound(guid)
+	}
+
+	return nil, nil
+}
+
+// @see StreamDeleter.PurgeStream
+func (es *MemEventStore) PurgeStream(ctx context.Context, guid EventID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	if _, ok := es.tombstones[guid]; !ok {
+		if _, ok := es.eventsByGuid[guid]; !ok {
+			return notFound(guid)
+		}
+		return invalidArgumentf("aggregate %s is not deleted", guid)
+	}
+
+	for _, e := range es.eventsByGuid[guid] {
+		kept := es.eventsByType[e.Type][:0]
+
+		for _, other := range es.eventsByType[e.Type] {
+			if other.ID != guid {
+				kept = append(kept, other)
+			}
+		}
+
+		es.eventsByType[e.Type] = kept
+	}
+
+	delete(es.eventsByGuid, guid)
+	delete(es.snapshots, guid)
+
+	return nil
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	result := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		result[k] = v
+	}
+	return result
+}
+
+func copyPayload(payload EventPayload) EventPayload {
+	if payload == nil {
+		return nil
+	}
+	return append(EventPayload{}, payload...)
 }
 
 // initializer for event store
@@ -74,5 +389,9 @@ func NewInMemStore() *MemEventStore {
 	return &MemEventStore{
 		eventsByGuid: map[EventID][]StoreEvent{},
 		eventsByType: map[EventType][]StoreEvent{},
+		snapshots:    map[EventID]Snapshot{},
+		tombstones:   map[EventID]DeletedError{},
+		typeNames:    newTypeDirectory(),
+		changed:      make(chan struct{}),
 	}
 }
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemStoreAssignsVersionAndTime(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}, {Type: 2, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.Update(ctx, "uuid", 2, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, err := es.Find(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	for i, e := range events {
+		if e.ID != "uuid" || e.Version != i+1 || e.TimeStamp == 0 {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+
+	byType, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1, BatchSize: 10})
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if len(byType) != 2 || byType[0].Version != 1 || byType[1].Version != 3 {
+		t.Errorf("unexpected events by type %+v", byType)
+	}
+}
+
+func TestMemStoreFindRange(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+
+	for v := 0; v < 5; v++ {
+		if err := es.Update(ctx, "uuid", v, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	versions := func(r StreamRange) []int {
+		events, err := es.FindRange(ctx, "uuid", r)
+
+		if err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		result := []int{}
+		for _, e := range events {
+			result = append(result, e.Version)
+		}
+		return result
+	}
+
+	assert.Equal(t, []int{3, 4, 5}, versions(StreamRange{AfterVersion: 2}))
+	assert.Equal(t, []int{1, 2}, versions(StreamRange{UpToVersion: 2}))
+	assert.Equal(t, []int{4}, versions(StreamRange{UpToVersion: 4, LastOnly: true}))
+	assert.Equal(t, []int{}, versions(StreamRange{AfterVersion: 5}))
+
+	if _, err := es.FindRange(ctx, "uuid", StreamRange{AfterVersion: 3, UpToVersion: 3}); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+
+	if _, err := es.FindRange(ctx, "missing", StreamRange{AfterVersion: 3}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+}
+
+func TestMemStoreConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+
+	const writers = 20
+	errs := make(chan error, writers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}, {Type: 2, Payload: EventPayload("{}")}})
+			es.GetEventsByType(ctx, TypeQuery{Type: 1})
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	applied := 0
+	for err := range errs {
+		var conflict *ConcurrencyError
+
+		switch {
+		case err == nil:
+			applied++
+		case errors.As(err, &conflict):
+			if conflict.Actual != 2 {
+				t.Errorf("unexpected conflict %+v", conflict)
+			}
+		default:
+			t.Errorf("unexpected error %+v", err)
+		}
+	}
+
+	if applied != 1 {
+		t.Errorf("expected exactly one update applied, got %d", applied)
+	}
+
+	if events, _ := es.Find(ctx, "uuid"); len(events) != 2 {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestMemStoreChanged(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+	changed := es.Changed()
+
+	select {
+	case <-changed:
+		t.Fatal("changed before any update")
+	default:
+	}
+
+	if err := es.Update(ctx, "uuid", 1, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err == nil {
+		t.Fatal("expected a conflict")
+	}
+
+	select {
+	case <-changed:
+		t.Fatal("changed by a failed update")
+	default:
+	}
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	select {
+	case <-changed:
+	default:
+		t.Error("not changed by the update")
+	}
+}
@@ -0,0 +1,34 @@
+package store
+
+import "context"
+
+// Well known keys of the event metadata
+const (
+	MetadataCorrelationID = "correlation_id" // id shared by all the messages of a workflow
+	MetadataCausationID   = "causation_id"   // id of the message that caused the event
+	MetadataPrincipal     = "principal"      // user acting on the aggregate
+	MetadataSource        = "source"         // service that produced the event
+)
+
+type metadataKey struct{}
+
+// WithMetadata returns a copy of ctx carrying the given metadata entry,
+// to be attached to the events stored on behalf of ctx
+func WithMetadata(ctx context.Context, key string, value string) context.Context {
+	metadata := MetadataFromContext(ctx)
+	metadata[key] = value
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+// MetadataFromContext returns a copy of the metadata carried by ctx
+func MetadataFromContext(ctx context.Context) map[string]string {
+	metadata := map[string]string{}
+
+	if m, ok := ctx.Value(metadataKey{}).(map[string]string); ok {
+		for k, v := range m {
+			metadata[k] = v
+		}
+	}
+
+	return metadata
+}
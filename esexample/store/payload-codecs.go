@@ -0,0 +1,168 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+// The payloads are bytes, marked with the content type of their codec. A payload
+// may be compressed on top of its encoding, which appends gzipSuffix to its content
+// type: decoding it uncompresses it first, whatever the compression of the writer.
+// The payloads written before the content types were recorded are JSON
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+
+	gzipSuffix = "+gzip"
+)
+
+// EventCodec turns the events into payloads and back
+type EventCodec interface {
+	// ContentType returns the content type of the payloads, as ContentTypeJSON
+	ContentType() string
+
+	Encode(e Event) (EventPayload, error)
+
+	// Decode fills in the event given by the mapper of its type
+	Decode(payload EventPayload, e Event) error
+}
+
+// CodecFor returns the codec of the payloads of the given content type, JSON for none
+func CodecFor(contentType string) (EventCodec, bool) {
+	switch strings.TrimSuffix(contentType, gzipSuffix) {
+	case "", ContentTypeJSON:
+		return JSONCodec{}, true
+	case ContentTypeProtobuf:
+		return ProtobufCodec{}, true
+	case ContentTypeMsgpack:
+		return MsgpackCodec{}, true
+	}
+	return nil, false
+}
+
+// JSONCodec encodes the events as JSON
+type JSONCodec struct{}
+
+// @see EventCodec.ContentType
+func (JSONCodec) ContentType() string { return ContentTypeJSON }
+
+// @see EventCodec.Encode
+func (JSONCodec) Encode(e Event) (EventPayload, error) {
+	b, err := json.Marshal(e)
+	return EventPayload(b), err
+}
+
+// @see EventCodec.Decode
+func (JSONCodec) Decode(payload EventPayload, e Event) error {
+	return json.Unmarshal(payload, e)
+}
+
+// ProtobufCodec encodes the events generated from protocol buffers, the other events are refused
+type ProtobufCodec struct{}
+
+// @see EventCodec.ContentType
+func (ProtobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+// @see EventCodec.Encode
+func (ProtobufCodec) Encode(e Event) (EventPayload, error) {
+	m, ok := e.(proto.Message)
+
+	if !ok {
+		return nil, fmt.Errorf("event %T is not a protocol buffer", e)
+	}
+
+	b, err := proto.Marshal(m)
+	return EventPayload(b), err
+}
+
+// @see EventCodec.Decode
+func (ProtobufCodec) Decode(payload EventPayload, e Event) error {
+	m, ok := e.(proto.Message)
+
+	if !ok {
+		return fmt.Errorf("event %T is not a protocol buffer", e)
+	}
+
+	return proto.Unmarshal(payload, m)
+}
+
+// msgpackHandle writes the strings and the bytes apart, the fields are named by their json tags
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// MsgpackCodec encodes the events as MessagePack, with the field names of JSON
+type MsgpackCodec struct{}
+
+// @see EventCodec.ContentType
+func (MsgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+// @see EventCodec.Encode
+func (MsgpackCodec) Encode(e Event) (EventPayload, error) {
+	var b []byte
+	err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(e)
+	return EventPayload(b), err
+}
+
+// @see EventCodec.Decode
+func (MsgpackCodec) Decode(payload EventPayload, e Event) error {
+	return codec.NewDecoderBytes(payload, msgpackHandle).Decode(e)
+}
+
+// Compress gzips the payload of the event if it has at least threshold bytes, 0 for never
+func Compress(e StoreEvent, threshold int) (StoreEvent, error) {
+	if threshold <= 0 || len(e.Payload) < threshold || strings.HasSuffix(e.ContentType, gzipSuffix) {
+		return e, nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+
+	if _, err := w.Write(e.Payload); err != nil {
+		return e, err
+	}
+
+	if err := w.Close(); err != nil {
+		return e, err
+	}
+
+	if e.ContentType == "" {
+		e.ContentType = ContentTypeJSON
+	}
+
+	e.Payload = EventPayload(buf.Bytes())
+	e.ContentType += gzipSuffix
+
+	return e, nil
+}
+
+// Uncompress restores the payload of an event compressed by Compress
+func Uncompress(e StoreEvent) (StoreEvent, error) {
+	if !strings.HasSuffix(e.ContentType, gzipSuffix) {
+		return e, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(e.Payload))
+
+	if err != nil {
+		return e, fmt.Errorf("uncompressing event %s version %d: %w", e.ID, e.Version, err)
+	}
+
+	payload, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return e, fmt.Errorf("uncompressing event %s version %d: %w", e.ID, e.Version, err)
+	}
+
+	e.Payload = EventPayload(payload)
+	e.ContentType = strings.TrimSuffix(e.ContentType, gzipSuffix)
+
+	return e, nil
+}
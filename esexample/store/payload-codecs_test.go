@@ -0,0 +1,150 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// observed is an event generated from protocol buffers
+type observed struct {
+	*wrapperspb.StringValue
+}
+
+func (e observed) GetEventType() EventType { return 7 }
+
+func TestPayloadCodecs(t *testing.T) {
+	for _, codec := range []EventCodec{JSONCodec{}, MsgpackCodec{}} {
+		e := &counterIncremented{ID: "uuid", By: 3}
+		payload, err := codec.Encode(e)
+
+		if err != nil {
+			t.Fatalf("%s: unexpected error %+v", codec.ContentType(), err)
+		}
+
+		var decoded counterIncremented
+
+		if err := codec.Decode(payload, &decoded); err != nil || decoded != *e {
+			t.Errorf("%s: unexpected event %+v, error %+v", codec.ContentType(), decoded, err)
+		}
+
+		if found, ok := CodecFor(codec.ContentType() + gzipSuffix); !ok || reflect.TypeOf(found) != reflect.TypeOf(codec) {
+			t.Errorf("%s: unexpected codec %T", codec.ContentType(), found)
+		}
+	}
+
+	// the fields of msgpack are named after the json tags
+	payload, _ := MsgpackCodec{}.Encode(&counterIncremented{ID: "uuid", By: 3})
+
+	if !bytes.Contains(payload, []byte("by")) || bytes.Contains(payload, []byte("By")) {
+		t.Errorf("unexpected msgpack payload %q", payload)
+	}
+
+	payload, err := ProtobufCodec{}.Encode(observed{wrapperspb.String("heart rate")})
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	decoded := observed{&wrapperspb.StringValue{}}
+
+	if err := (ProtobufCodec{}).Decode(payload, decoded); err != nil || decoded.Value != "heart rate" {
+		t.Errorf("unexpected event %+v, error %+v", decoded, err)
+	}
+
+	if _, err := (ProtobufCodec{}).Encode(&counterIncremented{}); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	if codec, ok := CodecFor(""); !ok || codec.ContentType() != ContentTypeJSON {
+		t.Errorf("unexpected codec %T", codec)
+	}
+
+	if _, ok := CodecFor("text/csv"); ok {
+		t.Errorf("unexpected codec")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := StoreEvent{ContentType: ContentTypeMsgpack, Payload: EventPayload(strings.Repeat("beat ", 100))}
+	small := StoreEvent{Payload: EventPayload(`{}`)}
+
+	compressed, err := Compress(large, 100)
+
+	if err != nil || compressed.ContentType != ContentTypeMsgpack+gzipSuffix || len(compressed.Payload) >= len(large.Payload) {
+		t.Fatalf("unexpected compression %+v, error %+v", compressed, err)
+	}
+
+	// compressing twice does nothing
+	if again, _ := Compress(compressed, 1); !bytes.Equal(again.Payload, compressed.Payload) {
+		t.Errorf("compressed twice")
+	}
+
+	if e, err := Uncompress(compressed); err != nil || e.ContentType != ContentTypeMsgpack || !bytes.Equal(e.Payload, large.Payload) {
+		t.Errorf("unexpected payload %+v, error %+v", e, err)
+	}
+
+	// the legacy payloads are JSON
+	if e, _ := Compress(small, 1); e.ContentType != ContentTypeJSON+gzipSuffix {
+		t.Errorf("unexpected content type %s", e.ContentType)
+	}
+
+	for _, threshold := range []int{0, 3} {
+		if e, _ := Compress(small, threshold); e.ContentType != "" || !bytes.Equal(e.Payload, small.Payload) {
+			t.Errorf("threshold %d: unexpected compression %+v", threshold, e)
+		}
+	}
+
+	if _, err := Uncompress(StoreEvent{ContentType: ContentTypeJSON + gzipSuffix, Payload: EventPayload(`{}`)}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestRepositoryPayloadCodecs(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+	r := newCounterRepository(es)
+
+	// an event written as JSON, before the codec was changed
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: counterIncrementedType, Payload: EventPayload(`{"id":"uuid","by":2}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	r.Codec = MsgpackCodec{}
+	r.CompressAbove = 1
+
+	a, err := r.Load(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	a.(*counter).increment(3)
+
+	if err := r.Save(ctx, a); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, _ := es.Find(ctx, "uuid")
+
+	if len(events) != 2 || events[1].ContentType != ContentTypeMsgpack+gzipSuffix {
+		t.Errorf("unexpected events %+v", events)
+	}
+
+	if a, err := r.Load(ctx, "uuid"); err != nil || a.(*counter).total != 5 {
+		t.Errorf("unexpected counter %+v, error %+v", a, err)
+	}
+
+	// a content type without codec fails the load
+	if err := es.Update(ctx, "uuid", 2, []StoreEvent{{Type: counterIncrementedType, ContentType: "text/csv", Payload: EventPayload(`uuid,1`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if _, err := r.Load(ctx, "uuid"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
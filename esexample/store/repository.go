@@ -0,0 +1,360 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Aggregate is an event sourced aggregate, as loaded and saved by a Repository
+type Aggregate interface {
+	// ID returns the id of the aggregate
+	ID() string
+
+	// On applies an event to the aggregate, new for the changes raised
+	// and not yet saved, which do not bump the version
+	On(event Event, new bool)
+
+	// Events returns the changes not yet saved
+	Events() []Event
+
+	// Version returns the version of the aggregate before the changes
+	Version() int
+
+	// ClearChanges forgets the changes once saved. The version is left as is:
+	// the aggregate is loaded again before being changed further, saving it
+	// as it is gives a concurrency conflict
+	ClearChanges()
+}
+
+// LoadStats tells how an aggregate was loaded, for the snapshot policy
+type LoadStats struct {
+	SnapshotVersion int           // version of the snapshot it was restored from, 0 if none
+	Replay          time.Duration // time it took to load it
+}
+
+// SnapshotAggregate is an Aggregate the Repository restores from snapshots
+type SnapshotAggregate interface {
+	Aggregate
+
+	// Snapshot captures the state of the aggregate, changes included
+	Snapshot() (Snapshot, error)
+
+	// RestoreSnapshot sets the state of a blank aggregate from a snapshot. A snapshot
+	// with a layout it does not read is refused with ErrIncompatibleSchema
+	RestoreSnapshot(s *Snapshot) error
+
+	// LoadStats returns the stats of the aggregate, filled in by the Repository
+	LoadStats() *LoadStats
+}
+
+// Repository runs the load, replay and save cycle of the aggregates of a kind:
+// the events are upcast, mapped from their type to an event and decoded, then
+// replayed on the blank aggregate given by New; the changes are encoded and
+// appended to the stream at the version the aggregate was loaded with.
+// When Types is set, the events are saved with the names of their types and
+// decoded by name, with the codec of their type; the events of the types it
+// does not know, or written without a name, are mapped from their code.
+// The payloads are marked with the content type of their codec and, when
+// CompressAbove is set, compressed from that size on; they are decoded with the
+// codec of their content type, so that the codec of a type may change.
+// Snapshots are used when SnapshotStore is set and the aggregate is a SnapshotAggregate,
+// new ones taken when SnapshotPolicy says so
+type Repository struct {
+	EventStore             EventStore
+	New                    func() Aggregate
+	EventTypeToEventMapper EventTypeToEventMapper
+	Codec                  EventCodec
+	CompressAbove          int // size in bytes from which the payloads are compressed, 0 for never
+	Types                  *EventTypeRegistry
+	Upcasters              *Upcasters
+	SnapshotStore          SnapshotStore
+	SnapshotPolicy         SnapshotPolicy
+}
+
+// initializer for a repository of JSON events without upcasters nor snapshots
+func NewRepository(es EventStore, factory func() Aggregate, mapper EventTypeToEventMapper) *Repository {
+	return &Repository{
+		EventStore:             es,
+		New:                    factory,
+		EventTypeToEventMapper: mapper,
+		Codec:                  JSONCodec{},
+		Upcasters:              NewUpcasters(),
+	}
+}
+
+// CheckTypes refuses the types of Types whose names the store bound to other codes, to be
+// called at startup, see EventTypeRegistry.CheckBindings
+func (r *Repository) CheckTypes(ctx context.Context) error {
+	if r.Types == nil {
+		return nil
+	}
+	return r.Types.CheckBindings(ctx, r.EventStore)
+}
+
+// Load rebuilds the aggregate from its latest snapshot, if any, and the following events
+func (r *Repository) Load(ctx context.Context, guid EventID) (Aggregate, error) {
+	return r.load(ctx, guid, StreamRange{})
+}
+
+// LoadAsOf rebuilds the aggregate as it was at the given point in time
+func (r *Repository) LoadAsOf(ctx context.Context, guid EventID, asOf time.Time) (Aggregate, error) {
+	return r.load(ctx, guid, StreamRange{AsOf: asOf.UnixNano() / int64(time.Millisecond)})
+}
+
+func (r *Repository) load(ctx context.Context, guid EventID, rng StreamRange) (Aggregate, error) {
+	start := time.Now()
+
+	var a Aggregate
+
+	// point in time reads always replay from the first event
+	if rng.IsZero() {
+		a = r.restore(ctx, guid)
+	}
+
+	if a != nil {
+		rng.AfterVersion = a.Version()
+	} else {
+		a = r.New()
+	}
+
+	events, err := r.EventStore.FindRange(ctx, guid, rng)
+
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := r.Decode(events)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range decoded {
+		a.On(e, false)
+	}
+
+	if sa, ok := a.(SnapshotAggregate); ok {
+		sa.LoadStats().Replay = time.Since(start)
+	}
+
+	return a, nil
+}
+
+// restore returns the aggregate from its latest snapshot, or nil if there is
+// no usable snapshot and the aggregate must be rebuilt from its events
+func (r *Repository) restore(ctx context.Context, guid EventID) Aggregate {
+	if r.SnapshotStore == nil {
+		return nil
+	}
+
+	a, ok := r.New().(SnapshotAggregate)
+
+	if !ok {
+		return nil
+	}
+
+	snapshot, err := r.SnapshotStore.LatestSnapshot(ctx, guid)
+
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Warn().Msgf("unable to read snapshot of aggregate %s: %+v", guid, err)
+		}
+		return nil
+	}
+
+	if err := a.RestoreSnapshot(snapshot); err != nil {
+		if errors.Is(err, ErrIncompatibleSchema) {
+			log.Debug().Msgf("ignoring snapshot of aggregate %s with schema version %d", guid, snapshot.SchemaVersion)
+		} else {
+			log.Warn().Msgf("unable to restore snapshot of aggregate %s: %+v", guid, err)
+		}
+		return nil
+	}
+
+	a.LoadStats().SnapshotVersion = snapshot.Version
+
+	return a
+}
+
+// Decode upcasts the events and decodes them into the events given by the mapper
+func (r *Repository) Decode(events []StoreEvent) ([]Event, error) {
+	var decoded []Event
+
+	for _, e := range events {
+
+		if e.Shredded {
+			return nil, fmt.Errorf("%w: event %s version %d", ErrShredded, e.ID, e.Version)
+		}
+
+		e, err := Uncompress(e)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// the payloads written by former releases are brought to the layout of today
+		if e, err = r.Upcasters.Upcast(e); err != nil {
+			return nil, err
+		}
+
+		tmp, codec, err := r.newEvent(e)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if codec, err = payloadCodec(codec, e.ContentType); err != nil {
+			return nil, err
+		}
+
+		if err := codec.Decode(e.Payload, tmp); err != nil {
+			return nil, err
+		}
+
+		decoded = append(decoded, tmp)
+	}
+
+	return decoded, nil
+}
+
+// newEvent returns the blank event to decode the stored event into, with its codec
+func (r *Repository) newEvent(e StoreEvent) (Event, EventCodec, error) {
+	if t, ok := r.registered(e.TypeName, e.Type); ok {
+		return t.New(), r.codec(t), nil
+	}
+
+	// the name is not known by the mapper, it must not be mistaken for another type
+	if e.TypeName != "" && r.Types != nil {
+		return nil, nil, fmt.Errorf("Event type not found %s", e.TypeName)
+	}
+
+	if r.EventTypeToEventMapper == nil {
+		return nil, nil, fmt.Errorf("Event type not found %d", e.Type)
+	}
+
+	tmp, err := r.EventTypeToEventMapper(e.Type)
+
+	return tmp, r.Codec, err
+}
+
+// registered returns the type of an event by its name or, for the events written without one, its code
+func (r *Repository) registered(name string, code EventType) (RegisteredType, bool) {
+	if r.Types == nil {
+		return RegisteredType{}, false
+	}
+
+	if name != "" {
+		return r.Types.LookupName(name)
+	}
+
+	return r.Types.Lookup(code)
+}
+
+// codec returns the codec of the payloads of the type
+func (r *Repository) codec(t RegisteredType) EventCodec {
+	if t.Codec != nil {
+		return t.Codec
+	}
+	return r.Codec
+}
+
+// payloadCodec returns the codec of the type if it wrote the payload, else the one of its content type
+func payloadCodec(codec EventCodec, contentType string) (EventCodec, error) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	if codec.ContentType() == contentType {
+		return codec, nil
+	}
+
+	if other, ok := CodecFor(contentType); ok {
+		return other, nil
+	}
+
+	return nil, fmt.Errorf("no codec for the payloads of content type %s", contentType)
+}
+
+// Save appends the changes of the aggregate to its stream, then clears them.
+// ErrConcurrencyConflict means that the stream moved on since the aggregate was loaded
+func (r *Repository) Save(ctx context.Context, a Aggregate) error {
+	var events []StoreEvent
+
+	id := EventID(a.ID())
+	metadata := MetadataFromContext(ctx)
+
+	for _, e := range a.Events() {
+
+		codec := r.Codec
+		var name string
+
+		if t, ok := r.registered("", e.GetEventType()); ok {
+			codec, name = r.codec(t), t.Name
+		}
+
+		payload, err := codec.Encode(e)
+
+		if err != nil {
+			return err
+		}
+
+		event, err := Compress(StoreEvent{
+			Payload:       payload,
+			ContentType:   codec.ContentType(),
+			Type:          e.GetEventType(),
+			TypeName:      name,
+			SchemaVersion: r.Upcasters.Latest(e.GetEventType()),
+			ID:            id,
+			Metadata:      metadata,
+		}, r.CompressAbove)
+
+		if err != nil {
+			return err
+		}
+
+		events = append(events, event)
+	}
+
+	if err := r.EventStore.Update(ctx, id, a.Version(), events); err != nil {
+		return err
+	}
+
+	r.takeSnapshot(ctx, a)
+	a.ClearChanges()
+
+	return nil
+}
+
+// takeSnapshot saves a snapshot of the aggregate if the policy asks for it.
+// Snapshots are an optimization: failing to save one doesn't fail the update
+func (r *Repository) takeSnapshot(ctx context.Context, a Aggregate) {
+	sa, ok := a.(SnapshotAggregate)
+
+	if !ok || r.SnapshotStore == nil || r.SnapshotPolicy == nil {
+		return
+	}
+
+	snapshot, err := sa.Snapshot()
+
+	if err != nil {
+		log.Warn().Msgf("unable to take snapshot of aggregate %s: %+v", a.ID(), err)
+		return
+	}
+
+	stats := sa.LoadStats()
+
+	if !r.SnapshotPolicy.ShouldSnapshot(snapshot.Version, stats.SnapshotVersion, stats.Replay) {
+		return
+	}
+
+	if err := r.SnapshotStore.SaveSnapshot(ctx, snapshot); err != nil {
+		log.Warn().Msgf("unable to save snapshot of aggregate %s: %+v", a.ID(), err)
+		return
+	}
+
+	stats.SnapshotVersion = snapshot.Version
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const counterIncrementedType EventType = 1
+
+type counterIncremented struct {
+	ID string `json:"id"`
+	By int    `json:"by"`
+}
+
+func (e *counterIncremented) GetEventType() EventType { return counterIncrementedType }
+
+func counterEventFromType(e EventType) (Event, error) {
+	if e == counterIncrementedType {
+		return &counterIncremented{}, nil
+	}
+	return nil, fmt.Errorf("Event type not found %d", e)
+}
+
+// counter is the smallest aggregate, restored from snapshots holding its total
+type counter struct {
+	id      string
+	total   int
+	version int
+	changes []Event
+	loaded  LoadStats
+}
+
+func newCounterRepository(es EventStore) *Repository {
+	return NewRepository(es, func() Aggregate { return &counter{} }, counterEventFromType)
+}
+
+func (c *counter) ID() string            { return c.id }
+func (c *counter) Events() []Event       { return c.changes }
+func (c *counter) Version() int          { return c.version }
+func (c *counter) ClearChanges()         { c.changes = nil }
+func (c *counter) LoadStats() *LoadStats { return &c.loaded }
+
+func (c *counter) On(event Event, new bool) {
+	e := event.(*counterIncremented)
+	c.id = e.ID
+	c.total += e.By
+
+	if !new {
+		c.version++
+	}
+}
+
+func (c *counter) increment(by int) {
+	e := &counterIncremented{ID: c.id, By: by}
+	c.changes = append(c.changes, e)
+	c.On(e, true)
+}
+
+func (c *counter) Snapshot() (Snapshot, error) {
+	return Snapshot{ID: EventID(c.id), Version: c.version + len(c.changes), SchemaVersion: 1, Payload: EventPayload(fmt.Sprint(c.total))}, nil
+}
+
+func (c *counter) RestoreSnapshot(s *Snapshot) error {
+	if s.SchemaVersion != 1 {
+		return ErrIncompatibleSchema
+	}
+
+	c.id, c.version = string(s.ID), s.Version
+	return json.Unmarshal([]byte(s.Payload), &c.total)
+}
+
+func TestRepositorySaveAndLoad(t *testing.T) {
+	ctx := WithMetadata(context.Background(), MetadataPrincipal, "nurse")
+	es := NewInMemStore()
+	r := newCounterRepository(es)
+
+	c := &counter{id: "uuid"}
+	c.increment(2)
+	c.increment(3)
+
+	if err := r.Save(ctx, c); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// the changes are cleared, the version is not bumped
+	if len(c.Events()) != 0 || c.Version() != 0 {
+		t.Errorf("unexpected changes %+v at version %d", c.Events(), c.Version())
+	}
+
+	// saving again without loading is a conflict
+	c.increment(1)
+
+	if err := r.Save(ctx, c); !errors.Is(err, ErrConcurrencyConflict) {
+		t.Errorf("expected ErrConcurrencyConflict, got %+v", err)
+	}
+
+	a, err := r.Load(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if loaded := a.(*counter); loaded.total != 5 || loaded.Version() != 2 {
+		t.Errorf("unexpected counter %+v", loaded)
+	}
+
+	events, _ := es.Find(ctx, "uuid")
+
+	if len(events) != 2 || string(events[0].Payload) != `{"id":"uuid","by":2}` || events[0].SchemaVersion != 1 || events[0].Metadata[MetadataPrincipal] != "nurse" {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+// upperCodec is a codec of its own, upper casing the JSON
+type upperCodec struct{ JSONCodec }
+
+func (c upperCodec) Encode(e Event) (EventPayload, error) {
+	payload, err := c.JSONCodec.Encode(e)
+	return EventPayload(strings.ToUpper(string(payload))), err
+}
+
+func (c upperCodec) Decode(payload EventPayload, e Event) error {
+	return c.JSONCodec.Decode(EventPayload(strings.ToLower(string(payload))), e)
+}
+
+func TestRepositoryCodecAndUpcasters(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+	r := newCounterRepository(es)
+	r.Codec = upperCodec{}
+
+	// the first layout counted by steps of ten
+	r.Upcasters = NewUpcasters().Register(counterIncrementedType, 1, JSONUpcaster(func(fields map[string]interface{}) error {
+		fields["by"] = fields["tens"].(float64) * 10
+		delete(fields, "tens")
+		return nil
+	}))
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: counterIncrementedType, Payload: EventPayload(`{"id":"uuid","tens":2}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	a, err := r.Load(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	c := a.(*counter)
+	c.increment(1)
+
+	if err := r.Save(ctx, c); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, _ := es.Find(ctx, "uuid")
+
+	if len(events) != 2 || string(events[1].Payload) != `{"ID":"UUID","BY":1}` || events[1].SchemaVersion != 2 {
+		t.Errorf("unexpected events %+v", events)
+	}
+
+	if a, err := r.Load(ctx, "uuid"); err != nil || a.(*counter).total != 21 {
+		t.Errorf("unexpected counter %+v, error %+v", a, err)
+	}
+
+	// an event of a type the mapper does not know fails the load
+	if err := es.Update(ctx, "uuid", 2, []StoreEvent{{Type: 9, Payload: EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if _, err := r.Load(ctx, "uuid"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// rangeRecorder records the last range read
+type rangeRecorder struct {
+	EventStore
+	last StreamRange
+}
+
+func (s *rangeRecorder) FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error) {
+	s.last = r
+	return s.EventStore.FindRange(ctx, guid, r)
+}
+
+func TestRepositorySnapshots(t *testing.T) {
+	ctx := context.Background()
+	memstore := NewInMemStore()
+	recorder := &rangeRecorder{EventStore: memstore}
+	r := newCounterRepository(recorder)
+	r.SnapshotStore = memstore
+	r.SnapshotPolicy = EveryNEvents(2)
+
+	c := &counter{id: "uuid"}
+	c.increment(1)
+
+	if err := r.Save(ctx, c); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		a, err := r.Load(ctx, "uuid")
+
+		if err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		a.(*counter).increment(1)
+
+		if err := r.Save(ctx, a); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	if snapshot, err := memstore.LatestSnapshot(ctx, "uuid"); err != nil || snapshot.Version != 2 {
+		t.Fatalf("unexpected snapshot %+v, error %+v", snapshot, err)
+	}
+
+	a, err := r.Load(ctx, "uuid")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	c = a.(*counter)
+
+	if recorder.last.AfterVersion != 2 || c.Version() != 3 || c.total != 3 || c.LoadStats().SnapshotVersion != 2 {
+		t.Errorf("unexpected counter %+v read after version %d", c, recorder.last.AfterVersion)
+	}
+
+	// a snapshot of another layout is ignored
+	if err := memstore.SaveSnapshot(ctx, Snapshot{ID: "uuid", Version: 3, SchemaVersion: 2, Payload: EventPayload("9")}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if a, err := r.Load(ctx, "uuid"); err != nil || recorder.last.AfterVersion != 0 || a.(*counter).total != 3 {
+		t.Errorf("unexpected counter %+v read after version %d, error %+v", a, recorder.last.AfterVersion, err)
+	}
+}
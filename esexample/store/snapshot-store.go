@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Snapshot is the serialized state of an aggregate at a given version.
+// SchemaVersion identifies the layout of Payload, so that a snapshot written
+// by an older release can be recognized and ignored
+type Snapshot struct {
+	ID            EventID      `json:"id"`
+	Version       int          `json:"version"`
+	SchemaVersion int          `json:"schema_version"`
+	Payload       EventPayload `json:"payload"`
+	TimeStamp     int64        `json:"time"`
+}
+
+type SnapshotStore interface {
+	// Save a snapshot of an aggregate
+	SaveSnapshot(ctx context.Context, snapshot Snapshot) error
+
+	// find the snapshot with the highest version for given ID (aggregate).
+	// returns ErrNotFound if the aggregate has no snapshot
+	LatestSnapshot(ctx context.Context, guid EventID) (*Snapshot, error)
+}
+
+// SnapshotPolicy decides whether a new snapshot should be taken after an aggregate is saved
+type SnapshotPolicy interface {
+	// version is the version of the aggregate just saved, snapshotVersion the version
+	// of the snapshot it was loaded from (0 if none) and replay the time it took to load it
+	ShouldSnapshot(version int, snapshotVersion int, replay time.Duration) bool
+}
+
+// EveryNEvents takes a snapshot once N events were saved since the last snapshot
+type EveryNEvents int
+
+func (n EveryNEvents) ShouldSnapshot(version int, snapshotVersion int, replay time.Duration) bool {
+	return n > 0 && version-snapshotVersion >= int(n)
+}
+
+// ReplayLongerThan takes a snapshot when loading the aggregate took longer than the given duration
+type ReplayLongerThan time.Duration
+
+func (d ReplayLongerThan) ShouldSnapshot(version int, snapshotVersion int, replay time.Duration) bool {
+	return replay > time.Duration(d)
+}
+
+// AnyOf takes a snapshot when any of the policies says so
+type AnyOf []SnapshotPolicy
+
+func (policies AnyOf) ShouldSnapshot(version int, snapshotVersion int, replay time.Duration) bool {
+	for _, p := range policies {
+		if p.ShouldSnapshot(version, snapshotVersion, replay) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateSnapshot(snapshot Snapshot) error {
+	if snapshot.ID == "" {
+		return invalidArgumentf("empty aggregate id")
+	}
+
+	if snapshot.Version <= 0 {
+		return invalidArgumentf("snapshot of aggregate %s at version %d", snapshot.ID, snapshot.Version)
+	}
+
+	return nil
+}
@@ -0,0 +1,706 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLiteSchema creates the tables of SQLEventStore in SQLite, such as the pure Go
+// modernc.org/sqlite. Streams hold the current version of each aggregate, which
+// guards the updates; the unique (stream_id, version) constraint is a second line
+// of defence. The seq column is the global sequence the events by type are read by.
+// event_type_names binds the names of the event types to their codes. The payloads
+// are blobs, the text payloads of a former release are read as their bytes. The
+// deletion time of a deleted stream is its tombstone, kept once its events are purged
+const SQLiteSchema = `
+CREATE TABLE IF NOT EXISTS streams (
+  id               TEXT PRIMARY KEY,
+  current_version  INTEGER NOT NULL,
+  deleted          INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS events (
+  seq              INTEGER PRIMARY KEY AUTOINCREMENT,
+  stream_id        TEXT NOT NULL REFERENCES streams (id),
+  version          INTEGER NOT NULL,
+  type             INTEGER NOT NULL,
+  type_name        TEXT,
+  schema_version   INTEGER NOT NULL DEFAULT 0,
+  content_type     TEXT,
+  payload          BLOB NOT NULL,
+  metadata         TEXT,
+  savetime         INTEGER NOT NULL,
+  UNIQUE (stream_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS events_by_type ON events (type, seq);
+
+CREATE TABLE IF NOT EXISTS event_type_names (
+  name             TEXT PRIMARY KEY,
+  type             INTEGER NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS snapshots (
+  id               TEXT NOT NULL,
+  version          INTEGER NOT NULL,
+  schema_version   INTEGER NOT NULL,
+  payload          BLOB NOT NULL,
+  savetime         INTEGER NOT NULL,
+  PRIMARY KEY (id, version)
+);
+`
+
+// SQLEventStore keeps the events in a relational database through database/sql.
+// The statements use ? placeholders. Events by type are read in order of the
+// global sequence: with a database whose sequences may commit out of order,
+// readers should ask for a Settle window
+type SQLEventStore struct {
+	db *sql.DB
+}
+
+// @see EventStore.Find
+func (es *SQLEventStore) Find(ctx context.Context, guid EventID) ([]StoreEvent, error) {
+	return es.FindRange(ctx, guid, StreamRange{})
+}
+
+// @see EventStore.FindRange
+func (es *SQLEventStore) FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	tx, err := es.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	defer tx.Rollback()
+
+	tombstone, err := sqlTombstone(ctx, tx, guid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tombstone != nil {
+		return nil, tombstone
+	}
+
+	stmt, values := sqlStreamQuery(guid, r)
+	rows, err := tx.QueryContext(ctx, stmt, values...)
+
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	defer rows.Close()
+
+	events := []StoreEvent{}
+
+	for rows.Next() {
+		e := StoreEvent{ID: guid}
+		var typeName, contentType, metadata sql.NullString
+		var payload []byte
+
+		if err := rows.Scan(&e.Version, &e.Type, &typeName, &e.SchemaVersion, &contentType, &payload, &metadata, &e.TimeStamp); err != nil {
+			return nil, sqlError(err)
+		}
+
+		e.TypeName, e.ContentType, e.Payload = typeName.String, contentType.String, EventPayload(payload)
+
+		if e.Metadata, err = decodeSQLMetadata(metadata); err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqlError(err)
+	}
+
+	return events, nil
+}
+
+// sqlStreamQuery builds the statement reading a range of a stream
+func sqlStreamQuery(guid EventID, r StreamRange) (string, []interface{}) {
+	stmt := `SELECT version, type, type_name, schema_version, content_type, payload, metadata, savetime FROM events WHERE stream_id = ? AND version > ?`
+	values := []interface{}{string(guid), r.AfterVersion}
+
+	if r.UpToVersion > 0 {
+		stmt += ` AND version <= ?`
+		values = append(values, r.UpToVersion)
+	}
+
+	if r.AsOf > 0 {
+		stmt += ` AND savetime <= ?`
+		values = append(values, r.AsOf)
+	}
+
+	if r.LastOnly {
+		stmt += ` ORDER BY version DESC LIMIT 1`
+	} else {
+		stmt += ` ORDER BY version`
+	}
+
+	return stmt, values
+}
+
+// @see EventStore.Update
+func (es *SQLEventStore) Update(ctx context.Context, guid EventID, expectedVersion int, events []StoreEvent) error {
+	if err := validateUpdate(guid, expectedVersion, events); err != nil {
+		return err
+	}
+
+	tx, err := es.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return sqlError(err)
+	}
+
+	defer tx.Rollback()
+
+	newVersion := expectedVersion + len(events)
+
+	if expectedVersion == 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO streams (id, current_version) VALUES (?, ?)`, string(guid), newVersion)
+
+		// the stream already exists, unless the insert failed for another reason
+		if err != nil {
+			return es.conflictOr(ctx, tx, guid, expectedVersion, err)
+		}
+	} else {
+		result, err := tx.ExecContext(ctx, `UPDATE streams SET current_version = ? WHERE id = ? AND current_version = ? AND deleted IS NULL`, newVersion, string(guid), expectedVersion)
+
+		if err != nil {
+			return sqlError(err)
+		}
+
+		if n, err := result.RowsAffected(); err != nil || n != 1 {
+			return es.conflictOr(ctx, tx, guid, expectedVersion, err)
+		}
+	}
+
+	bindings, _ := typeBindings(events)
+
+	for name, code := range bindings {
+		if err := bindSQLTypeName(ctx, tx, name, code); err != nil {
+			return err
+		}
+	}
+
+	savetime := time.Now().UnixNano() / int64(time.Millisecond)
+
+	for i, e := range events {
+		metadata, err := encodeSQLMetadata(e.Metadata)
+
+		if err != nil {
+			return err
+		}
+
+		typeName := sql.NullString{String: e.TypeName, Valid: e.TypeName != ""}
+		contentType := sql.NullString{String: e.ContentType, Valid: e.ContentType != ""}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO events (stream_id, version, type, type_name, schema_version, content_type, payload, metadata, savetime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			string(guid), expectedVersion+1+i, int(e.Type), typeName, e.SchemaVersion, contentType, []byte(e.Payload), metadata, savetime)
+
+		if err != nil {
+			return es.conflictOr(ctx, tx, guid, expectedVersion, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return es.conflictOr(ctx, tx, guid, expectedVersion, err)
+	}
+
+	return nil
+}
+
+// bindSQLTypeName binds the name of an event type to its code, unless it is bound already
+func bindSQLTypeName(ctx context.Context, tx *sql.Tx, name string, code EventType) error {
+	rows, err := tx.QueryContext(ctx, `SELECT name, type FROM event_type_names WHERE name = ? OR type = ?`, name, int(code))
+
+	if err != nil {
+		return sqlError(err)
+	}
+
+	defer rows.Close()
+
+	bound := false
+
+	for rows.Next() {
+		var boundName string
+		var boundCode EventType
+
+		if err := rows.Scan(&boundName, &boundCode); err != nil {
+			return sqlError(err)
+		}
+
+		if boundName != name || boundCode != code {
+			return typeConflict(name, code, boundName, boundCode)
+		}
+
+		bound = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return sqlError(err)
+	}
+
+	if bound {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO event_type_names (name, type) VALUES (?, ?)`, name, int(code))
+	return sqlError(err)
+}
+
+// @see EventTypeDirectory.EventTypeCodes
+func (es *SQLEventStore) EventTypeCodes(ctx context.Context, names []string) (map[string]EventType, error) {
+	bound := map[string]EventType{}
+
+	if len(names) == 0 {
+		return bound, nil
+	}
+
+	values := make([]interface{}, len(names))
+	for i, name := range names {
+		values[i] = name
+	}
+
+	rows, err := es.db.QueryContext(ctx, `SELECT name, type FROM event_type_names WHERE name IN (?`+strings.Repeat(`, ?`, len(names)-1)+`)`, values...)
+
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var code EventType
+
+		if err := rows.Scan(&name, &code); err != nil {
+			return nil, sqlError(err)
+		}
+
+		bound[name] = code
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqlError(err)
+	}
+
+	return bound, nil
+}
+
+// conflictOr tells a concurrency conflict from another failure of an update, once
+// rolled back: drivers report constraint violations each in their own way, the
+// current version of the stream does not depend on the driver
+func (es *SQLEventStore) conflictOr(ctx context.Context, tx *sql.Tx, guid EventID, expectedVersion int, err error) error {
+	tx.Rollback()
+
+	var actual int
+	var deleted sql.NullInt64
+	readErr := es.db.QueryRowContext(ctx, `SELECT current_version, deleted FROM streams WHERE id = ?`, string(guid)).Scan(&actual, &deleted)
+
+	if readErr == sql.ErrNoRows {
+		readErr = nil
+	}
+
+	if readErr == nil && deleted.Valid {
+		return NewDeletedError(guid, actual, deleted.Int64)
+	}
+
+	if readErr == nil && actual != expectedVersion {
+		return NewConcurrencyError(guid, expectedVersion, actual)
+	}
+
+	if err == nil {
+		err = fmt.Errorf("aggregate %s: update of version %d not applied", guid, expectedVersion)
+	}
+
+	return sqlError(err)
+}
+
+// @see EventStore.GetEventsByType
+func (es *SQLEventStore) GetEventsByType(ctx context.Context, query TypeQuery) ([]StoreEvent, Cursor, error) {
+	if err := query.validate(); err != nil {
+		return nil, query.After, err
+	}
+
+	query, err := resolveTypeNames(ctx, es, query)
+
+	if err != nil {
+		return nil, query.After, err
+	}
+
+	after, _ := query.After.Decode()
+
+	if query.BatchSize <= 0 {
+		query.BatchSize = defaultBatchSize
+	}
+
+	stmt, values := sqlByTypeQuery(query.types(), after, query.settleLimit(time.Now()), query.BatchSize)
+	rows, err := es.db.QueryContext(ctx, stmt, values...)
+
+	if err != nil {
+		return nil, query.After, sqlError(err)
+	}
+
+	defer rows.Close()
+
+	events := []StoreEvent{}
+	next := query.After
+
+	for rows.Next() {
+		var e StoreEvent
+		var seq int64
+		var typeName, contentType, metadata sql.NullString
+		var payload []byte
+
+		if err := rows.Scan(&seq, &e.ID, &e.Version, &e.Type, &typeName, &e.SchemaVersion, &contentType, &payload, &metadata, &e.TimeStamp); err != nil {
+			return nil, query.After, sqlError(err)
+		}
+
+		e.TypeName, e.ContentType, e.Payload = typeName.String, contentType.String, EventPayload(payload)
+
+		if e.Metadata, err = decodeSQLMetadata(metadata); err != nil {
+			return nil, query.After, err
+		}
+
+		e.Cursor = EncodeCursor(Position{SaveTime: e.TimeStamp, Version: e.Version, ID: e.ID, Seq: seq})
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, query.After, sqlError(err)
+	}
+
+	if len(events) > 0 {
+		next = events[len(events)-1].Cursor
+	}
+
+	return events, next, nil
+}
+
+// sqlByTypeQuery builds the statement reading the events of the types following a position,
+// of all the types when types is nil
+func sqlByTypeQuery(types []EventType, after Position, settleLimit int64, batchSize int) (string, []interface{}) {
+	var conditions []string
+	var values []interface{}
+
+	switch len(types) {
+	case 0:
+	case 1:
+		conditions = append(conditions, `type = ?`)
+		values = append(values, int(types[0]))
+	default:
+		conditions = append(conditions, `type IN (?`+strings.Repeat(`, ?`, len(types)-1)+`)`)
+
+		for _, etype := range types {
+			values = append(values, int(etype))
+		}
+	}
+
+	switch {
+	case after.Seq > 0:
+		conditions = append(conditions, `seq > ?`)
+		values = append(values, after.Seq)
+	case after.SaveTime > 0:
+		conditions = append(conditions, `savetime >= ?`)
+		values = append(values, after.SaveTime)
+	}
+
+	if settleLimit > 0 {
+		conditions = append(conditions, `savetime <= ?`)
+		values = append(values, settleLimit)
+	}
+
+	stmt := `SELECT seq, stream_id, version, type, type_name, schema_version, content_type, payload, metadata, savetime FROM events`
+
+	if len(conditions) > 0 {
+		stmt += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+
+	stmt += ` ORDER BY seq LIMIT ?`
+	values = append(values, batchSize)
+
+	return stmt, values
+}
+
+// @see SnapshotStore.SaveSnapshot
+func (es *SQLEventStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	if err := validateSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	tx, err := es.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return sqlError(err)
+	}
+
+	defer tx.Rollback()
+
+	savetime := time.Now().UnixNano() / int64(time.Millisecond)
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM snapshots WHERE id = ? AND version = ?`, string(snapshot.ID), snapshot.Version); err != nil {
+		return sqlError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO snapshots (id, version, schema_version, payload, savetime) VALUES (?, ?, ?, ?, ?)`,
+		string(snapshot.ID), snapshot.Version, snapshot.SchemaVersion, []byte(snapshot.Payload), savetime)
+
+	if err != nil {
+		return sqlError(err)
+	}
+
+	return sqlError(tx.Commit())
+}
+
+// @see SnapshotStore.LatestSnapshot
+func (es *SQLEventStore) LatestSnapshot(ctx context.Context, guid EventID) (*Snapshot, error) {
+	snapshot := &Snapshot{ID: guid}
+	var payload []byte
+
+	err := es.db.
+		QueryRowContext(ctx, `SELECT version, schema_version, payload, savetime FROM snapshots WHERE id = ? ORDER BY version DESC LIMIT 1`, string(guid)).
+		Scan(&snapshot.Version, &snapshot.SchemaVersion, &payload, &snapshot.TimeStamp)
+
+	snapshot.Payload = EventPayload(payload)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: no snapshot of aggregate %s", ErrNotFound, guid)
+	}
+
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	return snapshot, nil
+}
+
+// @see StreamDeleter.DeleteStream
+func (es *SQLEventStore) DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error {
+	if guid == "" || expectedVersion < 0 {
+		return invalidArgumentf("deletion of aggregate %q at version %d", guid, expectedVersion)
+	}
+
+	deleted := time.Now().UnixNano() / int64(time.Millisecond)
+	result, err := es.db.ExecContext(ctx, `UPDATE streams SET deleted = ? WHERE id = ? AND current_version = ? AND deleted IS NULL`, deleted, string(guid), expectedVersion)
+
+	if err != nil {
+		return sqlError(err)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 1 {
+		return nil
+	}
+
+	var actual int
+	var tombstone sql.NullInt64
+	err = es.db.QueryRowContext(ctx, `SELECT current_version, deleted FROM streams WHERE id = ?`, string(guid)).Scan(&actual, &tombstone)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return notFound(guid)
+	case err != nil:
+		return sqlError(err)
+	case tombstone.Valid:
+		return nil
+	}
+
+	return NewConcurrencyError(guid, expectedVersion, actual)
+}
+
+// @see StreamDeleter.Tombstone
+func (es *SQLEventStore) Tombstone(ctx context.Context, guid EventID) (*DeletedError, error) {
+	return sqlTombstone(ctx, es.db, guid)
+}
+
+// @see StreamDeleter.PurgeStream
+func (es *SQLEventStore) PurgeStream(ctx context.Context, guid EventID) error {
+	tx, err := es.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return sqlError(err)
+	}
+
+	defer tx.Rollback()
+
+	tombstone, err := sqlTombstone(ctx, tx, guid)
+
+	if err != nil {
+		return err
+	}
+
+	if tombstone == nil {
+		return invalidArgumentf("aggregate %s is not deleted", guid)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM events WHERE stream_id = ?`, string(guid)); err != nil {
+		return sqlError(err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM snapshots WHERE id = ?`, string(guid)); err != nil {
+		return sqlError(err)
+	}
+
+	return sqlError(tx.Commit())
+}
+
+// sqlTombstone returns the tombstone of a stream, nil if it is not deleted
+func sqlTombstone(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, guid EventID) (*DeletedError, error) {
+	var currentVersion int
+	var deleted sql.NullInt64
+
+	err := q.QueryRowContext(ctx, `SELECT current_version, deleted FROM streams WHERE id = ?`, string(guid)).Scan(&currentVersion, &deleted)
+
+	if err == sql.ErrNoRows {
+		return nil, notFound(guid)
+	}
+
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	if !deleted.Valid {
+		return nil, nil
+	}
+
+	return &DeletedError{ID: guid, Version: currentVersion, TimeStamp: deleted.Int64}, nil
+}
+
+func encodeSQLMetadata(metadata map[string]string) (interface{}, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(metadata)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func decodeSQLMetadata(metadata sql.NullString) (map[string]string, error) {
+	if !metadata.Valid || metadata.String == "" {
+		return nil, nil
+	}
+
+	var result map[string]string
+
+	if err := json.Unmarshal([]byte(metadata.String), &result); err != nil {
+		return nil, fmt.Errorf("invalid metadata %q: %w", metadata.String, err)
+	}
+
+	return result, nil
+}
+
+// sqlError maps the errors returned by database/sql into the store errors
+func sqlError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	if errors.Is(err, sql.ErrConnDone) || errors.Is(err, sql.ErrTxDone) {
+		return unavailable(err)
+	}
+
+	// SQLite reports contention on the database file as a busy or locked database
+	if msg := strings.ToLower(err.Error()); strings.Contains(msg, "database is locked") || strings.Contains(msg, "sqlite_busy") {
+		return unavailable(err)
+	}
+
+	return fmt.Errorf("SQL ERROR: %+v", err)
+}
+
+// CreateSQLiteSchema creates the tables of the store, if missing, and adds the
+// columns that the tables of a former release lack
+func CreateSQLiteSchema(ctx context.Context, db *sql.DB) error {
+	for _, stmt := range strings.Split(SQLiteSchema, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return sqlError(err)
+		}
+	}
+
+	// the databases created by former releases get the columns added since
+	for _, upgrade := range sqliteUpgrades {
+		columns, err := sqliteColumns(ctx, db, upgrade.table)
+
+		if err != nil {
+			return err
+		}
+
+		if columns[upgrade.column] {
+			continue
+		}
+
+		if _, err := db.ExecContext(ctx, upgrade.stmt); err != nil {
+			return sqlError(err)
+		}
+	}
+
+	return nil
+}
+
+// sqliteUpgrades add to the tables of a former release the columns they lack
+var sqliteUpgrades = []struct {
+	table  string
+	column string
+	stmt   string
+}{
+	{"events", "schema_version", `ALTER TABLE events ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 0`},
+	{"events", "type_name", `ALTER TABLE events ADD COLUMN type_name TEXT`},
+	{"events", "content_type", `ALTER TABLE events ADD COLUMN content_type TEXT`},
+	{"streams", "deleted", `ALTER TABLE streams ADD COLUMN deleted INTEGER`},
+}
+
+// sqliteColumns returns the names of the columns of a table
+func sqliteColumns(ctx context.Context, db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, table)
+
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	defer rows.Close()
+
+	columns := map[string]bool{}
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			return nil, sqlError(err)
+		}
+
+		columns[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqlError(err)
+	}
+
+	return columns, nil
+}
+
+// initializer for event store, the tables must exist, see SQLiteSchema
+func NewSQLEventStore(db *sql.DB) *SQLEventStore {
+	return &SQLEventStore{db: db}
+}
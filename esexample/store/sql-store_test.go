@@ -0,0 +1,237 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func newSQLiteStore(t *testing.T) *SQLEventStore {
+	db, err := sql.Open("sqlite", ":memory:")
+
+	if err != nil {
+		t.Fatalf("unable to open the database: %+v", err)
+	}
+
+	// every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if err := CreateSQLiteSchema(context.Background(), db); err != nil {
+		t.Fatalf("unable to create the schema: %+v", err)
+	}
+
+	return NewSQLEventStore(db)
+}
+
+func TestSQLStoreUpdateAndFind(t *testing.T) {
+	ctx := context.Background()
+	es := newSQLiteStore(t)
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}"), Metadata: map[string]string{"k": "v"}}, {Type: 2, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.Update(ctx, "uuid", 2, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, err := es.Find(ctx, "uuid")
+
+	if err != nil || len(events) != 3 {
+		t.Fatalf("unexpected events %+v, error %+v", events, err)
+	}
+
+	for i, e := range events {
+		if e.ID != "uuid" || e.Version != i+1 || e.TimeStamp == 0 {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+
+	if events[0].Metadata["k"] != "v" || events[1].Metadata != nil {
+		t.Errorf("unexpected metadata %+v %+v", events[0].Metadata, events[1].Metadata)
+	}
+
+	if last, _ := es.FindRange(ctx, "uuid", StreamRange{LastOnly: true}); len(last) != 1 || last[0].Version != 3 {
+		t.Errorf("unexpected last event %+v", last)
+	}
+
+	if _, err := es.Find(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+}
+
+func TestSQLStoreConflicts(t *testing.T) {
+	ctx := context.Background()
+	es := newSQLiteStore(t)
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	cases := map[string]int{"stream exists": 0, "stale version": 2, "missing stream": 3}
+
+	for name, expected := range cases {
+		guid := EventID("uuid")
+		if name == "missing stream" {
+			guid = "missing"
+		}
+
+		err := es.Update(ctx, guid, expected, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}})
+
+		var conflict *ConcurrencyError
+		if !errors.As(err, &conflict) || conflict.Expected != expected {
+			t.Errorf("%s: expected a conflict, got %+v", name, err)
+		}
+	}
+
+	if events, _ := es.Find(ctx, "uuid"); len(events) != 1 {
+		t.Errorf("conflicting updates were applied: %+v", events)
+	}
+}
+
+func TestSQLStoreConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	es := newSQLiteStore(t)
+
+	const writers = 10
+	errs := make(chan error, writers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}})
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	applied := 0
+	for err := range errs {
+		if err == nil {
+			applied++
+		} else if !errors.Is(err, ErrConcurrencyConflict) {
+			t.Errorf("unexpected error %+v", err)
+		}
+	}
+
+	if applied != 1 {
+		t.Errorf("expected exactly one update applied, got %d", applied)
+	}
+}
+
+func TestSQLStoreEventsByType(t *testing.T) {
+	ctx := context.Background()
+	es := newSQLiteStore(t)
+
+	for _, guid := range []EventID{"uuid1", "uuid2"} {
+		if err := es.Update(ctx, guid, 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}, {Type: 2, Payload: EventPayload("{}")}, {Type: 1, Payload: EventPayload("{}")}}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	var read []StoreEvent
+	after := Cursor("")
+
+	for i := 0; i < 10; i++ {
+		events, next, err := es.GetEventsByType(ctx, TypeQuery{Type: 1, After: after, BatchSize: 1})
+
+		if err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+
+		if len(events) == 0 {
+			if next != after {
+				t.Errorf("expected cursor to stay at %s, got %s", after, next)
+			}
+			break
+		}
+
+		read = append(read, events...)
+		after = next
+	}
+
+	if len(read) != 4 || read[0].ID != "uuid1" || read[1].Version != 3 || read[2].ID != "uuid2" {
+		t.Errorf("unexpected events %+v", read)
+	}
+}
+
+func TestSQLStoreSnapshots(t *testing.T) {
+	ctx := context.Background()
+	es := newSQLiteStore(t)
+
+	for _, v := range []int{2, 5, 5} {
+		if err := es.SaveSnapshot(ctx, Snapshot{ID: "uuid", Version: v, SchemaVersion: 1, Payload: EventPayload("{}")}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	if s, err := es.LatestSnapshot(ctx, "uuid"); err != nil || s.Version != 5 || s.TimeStamp == 0 {
+		t.Errorf("unexpected snapshot %+v, error %+v", s, err)
+	}
+
+	if _, err := es.LatestSnapshot(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+}
+
+// the tables of a database created by a former release gain the columns they lack
+func TestSQLStoreUpgradesFormerSchema(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+
+	if err != nil {
+		t.Fatalf("unable to open the database: %+v", err)
+	}
+
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	former := []string{
+		`CREATE TABLE streams (id TEXT PRIMARY KEY, current_version INTEGER NOT NULL)`,
+		`CREATE TABLE events (seq INTEGER PRIMARY KEY AUTOINCREMENT, stream_id TEXT NOT NULL, version INTEGER NOT NULL,
+		type INTEGER NOT NULL, payload TEXT NOT NULL, metadata TEXT, savetime INTEGER NOT NULL, UNIQUE (stream_id, version))`,
+		`INSERT INTO streams (id, current_version) VALUES ('uuid', 1)`,
+		`INSERT INTO events (stream_id, version, type, payload, savetime) VALUES ('uuid', 1, 1, '{}', 1000)`,
+	}
+
+	for _, stmt := range former {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("unable to create the former schema: %+v", err)
+		}
+	}
+
+	// twice, as every release runs it at start
+	for i := 0; i < 2; i++ {
+		if err := CreateSQLiteSchema(ctx, db); err != nil {
+			t.Fatalf("unable to upgrade the schema: %+v", err)
+		}
+	}
+
+	es := NewSQLEventStore(db)
+
+	if err := es.Update(ctx, "uuid", 1, []StoreEvent{{Type: 1, SchemaVersion: 2, Payload: EventPayload("{}")}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	events, err := es.Find(ctx, "uuid")
+
+	if err != nil || len(events) != 2 || events[0].SchemaVersion != 0 || events[1].SchemaVersion != 2 {
+		t.Errorf("unexpected events %+v, error %+v", events, err)
+	}
+
+	if err := es.DeleteStream(ctx, "uuid", 2); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if _, err := es.Find(ctx, "uuid"); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected ErrDeleted, got %+v", err)
+	}
+}
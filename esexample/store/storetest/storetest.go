@@ -0,0 +1,944 @@
+// Package storetest is a behavioral test suite for the implementations of store.EventStore.
+// Every backend runs it, so that they agree on the semantics the aggregates rely on:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.EventStore {
+//			return store.NewInMemStore()
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"my/esexample/store"
+
+	"github.com/google/uuid"
+)
+
+// Factory returns the store a test runs against. It is called once per test;
+// the store may be shared with other tests, as each test works on aggregates
+// and event types of its own
+type Factory func(t *testing.T) store.EventStore
+
+// Run runs the whole suite against the stores of the factory, each test as a subtest
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, es store.EventStore)
+	}{
+		{"UnknownAggregate", testUnknownAggregate},
+		{"AppendAndFind", testAppendAndFind},
+		{"VersionConflicts", testVersionConflicts},
+		{"InvalidUpdates", testInvalidUpdates},
+		{"StreamRange", testStreamRange},
+		{"EmptyType", testEmptyType},
+		{"ByTypePagination", testByTypePagination},
+		{"ByTypeBatchSize", testByTypeBatchSize},
+		{"ByTypeFollowsNewEvents", testByTypeFollowsNewEvents},
+		{"Settle", testSettle},
+		{"MultiType", testMultiType},
+		{"AllTypes", testAllTypes},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"MetadataRoundTrip", testMetadataRoundTrip},
+		{"SchemaVersionRoundTrip", testSchemaVersionRoundTrip},
+		{"TypeNames", testTypeNames},
+		{"BinaryPayloads", testBinaryPayloads},
+		{"Timestamps", testTimestamps},
+		{"Snapshots", testSnapshots},
+		{"DeleteStream", testDeleteStream},
+		{"PurgeStream", testPurgeStream},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, factory(t))
+		})
+	}
+}
+
+var (
+	rngMutex sync.Mutex
+	rng      = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// newType returns an event type no other test writes to
+func newType() store.EventType {
+	rngMutex.Lock()
+	defer rngMutex.Unlock()
+
+	return store.EventType(1000 + rng.Int31n(1<<24))
+}
+
+func newID() store.EventID {
+	return store.EventID(uuid.New().String())
+}
+
+func events(etype store.EventType, payloads ...string) []store.StoreEvent {
+	result := make([]store.StoreEvent, 0, len(payloads))
+
+	for _, p := range payloads {
+		result = append(result, store.StoreEvent{Type: etype, Payload: store.EventPayload(p)})
+	}
+
+	return result
+}
+
+func mustUpdate(t *testing.T, es store.EventStore, guid store.EventID, expectedVersion int, events []store.StoreEvent) {
+	t.Helper()
+
+	if err := es.Update(context.Background(), guid, expectedVersion, events); err != nil {
+		t.Fatalf("update of %s at version %d: %+v", guid, expectedVersion, err)
+	}
+}
+
+func mustFind(t *testing.T, es store.EventStore, guid store.EventID, r store.StreamRange) []store.StoreEvent {
+	t.Helper()
+
+	events, err := es.FindRange(context.Background(), guid, r)
+
+	if err != nil {
+		t.Fatalf("find of %s in %+v: %+v", guid, r, err)
+	}
+
+	return events
+}
+
+// readAll pages through the events of a type, checking the batches and the cursors
+func readAll(t *testing.T, es store.EventStore, query store.TypeQuery) ([]store.StoreEvent, store.Cursor) {
+	t.Helper()
+
+	var result []store.StoreEvent
+
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			t.Fatalf("paging by type does not end, read %d events", len(result))
+		}
+
+		batch, next, err := es.GetEventsByType(context.Background(), query)
+
+		if err != nil {
+			t.Fatalf("events of %+v: %+v", query, err)
+		}
+
+		if query.BatchSize > 0 && len(batch) > query.BatchSize {
+			t.Fatalf("got %d events in a batch of %d", len(batch), query.BatchSize)
+		}
+
+		if len(batch) == 0 {
+			if next != query.After {
+				t.Fatalf("cursor moved from %q to %q without events", query.After, next)
+			}
+			return result, next
+		}
+
+		if next != batch[len(batch)-1].Cursor {
+			t.Errorf("cursor %q is not the one of the last event %q", next, batch[len(batch)-1].Cursor)
+		}
+
+		result = append(result, batch...)
+		query.After = next
+	}
+}
+
+func testUnknownAggregate(t *testing.T, es store.EventStore) {
+	ctx := context.Background()
+	guid := newID()
+
+	if _, err := es.Find(ctx, guid); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("Find: expected ErrNotFound, got %+v", err)
+	}
+
+	if _, err := es.FindRange(ctx, guid, store.StreamRange{AfterVersion: 1}); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("FindRange: expected ErrNotFound, got %+v", err)
+	}
+}
+
+func testAppendAndFind(t *testing.T, es store.EventStore) {
+	guid := newID()
+	etype := newType()
+
+	mustUpdate(t, es, guid, 0, events(etype, `{"n":1}`, `{"n":2}`))
+	mustUpdate(t, es, guid, 2, events(etype+1, `{"n":3}`))
+
+	found, err := es.Find(context.Background(), guid)
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	expected := []struct {
+		payload string
+		etype   store.EventType
+	}{{`{"n":1}`, etype}, {`{"n":2}`, etype}, {`{"n":3}`, etype + 1}}
+
+	if len(found) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), found)
+	}
+
+	for i, e := range found {
+		if e.ID != guid || e.Version != i+1 || string(e.Payload) != expected[i].payload || e.Type != expected[i].etype {
+			t.Errorf("event %d: unexpected %+v", i, e)
+		}
+	}
+}
+
+func testVersionConflicts(t *testing.T, es store.EventStore) {
+	guid := newID()
+	etype := newType()
+
+	mustUpdate(t, es, guid, 0, events(etype, "{}", "{}"))
+
+	for _, expected := range []int{0, 1, 3} {
+		err := es.Update(context.Background(), guid, expected, events(etype, "{}"))
+
+		if !errors.Is(err, store.ErrConcurrencyConflict) {
+			t.Errorf("expected version %d: expected ErrConcurrencyConflict, got %+v", expected, err)
+			continue
+		}
+
+		var conflict *store.ConcurrencyError
+
+		if !errors.As(err, &conflict) {
+			t.Errorf("expected version %d: expected a ConcurrencyError, got %T", expected, err)
+			continue
+		}
+
+		if conflict.ID != guid || conflict.Expected != expected || conflict.Actual != 2 {
+			t.Errorf("expected version %d: unexpected conflict %+v", expected, conflict)
+		}
+	}
+
+	if found := mustFind(t, es, guid, store.StreamRange{}); len(found) != 2 {
+		t.Errorf("conflicting updates were applied: %+v", found)
+	}
+
+	// a new aggregate is only created at version 0
+	if err := es.Update(context.Background(), newID(), 1, events(etype, "{}")); !errors.Is(err, store.ErrConcurrencyConflict) {
+		t.Errorf("unknown aggregate at version 1: expected ErrConcurrencyConflict, got %+v", err)
+	}
+}
+
+func testInvalidUpdates(t *testing.T, es store.EventStore) {
+	ctx := context.Background()
+	guid := newID()
+
+	if err := es.Update(ctx, guid, 0, nil); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("no events: expected ErrInvalidArgument, got %+v", err)
+	}
+
+	if err := es.Update(ctx, guid, -1, events(newType(), "{}")); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("negative version: expected ErrInvalidArgument, got %+v", err)
+	}
+
+	if _, err := es.Find(ctx, guid); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("invalid updates created the aggregate: %+v", err)
+	}
+}
+
+func testStreamRange(t *testing.T, es store.EventStore) {
+	guid := newID()
+	etype := newType()
+
+	mustUpdate(t, es, guid, 0, events(etype, "{}", "{}", "{}", "{}", "{}"))
+
+	cases := []struct {
+		r        store.StreamRange
+		versions []int
+	}{
+		{store.StreamRange{}, []int{1, 2, 3, 4, 5}},
+		{store.StreamRange{AfterVersion: 3}, []int{4, 5}},
+		{store.StreamRange{UpToVersion: 2}, []int{1, 2}},
+		{store.StreamRange{AfterVersion: 1, UpToVersion: 3}, []int{2, 3}},
+		{store.StreamRange{LastOnly: true}, []int{5}},
+		{store.StreamRange{UpToVersion: 3, LastOnly: true}, []int{3}},
+		{store.StreamRange{AfterVersion: 5}, nil},
+	}
+
+	for _, c := range cases {
+		found := mustFind(t, es, guid, c.r)
+
+		if len(found) != len(c.versions) {
+			t.Errorf("range %+v: expected versions %v, got %+v", c.r, c.versions, found)
+			continue
+		}
+
+		for i, e := range found {
+			if e.Version != c.versions[i] {
+				t.Errorf("range %+v: expected versions %v, got %+v", c.r, c.versions, found)
+				break
+			}
+		}
+	}
+
+	if _, err := es.FindRange(context.Background(), guid, store.StreamRange{AfterVersion: 3, UpToVersion: 2}); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("empty range: expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func testEmptyType(t *testing.T, es store.EventStore) {
+	etype := newType()
+
+	for _, after := range []store.Cursor{"", store.CursorFrom(1)} {
+		found, next, err := es.GetEventsByType(context.Background(), store.TypeQuery{Type: etype, After: after})
+
+		if err != nil || len(found) != 0 || next != after {
+			t.Errorf("after %q: expected no events and the same cursor, got %+v, %q, %+v", after, found, next, err)
+		}
+	}
+
+	if _, _, err := es.GetEventsByType(context.Background(), store.TypeQuery{Type: etype, After: "garbage"}); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("malformed cursor: expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+// the events of a type come in the same order on every read, whatever the batch size.
+// Within a millisecond the order is up to the store, only the order of the versions
+// of an aggregate is given
+func testByTypePagination(t *testing.T, es store.EventStore) {
+	etype := newType()
+	other := newType()
+	first, second := newID(), newID()
+
+	// interleave the events of two aggregates with events of another type
+	mustUpdate(t, es, first, 0, []store.StoreEvent{{Type: etype, Payload: store.EventPayload("1")}, {Type: other, Payload: store.EventPayload("x")}, {Type: etype, Payload: store.EventPayload("2")}})
+	mustUpdate(t, es, second, 0, []store.StoreEvent{{Type: etype, Payload: store.EventPayload("3")}})
+	mustUpdate(t, es, first, 3, []store.StoreEvent{{Type: other, Payload: store.EventPayload("y")}, {Type: etype, Payload: store.EventPayload("4")}})
+	mustUpdate(t, es, second, 1, []store.StoreEvent{{Type: etype, Payload: store.EventPayload("5")}, {Type: etype, Payload: store.EventPayload("6")}})
+
+	expected := map[string]struct {
+		id      store.EventID
+		version int
+	}{"1": {first, 1}, "2": {first, 3}, "3": {second, 1}, "4": {first, 5}, "5": {second, 2}, "6": {second, 3}}
+
+	var order []store.StoreEvent
+
+	for _, size := range []int{1, 2, 4, 100} {
+		found, _ := readAll(t, es, store.TypeQuery{Type: etype, BatchSize: size})
+
+		if len(found) != len(expected) {
+			t.Errorf("batches of %d: expected %d events, got %+v", size, len(expected), found)
+			continue
+		}
+
+		last := map[store.EventID]int{}
+
+		for i, e := range found {
+			want, ok := expected[string(e.Payload)]
+
+			if !ok || e.ID != want.id || e.Version != want.version || e.Type != etype {
+				t.Errorf("batches of %d: unexpected event %+v", size, e)
+			}
+
+			if e.Version <= last[e.ID] {
+				t.Errorf("batches of %d: version %d of %s read after version %d", size, e.Version, e.ID, last[e.ID])
+			}
+			last[e.ID] = e.Version
+
+			if order != nil && (order[i].ID != e.ID || order[i].Version != e.Version) {
+				t.Errorf("batches of %d: event %d is %s at %d, it was %s at %d", size, i, e.ID, e.Version, order[i].ID, order[i].Version)
+			}
+		}
+
+		if order == nil {
+			order = found
+		}
+	}
+}
+
+func testByTypeBatchSize(t *testing.T, es store.EventStore) {
+	etype := newType()
+
+	mustUpdate(t, es, newID(), 0, events(etype, "{}", "{}", "{}", "{}", "{}", "{}", "{}"))
+
+	for _, size := range []int{1, 3, 7} {
+		found, _, err := es.GetEventsByType(context.Background(), store.TypeQuery{Type: etype, BatchSize: size})
+
+		if err != nil || len(found) != size {
+			t.Errorf("batch of %d: got %d events, %+v", size, len(found), err)
+		}
+	}
+
+	// no batch size is the store's default, large enough for a few events
+	if found, _, err := es.GetEventsByType(context.Background(), store.TypeQuery{Type: etype}); err != nil || len(found) != 7 {
+		t.Errorf("default batch: got %d events, %+v", len(found), err)
+	}
+}
+
+func testByTypeFollowsNewEvents(t *testing.T, es store.EventStore) {
+	etype := newType()
+	guid := newID()
+
+	mustUpdate(t, es, guid, 0, events(etype, "1", "2"))
+
+	found, cursor := readAll(t, es, store.TypeQuery{Type: etype, BatchSize: 10})
+
+	if len(found) != 2 {
+		t.Fatalf("expected 2 events, got %+v", found)
+	}
+
+	// events saved in the millisecond of the cursor may sort before it, see testSettle
+	time.Sleep(2 * time.Millisecond)
+
+	mustUpdate(t, es, guid, 2, events(etype, "3"))
+	time.Sleep(2 * time.Millisecond)
+	mustUpdate(t, es, newID(), 0, events(etype, "4"))
+
+	found, _ = readAll(t, es, store.TypeQuery{Type: etype, After: cursor, BatchSize: 10})
+
+	if len(found) != 2 || string(found[0].Payload) != "3" || string(found[1].Payload) != "4" {
+		t.Errorf("expected the 2 new events, got %+v", found)
+	}
+}
+
+// a settle window leaves out the events saved too recently
+func testSettle(t *testing.T, es store.EventStore) {
+	etype := newType()
+
+	mustUpdate(t, es, newID(), 0, events(etype, "1"))
+
+	found, next, err := es.GetEventsByType(context.Background(), store.TypeQuery{Type: etype, Settle: time.Hour})
+
+	if err != nil || len(found) != 0 || next != "" {
+		t.Errorf("settle of an hour: expected no events, got %+v, %q, %+v", found, next, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	found, _, err = es.GetEventsByType(context.Background(), store.TypeQuery{Type: etype, Settle: 10 * time.Millisecond})
+
+	if err != nil || len(found) != 1 {
+		t.Errorf("settled: expected the event, got %+v, %+v", found, err)
+	}
+}
+
+// writeSpaced saves each event in an update of its own, a few milliseconds apart so
+// that their order is the same in every store, and returns them as saved
+func writeSpaced(t *testing.T, es store.EventStore, guid store.EventID, types ...store.EventType) []store.StoreEvent {
+	var saved []store.StoreEvent
+
+	for i, etype := range types {
+		time.Sleep(2 * time.Millisecond)
+		mustUpdate(t, es, guid, i, events(etype, strconv.Itoa(i)))
+		saved = append(saved, store.StoreEvent{ID: guid, Version: i + 1, Type: etype, Payload: store.EventPayload(strconv.Itoa(i))})
+	}
+
+	return saved
+}
+
+// checkOrder compares the events read with the expected ones, in order
+func checkOrder(t *testing.T, name string, found, expected []store.StoreEvent) {
+	t.Helper()
+
+	if len(found) != len(expected) {
+		t.Errorf("%s: expected %d events, got %+v", name, len(expected), found)
+		return
+	}
+
+	for i, e := range found {
+		want := expected[i]
+
+		if e.ID != want.ID || e.Version != want.Version || e.Type != want.Type || !bytes.Equal(e.Payload, want.Payload) {
+			t.Errorf("%s: event %d is %+v, expected %+v", name, i, e, want)
+		}
+	}
+}
+
+// the events of several types come as one stream, in save order, with a single cursor
+func testMultiType(t *testing.T, es store.EventStore) {
+	admitted, transferred, discharged, other := newType(), newType(), newType(), newType()
+
+	saved := writeSpaced(t, es, newID(), admitted, other, transferred, transferred, discharged)
+	saved = append(saved, writeSpaced(t, es, newID(), discharged, admitted, other)...)
+
+	var expected []store.StoreEvent
+	for _, e := range saved {
+		if e.Type != other {
+			expected = append(expected, e)
+		}
+	}
+
+	types := []store.EventType{admitted, transferred, discharged}
+
+	for _, size := range []int{1, 2, 100} {
+		found, _ := readAll(t, es, store.TypeQuery{Types: types, BatchSize: size})
+		checkOrder(t, fmt.Sprintf("batches of %d", size), found, expected)
+	}
+
+	// the cursor of an event resumes the stream right after it
+	found, _ := readAll(t, es, store.TypeQuery{Types: types, BatchSize: 100})
+
+	if len(found) == len(expected) {
+		rest, _ := readAll(t, es, store.TypeQuery{Types: types, After: found[2].Cursor, BatchSize: 2})
+		checkOrder(t, "resumed", rest, expected[3:])
+	}
+
+	// a single type in Types reads as Type
+	found, _ = readAll(t, es, store.TypeQuery{Types: []store.EventType{transferred}, BatchSize: 1})
+	checkOrder(t, "single type", found, expected[1:3])
+}
+
+// all the types come as one stream, following the cursor of the last read
+func testAllTypes(t *testing.T, es store.EventStore) {
+	ctx := context.Background()
+
+	// the events of the other tests come first
+	_, cursor := readAll(t, es, store.TypeQuery{AllTypes: true, BatchSize: 100})
+
+	first, second := newType(), newType()
+	expected := writeSpaced(t, es, newID(), first, second, first)
+
+	for _, size := range []int{1, 100} {
+		found, _ := readAll(t, es, store.TypeQuery{AllTypes: true, After: cursor, BatchSize: size})
+		checkOrder(t, fmt.Sprintf("batches of %d", size), found, expected)
+	}
+
+	if _, _, err := es.GetEventsByType(ctx, store.TypeQuery{AllTypes: true, Types: []store.EventType{first}}); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("all types and types: expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, es store.EventStore) {
+	const (
+		writers = 8
+		rounds  = 5
+	)
+
+	guid := newID()
+	etype := newType()
+
+	// in every round all the writers race to append at the same version, one of them wins
+	for round := 0; round < rounds; round++ {
+		errs := make(chan error, writers)
+
+		var start, done sync.WaitGroup
+		start.Add(1)
+
+		for w := 0; w < writers; w++ {
+			done.Add(1)
+			go func() {
+				defer done.Done()
+				start.Wait()
+				errs <- es.Update(context.Background(), guid, round, events(etype, "{}"))
+			}()
+		}
+
+		start.Done()
+		done.Wait()
+		close(errs)
+
+		applied := 0
+
+		for err := range errs {
+			switch {
+			case err == nil:
+				applied++
+			case !errors.Is(err, store.ErrConcurrencyConflict):
+				t.Errorf("round %d: unexpected error %+v", round, err)
+			}
+		}
+
+		if applied != 1 {
+			t.Fatalf("round %d: expected exactly one update applied, got %d", round, applied)
+		}
+	}
+
+	found := mustFind(t, es, guid, store.StreamRange{})
+
+	if len(found) != rounds {
+		t.Fatalf("expected %d events, got %+v", rounds, found)
+	}
+
+	for i, e := range found {
+		if e.Version != i+1 {
+			t.Errorf("expected version %d, got %+v", i+1, e)
+		}
+	}
+
+	if byType, _ := readAll(t, es, store.TypeQuery{Type: etype, BatchSize: 100}); len(byType) != rounds {
+		t.Errorf("expected %d events by type, got %+v", rounds, byType)
+	}
+}
+
+func testMetadataRoundTrip(t *testing.T, es store.EventStore) {
+	guid := newID()
+	etype := newType()
+	metadata := map[string]string{"correlation-id": "c-1", "user": "zoë", "empty": ""}
+
+	mustUpdate(t, es, guid, 0, []store.StoreEvent{
+		{Type: etype, Payload: store.EventPayload(`{"a":"b"}`), Metadata: metadata},
+		{Type: etype, Payload: store.EventPayload(`{}`)},
+	})
+
+	check := func(source string, found []store.StoreEvent) {
+		if len(found) != 2 {
+			t.Errorf("%s: expected 2 events, got %+v", source, found)
+			return
+		}
+
+		if len(found[0].Metadata) != len(metadata) {
+			t.Errorf("%s: expected metadata %v, got %v", source, metadata, found[0].Metadata)
+		}
+
+		for k, v := range metadata {
+			if got, ok := found[0].Metadata[k]; !ok || got != v {
+				t.Errorf("%s: metadata %q: expected %q, got %q", source, k, v, got)
+			}
+		}
+
+		if len(found[1].Metadata) != 0 {
+			t.Errorf("%s: expected no metadata, got %v", source, found[1].Metadata)
+		}
+	}
+
+	check("find", mustFind(t, es, guid, store.StreamRange{}))
+
+	byType, _ := readAll(t, es, store.TypeQuery{Type: etype, BatchSize: 10})
+	check("by type", byType)
+
+	// the store keeps its own copy
+	metadata["user"] = "changed"
+	if found := mustFind(t, es, guid, store.StreamRange{}); found[0].Metadata["user"] != "zoë" {
+		t.Errorf("metadata changed with the caller's map: %v", found[0].Metadata)
+	}
+}
+
+func testSchemaVersionRoundTrip(t *testing.T, es store.EventStore) {
+	guid := newID()
+	etype := newType()
+
+	mustUpdate(t, es, guid, 0, []store.StoreEvent{
+		{Type: etype, Payload: store.EventPayload(`{}`)},
+		{Type: etype, SchemaVersion: 1, Payload: store.EventPayload(`{}`)},
+		{Type: etype, SchemaVersion: 3, Payload: store.EventPayload(`{}`)},
+	})
+
+	check := func(source string, found []store.StoreEvent) {
+		if len(found) != 3 {
+			t.Errorf("%s: expected 3 events, got %+v", source, found)
+			return
+		}
+
+		for i, expected := range []int{0, 1, 3} {
+			if found[i].SchemaVersion != expected {
+				t.Errorf("%s: event %d: expected schema version %d, got %d", source, i+1, expected, found[i].SchemaVersion)
+			}
+		}
+	}
+
+	check("find", mustFind(t, es, guid, store.StreamRange{}))
+
+	byType, _ := readAll(t, es, store.TypeQuery{Type: etype, BatchSize: 10})
+	check("by type", byType)
+}
+
+func testTypeNames(t *testing.T, es store.EventStore) {
+	ctx := context.Background()
+	guid := newID()
+	etype := newType()
+	name := fmt.Sprintf("storetest.type_%d", etype)
+
+	named := events(etype, `{"n":1}`, `{"n":2}`)
+	for i := range named {
+		named[i].TypeName = name
+	}
+
+	mustUpdate(t, es, guid, 0, named)
+
+	// the events written before the type was named are still read with it
+	mustUpdate(t, es, guid, 2, events(etype, `{"n":3}`))
+
+	check := func(source string, found []store.StoreEvent) {
+		if len(found) != 3 || found[0].TypeName != name || found[1].TypeName != name || found[2].TypeName != "" {
+			t.Errorf("%s: unexpected events %+v", source, found)
+		}
+	}
+
+	check("find", mustFind(t, es, guid, store.StreamRange{}))
+
+	byName, _ := readAll(t, es, store.TypeQuery{TypeNames: []string{name}, BatchSize: 10})
+	check("by name", byName)
+
+	// a name no event was written with selects nothing
+	if unbound, _ := readAll(t, es, store.TypeQuery{TypeNames: []string{name + "_unbound"}, BatchSize: 10}); len(unbound) != 0 {
+		t.Errorf("unexpected events of an unbound name %+v", unbound)
+	}
+
+	// a name is bound to a single code and a code to a single name
+	conflicts := []store.StoreEvent{
+		{Type: newType(), TypeName: name, Payload: store.EventPayload(`{}`)},
+		{Type: etype, TypeName: name + "_other", Payload: store.EventPayload(`{}`)},
+		{Type: etype, TypeName: "unnamed", Payload: store.EventPayload(`{}`)},
+	}
+
+	for _, e := range conflicts {
+		if err := es.Update(ctx, newID(), 0, []store.StoreEvent{e}); !errors.Is(err, store.ErrInvalidArgument) {
+			t.Errorf("%d %s: expected ErrInvalidArgument, got %+v", e.Type, e.TypeName, err)
+		}
+	}
+
+	if found := mustFind(t, es, guid, store.StreamRange{}); len(found) != 3 {
+		t.Errorf("unexpected events after the refused updates %+v", found)
+	}
+}
+
+func testBinaryPayloads(t *testing.T, es store.EventStore) {
+	ctx := context.Background()
+	guid := newID()
+	etype := newType()
+
+	// bytes which are not text, as a compressed payload
+	binary := store.EventPayload{0x1f, 0x8b, 0x00, 0xff, 0xfe, '\n', 0x80}
+
+	mustUpdate(t, es, guid, 0, []store.StoreEvent{
+		{Type: etype, ContentType: store.ContentTypeMsgpack + "+gzip", Payload: binary},
+		{Type: etype, Payload: store.EventPayload(`{"legacy":true}`)},
+	})
+
+	check := func(source string, found []store.StoreEvent) {
+		if len(found) != 2 || !bytes.Equal(found[0].Payload, binary) || found[0].ContentType != store.ContentTypeMsgpack+"+gzip" ||
+			string(found[1].Payload) != `{"legacy":true}` || found[1].ContentType != "" {
+			t.Errorf("%s: unexpected events %+v", source, found)
+		}
+	}
+
+	check("find", mustFind(t, es, guid, store.StreamRange{}))
+
+	byType, _ := readAll(t, es, store.TypeQuery{Type: etype, BatchSize: 10})
+	check("by type", byType)
+
+	snapshots, ok := es.(store.SnapshotStore)
+
+	if !ok {
+		return
+	}
+
+	if err := snapshots.SaveSnapshot(ctx, store.Snapshot{ID: guid, Version: 2, SchemaVersion: 1, Payload: binary}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if s, err := snapshots.LatestSnapshot(ctx, guid); err != nil || !bytes.Equal(s.Payload, binary) {
+		t.Errorf("unexpected snapshot %+v, error %+v", s, err)
+	}
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func testTimestamps(t *testing.T, es store.EventStore) {
+	guid := newID()
+	etype := newType()
+
+	before := millis(time.Now())
+	mustUpdate(t, es, guid, 0, events(etype, "1", "2"))
+	after := millis(time.Now())
+
+	// the next update is saved at a later millisecond
+	time.Sleep(5 * time.Millisecond)
+	mustUpdate(t, es, guid, 2, events(etype, "3"))
+
+	found := mustFind(t, es, guid, store.StreamRange{})
+
+	if len(found) != 3 {
+		t.Fatalf("expected 3 events, got %+v", found)
+	}
+
+	for i, e := range found[:2] {
+		if e.TimeStamp < before || e.TimeStamp > after {
+			t.Errorf("event %d: time %d not within the update [%d, %d]", i, e.TimeStamp, before, after)
+		}
+	}
+
+	if found[2].TimeStamp <= found[1].TimeStamp {
+		t.Errorf("times do not follow the updates: %d then %d", found[1].TimeStamp, found[2].TimeStamp)
+	}
+
+	asOf := mustFind(t, es, guid, store.StreamRange{AsOf: found[1].TimeStamp})
+
+	if len(asOf) != 2 {
+		t.Errorf("as of %d: expected the first 2 events, got %+v", found[1].TimeStamp, asOf)
+	}
+
+	byType, _ := readAll(t, es, store.TypeQuery{Type: etype, BatchSize: 10})
+
+	if len(byType) != len(found) {
+		t.Fatalf("expected %d events by type, got %+v", len(found), byType)
+	}
+
+	for i, e := range byType {
+		if e.TimeStamp != found[i].TimeStamp {
+			t.Errorf("event %d: time %d by type, %d in the stream", i, e.TimeStamp, found[i].TimeStamp)
+		}
+	}
+}
+
+func testSnapshots(t *testing.T, es store.EventStore) {
+	snapshots, ok := es.(store.SnapshotStore)
+
+	if !ok {
+		t.Skip("snapshots not supported by the store")
+	}
+
+	ctx := context.Background()
+	guid := newID()
+
+	if _, err := snapshots.LatestSnapshot(ctx, guid); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+
+	before := millis(time.Now())
+
+	for _, version := range []int{2, 5, 3} {
+		err := snapshots.SaveSnapshot(ctx, store.Snapshot{ID: guid, Version: version, SchemaVersion: 7, Payload: store.EventPayload(`{"v":"x"}`)})
+
+		if err != nil {
+			t.Fatalf("save of version %d: %+v", version, err)
+		}
+	}
+
+	latest, err := snapshots.LatestSnapshot(ctx, guid)
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if latest.ID != guid || latest.Version != 5 || latest.SchemaVersion != 7 || string(latest.Payload) != `{"v":"x"}` || latest.TimeStamp < before {
+		t.Errorf("unexpected snapshot %+v", latest)
+	}
+
+	if err := snapshots.SaveSnapshot(ctx, store.Snapshot{ID: guid}); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("version 0: expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+func testDeleteStream(t *testing.T, es store.EventStore) {
+	deleter, ok := es.(store.StreamDeleter)
+
+	if !ok {
+		t.Skip("stream deletion not supported by the store")
+	}
+
+	ctx := context.Background()
+	guid := newID()
+	etype := newType()
+
+	mustUpdate(t, es, guid, 0, events(etype, `{"n":1}`, `{"n":2}`))
+
+	if err := deleter.DeleteStream(ctx, newID(), 0); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("unknown aggregate: expected ErrNotFound, got %+v", err)
+	}
+
+	if err := deleter.DeleteStream(ctx, guid, 1); !errors.Is(err, store.ErrConcurrencyConflict) {
+		t.Errorf("stale version: expected ErrConcurrencyConflict, got %+v", err)
+	}
+
+	if deleted, err := deleter.Tombstone(ctx, guid); err != nil || deleted != nil {
+		t.Errorf("unexpected tombstone %+v, error %+v", deleted, err)
+	}
+
+	before := millis(time.Now())
+
+	// deleting a deleted stream keeps its tombstone
+	for i := 0; i < 2; i++ {
+		if err := deleter.DeleteStream(ctx, guid, 2); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	deleted, err := deleter.Tombstone(ctx, guid)
+
+	if err != nil || deleted == nil || deleted.Version != 2 || deleted.TimeStamp < before-1000 {
+		t.Fatalf("unexpected tombstone %+v, error %+v", deleted, err)
+	}
+
+	for _, r := range []store.StreamRange{{}, {AfterVersion: 1}, {LastOnly: true}} {
+		var found *store.DeletedError
+
+		if _, err := es.FindRange(ctx, guid, r); !errors.As(err, &found) || found.Version != 2 {
+			t.Errorf("find in %+v: expected a DeletedError, got %+v", r, err)
+		}
+	}
+
+	for _, expected := range []int{0, 2} {
+		if err := es.Update(ctx, guid, expected, events(etype, "{}")); !errors.Is(err, store.ErrDeleted) {
+			t.Errorf("update at version %d: expected ErrDeleted, got %+v", expected, err)
+		}
+	}
+
+	// the events stay readable by type until the stream is purged
+	if found, _ := readAll(t, es, store.TypeQuery{Type: etype}); len(found) != 2 {
+		t.Errorf("expected the 2 events by type, got %+v", found)
+	}
+}
+
+func testPurgeStream(t *testing.T, es store.EventStore) {
+	deleter, ok := es.(store.StreamDeleter)
+
+	if !ok {
+		t.Skip("stream deletion not supported by the store")
+	}
+
+	ctx := context.Background()
+	guid := newID()
+	etype := newType()
+
+	mustUpdate(t, es, guid, 0, events(etype, `{"n":1}`, `{"n":2}`, `{"n":3}`))
+
+	snapshots, hasSnapshots := es.(store.SnapshotStore)
+
+	if hasSnapshots {
+		if err := snapshots.SaveSnapshot(ctx, store.Snapshot{ID: guid, Version: 3, Payload: store.EventPayload(`{}`)}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	if err := deleter.PurgeStream(ctx, guid); errors.Is(err, store.ErrNotSupported) {
+		t.Skip("purge not supported by the store")
+	} else if !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("stream not deleted: expected ErrInvalidArgument, got %+v", err)
+	}
+
+	if err := deleter.DeleteStream(ctx, guid, 3); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// purging a purged stream does nothing
+	for i := 0; i < 2; i++ {
+		if err := deleter.PurgeStream(ctx, guid); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	if found, _ := readAll(t, es, store.TypeQuery{Type: etype}); len(found) != 0 {
+		t.Errorf("purged events still read by type: %+v", found)
+	}
+
+	// the tombstone outlives the events, the aggregate id is not reused
+	if deleted, err := deleter.Tombstone(ctx, guid); err != nil || deleted == nil || deleted.Version != 3 {
+		t.Errorf("unexpected tombstone %+v, error %+v", deleted, err)
+	}
+
+	if _, err := es.Find(ctx, guid); !errors.Is(err, store.ErrDeleted) {
+		t.Errorf("expected ErrDeleted, got %+v", err)
+	}
+
+	if err := es.Update(ctx, guid, 0, events(etype, "{}")); !errors.Is(err, store.ErrDeleted) {
+		t.Errorf("expected ErrDeleted, got %+v", err)
+	}
+
+	if hasSnapshots {
+		if _, err := snapshots.LatestSnapshot(ctx, guid); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected the snapshots purged, got %+v", err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// A stream is retired in two steps. Deleting it writes a tombstone at its current version:
+// reading it or appending to it then fails with a DeletedError, while its events stay in
+// the store and readable by type, so that the projections see them and the deletion can be
+// looked into. Purging it, once the retention of the deletion elapsed, removes its events,
+// their index by type and its snapshots for good; the tombstone stays, the aggregate id
+// can't be used again. Archiving a stream moves it to a StreamArchive, see ArchivedEventStore
+
+// StreamDeleter is implemented by the stores whose streams can be deleted
+type StreamDeleter interface {
+	// DeleteStream writes the tombstone of the stream of the aggregate at expectedVersion,
+	// ConcurrencyError if the stream is at another version. Deleting a deleted stream keeps
+	// its tombstone, ErrNotFound for an unknown aggregate
+	DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error
+
+	// Tombstone returns the tombstone of the stream of the aggregate, nil if it is not deleted
+	Tombstone(ctx context.Context, guid EventID) (*DeletedError, error)
+
+	// PurgeStream removes for good the events and snapshots of a deleted stream, whatever
+	// its retention, see PurgeAfter. Purging a purged stream does nothing
+	PurgeStream(ctx context.Context, guid EventID) error
+}
+
+// StreamArchiver is implemented by the stores which move closed streams out of the store
+type StreamArchiver interface {
+	// ArchiveStream moves the stream of the aggregate to the archive, where it stays readable
+	// by Find and FindRange but not by type. Archiving an archived stream does nothing
+	ArchiveStream(ctx context.Context, guid EventID) error
+}
+
+// PurgeAfter purges the stream of a deleted aggregate once its deletion is older than retention,
+// ErrRetained before that and ErrInvalidArgument if the stream is not deleted
+func PurgeAfter(ctx context.Context, es EventStore, guid EventID, retention time.Duration) error {
+	deleter, ok := es.(StreamDeleter)
+
+	if !ok {
+		return fmt.Errorf("%w: stream deletion", ErrNotSupported)
+	}
+
+	deleted, err := deleter.Tombstone(ctx, guid)
+
+	if err != nil {
+		return err
+	}
+
+	if deleted == nil {
+		return invalidArgumentf("aggregate %s is not deleted", guid)
+	}
+
+	until := time.Unix(0, deleted.TimeStamp*int64(time.Millisecond)).Add(retention)
+
+	if time.Now().Before(until) {
+		return fmt.Errorf("%w: aggregate %s is kept until %s", ErrRetained, guid, until.UTC().Format(time.RFC3339))
+	}
+
+	return deleter.PurgeStream(ctx, guid)
+}
@@ -0,0 +1,360 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Archiving a closed stream copies its events to a StreamArchive, then deletes and purges it
+// from the event store, so that the hot partitions only hold the living aggregates. The events
+// are archived as stored, sealed when the store is encrypted: the ArchivedEventStore sits
+// under the EncryptedEventStore, and shredding the data key of an archived aggregate erases
+// its archive as well. The archived events are out of the index by type, the projections
+// replaying the whole history don't see them anymore
+
+// StreamArchive keeps the events of the archived streams
+type StreamArchive interface {
+	// WriteStream archives the events of the aggregate, replacing its former archive
+	WriteStream(ctx context.Context, guid EventID, events []StoreEvent) error
+
+	// ReadStream returns the archived events of the aggregate, ErrNotFound if it is not archived
+	ReadStream(ctx context.Context, guid EventID) ([]StoreEvent, error)
+
+	// RemoveStream deletes the archive of the aggregate, whether it has one or not
+	RemoveStream(ctx context.Context, guid EventID) error
+}
+
+// FileArchive is a StreamArchive keeping each stream in a gzipped JSON file of Dir
+type FileArchive struct {
+	Dir string
+}
+
+// initializer for an archive in dir, created if need be
+func NewFileArchive(dir string) (*FileArchive, error) {
+	if dir == "" {
+		return nil, invalidArgumentf("empty archive directory")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileArchive{Dir: dir}, nil
+}
+
+// @see StreamArchive.WriteStream
+func (a *FileArchive) WriteStream(ctx context.Context, guid EventID, events []StoreEvent) error {
+	path, err := a.path(guid)
+
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// the archive is written aside and renamed, a reader never sees it half written
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return syncDir(a.Dir)
+}
+
+// @see StreamArchive.ReadStream
+func (a *FileArchive) ReadStream(ctx context.Context, guid EventID) ([]StoreEvent, error) {
+	path, err := a.path(guid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: aggregate %s is not archived", ErrNotFound, guid)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, fmt.Errorf("reading archive %s: %w", path, err)
+	}
+
+	var events []StoreEvent
+
+	if err := json.NewDecoder(r).Decode(&events); err != nil {
+		return nil, fmt.Errorf("reading archive %s: %w", path, err)
+	}
+
+	return events, nil
+}
+
+// @see StreamArchive.RemoveStream
+func (a *FileArchive) RemoveStream(ctx context.Context, guid EventID) error {
+	path, err := a.path(guid)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (a *FileArchive) path(guid EventID) (string, error) {
+	if guid == "" || strings.ContainsAny(string(guid), `/\`) || strings.HasPrefix(string(guid), ".") {
+		return "", invalidArgumentf("aggregate id %q can't name an archive", guid)
+	}
+
+	return filepath.Join(a.Dir, string(guid)+".json.gz"), nil
+}
+
+// ArchivedEventStore archives the closed streams of another store, which must be a
+// StreamDeleter, to Archive. Find and FindRange read the archived streams through:
+// the stream of an archived aggregate is read from the archive as it was when archived.
+// An archive only stands for the stream when its last version is the version of the
+// tombstone, an archive left by a failed archival is never read
+type ArchivedEventStore struct {
+	Archive StreamArchive
+
+	es EventStore
+}
+
+// initializer for a store archiving the streams of es to archive
+func NewArchivedEventStore(es EventStore, archive StreamArchive) *ArchivedEventStore {
+	return &ArchivedEventStore{Archive: archive, es: es}
+}
+
+// @see EventStore.Find
+func (es *ArchivedEventStore) Find(ctx context.Context, guid EventID) ([]StoreEvent, error) {
+	return es.FindRange(ctx, guid, StreamRange{})
+}
+
+// @see EventStore.FindRange, a deleted stream is read from the archive if it was archived
+func (es *ArchivedEventStore) FindRange(ctx context.Context, guid EventID, r StreamRange) ([]StoreEvent, error) {
+	events, err := es.es.FindRange(ctx, guid, r)
+
+	if !errors.Is(err, ErrDeleted) {
+		return events, err
+	}
+
+	var deleted *DeletedError
+
+	if !errors.As(err, &deleted) {
+		return nil, err
+	}
+
+	archived, archiveErr := es.readArchive(ctx, deleted)
+
+	if errors.Is(archiveErr, ErrNotFound) {
+		return nil, err
+	}
+
+	if archiveErr != nil {
+		return nil, archiveErr
+	}
+
+	result := []StoreEvent{}
+	for _, e := range archived {
+		if r.Includes(e) {
+			result = append(result, e)
+		}
+	}
+
+	if r.LastOnly && len(result) > 1 {
+		result = result[len(result)-1:]
+	}
+
+	return result, nil
+}
+
+// @see EventStore.GetEventsByType
+func (es *ArchivedEventStore) GetEventsByType(ctx context.Context, query TypeQuery) ([]StoreEvent, Cursor, error) {
+	return es.es.GetEventsByType(ctx, query)
+}
+
+// @see EventStore.Update
+func (es *ArchivedEventStore) Update(ctx context.Context, guid EventID, expectedVersion int, events []StoreEvent) error {
+	return es.es.Update(ctx, guid, expectedVersion, events)
+}
+
+// @see StreamArchiver.ArchiveStream. The stream is deleted at the last version archived, an
+// event appended meanwhile fails the deletion with a ConcurrencyError, the archive is removed
+// and written again on the next attempt. A stream deleted without being archived, or at
+// another version than the one archived, can't be archived
+func (es *ArchivedEventStore) ArchiveStream(ctx context.Context, guid EventID) error {
+	deleter, ok := es.es.(StreamDeleter)
+
+	if !ok {
+		return fmt.Errorf("%w: stream deletion", ErrNotSupported)
+	}
+
+	deleted, err := deleter.Tombstone(ctx, guid)
+
+	if err != nil {
+		return err
+	}
+
+	if deleted == nil {
+		events, err := es.es.Find(ctx, guid)
+
+		if err != nil {
+			return err
+		}
+
+		if err := es.Archive.WriteStream(ctx, guid, events); err != nil {
+			return err
+		}
+
+		if err := deleter.DeleteStream(ctx, guid, events[len(events)-1].Version); err != nil {
+			if errors.Is(err, ErrConcurrencyConflict) {
+				if removeErr := es.Archive.RemoveStream(ctx, guid); removeErr != nil {
+					return fmt.Errorf("%w, and removing the archive: %v", err, removeErr)
+				}
+			}
+
+			return err
+		}
+	} else if _, err := es.readArchive(ctx, deleted); errors.Is(err, ErrNotFound) {
+		return invalidArgumentf("aggregate %s was deleted at version %d without being archived", guid, deleted.Version)
+	} else if err != nil {
+		return err
+	}
+
+	return deleter.PurgeStream(ctx, guid)
+}
+
+// readArchive reads the archive of the deleted stream, ErrNotFound when there is none or
+// when it was not archived at the version of its tombstone
+func (es *ArchivedEventStore) readArchive(ctx context.Context, deleted *DeletedError) ([]StoreEvent, error) {
+	archived, err := es.Archive.ReadStream(ctx, deleted.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(archived) == 0 || archived[len(archived)-1].Version != deleted.Version {
+		return nil, fmt.Errorf("%w: aggregate %s deleted at version %d is not archived at this version", ErrNotFound, deleted.ID, deleted.Version)
+	}
+
+	return archived, nil
+}
+
+// @see StreamDeleter.DeleteStream
+func (es *ArchivedEventStore) DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error {
+	deleter, ok := es.es.(StreamDeleter)
+
+	if !ok {
+		return fmt.Errorf("%w: stream deletion", ErrNotSupported)
+	}
+
+	return deleter.DeleteStream(ctx, guid, expectedVersion)
+}
+
+// @see StreamDeleter.Tombstone
+func (es *ArchivedEventStore) Tombstone(ctx context.Context, guid EventID) (*DeletedError, error) {
+	deleter, ok := es.es.(StreamDeleter)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: stream deletion", ErrNotSupported)
+	}
+
+	return deleter.Tombstone(ctx, guid)
+}
+
+// @see StreamDeleter.PurgeStream, which removes the archive of the stream as well
+func (es *ArchivedEventStore) PurgeStream(ctx context.Context, guid EventID) error {
+	deleter, ok := es.es.(StreamDeleter)
+
+	if !ok {
+		return fmt.Errorf("%w: stream deletion", ErrNotSupported)
+	}
+
+	if err := deleter.PurgeStream(ctx, guid); err != nil {
+		return err
+	}
+
+	return es.Archive.RemoveStream(ctx, guid)
+}
+
+// @see SnapshotStore.SaveSnapshot
+func (es *ArchivedEventStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	snapshots, ok := es.es.(SnapshotStore)
+
+	if !ok {
+		return fmt.Errorf("%w: snapshots", ErrNotSupported)
+	}
+
+	return snapshots.SaveSnapshot(ctx, snapshot)
+}
+
+// @see SnapshotStore.LatestSnapshot
+func (es *ArchivedEventStore) LatestSnapshot(ctx context.Context, guid EventID) (*Snapshot, error) {
+	snapshots, ok := es.es.(SnapshotStore)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: snapshots", ErrNotSupported)
+	}
+
+	return snapshots.LatestSnapshot(ctx, guid)
+}
+
+// @see EventTypeDirectory.EventTypeCodes
+func (es *ArchivedEventStore) EventTypeCodes(ctx context.Context, names []string) (map[string]EventType, error) {
+	if directory, ok := es.es.(EventTypeDirectory); ok {
+		return directory.EventTypeCodes(ctx, names)
+	}
+
+	return map[string]EventType{}, nil
+}
+
+// @see ChangeNotifier.Changed, a nil channel when the store does not notify
+func (es *ArchivedEventStore) Changed() <-chan struct{} {
+	if notifier, ok := es.es.(ChangeNotifier); ok {
+		return notifier.Changed()
+	}
+
+	return nil
+}
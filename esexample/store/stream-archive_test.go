@@ -0,0 +1,220 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newArchivedTestStore(t *testing.T) (*ArchivedEventStore, *MemEventStore, string) {
+	dir, err := ioutil.TempDir("", "archive")
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	archive, err := NewFileArchive(dir)
+
+	if err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	inner := NewInMemStore()
+
+	return NewArchivedEventStore(inner, archive), inner, dir
+}
+
+func TestArchiveStream(t *testing.T) {
+	ctx := context.Background()
+	es, inner, dir := newArchivedTestStore(t)
+
+	events := []StoreEvent{
+		{Type: 1, ContentType: ContentTypeJSON, Payload: EventPayload(`{"n":1}`), Metadata: map[string]string{"user": "ann"}},
+		{Type: 2, Payload: EventPayload(`{"n":2}`)},
+		{Type: 1, Payload: EventPayload(`{"n":3}`)},
+	}
+
+	if err := es.Update(ctx, "uuid", 0, events); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// archiving an archived stream does nothing
+	for i := 0; i < 2; i++ {
+		if err := es.ArchiveStream(ctx, "uuid"); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "uuid.json.gz")); err != nil {
+		t.Errorf("archive not written: %+v", err)
+	}
+
+	// the events left the store and its index by type
+	if _, err := inner.Find(ctx, "uuid"); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected ErrDeleted, got %+v", err)
+	}
+
+	if byType, _, err := es.GetEventsByType(ctx, TypeQuery{Type: 1}); err != nil || len(byType) != 0 {
+		t.Errorf("unexpected events %+v, error %+v", byType, err)
+	}
+
+	found, err := es.Find(ctx, "uuid")
+
+	if err != nil || len(found) != 3 {
+		t.Fatalf("unexpected events %+v, error %+v", found, err)
+	}
+
+	if found[0].Version != 1 || found[0].ContentType != ContentTypeJSON || found[0].Metadata["user"] != "ann" || string(found[2].Payload) != `{"n":3}` {
+		t.Errorf("unexpected archived events %+v", found)
+	}
+
+	// the ranges apply to the archived streams
+	if found, err := es.FindRange(ctx, "uuid", StreamRange{AfterVersion: 1, LastOnly: true}); err != nil || len(found) != 1 || found[0].Version != 3 {
+		t.Errorf("unexpected events %+v, error %+v", found, err)
+	}
+
+	if found, err := es.FindRange(ctx, "uuid", StreamRange{UpToVersion: 2}); err != nil || len(found) != 2 {
+		t.Errorf("unexpected events %+v, error %+v", found, err)
+	}
+
+	if err := es.Update(ctx, "uuid", 3, events[:1]); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected ErrDeleted, got %+v", err)
+	}
+
+	// purging an archived stream removes its archive
+	if err := es.PurgeStream(ctx, "uuid"); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if _, err := es.Find(ctx, "uuid"); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected ErrDeleted, got %+v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "uuid.json.gz")); !os.IsNotExist(err) {
+		t.Errorf("archive left behind: %+v", err)
+	}
+}
+
+func TestArchiveDeletedStream(t *testing.T) {
+	ctx := context.Background()
+	es, _, _ := newArchivedTestStore(t)
+
+	if err := es.ArchiveStream(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.DeleteStream(ctx, "uuid", 1); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// the events of a deleted stream can't be read anymore to be archived
+	if err := es.ArchiveStream(ctx, "uuid"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+
+	if _, err := es.Archive.ReadStream(ctx, "../uuid"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+}
+
+// racingStore appends an event to the stream just before deleting it
+type racingStore struct {
+	*MemEventStore
+}
+
+func (es racingStore) DeleteStream(ctx context.Context, guid EventID, expectedVersion int) error {
+	if err := es.Update(ctx, guid, expectedVersion, []StoreEvent{{Type: 1, Payload: EventPayload(`{}`)}}); err != nil {
+		return err
+	}
+
+	return es.MemEventStore.DeleteStream(ctx, guid, expectedVersion)
+}
+
+func TestArchiveOutdated(t *testing.T) {
+	ctx := context.Background()
+	es, inner, _ := newArchivedTestStore(t)
+	racing := NewArchivedEventStore(racingStore{inner}, es.Archive)
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	// the archive of a stream which moved on is removed
+	if err := racing.ArchiveStream(ctx, "uuid"); !errors.Is(err, ErrConcurrencyConflict) {
+		t.Errorf("expected ErrConcurrencyConflict, got %+v", err)
+	}
+
+	if _, err := es.Archive.ReadStream(ctx, "uuid"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("archive left behind: %+v", err)
+	}
+
+	// an archive older than the tombstone is never read nor taken for the stream
+	events, _ := es.Find(ctx, "uuid")
+
+	if err := es.Archive.WriteStream(ctx, "uuid", events[:1]); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := es.DeleteStream(ctx, "uuid", 2); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if _, err := es.Find(ctx, "uuid"); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected ErrDeleted, got %+v", err)
+	}
+
+	if err := es.ArchiveStream(ctx, "uuid"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %+v", err)
+	}
+
+	if byType, _, _ := es.GetEventsByType(ctx, TypeQuery{Type: 1}); len(byType) != 2 {
+		t.Errorf("events of an outdated archive purged: %+v", byType)
+	}
+}
+
+func TestPurgeAfterRetention(t *testing.T) {
+	ctx := context.Background()
+	es := NewInMemStore()
+
+	if err := es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload(`{}`)}}); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := PurgeAfter(ctx, es, "uuid", 0); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("stream not deleted: expected ErrInvalidArgument, got %+v", err)
+	}
+
+	if err := es.DeleteStream(ctx, "uuid", 1); err != nil {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if err := PurgeAfter(ctx, es, "uuid", time.Hour); !errors.Is(err, ErrRetained) {
+		t.Errorf("expected ErrRetained, got %+v", err)
+	}
+
+	if byType, _, _ := es.GetEventsByType(ctx, TypeQuery{Type: 1}); len(byType) != 1 {
+		t.Errorf("retained events purged: %+v", byType)
+	}
+
+	if err := PurgeAfter(ctx, es, "uuid", 0); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+
+	if byType, _, _ := es.GetEventsByType(ctx, TypeQuery{Type: 1}); len(byType) != 0 {
+		t.Errorf("unexpected events %+v", byType)
+	}
+
+	if err := PurgeAfter(ctx, NewInMemStore(), "missing", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %+v", err)
+	}
+}
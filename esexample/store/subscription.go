@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultPollInterval = 500 * time.Millisecond
+	defaultHeartbeat    = 5 * time.Second
+	defaultBatchSize    = 100
+
+	// DefaultSubscriptionSettle is the settle window of the subscriptions served to the
+	// clients which don't ask for one: without it, an event whose write becomes visible
+	// after a later one was delivered would be skipped for good
+	DefaultSubscriptionSettle = time.Second
+)
+
+// SubscriptionHandler receives the events of a subscription in order of position
+// within each event type. A nil event is a heartbeat, sent when no event was
+// delivered for a while. Returning an error ends the subscription
+type SubscriptionHandler func(e *StoreEvent) error
+
+// ChangeNotifier is implemented by the stores that can tell when new events are saved,
+// so that subscriptions do not wait for the next poll
+type ChangeNotifier interface {
+	// Changed returns a channel which is closed when new events are saved
+	Changed() <-chan struct{}
+}
+
+type SubscriptionOptions struct {
+	PollInterval time.Duration // how often the store is polled for new events
+	Heartbeat    time.Duration // how long without events before a heartbeat is sent
+	BatchSize    int           // how many events are read at once
+	Settle       time.Duration // how long to wait for concurrent writes to become visible, see TypeQuery
+}
+
+func (o SubscriptionOptions) withDefaults() SubscriptionOptions {
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultPollInterval
+	}
+
+	if o.Heartbeat <= 0 {
+		o.Heartbeat = defaultHeartbeat
+	}
+
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultBatchSize
+	}
+
+	return o
+}
+
+// Subscribe delivers the events of the given types saved after the given cursors:
+// first the historical catch-up, then the new events as they are written.
+// It returns when ctx is done, the store fails or the handler returns an error
+func Subscribe(ctx context.Context, es EventStore, positions map[EventType]Cursor, opts SubscriptionOptions, handler SubscriptionHandler) error {
+	opts = opts.withDefaults()
+
+	if len(positions) == 0 {
+		return invalidArgumentf("no event types to subscribe to")
+	}
+
+	current := make(map[EventType]Cursor, len(positions))
+	for etype, after := range positions {
+		current[etype] = after
+	}
+
+	lastSent := time.Now()
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+
+	notifier, _ := es.(ChangeNotifier)
+
+	for {
+		// taken before reading, so that an update during the read is not missed
+		var changed <-chan struct{}
+		if notifier != nil {
+			changed = notifier.Changed()
+		}
+
+		for etype := range current {
+			for {
+				query := TypeQuery{Type: etype, After: current[etype], BatchSize: opts.BatchSize, Settle: opts.Settle}
+				events, next, err := es.GetEventsByType(ctx, query)
+
+				if err != nil {
+					return err
+				}
+
+				for i := range events {
+					if err := handler(&events[i]); err != nil {
+						return err
+					}
+				}
+
+				current[etype] = next
+
+				if len(events) > 0 {
+					lastSent = time.Now()
+				}
+
+				// a full page means there is more to catch up with
+				if len(events) < opts.BatchSize {
+					break
+				}
+			}
+		}
+
+		if time.Since(lastSent) >= opts.Heartbeat {
+			if err := handler(nil); err != nil {
+				return err
+			}
+			lastSent = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSubscribeCatchUpAndLiveEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	es := NewInMemStore()
+
+	for i, guid := range []EventID{"uuid1", "uuid2", "uuid3"} {
+		if err := es.Update(ctx, guid, 0, []StoreEvent{{Type: EventType(1 + i%2), Payload: EventPayload("{}")}}); err != nil {
+			t.Fatalf("unexpected error %+v", err)
+		}
+	}
+
+	var received []EventID
+	heartbeats := 0
+	done := errors.New("done")
+
+	opts := SubscriptionOptions{PollInterval: 5 * time.Millisecond, Heartbeat: 10 * time.Millisecond}
+
+	err := Subscribe(ctx, es, map[EventType]Cursor{1: ""}, opts, func(e *StoreEvent) error {
+		if e != nil {
+			if e.Type != 1 {
+				t.Errorf("unexpected event type %d", e.Type)
+			}
+			received = append(received, e.ID)
+			if len(received) == 3 {
+				return done
+			}
+			return nil
+		}
+
+		// write a new event once caught up, it must be delivered after the heartbeat
+		heartbeats++
+		if heartbeats == 1 {
+			time.Sleep(2 * time.Millisecond)
+			return es.Update(ctx, "uuid4", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}})
+		}
+		return nil
+	})
+
+	if err != done {
+		t.Fatalf("unexpected error %+v", err)
+	}
+
+	if received[0] != "uuid1" || received[1] != "uuid3" || received[2] != "uuid4" {
+		t.Errorf("unexpected events %+v", received)
+	}
+}
+
+// the in memory store wakes the subscription up, without waiting for the next poll
+func TestSubscribeWakesUpOnChange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	es := NewInMemStore()
+	opts := SubscriptionOptions{PollInterval: time.Hour, Heartbeat: time.Hour}
+	done := errors.New("done")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		es.Update(ctx, "uuid", 0, []StoreEvent{{Type: 1, Payload: EventPayload("{}")}})
+	}()
+
+	start := time.Now()
+	err := Subscribe(ctx, es, map[EventType]Cursor{1: ""}, opts, func(e *StoreEvent) error {
+		return done
+	})
+
+	if err != done || time.Since(start) > time.Second {
+		t.Errorf("expected the event to be delivered at once, got %+v after %v", err, time.Since(start))
+	}
+}
+
+func TestSubscribeEndsWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	opts := SubscriptionOptions{PollInterval: 5 * time.Millisecond}
+	err := Subscribe(ctx, NewInMemStore(), map[EventType]Cursor{1: ""}, opts, func(e *StoreEvent) error { return nil })
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %+v", err)
+	}
+}
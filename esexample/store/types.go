@@ -16,15 +16,76 @@ type Event interface {
 }
 
 type EventID string
-type EventPayload string
+type EventPayload []byte
 type EventType int
 type EventTypeToEventMapper func(e EventType) (Event, error)
 
+// StoreEvent is an event as persisted in the store. Version is the version
+// of the aggregate produced by the event and TimeStamp its save time in
+// milliseconds, both assigned by the store on Update. SchemaVersion is the
+// version of the layout of the payload, given by the writer and kept as is,
+// 0 for the events written before the payloads were versioned, see Upcasters.
+// TypeName is the name of the type, empty for the events written before the
+// types had names, see EventTypeRegistry. ContentType tells how the payload is
+// encoded, as "application/json+gzip", empty for the JSON payloads written before
+// the payloads were bytes, see EventCodec. Shredded is set on the events read
+// through an EncryptedEventStore whose data key was shredded, their payload
+// is gone but for the fields left in clear.
+// Metadata carries the correlation, causation, principal and any custom
+// header. Cursor is the position of the event among the events by type,
+// only set by GetEventsByType
 type StoreEvent struct {
-	ID        EventID      `json:"id"`
-	Payload   EventPayload `json:"payload"`
-	Type      EventType    `json:"type"`
-	TimeStamp int64        `json:"time"`
+	ID            EventID           `json:"id"`
+	Version       int               `json:"version"`
+	Payload       EventPayload      `json:"payload"`
+	ContentType   string            `json:"content_type,omitempty"`
+	Type          EventType         `json:"type"`
+	TypeName      string            `json:"type_name,omitempty"`
+	SchemaVersion int               `json:"schema_version,omitempty"`
+	TimeStamp     int64             `json:"time"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Cursor        Cursor            `json:"cursor,omitempty"`
+	Shredded      bool              `json:"shredded,omitempty"`
+}
+
+// StreamRange restricts the events of an aggregate returned by FindRange.
+// The zero value selects the whole stream
+type StreamRange struct {
+	AfterVersion int   // only events with a version greater than AfterVersion
+	UpToVersion  int   // only events up to and including this version, 0 for no upper bound
+	AsOf         int64 // only events saved at or before this time in millis, 0 for no time bound
+	LastOnly     bool  // only the last of the selected events
+}
+
+// IsZero tells whether the range selects the whole stream
+func (r StreamRange) IsZero() bool {
+	return r == StreamRange{}
+}
+
+// Validate rejects ranges that can't select anything
+func (r StreamRange) Validate() error {
+	if r.AfterVersion < 0 || r.UpToVersion < 0 || r.AsOf < 0 {
+		return invalidArgumentf("negative bound in range %+v", r)
+	}
+
+	if r.UpToVersion > 0 && r.UpToVersion <= r.AfterVersion {
+		return invalidArgumentf("empty version range (%d, %d]", r.AfterVersion, r.UpToVersion)
+	}
+
+	return nil
+}
+
+// Includes tells whether the event falls in the range, LastOnly aside
+func (r StreamRange) Includes(e StoreEvent) bool {
+	if e.Version <= r.AfterVersion {
+		return false
+	}
+
+	if r.UpToVersion > 0 && e.Version > r.UpToVersion {
+		return false
+	}
+
+	return r.AsOf == 0 || e.TimeStamp <= r.AsOf
 }
 
 func GetEventTypeFromJSON(e string) (EventType, error) {
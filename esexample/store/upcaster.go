@@ -0,0 +1,94 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Upcaster transforms the payload of an event from one schema version to the next
+type Upcaster func(payload EventPayload) (EventPayload, error)
+
+// Upcasters chains, by event type, the upcasters bringing the payloads written by former
+// releases to the latest schema version, before they are decoded. The payloads of a type
+// without upcasters are at version 1. The events written before the payloads were
+// versioned have SchemaVersion 0, read as 1
+type Upcasters struct {
+	chains map[EventType][]Upcaster // the upcaster of version v is at v-1
+}
+
+// initializer for an empty registry
+func NewUpcasters() *Upcasters {
+	return &Upcasters{chains: map[EventType][]Upcaster{}}
+}
+
+// Register adds the upcaster from version from to from+1 of the given type. The
+// upcasters of a type are registered in order of version, starting from 1
+func (u *Upcasters) Register(etype EventType, from int, up Upcaster) *Upcasters {
+	if from != len(u.chains[etype])+1 {
+		panic(fmt.Sprintf("upcaster of event type %d from version %d registered after version %d", etype, from, len(u.chains[etype])))
+	}
+
+	u.chains[etype] = append(u.chains[etype], up)
+	return u
+}
+
+// Latest returns the schema version of the payloads written today for the given type
+func (u *Upcasters) Latest(etype EventType) int {
+	if u == nil {
+		return 1
+	}
+	return len(u.chains[etype]) + 1
+}
+
+// Upcast brings the payload of the event to the latest schema version of its type.
+// A payload written by a newer release is refused with ErrIncompatibleSchema
+func (u *Upcasters) Upcast(e StoreEvent) (StoreEvent, error) {
+	version := e.SchemaVersion
+	if version == 0 {
+		version = 1
+	}
+
+	latest := u.Latest(e.Type)
+
+	if version > latest {
+		return e, fmt.Errorf("%w: event %s version %d of type %d has schema version %d, newer than %d",
+			ErrIncompatibleSchema, e.ID, e.Version, e.Type, version, latest)
+	}
+
+	for ; version < latest; version++ {
+		payload, err := u.chains[e.Type][version-1](e.Payload)
+
+		if err != nil {
+			return e, fmt.Errorf("event %s version %d of type %d: upcasting from schema version %d: %w",
+				e.ID, e.Version, e.Type, version, err)
+		}
+
+		e.Payload = payload
+	}
+
+	e.SchemaVersion = latest
+	return e, nil
+}
+
+// JSONUpcaster makes an upcaster of a function editing the fields of a JSON object payload
+func JSONUpcaster(edit func(fields map[string]interface{}) error) Upcaster {
+	return func(payload EventPayload) (EventPayload, error) {
+		var fields map[string]interface{}
+
+		if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+			return payload, err
+		}
+
+		if err := edit(fields); err != nil {
+			return payload, err
+		}
+
+		b, err := json.Marshal(fields)
+
+		if err != nil {
+			return payload, err
+		}
+
+		return EventPayload(b), nil
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func renameField(from, to string) Upcaster {
+	return JSONUpcaster(func(fields map[string]interface{}) error {
+		fields[to] = fields[from]
+		delete(fields, from)
+		return nil
+	})
+}
+
+func TestUpcastChain(t *testing.T) {
+	u := NewUpcasters().
+		Register(1, 1, renameField("patient_name", "full_name")).
+		Register(1, 2, renameField("full_name", "name"))
+
+	if u.Latest(1) != 3 || u.Latest(2) != 1 {
+		t.Errorf("unexpected latest versions %d and %d", u.Latest(1), u.Latest(2))
+	}
+
+	for _, e := range []StoreEvent{
+		{Type: 1, Payload: EventPayload(`{"patient_name":"john"}`)},
+		{Type: 1, SchemaVersion: 1, Payload: EventPayload(`{"patient_name":"john"}`)},
+		{Type: 1, SchemaVersion: 2, Payload: EventPayload(`{"full_name":"john"}`)},
+		{Type: 1, SchemaVersion: 3, Payload: EventPayload(`{"name":"john"}`)},
+	} {
+		upcast, err := u.Upcast(e)
+
+		if err != nil || string(upcast.Payload) != `{"name":"john"}` || upcast.SchemaVersion != 3 {
+			t.Errorf("unexpected upcast of %+v: %+v, error %+v", e, upcast, err)
+		}
+	}
+
+	// the events of a type without upcasters are left as they are
+	e := StoreEvent{Type: 2, Payload: EventPayload(`{"patient_name":"john"}`)}
+
+	if upcast, err := u.Upcast(e); err != nil || !bytes.Equal(upcast.Payload, e.Payload) || upcast.SchemaVersion != 1 {
+		t.Errorf("unexpected upcast %+v, error %+v", upcast, err)
+	}
+}
+
+func TestUpcastFailures(t *testing.T) {
+	u := NewUpcasters().Register(1, 1, renameField("a", "b"))
+
+	if _, err := u.Upcast(StoreEvent{Type: 1, SchemaVersion: 3, Payload: EventPayload(`{}`)}); !errors.Is(err, ErrIncompatibleSchema) {
+		t.Errorf("expected ErrIncompatibleSchema, got %+v", err)
+	}
+
+	if _, err := u.Upcast(StoreEvent{Type: 1, Payload: EventPayload(`not json`)}); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic registering a gap in the chain")
+		}
+	}()
+
+	u.Register(1, 3, renameField("b", "c"))
+}